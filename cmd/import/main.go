@@ -0,0 +1,91 @@
+// Command import loads users or chats from a CSV file, the same way the
+// admin import endpoint does.
+//
+//	go run ./cmd/import -kind chats -mapping '{"Patient email":"email"}' -dry-run intake.csv
+package main
+
+import (
+	"chat-api/database"
+	"chat-api/importer"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	kind := flag.String("kind", "", "what the rows are: users or chats")
+	mapping := flag.String("mapping", "", `JSON object mapping CSV headers to fields, e.g. {"Patient email":"email"}`)
+	dryRun := flag.Bool("dry-run", false, "validate only and report row errors")
+	errorsFile := flag.String("errors", "", "write row errors as CSV to this file instead of stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: import -kind users|chats [flags] file.csv\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := importer.Options{Kind: *kind, DryRun: *dryRun}
+	if *mapping != "" {
+		if err := json.Unmarshal([]byte(*mapping), &opts.Mapping); err != nil {
+			log.Fatal("Invalid -mapping: ", err)
+		}
+	}
+	if _, err := importer.Fields(opts.Kind); err != nil {
+		log.Fatal(err)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, using system environment variables")
+	}
+	database.ConnectDB()
+	defer database.CloseDB()
+	if err := database.Migrate(); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	opts.Progress = func(processed, total int) {
+		log.Printf("Imported %d of %d rows", processed, total)
+	}
+	result, runErr := importer.Run(context.Background(), database.DB, file, opts)
+
+	if len(result.Errors) > 0 {
+		out := os.Stderr
+		if *errorsFile != "" {
+			if out, err = os.Create(*errorsFile); err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+		if err := importer.WriteErrors(out, result.Errors); err != nil {
+			log.Println("Failed to write row errors:", err)
+		}
+	}
+
+	switch {
+	case errors.Is(runErr, importer.ErrInvalidRows):
+		log.Printf("%d of %d rows have errors, nothing was imported", len(result.Errors), result.Rows)
+		database.CloseDB()
+		os.Exit(1)
+	case runErr != nil:
+		log.Fatal("Import failed: ", runErr)
+	case *dryRun:
+		log.Printf("Dry run: all %d rows are valid", result.Rows)
+	default:
+		log.Printf("Imported %d %s", result.Imported, opts.Kind)
+	}
+}
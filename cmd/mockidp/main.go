@@ -0,0 +1,48 @@
+// Command mockidp runs a local OpenID Connect provider that signs every
+// login in as one user, to try the /auth/oidc flow without a real one.
+//
+//	go run ./cmd/mockidp -email doctor@hospital.test -roles Clinicians
+//
+// and start the API with
+//
+//	OIDC_PROVIDERS=mock OIDC_MOCK_ISSUER=http://localhost:9000 OIDC_MOCK_CLIENT_ID=chat-api \
+//	OIDC_MOCK_ROLE_MAP=Clinicians=clinician
+//
+// then open http://localhost:3000/auth/oidc/mock in a browser.
+package main
+
+import (
+	"chat-api/oidc"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, as the API reaches this server")
+	sub := flag.String("sub", "mock-user-1", "subject of the signed in user")
+	email := flag.String("email", "doctor@hospital.test", "email of the signed in user")
+	verified := flag.Bool("email-verified", true, "whether the email is reported verified")
+	name := flag.String("name", "Mock Doctor", "name of the signed in user")
+	roles := flag.String("roles", "", "comma separated values of the roles claim")
+	flag.Parse()
+
+	claims := map[string]interface{}{
+		"sub":            *sub,
+		"email":          *email,
+		"email_verified": *verified,
+		"name":           *name,
+	}
+	if *roles != "" {
+		claims["roles"] = strings.Split(*roles, ",")
+	}
+
+	idp, err := oidc.NewMockIdP(strings.TrimSuffix(*issuer, "/"), claims)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Mock OIDC provider %s listening on %s, signing in as %s", *issuer, *addr, *email)
+	log.Fatal(http.ListenAndServe(*addr, idp))
+}
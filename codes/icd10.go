@@ -0,0 +1,216 @@
+package codes
+
+import (
+	"bufio"
+	"bytes"
+	"chat-api/models"
+	"embed"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//go:embed data/icd10.tsv data/synonyms.tsv
+var dataFiles embed.FS
+
+type ICD10Code struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+var (
+	loadOnce sync.Once
+	table    []ICD10Code
+	byCode   map[string]ICD10Code
+	synonyms map[string]string // normalized term -> code
+)
+
+func load() {
+	byCode = map[string]ICD10Code{}
+	synonyms = map[string]string{}
+
+	readTSV("data/icd10.tsv", func(cols []string) {
+		code := ICD10Code{Code: strings.ToUpper(cols[0]), Description: cols[1]}
+		table = append(table, code)
+		byCode[code.Code] = code
+		synonyms[Normalize(code.Description)] = code.Code
+	})
+	readTSV("data/synonyms.tsv", func(cols []string) {
+		code := strings.ToUpper(cols[1])
+		if _, ok := byCode[code]; !ok {
+			log.Printf("icd10: synonym %q points to unknown code %s", cols[0], code)
+			return
+		}
+		synonyms[Normalize(cols[0])] = code
+	})
+
+	sort.Slice(table, func(i, j int) bool { return table[i].Code < table[j].Code })
+}
+
+func readTSV(name string, fn func(cols []string)) {
+	data, err := dataFiles.ReadFile(name)
+	if err != nil {
+		log.Fatal("icd10: cannot read bundled table:", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cols := strings.SplitN(line, "\t", 2)
+		if len(cols) != 2 {
+			continue
+		}
+		fn(cols)
+	}
+}
+
+// Normalize lowercases a term, drops punctuation and collapses whitespace so
+// that "Type-2  Diabetes." and "type 2 diabetes" compare equal. A dot is kept
+// only inside codes like "e11.9". Thai vowel and tone marks are unicode Mn, so
+// Thai text survives intact.
+func Normalize(s string) string {
+	runes := []rune(strings.ToLower(s))
+	var b strings.Builder
+	space := false
+	for i, r := range runes {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		case r == '.' && !space && b.Len() > 0 && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			b.WriteRune(r)
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// Lookup returns the code entry for an exact ICD-10 code such as "E11.9".
+func Lookup(code string) (ICD10Code, bool) {
+	loadOnce.Do(load)
+	c, ok := byCode[strings.ToUpper(strings.TrimSpace(code))]
+	return c, ok
+}
+
+// Search returns codes matching q for autocomplete, best matches first:
+// code prefix, then description/synonym prefix, then substring matches.
+func Search(q string, limit int) []ICD10Code {
+	loadOnce.Do(load)
+	q = Normalize(q)
+	if q == "" {
+		return []ICD10Code{}
+	}
+
+	rank := map[string]int{}
+	consider := func(code string, r int) {
+		if old, ok := rank[code]; !ok || r < old {
+			rank[code] = r
+		}
+	}
+
+	upper := strings.ToUpper(q)
+	for _, c := range table {
+		desc := Normalize(c.Description)
+		switch {
+		case strings.HasPrefix(c.Code, upper):
+			consider(c.Code, 0)
+		case strings.HasPrefix(desc, q):
+			consider(c.Code, 1)
+		case strings.Contains(desc, q):
+			consider(c.Code, 3)
+		}
+	}
+	for term, code := range synonyms {
+		switch {
+		case term == q:
+			consider(code, 0)
+		case strings.HasPrefix(term, q):
+			consider(code, 2)
+		case strings.Contains(term, q):
+			consider(code, 3)
+		}
+	}
+
+	results := make([]ICD10Code, 0, len(rank))
+	for code := range rank {
+		results = append(results, byCode[code])
+	}
+	sort.Slice(results, func(i, j int) bool {
+		ri, rj := rank[results[i].Code], rank[results[j].Code]
+		if ri != rj {
+			return ri < rj
+		}
+		return results[i].Code < results[j].Code
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Resolve maps free disease text to zero or more ICD-10 codes. The text is
+// split on commas, slashes, "and" and "และ" so "DM2, HT" yields E11.9 and I10.
+// Each part must match a code, a description or a synonym exactly.
+func Resolve(text string) []ICD10Code {
+	loadOnce.Do(load)
+
+	splitter := strings.NewReplacer(",", "\n", "/", "\n", ";", "\n", "+", "\n", "、", "\n", " and ", "\n", "และ", "\n")
+	seen := map[string]bool{}
+	var results []ICD10Code
+	for _, part := range strings.Split(splitter.Replace(strings.ToLower(text)), "\n") {
+		term := Normalize(part)
+		if term == "" {
+			continue
+		}
+		code, ok := byCode[strings.ToUpper(term)]
+		if !ok {
+			c, found := synonyms[term]
+			if !found {
+				continue
+			}
+			code = byCode[c]
+		}
+		if !seen[code.Code] {
+			seen[code.Code] = true
+			results = append(results, code)
+		}
+	}
+	return results
+}
+
+// Diagnoses returns the coded diagnoses of a chat: the explicit codes when
+// any are given, otherwise whatever Resolve finds in the free text disease.
+func Diagnoses(explicit []string, disease *string) ([]models.ChatDiagnosis, error) {
+	var diagnoses []models.ChatDiagnosis
+	if len(explicit) > 0 {
+		for _, raw := range explicit {
+			code, ok := Lookup(raw)
+			if !ok {
+				return nil, fmt.Errorf("unknown ICD-10 code %q", raw)
+			}
+			diagnoses = append(diagnoses, models.ChatDiagnosis{
+				Code: code.Code, Description: code.Description, Source: "manual",
+			})
+		}
+		return diagnoses, nil
+	}
+
+	if disease == nil {
+		return nil, nil
+	}
+	for _, code := range Resolve(*disease) {
+		diagnoses = append(diagnoses, models.ChatDiagnosis{
+			Code: code.Code, Description: code.Description, Source: "synonym",
+		})
+	}
+	return diagnoses, nil
+}
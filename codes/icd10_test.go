@@ -0,0 +1,81 @@
+package codes
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	for in, want := range map[string]string{
+		"Type-2  Diabetes.": "type 2 diabetes",
+		"E11.9":             "e11.9",
+		"end.":              "end",
+		"เบาหวาน":           "เบาหวาน",
+	} {
+		if got := Normalize(in); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if c, ok := Lookup(" e11.9 "); !ok || c.Code != "E11.9" {
+		t.Errorf("Lookup(e11.9) = %+v, %v", c, ok)
+	}
+	if _, ok := Lookup("Z99.99"); ok {
+		t.Error("Lookup found a code that is not in the table")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"DM2, HT", []string{"E11.9", "I10"}},
+		{"dm2 and htn and dm2", []string{"E11.9", "I10"}},
+		{"เบาหวาน", []string{"E14.9"}},
+		{"essential (primary) hypertension", []string{"I10"}},
+		{"a bit of a headache and tired", nil},
+	}
+	for _, tt := range tests {
+		got := Resolve(tt.text)
+		if len(got) != len(tt.want) {
+			t.Errorf("Resolve(%q) = %+v, want %v", tt.text, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Code != tt.want[i] {
+				t.Errorf("Resolve(%q)[%d] = %s, want %s", tt.text, i, got[i].Code, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSearchRanksCodePrefixFirst(t *testing.T) {
+	got := Search("I10", 5)
+	if len(got) == 0 || got[0].Code != "I10" {
+		t.Fatalf("Search(I10) = %+v", got)
+	}
+	if got := Search("diabetes", 2); len(got) != 2 {
+		t.Errorf("Search with limit 2 returned %d results", len(got))
+	}
+	if got := Search("  ", 5); len(got) != 0 {
+		t.Errorf("Search(blank) = %+v, want none", got)
+	}
+}
+
+func TestDiagnoses(t *testing.T) {
+	disease := "DM2"
+	got, err := Diagnoses([]string{"i10"}, &disease)
+	if err != nil || len(got) != 1 || got[0].Code != "I10" || got[0].Source != "manual" {
+		t.Errorf("explicit codes: %+v, %v, want I10 only, from the explicit list", got, err)
+	}
+	if _, err := Diagnoses([]string{"Z99.99"}, nil); err == nil {
+		t.Error("an unknown explicit code was accepted")
+	}
+	got, err = Diagnoses(nil, &disease)
+	if err != nil || len(got) != 1 || got[0].Code != "E11.9" || got[0].Source != "synonym" {
+		t.Errorf("free text: %+v, %v, want E11.9 resolved from the text", got, err)
+	}
+	if got, err := Diagnoses(nil, nil); err != nil || len(got) != 0 {
+		t.Errorf("nothing given: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS chat_diagnoses (
+    chat_id     UUID NOT NULL REFERENCES chats (chat_id) ON DELETE CASCADE,
+    code        TEXT NOT NULL,
+    description TEXT NOT NULL,
+    source      TEXT NOT NULL DEFAULT 'manual',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (chat_id, code)
+);
+
+CREATE INDEX IF NOT EXISTS chat_diagnoses_code_idx ON chat_diagnoses (code);
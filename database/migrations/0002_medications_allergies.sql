@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS user_medications (
+    medication_id UUID PRIMARY KEY,
+    user_id       UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    name          TEXT NOT NULL,
+    dose          TEXT,
+    frequency     TEXT,
+    start_date    DATE,
+    stop_date     DATE,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_medications_user_id_idx ON user_medications (user_id);
+
+CREATE TABLE IF NOT EXISTS user_allergies (
+    allergy_id UUID PRIMARY KEY,
+    user_id    UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    substance  TEXT NOT NULL,
+    reaction   TEXT,
+    severity   TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS user_allergies_user_id_idx ON user_allergies (user_id);
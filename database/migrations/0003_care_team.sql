@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS care_team (
+    clinician_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    patient_id   UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    assigned_by  UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (clinician_id, patient_id),
+    CHECK (clinician_id <> patient_id)
+);
+
+CREATE INDEX IF NOT EXISTS care_team_patient_id_idx ON care_team (patient_id);
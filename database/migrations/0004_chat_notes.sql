@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS chat_notes (
+    note_id    UUID PRIMARY KEY,
+    chat_id    UUID NOT NULL REFERENCES chats (chat_id) ON DELETE CASCADE,
+    author_id  UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    note_type  TEXT NOT NULL,
+    body       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS chat_notes_chat_id_idx ON chat_notes (chat_id, created_at);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS chat_attachments (
+    attachment_id UUID PRIMARY KEY,
+    chat_id       UUID NOT NULL REFERENCES chats (chat_id) ON DELETE CASCADE,
+    uploaded_by   UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    filename      TEXT NOT NULL,
+    content_type  TEXT NOT NULL,
+    size_bytes    BIGINT NOT NULL,
+    storage_key   TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS chat_attachments_chat_id_idx ON chat_attachments (chat_id, created_at);
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS hl7_patient_identifiers (
+    assigning_authority TEXT NOT NULL,
+    identifier          TEXT NOT NULL,
+    user_id             UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (assigning_authority, identifier)
+);
+
+CREATE INDEX IF NOT EXISTS hl7_patient_identifiers_user_id_idx ON hl7_patient_identifiers (user_id);
+
+CREATE TABLE IF NOT EXISTS hl7_dead_letters (
+    dead_letter_id UUID PRIMARY KEY,
+    remote_addr    TEXT NOT NULL,
+    message_type   TEXT,
+    control_id     TEXT,
+    raw_message    TEXT NOT NULL,
+    error          TEXT NOT NULL,
+    received_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS hl7_dead_letters_received_at_idx ON hl7_dead_letters (received_at);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS export_jobs (
+    job_id       UUID PRIMARY KEY,
+    kind         TEXT NOT NULL,
+    requested_by UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    format       TEXT NOT NULL,
+    params       JSONB NOT NULL DEFAULT '{}',
+    status       TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    row_count    BIGINT NOT NULL DEFAULT 0,
+    storage_key  TEXT,
+    error        TEXT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS export_jobs_created_at_idx ON export_jobs (created_at);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS import_jobs (
+    job_id         UUID PRIMARY KEY,
+    kind           TEXT NOT NULL CHECK (kind IN ('users', 'chats')),
+    requested_by   UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    filename       TEXT NOT NULL,
+    dry_run        BOOLEAN NOT NULL DEFAULT FALSE,
+    status         TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    total_rows     INTEGER NOT NULL DEFAULT 0,
+    processed_rows INTEGER NOT NULL DEFAULT 0,
+    error_count    INTEGER NOT NULL DEFAULT 0,
+    error_key      TEXT,
+    error          TEXT,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS import_jobs_created_at_idx ON import_jobs (created_at);
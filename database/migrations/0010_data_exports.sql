@@ -0,0 +1,16 @@
+ALTER TABLE export_jobs ADD COLUMN IF NOT EXISTS subject_id UUID REFERENCES users (user_id) ON DELETE CASCADE;
+ALTER TABLE export_jobs ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS export_jobs_subject_id_idx ON export_jobs (subject_id, created_at);
+
+CREATE TABLE IF NOT EXISTS user_notifications (
+    notification_id UUID PRIMARY KEY,
+    user_id         UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    kind            TEXT NOT NULL,
+    body            TEXT NOT NULL,
+    link            TEXT,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    read_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS user_notifications_user_id_idx ON user_notifications (user_id, created_at);
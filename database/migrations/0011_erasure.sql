@@ -0,0 +1,34 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS erased_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS erasure_requests (
+    request_id   UUID PRIMARY KEY,
+    user_id      UUID NOT NULL REFERENCES users (user_id),
+    requested_by UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    reason       TEXT,
+    status       TEXT NOT NULL DEFAULT 'pending'
+                 CHECK (status IN ('pending', 'approved', 'rejected', 'cancelled', 'completed')),
+    grace_until  TIMESTAMPTZ NOT NULL,
+    decided_by   UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    decided_at   TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- At most one open request per user
+CREATE UNIQUE INDEX IF NOT EXISTS erasure_requests_open_idx ON erasure_requests (user_id)
+    WHERE status IN ('pending', 'approved');
+
+-- Append-only, hash chained record of every step of every erasure. Each
+-- entry's hash covers the previous hash, so editing or deleting an entry
+-- breaks every later one.
+CREATE TABLE IF NOT EXISTS erasure_log (
+    log_id     BIGSERIAL PRIMARY KEY,
+    request_id UUID NOT NULL,
+    user_id    UUID NOT NULL,
+    event      TEXT NOT NULL,
+    actor_id   UUID,
+    details    TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    prev_hash  TEXT NOT NULL,
+    hash       TEXT NOT NULL
+);
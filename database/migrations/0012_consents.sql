@@ -0,0 +1,32 @@
+-- Policy texts are versioned; a consent records the version the user saw
+CREATE TABLE IF NOT EXISTS consent_policies (
+    consent_type TEXT NOT NULL,
+    version      INT NOT NULL,
+    body         TEXT NOT NULL,
+    created_by   UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (consent_type, version)
+);
+
+INSERT INTO consent_policies (consent_type, version, body) VALUES
+    ('data_processing', 1, 'I agree that the health information I enter is stored and processed to provide this service.'),
+    ('research_use', 1, 'I agree that my health information, with direct identifiers removed, may be used for medical research.'),
+    ('ai_processing', 1, 'I agree that my health information may be processed by automated systems to generate replies.'),
+    ('clinician_sharing', 1, 'I agree that clinicians on my care team may view my health information.')
+ON CONFLICT DO NOTHING;
+
+-- Withdrawing sets withdrawn_at; granting again adds a new row, so the
+-- table is the full history
+CREATE TABLE IF NOT EXISTS user_consents (
+    consent_id     UUID PRIMARY KEY,
+    user_id        UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    consent_type   TEXT NOT NULL,
+    policy_version INT NOT NULL,
+    granted_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    withdrawn_at   TIMESTAMPTZ,
+    recorded_by    UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    FOREIGN KEY (consent_type, policy_version) REFERENCES consent_policies (consent_type, version)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_consents_active_idx ON user_consents (user_id, consent_type)
+    WHERE withdrawn_at IS NULL;
@@ -0,0 +1,36 @@
+-- Inactivity clock for user retention, started at sign in. Existing users
+-- start from the day this migration runs.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_active_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE TABLE IF NOT EXISTS retention_policies (
+    policy_id    UUID PRIMARY KEY,
+    resource     TEXT NOT NULL
+                 CHECK (resource IN ('chats', 'users', 'notifications', 'export_jobs', 'import_jobs', 'hl7_dead_letters')),
+    -- Only records owned by users with this role, all roles when NULL
+    role         TEXT CHECK (role IN ('user', 'clinician', 'admin')),
+    max_age_days INTEGER NOT NULL CHECK (max_age_days > 0),
+    enabled      BOOLEAN NOT NULL DEFAULT TRUE,
+    description  TEXT,
+    created_by   UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- One row per policy run, kept after the policy itself is deleted
+CREATE TABLE IF NOT EXISTS retention_runs (
+    run_id       UUID PRIMARY KEY,
+    policy_id    UUID NOT NULL,
+    resource     TEXT NOT NULL,
+    role         TEXT,
+    max_age_days INTEGER NOT NULL,
+    cutoff       TIMESTAMPTZ NOT NULL,
+    dry_run      BOOLEAN NOT NULL,
+    triggered_by UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    matched      INTEGER NOT NULL DEFAULT 0,
+    deleted      INTEGER NOT NULL DEFAULT 0,
+    error        TEXT,
+    started_at   TIMESTAMPTZ NOT NULL,
+    finished_at  TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS retention_runs_started_at_idx ON retention_runs (started_at);
@@ -0,0 +1,62 @@
+-- Pre-aggregated chat statistics for the analytics endpoints. Rows are per
+-- day and demographic cell, never per chat, and are refreshed by the
+-- scheduler. Dimensions are never NULL so the unique indexes allow
+-- REFRESH ... CONCURRENTLY.
+CREATE OR REPLACE FUNCTION analytics_age_band(age INTEGER) RETURNS TEXT AS $$
+    SELECT CASE
+        WHEN age IS NULL OR age < 0 THEN 'unknown'
+        WHEN age < 18 THEN '0-17'
+        WHEN age < 30 THEN '18-29'
+        WHEN age < 45 THEN '30-44'
+        WHEN age < 65 THEN '45-64'
+        ELSE '65+'
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION analytics_gender(gender TEXT) RETURNS TEXT AS $$
+    SELECT CASE
+        WHEN gender IS NULL OR btrim(gender) = '' THEN 'unknown'
+        WHEN lower(btrim(gender)) IN ('male', 'm', 'man') THEN 'male'
+        WHEN lower(btrim(gender)) IN ('female', 'f', 'woman') THEN 'female'
+        ELSE 'other'
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_chats_daily AS
+SELECT date_trunc('day', created_at)::date AS day,
+       analytics_age_band(age)             AS age_band,
+       analytics_gender(gender)            AS gender,
+       COUNT(*)                            AS chats,
+       SUM(height)                         AS height_sum,
+       COUNT(height)                       AS height_n,
+       SUM(weight)                         AS weight_sum,
+       COUNT(weight)                       AS weight_n,
+       SUM(pulse)                          AS pulse_sum,
+       COUNT(pulse)                        AS pulse_n,
+       SUM(split_part(blood_pressure, '/', 1)::int) FILTER (WHERE blood_pressure ~ '^\s*\d{2,3}\s*/\s*\d{2,3}\s*$') AS systolic_sum,
+       SUM(split_part(blood_pressure, '/', 2)::int) FILTER (WHERE blood_pressure ~ '^\s*\d{2,3}\s*/\s*\d{2,3}\s*$') AS diastolic_sum,
+       COUNT(*) FILTER (WHERE blood_pressure ~ '^\s*\d{2,3}\s*/\s*\d{2,3}\s*$') AS blood_pressure_n
+FROM chats
+GROUP BY 1, 2, 3;
+
+CREATE UNIQUE INDEX IF NOT EXISTS analytics_chats_daily_idx ON analytics_chats_daily (day, age_band, gender);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_diagnoses_daily AS
+SELECT date_trunc('day', c.created_at)::date AS day,
+       analytics_age_band(c.age)             AS age_band,
+       analytics_gender(c.gender)            AS gender,
+       d.code                                AS code,
+       COUNT(*)                              AS chats
+FROM chats c JOIN chat_diagnoses d ON d.chat_id = c.chat_id
+GROUP BY 1, 2, 3, 4;
+
+CREATE UNIQUE INDEX IF NOT EXISTS analytics_diagnoses_daily_idx ON analytics_diagnoses_daily (day, age_band, gender, code);
+
+CREATE TABLE IF NOT EXISTS analytics_refreshes (
+    view_name    TEXT PRIMARY KEY,
+    refreshed_at TIMESTAMPTZ NOT NULL
+);
+
+INSERT INTO analytics_refreshes (view_name, refreshed_at)
+VALUES ('analytics_chats_daily', NOW()), ('analytics_diagnoses_daily', NOW())
+ON CONFLICT (view_name) DO NOTHING;
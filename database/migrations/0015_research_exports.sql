@@ -0,0 +1,13 @@
+-- Outcome of the k-anonymity check of research exports
+ALTER TABLE export_jobs ADD COLUMN IF NOT EXISTS report JSONB;
+
+-- Which users, under which consent, are in each released research export
+CREATE TABLE IF NOT EXISTS research_export_subjects (
+    job_id     UUID NOT NULL REFERENCES export_jobs (job_id) ON DELETE CASCADE,
+    user_id    UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    consent_id UUID NOT NULL REFERENCES user_consents (consent_id) ON DELETE CASCADE,
+    records    INTEGER NOT NULL,
+    PRIMARY KEY (job_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS research_export_subjects_user_id_idx ON research_export_subjects (user_id);
@@ -0,0 +1,18 @@
+-- Accounts that exist already are trusted as before; new ones start
+-- unverified
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT FALSE;
+
+-- One row per verification email. The emailed token is signed and names
+-- the row, which makes it single use and ties it to the address it was
+-- sent to.
+CREATE TABLE IF NOT EXISTS email_verifications (
+    verification_id UUID PRIMARY KEY,
+    user_id         UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    email           TEXT NOT NULL,
+    expires_at      TIMESTAMPTZ NOT NULL,
+    used_at         TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS email_verifications_user_id_idx ON email_verifications (user_id, created_at);
@@ -0,0 +1,15 @@
+-- Tokens issued at or before this time are no longer accepted
+ALTER TABLE users ADD COLUMN IF NOT EXISTS sessions_valid_after TIMESTAMPTZ;
+
+-- Only the SHA-256 of a reset token is stored, the token itself is only
+-- ever in the email
+CREATE TABLE IF NOT EXISTS password_resets (
+    token_hash   TEXT PRIMARY KEY,
+    user_id      UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    expires_at   TIMESTAMPTZ NOT NULL,
+    used_at      TIMESTAMPTZ,
+    requested_ip TEXT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_id_idx ON password_resets (user_id, created_at);
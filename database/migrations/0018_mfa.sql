@@ -0,0 +1,16 @@
+-- TOTP second factor. The secret is set when enrolment starts and only
+-- takes effect once a code from it was verified (mfa_enabled_at). The
+-- last accepted time step keeps a code from being used twice.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_secret TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_enabled_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_last_step BIGINT;
+
+-- Single use codes for when the authenticator is lost, stored as SHA-256
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    code_hash  TEXT PRIMARY KEY,
+    user_id    UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS mfa_recovery_codes_user_id_idx ON mfa_recovery_codes (user_id);
@@ -0,0 +1,24 @@
+-- Sign-ins started at /auth/oidc/:provider and not yet finished. The PKCE
+-- verifier never leaves the server; the row is deleted when the callback
+-- uses it.
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state         TEXT PRIMARY KEY,
+    provider      TEXT NOT NULL,
+    nonce         TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    expires_at    TIMESTAMPTZ NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- External accounts linked to users, by the provider's stable subject
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider      TEXT NOT NULL,
+    subject       TEXT NOT NULL,
+    user_id       UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    email         TEXT,
+    linked_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_login_at TIMESTAMPTZ,
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
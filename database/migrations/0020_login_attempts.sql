@@ -0,0 +1,29 @@
+-- Every sign-in attempt, for security review. email is what was typed,
+-- user_id is set when it matched an account.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    attempt_id UUID PRIMARY KEY,
+    email      TEXT NOT NULL,
+    user_id    UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    ip         TEXT NOT NULL,
+    success    BOOLEAN NOT NULL,
+    reason     TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_created_at_idx ON login_attempts (created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_email_idx ON login_attempts (lower(email), created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
+
+-- Recent consecutive failures per email address ('email:<address>') and
+-- per client IP ('ip:<address>'). Unknown addresses are throttled like
+-- real ones so lockouts do not reveal which accounts exist.
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key             TEXT PRIMARY KEY,
+    failures        INTEGER NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    locked_until    TIMESTAMPTZ
+);
+
+ALTER TABLE retention_policies DROP CONSTRAINT IF EXISTS retention_policies_resource_check;
+ALTER TABLE retention_policies ADD CONSTRAINT retention_policies_resource_check
+    CHECK (resource IN ('chats', 'users', 'notifications', 'export_jobs', 'import_jobs', 'hl7_dead_letters', 'login_attempts'));
@@ -0,0 +1,22 @@
+-- One row per issued JWT (its sid claim). Revoking the row ends the
+-- token before it expires.
+CREATE TABLE IF NOT EXISTS sessions (
+    session_id   UUID PRIMARY KEY,
+    user_id      UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    method       TEXT NOT NULL, -- password, signup, oidc:<provider>, with +mfa when a second factor was used
+    user_agent   TEXT,
+    ip           TEXT NOT NULL,
+    last_ip      TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    revoked_at   TIMESTAMPTZ,
+    revoked_by   UUID REFERENCES users (user_id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id, created_at);
+
+ALTER TABLE retention_policies DROP CONSTRAINT IF EXISTS retention_policies_resource_check;
+ALTER TABLE retention_policies ADD CONSTRAINT retention_policies_resource_check
+    CHECK (resource IN ('chats', 'users', 'notifications', 'export_jobs', 'import_jobs', 'hl7_dead_letters',
+                        'login_attempts', 'sessions'));
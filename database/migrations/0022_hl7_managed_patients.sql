@@ -0,0 +1,9 @@
+-- Which import created the user (hl7, fhir), NULL for sign-ups and users
+-- created by an admin. The HL7 feed only updates patients it created.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_via TEXT;
+
+-- Patients already linked to HL7 identifiers stay managed by the feed.
+-- Staff accounts matched by email before this check existed are not.
+UPDATE users SET created_via = 'hl7'
+WHERE created_via IS NULL AND role = 'user'
+  AND user_id IN (SELECT user_id FROM hl7_patient_identifiers);
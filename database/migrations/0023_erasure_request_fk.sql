@@ -0,0 +1,5 @@
+-- Deleting a user row directly, outside the erasure flow, takes its
+-- requests with it; the hash chained erasure_log keeps the record.
+ALTER TABLE erasure_requests DROP CONSTRAINT IF EXISTS erasure_requests_user_id_fkey;
+ALTER TABLE erasure_requests ADD CONSTRAINT erasure_requests_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users (user_id) ON DELETE CASCADE;
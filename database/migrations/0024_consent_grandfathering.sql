@@ -0,0 +1,19 @@
+-- Users who entered data or were on a care team before consents existed
+-- keep that processing. Their consent is recorded as grandfathered against
+-- the first policy version, so it shows as outdated and the app can ask for
+-- an explicit grant.
+ALTER TABLE user_consents ADD COLUMN IF NOT EXISTS grandfathered BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Random (version 4) IDs like uuid.New() makes for the rows the server
+-- inserts; gen_random_uuid is built in from PostgreSQL 13
+WITH introduced AS (
+    SELECT MIN(created_at) AS at FROM consent_policies
+), legacy (user_id, consent_type) AS (
+    SELECT DISTINCT c.user_id, 'data_processing' FROM chats c, introduced WHERE c.created_at < introduced.at
+    UNION
+    SELECT DISTINCT ct.patient_id, 'clinician_sharing' FROM care_team ct, introduced WHERE ct.created_at < introduced.at
+)
+INSERT INTO user_consents (consent_id, user_id, consent_type, policy_version, granted_at, grandfathered)
+SELECT gen_random_uuid(), l.user_id, l.consent_type, 1, introduced.at, TRUE
+FROM legacy l, introduced
+WHERE NOT EXISTS (SELECT 1 FROM user_consents uc WHERE uc.user_id = l.user_id AND uc.consent_type = l.consent_type);
@@ -0,0 +1,17 @@
+-- The record of who was released outlives the user and consent rows: when
+-- either is deleted the link is cleared and the pseudonym used in the
+-- dataset stays. Rows from before this migration have no pseudonym.
+ALTER TABLE research_export_subjects ADD COLUMN IF NOT EXISTS pseudonym TEXT;
+
+ALTER TABLE research_export_subjects DROP CONSTRAINT IF EXISTS research_export_subjects_pkey;
+ALTER TABLE research_export_subjects ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE research_export_subjects ALTER COLUMN consent_id DROP NOT NULL;
+
+ALTER TABLE research_export_subjects DROP CONSTRAINT IF EXISTS research_export_subjects_user_id_fkey;
+ALTER TABLE research_export_subjects ADD CONSTRAINT research_export_subjects_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users (user_id) ON DELETE SET NULL;
+ALTER TABLE research_export_subjects DROP CONSTRAINT IF EXISTS research_export_subjects_consent_id_fkey;
+ALTER TABLE research_export_subjects ADD CONSTRAINT research_export_subjects_consent_id_fkey
+    FOREIGN KEY (consent_id) REFERENCES user_consents (consent_id) ON DELETE SET NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS research_export_subjects_job_user_idx ON research_export_subjects (job_id, user_id);
@@ -0,0 +1,4 @@
+-- The address the reset link was mailed to. Using the link only verifies
+-- the account's email while it is still that address; older rows have none
+-- and verify nothing.
+ALTER TABLE password_resets ADD COLUMN IF NOT EXISTS email TEXT;
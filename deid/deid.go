@@ -0,0 +1,136 @@
+// Package deid de-identifies records for release outside the clinic:
+// keyed pseudonyms in place of identifiers, generalised quasi-identifiers
+// and a k-anonymity check over them.
+package deid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Pseudonymizer derives stable pseudonyms from a secret key. The same key
+// and project always give the same pseudonym for an ID, so records of one
+// patient stay linked across exports, while different projects cannot link
+// their datasets to each other.
+type Pseudonymizer struct {
+	key     []byte
+	project string
+}
+
+func NewPseudonymizer(key []byte, project string) *Pseudonymizer {
+	return &Pseudonymizer{key: key, project: project}
+}
+
+func (p *Pseudonymizer) mac(kind, id string) []byte {
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(p.project + "\x00" + kind + "\x00" + id))
+	return h.Sum(nil)
+}
+
+// ID returns the pseudonym of id, which is of the given kind ("patient",
+// "chat"), as 20 hex characters.
+func (p *Pseudonymizer) ID(kind, id string) string {
+	return hex.EncodeToString(p.mac(kind, id))[:20]
+}
+
+// DateShift returns the number of days, in [-maxDays, maxDays] and never
+// zero, by which all dates of the patient are moved. One offset per patient
+// keeps the intervals between their records intact.
+func (p *Pseudonymizer) DateShift(patientID string, maxDays int) int {
+	if maxDays <= 0 {
+		return 0
+	}
+	n := binary.BigEndian.Uint64(p.mac("date-shift", patientID)[:8])
+	shift := int(n%uint64(maxDays)) + 1
+	if n&(1<<63) != 0 {
+		shift = -shift
+	}
+	return shift
+}
+
+// AgeBand generalises an age to a five year band, with everyone 90 and
+// over in one band as ages that high are rare enough to identify.
+func AgeBand(age *int16) string {
+	switch {
+	case age == nil || *age < 0:
+		return "unknown"
+	case *age >= 90:
+		return "90+"
+	}
+	low := *age / 5 * 5
+	return fmt.Sprintf("%d-%d", low, low+4)
+}
+
+// Range generalises a measurement to the interval of the given width it
+// falls in, e.g. 173.5 with width 10 becomes "170-180".
+func Range(v *float32, width float64) string {
+	if v == nil || width <= 0 {
+		return "unknown"
+	}
+	low := math.Floor(float64(*v)/width) * width
+	return fmt.Sprintf("%g-%g", low, low+width)
+}
+
+// Report describes the outcome of EnforceK.
+type Report struct {
+	K              int `json:"k"`
+	Records        int `json:"records"`
+	Suppressed     int `json:"suppressed"`
+	Classes        int `json:"equivalence_classes"`
+	MinClassSize   int `json:"min_class_size"`
+	SmallestBefore int `json:"min_class_size_before_suppression"`
+}
+
+// SuppressionRate is the share of records removed.
+func (r Report) SuppressionRate() float64 {
+	if r.Records == 0 {
+		return 0
+	}
+	return float64(r.Suppressed) / float64(r.Records)
+}
+
+// EnforceK groups records by their quasi-identifier values and marks those
+// in groups of fewer than k distinct subjects for suppression, so every
+// released record is indistinguishable from those of at least k-1 other
+// people. subjects[i] identifies whose record i is; counting people rather
+// than records stops one patient with many records filling a group alone.
+// keep[i] tells whether record i may be released.
+func EnforceK(quasi [][]string, subjects []string, k int) (keep []bool, report Report) {
+	report = Report{K: k, Records: len(quasi)}
+	keys := make([]string, len(quasi))
+	members := map[string]map[string]bool{}
+	for i, q := range quasi {
+		keys[i] = strings.Join(q, "\x00")
+		if members[keys[i]] == nil {
+			members[keys[i]] = map[string]bool{}
+		}
+		members[keys[i]][subjects[i]] = true
+	}
+
+	for _, m := range members {
+		n := len(m)
+		if report.SmallestBefore == 0 || n < report.SmallestBefore {
+			report.SmallestBefore = n
+		}
+		if n >= k {
+			report.Classes++
+			if report.MinClassSize == 0 || n < report.MinClassSize {
+				report.MinClassSize = n
+			}
+		}
+	}
+
+	keep = make([]bool, len(quasi))
+	for i, key := range keys {
+		keep[i] = len(members[key]) >= k
+		if !keep[i] {
+			report.Suppressed++
+		}
+	}
+	return keep, report
+}
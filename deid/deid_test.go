@@ -0,0 +1,93 @@
+package deid
+
+import "testing"
+
+func TestPseudonymsAreStablePerProjectAndKey(t *testing.T) {
+	p := NewPseudonymizer([]byte("key"), "study-a")
+	id := p.ID("patient", "u1")
+	if len(id) != 20 {
+		t.Errorf("ID = %q, want 20 hex characters", id)
+	}
+	if again := NewPseudonymizer([]byte("key"), "study-a").ID("patient", "u1"); again != id {
+		t.Errorf("same key and project gave %q then %q", id, again)
+	}
+	for name, other := range map[string]string{
+		"other project": NewPseudonymizer([]byte("key"), "study-b").ID("patient", "u1"),
+		"other key":     NewPseudonymizer([]byte("other"), "study-a").ID("patient", "u1"),
+		"other kind":    p.ID("chat", "u1"),
+		"other id":      p.ID("patient", "u2"),
+	} {
+		if other == id {
+			t.Errorf("%s gave the same pseudonym %q", name, id)
+		}
+	}
+}
+
+func TestDateShift(t *testing.T) {
+	p := NewPseudonymizer([]byte("key"), "study")
+	negative, positive := false, false
+	for i := 0; i < 200; i++ {
+		id := string(rune('a'+i%26)) + string(rune('0'+i/26))
+		shift := p.DateShift(id, 30)
+		if shift == 0 || shift < -30 || shift > 30 {
+			t.Fatalf("DateShift(%s) = %d, want a non-zero shift within 30 days", id, shift)
+		}
+		if shift != p.DateShift(id, 30) {
+			t.Fatalf("DateShift(%s) is not stable", id)
+		}
+		negative = negative || shift < 0
+		positive = positive || shift > 0
+	}
+	if !negative || !positive {
+		t.Error("DateShift only moved dates in one direction")
+	}
+	if shift := p.DateShift("a", 0); shift != 0 {
+		t.Errorf("DateShift with maxDays 0 = %d, want 0", shift)
+	}
+}
+
+func TestGeneralisation(t *testing.T) {
+	age := func(n int16) *int16 { return &n }
+	for _, tt := range []struct {
+		age  *int16
+		want string
+	}{{nil, "unknown"}, {age(-1), "unknown"}, {age(0), "0-4"}, {age(37), "35-39"}, {age(89), "85-89"}, {age(90), "90+"}, {age(104), "90+"}} {
+		if got := AgeBand(tt.age); got != tt.want {
+			t.Errorf("AgeBand(%v) = %q, want %q", tt.age, got, tt.want)
+		}
+	}
+
+	v := float32(173.5)
+	if got := Range(&v, 10); got != "170-180" {
+		t.Errorf("Range(173.5, 10) = %q, want 170-180", got)
+	}
+	if got := Range(nil, 10); got != "unknown" {
+		t.Errorf("Range(nil) = %q, want unknown", got)
+	}
+}
+
+func TestEnforceKCountsPeopleNotRecords(t *testing.T) {
+	quasi := [][]string{
+		{"30-34", "female"}, {"30-34", "female"}, {"30-34", "female"}, // one patient, three records
+		{"40-44", "male"}, {"40-44", "male"}, // two patients
+	}
+	subjects := []string{"p1", "p1", "p1", "p2", "p3"}
+
+	keep, report := EnforceK(quasi, subjects, 2)
+	want := []bool{false, false, false, true, true}
+	for i := range want {
+		if keep[i] != want[i] {
+			t.Errorf("keep[%d] = %v, want %v", i, keep[i], want[i])
+		}
+	}
+	if report.Records != 5 || report.Suppressed != 3 || report.Classes != 1 ||
+		report.MinClassSize != 2 || report.SmallestBefore != 1 {
+		t.Errorf("report = %+v", report)
+	}
+	if rate := report.SuppressionRate(); rate != 0.6 {
+		t.Errorf("SuppressionRate = %v, want 0.6", rate)
+	}
+	if (Report{}).SuppressionRate() != 0 {
+		t.Error("SuppressionRate of an empty report is not 0")
+	}
+}
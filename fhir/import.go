@@ -0,0 +1,355 @@
+package fhir
+
+import (
+	"chat-api/utils"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ImportEntry is one entry of an incoming transaction Bundle, decoded into
+// the resource type it declares.
+type ImportEntry struct {
+	FullURL      string
+	ResourceType string
+	Patient      *Patient
+	Observation  *Observation
+	Condition    *Condition
+}
+
+type rawEntry struct {
+	FullURL  string          `json:"fullUrl"`
+	Resource json.RawMessage `json:"resource"`
+	Request  *BundleRequest  `json:"request"`
+}
+
+type rawBundle struct {
+	ResourceType string     `json:"resourceType"`
+	Type         string     `json:"type"`
+	Entry        []rawEntry `json:"entry"`
+}
+
+// ParseTransaction decodes a transaction Bundle. Structural problems with
+// the Bundle itself are returned as an error; problems with a single entry
+// are returned per entry so the caller can report them individually.
+func ParseTransaction(body []byte) ([]ImportEntry, []error, error) {
+	var bundle rawBundle
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if bundle.ResourceType != "Bundle" {
+		return nil, nil, fmt.Errorf("resourceType must be Bundle")
+	}
+	if bundle.Type != "transaction" {
+		return nil, nil, fmt.Errorf("Bundle.type must be transaction")
+	}
+	if len(bundle.Entry) == 0 {
+		return nil, nil, fmt.Errorf("Bundle has no entries")
+	}
+
+	entries := make([]ImportEntry, len(bundle.Entry))
+	errs := make([]error, len(bundle.Entry))
+	for i, raw := range bundle.Entry {
+		entries[i].FullURL = raw.FullURL
+
+		var head struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err := json.Unmarshal(raw.Resource, &head); err != nil || head.ResourceType == "" {
+			errs[i] = fmt.Errorf("entry has no resource")
+			continue
+		}
+		entries[i].ResourceType = head.ResourceType
+
+		if raw.Request != nil && raw.Request.Method != "POST" && raw.Request.Method != "PUT" {
+			errs[i] = fmt.Errorf("request.method %s is not supported", raw.Request.Method)
+			continue
+		}
+
+		var err error
+		switch head.ResourceType {
+		case "Patient":
+			entries[i].Patient = &Patient{}
+			err = json.Unmarshal(raw.Resource, entries[i].Patient)
+		case "Observation":
+			entries[i].Observation = &Observation{}
+			err = json.Unmarshal(raw.Resource, entries[i].Observation)
+		case "Condition":
+			entries[i].Condition = &Condition{}
+			err = json.Unmarshal(raw.Resource, entries[i].Condition)
+		default:
+			err = fmt.Errorf("resource type %s is not supported", head.ResourceType)
+		}
+		if err != nil {
+			errs[i] = err
+		}
+	}
+	return entries, errs, nil
+}
+
+// Email returns the patient's first email telecom.
+func (p *Patient) Email() string {
+	for _, t := range p.Telecom {
+		if t.System == "email" && t.Value != "" {
+			return strings.TrimSpace(t.Value)
+		}
+	}
+	return ""
+}
+
+// DisplayName returns HumanName.text, or the given and family parts joined.
+func (p *Patient) DisplayName() string {
+	for _, n := range p.Name {
+		if n.Text != "" {
+			return n.Text
+		}
+		parts := append(append([]string{}, n.Given...), n.Family)
+		if name := strings.TrimSpace(strings.Join(parts, " ")); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// Age derives the age in whole years from birthDate (YYYY, YYYY-MM or
+// YYYY-MM-DD).
+func (p *Patient) Age(now time.Time) (int, bool) {
+	var birth time.Time
+	var err error
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if birth, err = time.Parse(layout, p.BirthDate); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return 0, false
+	}
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	return age, age >= 0
+}
+
+// ObservationTime returns effectiveDateTime, else issued, else fallback.
+func ObservationTime(o *Observation, fallback time.Time) time.Time {
+	return parseDateTime(o.EffectiveDateTime, o.Issued, fallback)
+}
+
+// ConditionTime returns recordedDate, else onsetDateTime, else fallback.
+func ConditionTime(c *Condition, fallback time.Time) time.Time {
+	return parseDateTime(c.RecordedDate, c.OnsetDateTime, fallback)
+}
+
+func parseDateTime(first, second string, fallback time.Time) time.Time {
+	for _, v := range []string{first, second} {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t
+			}
+		}
+	}
+	return fallback
+}
+
+// Vitals collects the chat vital fields an Observation can fill.
+type Vitals struct {
+	Height    *float32
+	Weight    *float32
+	Pulse     *int16
+	Systolic  *int
+	Diastolic *int
+}
+
+func (c CodeableConcept) loincCode() string {
+	for _, coding := range c.Coding {
+		if coding.System == SystemLOINC {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+func quantityIn(q *Quantity, units map[string]float64) (float64, error) {
+	if q == nil || q.Value == nil {
+		return 0, fmt.Errorf("valueQuantity is required")
+	}
+	unit := q.Code
+	if unit == "" {
+		unit = q.Unit
+	}
+	factor, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("unsupported unit %q", unit)
+	}
+	return *q.Value * factor, nil
+}
+
+var (
+	lengthUnits   = map[string]float64{"cm": 1, "m": 100, "mm": 0.1, "[in_i]": 2.54, "in": 2.54}
+	massUnits     = map[string]float64{"kg": 1, "g": 0.001, "[lb_av]": 0.45359237, "lb": 0.45359237}
+	rateUnits     = map[string]float64{"/min": 1, "{beats}/min": 1, "beats/minute": 1, "bpm": 1}
+	pressureUnits = map[string]float64{"mm[Hg]": 1, "mmHg": 1}
+)
+
+// IsVitalSign reports whether ApplyObservation understands the Observation's
+// code.
+func IsVitalSign(o *Observation) bool {
+	switch o.Code.loincCode() {
+	case "8302-2", "8306-3", "3137-7", "29463-7", "3141-9", "8867-4",
+		"85354-9", "55284-4", "8480-6", "8462-4", "39156-5":
+		return true
+	}
+	return false
+}
+
+// ApplyObservation copies a vital sign Observation into v, converting units
+// to the ones the chats table stores (cm, kg, beats/min, mmHg).
+func ApplyObservation(o *Observation, v *Vitals) error {
+	switch code := o.Code.loincCode(); code {
+	case "8302-2", "8306-3", "3137-7": // body height, lying, measured
+		cm, err := quantityIn(o.ValueQuantity, lengthUnits)
+		if err != nil {
+			return err
+		}
+		if err := inRange("height", cm, 1, 300); err != nil {
+			return err
+		}
+		h := float32(cm)
+		v.Height = &h
+	case "29463-7", "3141-9": // body weight, measured
+		kg, err := quantityIn(o.ValueQuantity, massUnits)
+		if err != nil {
+			return err
+		}
+		if err := inRange("weight", kg, 1, 500); err != nil {
+			return err
+		}
+		w := float32(kg)
+		v.Weight = &w
+	case "8867-4": // heart rate
+		bpm, err := quantityIn(o.ValueQuantity, rateUnits)
+		if err != nil {
+			return err
+		}
+		if err := inRange("pulse", bpm, 1, 300); err != nil {
+			return err
+		}
+		p := int16(bpm + 0.5)
+		v.Pulse = &p
+	case "85354-9", "55284-4": // blood pressure panels
+		if o.ValueString != nil {
+			sys, dia, ok := utils.ParseBloodPressure(*o.ValueString)
+			if !ok {
+				return fmt.Errorf("blood pressure valueString must look like 120/80")
+			}
+			if err := inRange("systolic pressure", float64(sys), 1, 300); err != nil {
+				return err
+			}
+			if err := inRange("diastolic pressure", float64(dia), 1, 300); err != nil {
+				return err
+			}
+			v.Systolic, v.Diastolic = &sys, &dia
+			return nil
+		}
+		for _, comp := range o.Component {
+			if err := applyPressure(comp.Code.loincCode(), comp.ValueQuantity, v); err != nil {
+				return err
+			}
+		}
+		if v.Systolic == nil || v.Diastolic == nil {
+			return fmt.Errorf("blood pressure needs systolic and diastolic components")
+		}
+	case "8480-6", "8462-4":
+		return applyPressure(code, o.ValueQuantity, v)
+	case "39156-5":
+		// BMI is derived from height and weight, nothing to store
+	case "":
+		return fmt.Errorf("Observation.code needs a LOINC coding")
+	default:
+		return fmt.Errorf("unsupported Observation code %s", code)
+	}
+	return nil
+}
+
+func applyPressure(code string, q *Quantity, v *Vitals) error {
+	mmHg, err := quantityIn(q, pressureUnits)
+	if err != nil {
+		return err
+	}
+	n := int(mmHg + 0.5)
+	switch code {
+	case "8480-6":
+		err = inRange("systolic pressure", mmHg, 1, 300)
+		v.Systolic = &n
+	case "8462-4":
+		err = inRange("diastolic pressure", mmHg, 1, 300)
+		v.Diastolic = &n
+	}
+	return err
+}
+
+// inRange applies the bounds the CSV importer uses for the same columns, so
+// both imports reject the same readings.
+func inRange(field string, n, min, max float64) error {
+	if n < min || n > max {
+		return fmt.Errorf("%s must be between %g and %g, got %g", field, min, max, n)
+	}
+	return nil
+}
+
+// ICD10Codes returns the ICD-10 codes of a Condition.
+func (c *Condition) ICD10Codes() []string {
+	if c.Code == nil {
+		return nil
+	}
+	var out []string
+	for _, coding := range c.Code.Coding {
+		if coding.System == SystemICD10 || strings.HasPrefix(coding.System, "http://hl7.org/fhir/sid/icd-10") {
+			out = append(out, coding.Code)
+		}
+	}
+	return out
+}
+
+// Text returns the Condition's human readable description.
+func (c *Condition) Text() string {
+	if c.Code == nil {
+		return ""
+	}
+	if c.Code.Text != "" {
+		return c.Code.Text
+	}
+	for _, coding := range c.Code.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+	}
+	return ""
+}
+
+// ObservationID returns the id ObservationsFromChat gives the Observation
+// of the same kind, so import reports point at what export will serve.
+func ObservationID(chatID string, o *Observation) string {
+	switch o.Code.loincCode() {
+	case "8302-2", "8306-3", "3137-7":
+		return chatID + "-height"
+	case "29463-7", "3141-9":
+		return chatID + "-weight"
+	case "8867-4":
+		return chatID + "-heart-rate"
+	case "39156-5":
+		return chatID + "-bmi"
+	default:
+		return chatID + "-blood-pressure"
+	}
+}
+
+// ConditionID mirrors the ids ConditionsFromChat assigns.
+func ConditionID(chatID string, c *Condition) string {
+	if codes := c.ICD10Codes(); len(codes) > 0 {
+		return chatID + "-" + strings.ReplaceAll(strings.ToUpper(codes[0]), ".", "")
+	}
+	return chatID + "-disease"
+}
@@ -0,0 +1,125 @@
+package fhir
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyObservation(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name  string
+		obs   Observation
+		check func(v Vitals) bool
+		err   string
+	}{
+		{"height in m", Observation{Code: loinc("8302-2", ""), ValueQuantity: quantity(1.8, "", "m")},
+			func(v Vitals) bool { return v.Height != nil && *v.Height == 180 }, ""},
+		{"height in inches", Observation{Code: loinc("8302-2", ""), ValueQuantity: quantity(70, "", "[in_i]")},
+			func(v Vitals) bool { return v.Height != nil && *v.Height > 177.7 && *v.Height < 177.9 }, ""},
+		{"weight in lb", Observation{Code: loinc("29463-7", ""), ValueQuantity: quantity(100, "", "[lb_av]")},
+			func(v Vitals) bool { return v.Weight != nil && *v.Weight > 45.35 && *v.Weight < 45.36 }, ""},
+		{"weight in g", Observation{Code: loinc("29463-7", ""), ValueQuantity: quantity(70500, "", "g")},
+			func(v Vitals) bool { return v.Weight != nil && *v.Weight == 70.5 }, ""},
+		{"pulse rounds", Observation{Code: loinc("8867-4", ""), ValueQuantity: quantity(71.6, "", "/min")},
+			func(v Vitals) bool { return v.Pulse != nil && *v.Pulse == 72 }, ""},
+		{"pressure panel", Observation{Code: loinc("85354-9", ""), Component: []ObservationComponent{
+			{Code: loinc("8480-6", ""), ValueQuantity: quantity(120, "", "mm[Hg]")},
+			{Code: loinc("8462-4", ""), ValueQuantity: quantity(80, "", "mm[Hg]")},
+		}}, func(v Vitals) bool { return *v.Systolic == 120 && *v.Diastolic == 80 }, ""},
+		{"pressure string", Observation{Code: loinc("85354-9", ""), ValueString: str("135/85 mmHg")},
+			func(v Vitals) bool { return *v.Systolic == 135 && *v.Diastolic == 85 }, ""},
+		{"single systolic", Observation{Code: loinc("8480-6", ""), ValueQuantity: quantity(110, "", "mmHg")},
+			func(v Vitals) bool { return *v.Systolic == 110 && v.Diastolic == nil }, ""},
+		{"bmi ignored", Observation{Code: loinc("39156-5", ""), ValueQuantity: quantity(22, "", "kg/m2")},
+			func(v Vitals) bool { return v == Vitals{} }, ""},
+
+		{"zero height", Observation{Code: loinc("8302-2", ""), ValueQuantity: quantity(0, "", "cm")}, nil, "height must be between"},
+		{"negative weight", Observation{Code: loinc("29463-7", ""), ValueQuantity: quantity(-5, "", "kg")}, nil, "weight must be between"},
+		{"pulse overflow", Observation{Code: loinc("8867-4", ""), ValueQuantity: quantity(40000, "", "/min")}, nil, "pulse must be between"},
+		{"pressure too high", Observation{Code: loinc("8462-4", ""), ValueQuantity: quantity(900, "", "mmHg")}, nil, "diastolic pressure must be between"},
+		{"free text pressure", Observation{Code: loinc("85354-9", ""), ValueString: str("normal")}, nil, "must look like 120/80"},
+		{"half a panel", Observation{Code: loinc("85354-9", ""), Component: []ObservationComponent{
+			{Code: loinc("8480-6", ""), ValueQuantity: quantity(120, "", "mm[Hg]")},
+		}}, nil, "needs systolic and diastolic"},
+		{"unknown unit", Observation{Code: loinc("8302-2", ""), ValueQuantity: quantity(5, "", "ft")}, nil, `unsupported unit "ft"`},
+		{"no value", Observation{Code: loinc("8867-4", "")}, nil, "valueQuantity is required"},
+		{"no LOINC", Observation{Code: CodeableConcept{Text: "height"}}, nil, "needs a LOINC coding"},
+		{"other code", Observation{Code: loinc("2339-0", "")}, nil, "unsupported Observation code 2339-0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v Vitals
+			err := ApplyObservation(&tt.obs, &v)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(v) {
+				t.Errorf("unexpected vitals %+v", v)
+			}
+		})
+	}
+}
+
+func TestParseTransaction(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		err   string
+		types []string
+		errs  []string
+	}{
+		{"invalid JSON", `{`, "invalid JSON", nil, nil},
+		{"not a bundle", `{"resourceType":"Patient"}`, "resourceType must be Bundle", nil, nil},
+		{"batch", `{"resourceType":"Bundle","type":"batch","entry":[{}]}`, "must be transaction", nil, nil},
+		{"empty", `{"resourceType":"Bundle","type":"transaction"}`, "no entries", nil, nil},
+		{"entries", `{"resourceType":"Bundle","type":"transaction","entry":[
+			{"fullUrl":"urn:uuid:1","resource":{"resourceType":"Patient","birthDate":"1980"},"request":{"method":"POST"}},
+			{"resource":{"resourceType":"Observation","code":{"coding":[{"system":"http://loinc.org","code":"8867-4"}]}}},
+			{"resource":{"resourceType":"Condition"},"request":{"method":"DELETE"}},
+			{"resource":{"resourceType":"Encounter"}},
+			{"resource":{}},
+			{"resource":{"resourceType":"Observation","code":"pulse"}}
+		]}`, "", []string{"Patient", "Observation", "Condition", "Encounter", "", "Observation"},
+			[]string{"", "", "DELETE is not supported", "Encounter is not supported", "no resource", "cannot unmarshal"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, errs, err := ParseTransaction([]byte(tt.body))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.types) {
+				t.Fatalf("got %d entries, want %d", len(entries), len(tt.types))
+			}
+			for i, e := range entries {
+				if e.ResourceType != tt.types[i] {
+					t.Errorf("entry %d type = %q, want %q", i, e.ResourceType, tt.types[i])
+				}
+				if want := tt.errs[i]; want == "" && errs[i] != nil {
+					t.Errorf("entry %d: unexpected error %v", i, errs[i])
+				} else if want != "" && (errs[i] == nil || !strings.Contains(errs[i].Error(), want)) {
+					t.Errorf("entry %d error = %v, want %q", i, errs[i], want)
+				}
+			}
+			if entries[0].FullURL != "urn:uuid:1" || entries[0].Patient == nil || entries[0].Patient.BirthDate != "1980" {
+				t.Errorf("patient entry not decoded: %+v", entries[0])
+			}
+			if o := entries[1].Observation; o == nil || o.Code.loincCode() != "8867-4" {
+				t.Errorf("observation entry not decoded: %+v", entries[1])
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package fhir
+
+import (
+	"chat-api/models"
+	"chat-api/utils"
+	"strings"
+	"time"
+)
+
+var vitalSignsCategory = []CodeableConcept{{
+	Coding: []Coding{{System: SystemObsCategory, Code: "vital-signs", Display: "Vital Signs"}},
+}}
+
+func PatientReference(userID string) *Reference {
+	return &Reference{Reference: "Patient/" + userID}
+}
+
+func dateTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Gender maps the free-text gender column, English or Thai, to the FHIR
+// administrative gender value set.
+func Gender(g *string) string {
+	if g == nil {
+		return ""
+	}
+	switch strings.ToLower(strings.TrimSpace(*g)) {
+	case "male", "m", "man", "ชาย", "เพศชาย":
+		return "male"
+	case "female", "f", "woman", "หญิง", "เพศหญิง":
+		return "female"
+	case "":
+		return ""
+	case "unknown":
+		return "unknown"
+	default:
+		return "other"
+	}
+}
+
+func FromUser(user models.UserResponse) Patient {
+	p := Patient{
+		ResourceType: "Patient",
+		ID:           user.UserID.String(),
+		Identifier:   []Identifier{{System: SystemUserID, Value: user.UserID.String()}},
+		Telecom:      []ContactPoint{{System: "email", Value: user.Email}},
+		Gender:       Gender(user.Gender),
+	}
+	if user.Name != nil && *user.Name != "" {
+		p.Name = []HumanName{{Text: *user.Name}}
+	}
+	if user.ProfileImageUrl != nil && *user.ProfileImageUrl != "" {
+		p.Photo = []Attachment{{ContentType: "image/jpeg", URL: *user.ProfileImageUrl}}
+	}
+	return p
+}
+
+func quantity(v float64, unit, code string) *Quantity {
+	return &Quantity{Value: &v, Unit: unit, System: SystemUCUM, Code: code}
+}
+
+func loinc(code, display string) CodeableConcept {
+	return CodeableConcept{Coding: []Coding{{System: SystemLOINC, Code: code, Display: display}}, Text: display}
+}
+
+// ObservationsFromChat maps the vitals recorded in an intake chat to vital
+// sign Observations, adding BMI when both height and weight are present.
+func ObservationsFromChat(chat models.Chat) []Observation {
+	base := func(suffix string, code CodeableConcept) Observation {
+		return Observation{
+			ResourceType:      "Observation",
+			ID:                chat.ChatID.String() + "-" + suffix,
+			Status:            "final",
+			Category:          vitalSignsCategory,
+			Code:              code,
+			Subject:           PatientReference(chat.UserID.String()),
+			EffectiveDateTime: dateTime(chat.CreatedAt),
+		}
+	}
+
+	var obs []Observation
+	if chat.Height != nil {
+		o := base("height", loinc("8302-2", "Body height"))
+		o.ValueQuantity = quantity(float64(*chat.Height), "cm", "cm")
+		obs = append(obs, o)
+	}
+	if chat.Weight != nil {
+		o := base("weight", loinc("29463-7", "Body weight"))
+		o.ValueQuantity = quantity(float64(*chat.Weight), "kg", "kg")
+		obs = append(obs, o)
+	}
+	if bmi := utils.BMI(chat.Height, chat.Weight); bmi != nil {
+		o := base("bmi", loinc("39156-5", "Body mass index (BMI) [Ratio]"))
+		o.ValueQuantity = quantity(float64(int(*bmi*10+0.5))/10, "kg/m2", "kg/m2")
+		obs = append(obs, o)
+	}
+	if chat.Pulse != nil {
+		o := base("heart-rate", loinc("8867-4", "Heart rate"))
+		o.ValueQuantity = quantity(float64(*chat.Pulse), "beats/minute", "/min")
+		obs = append(obs, o)
+	}
+	if chat.BloodPressure != nil {
+		o := base("blood-pressure", loinc("85354-9", "Blood pressure panel with all children optional"))
+		if sys, dia, ok := utils.ParseBloodPressure(*chat.BloodPressure); ok {
+			o.Component = []ObservationComponent{
+				{Code: loinc("8480-6", "Systolic blood pressure"), ValueQuantity: quantity(float64(sys), "mmHg", "mm[Hg]")},
+				{Code: loinc("8462-4", "Diastolic blood pressure"), ValueQuantity: quantity(float64(dia), "mmHg", "mm[Hg]")},
+			}
+		} else {
+			// Keep unparseable readings rather than dropping them
+			o.ValueString = chat.BloodPressure
+		}
+		obs = append(obs, o)
+	}
+	return obs
+}
+
+// ConditionsFromChat maps coded diagnoses to ICD-10 Conditions. Free text
+// without a code still becomes a text-only Condition.
+func ConditionsFromChat(chat models.Chat) []Condition {
+	base := func(suffix string, code *CodeableConcept) Condition {
+		return Condition{
+			ResourceType: "Condition",
+			ID:           chat.ChatID.String() + "-" + suffix,
+			ClinicalStatus: &CodeableConcept{
+				Coding: []Coding{{System: SystemCondClinical, Code: "active"}},
+			},
+			// Reported by the patient during intake, not confirmed by a clinician
+			VerificationStatus: &CodeableConcept{
+				Coding: []Coding{{System: SystemCondVerify, Code: "unconfirmed"}},
+			},
+			Category: []CodeableConcept{{
+				Coding: []Coding{{System: SystemCondCategory, Code: "problem-list-item", Display: "Problem List Item"}},
+			}},
+			Code:         code,
+			Subject:      Reference{Reference: "Patient/" + chat.UserID.String()},
+			RecordedDate: dateTime(chat.CreatedAt),
+		}
+	}
+
+	var conditions []Condition
+	for _, d := range chat.Diagnoses {
+		code := &CodeableConcept{Coding: []Coding{{System: SystemICD10, Code: d.Code, Display: d.Description}}}
+		if chat.Disease != nil {
+			code.Text = *chat.Disease
+		}
+		conditions = append(conditions, base(strings.ReplaceAll(d.Code, ".", ""), code))
+	}
+	if len(conditions) == 0 && chat.Disease != nil && strings.TrimSpace(*chat.Disease) != "" {
+		conditions = append(conditions, base("disease", &CodeableConcept{Text: *chat.Disease}))
+	}
+	return conditions
+}
+
+// QuestionnaireResponseFromChat maps the LODCRAFT symptom answers. Returns
+// false when the chat has no answers at all.
+func QuestionnaireResponseFromChat(chat models.Chat) (QuestionnaireResponse, bool) {
+	qr := QuestionnaireResponse{
+		ResourceType:  "QuestionnaireResponse",
+		ID:            chat.ChatID.String(),
+		Questionnaire: QuestionnaireLODCRAFT,
+		Status:        "completed",
+		Subject:       PatientReference(chat.UserID.String()),
+		Authored:      dateTime(chat.UpdatedAt),
+	}
+	for _, key := range models.LODCRAFTKeys {
+		answer := chat.LODCRAFTAnswer(key)
+		if answer == nil || strings.TrimSpace(*answer) == "" {
+			continue
+		}
+		qr.Item = append(qr.Item, QuestionnaireResponseItem{
+			LinkID: key,
+			Text:   models.LODCRAFTLabels[key],
+			Answer: []QuestionnaireResponseAnswer{{ValueString: *answer}},
+		})
+	}
+	return qr, len(qr.Item) > 0
+}
+
+// NewBundle wraps resources in a Bundle of the given type (searchset,
+// collection, ...), giving each entry a fullUrl under baseURL.
+func NewBundle(bundleType, baseURL string, resources []interface{}) Bundle {
+	b := Bundle{
+		ResourceType: "Bundle",
+		Type:         bundleType,
+		Timestamp:    dateTime(time.Now()),
+		Entry:        []BundleEntry{},
+	}
+	for _, r := range resources {
+		b.Entry = append(b.Entry, BundleEntry{FullURL: baseURL + "/" + resourcePath(r), Resource: r})
+	}
+	if bundleType == "searchset" {
+		total := len(b.Entry)
+		b.Total = &total
+	}
+	return b
+}
+
+func resourcePath(r interface{}) string {
+	switch v := r.(type) {
+	case Patient:
+		return "Patient/" + v.ID
+	case Observation:
+		return "Observation/" + v.ID
+	case Condition:
+		return "Condition/" + v.ID
+	case QuestionnaireResponse:
+		return "QuestionnaireResponse/" + v.ID
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package fhir
+
+// A minimal subset of the FHIR R4 data model, enough for the resources this
+// API exchanges. Field names follow the specification so encoding/json
+// produces valid FHIR JSON.
+
+const (
+	SystemLOINC           = "http://loinc.org"
+	SystemUCUM            = "http://unitsofmeasure.org"
+	SystemICD10           = "http://hl7.org/fhir/sid/icd-10"
+	SystemObsCategory     = "http://terminology.hl7.org/CodeSystem/observation-category"
+	SystemCondClinical    = "http://terminology.hl7.org/CodeSystem/condition-clinical"
+	SystemCondVerify      = "http://terminology.hl7.org/CodeSystem/condition-ver-status"
+	SystemCondCategory    = "http://terminology.hl7.org/CodeSystem/condition-category"
+	SystemUserID          = "urn:chat-api:user-id"
+	QuestionnaireLODCRAFT = "urn:chat-api:questionnaire:lodcraft"
+)
+
+type Meta struct {
+	LastUpdated string `json:"lastUpdated,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type HumanName struct {
+	Text   string   `json:"text,omitempty"`
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+type ContactPoint struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type Attachment struct {
+	ContentType string `json:"contentType,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+type Quantity struct {
+	Value  *float64 `json:"value,omitempty"`
+	Unit   string   `json:"unit,omitempty"`
+	System string   `json:"system,omitempty"`
+	Code   string   `json:"code,omitempty"`
+}
+
+type Annotation struct {
+	Text string `json:"text"`
+}
+
+type Patient struct {
+	ResourceType string         `json:"resourceType"`
+	ID           string         `json:"id,omitempty"`
+	Meta         *Meta          `json:"meta,omitempty"`
+	Identifier   []Identifier   `json:"identifier,omitempty"`
+	Active       *bool          `json:"active,omitempty"`
+	Name         []HumanName    `json:"name,omitempty"`
+	Telecom      []ContactPoint `json:"telecom,omitempty"`
+	Gender       string         `json:"gender,omitempty"`
+	BirthDate    string         `json:"birthDate,omitempty"`
+	Photo        []Attachment   `json:"photo,omitempty"`
+}
+
+type ObservationComponent struct {
+	Code          CodeableConcept `json:"code"`
+	ValueQuantity *Quantity       `json:"valueQuantity,omitempty"`
+}
+
+type Observation struct {
+	ResourceType      string                 `json:"resourceType"`
+	ID                string                 `json:"id,omitempty"`
+	Status            string                 `json:"status"`
+	Category          []CodeableConcept      `json:"category,omitempty"`
+	Code              CodeableConcept        `json:"code"`
+	Subject           *Reference             `json:"subject,omitempty"`
+	EffectiveDateTime string                 `json:"effectiveDateTime,omitempty"`
+	Issued            string                 `json:"issued,omitempty"`
+	ValueQuantity     *Quantity              `json:"valueQuantity,omitempty"`
+	ValueString       *string                `json:"valueString,omitempty"`
+	Component         []ObservationComponent `json:"component,omitempty"`
+	Note              []Annotation           `json:"note,omitempty"`
+}
+
+type Condition struct {
+	ResourceType       string            `json:"resourceType"`
+	ID                 string            `json:"id,omitempty"`
+	ClinicalStatus     *CodeableConcept  `json:"clinicalStatus,omitempty"`
+	VerificationStatus *CodeableConcept  `json:"verificationStatus,omitempty"`
+	Category           []CodeableConcept `json:"category,omitempty"`
+	Code               *CodeableConcept  `json:"code,omitempty"`
+	Subject            Reference         `json:"subject"`
+	RecordedDate       string            `json:"recordedDate,omitempty"`
+	OnsetDateTime      string            `json:"onsetDateTime,omitempty"`
+	Note               []Annotation      `json:"note,omitempty"`
+}
+
+type QuestionnaireResponseAnswer struct {
+	ValueString string `json:"valueString"`
+}
+
+type QuestionnaireResponseItem struct {
+	LinkID string                        `json:"linkId"`
+	Text   string                        `json:"text,omitempty"`
+	Answer []QuestionnaireResponseAnswer `json:"answer,omitempty"`
+}
+
+type QuestionnaireResponse struct {
+	ResourceType  string                      `json:"resourceType"`
+	ID            string                      `json:"id,omitempty"`
+	Questionnaire string                      `json:"questionnaire,omitempty"`
+	Status        string                      `json:"status"`
+	Subject       *Reference                  `json:"subject,omitempty"`
+	Authored      string                      `json:"authored,omitempty"`
+	Item          []QuestionnaireResponseItem `json:"item,omitempty"`
+}
+
+type BundleRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type BundleResponse struct {
+	Status   string            `json:"status"`
+	Location string            `json:"location,omitempty"`
+	Outcome  *OperationOutcome `json:"outcome,omitempty"`
+}
+
+type BundleEntry struct {
+	FullURL  string          `json:"fullUrl,omitempty"`
+	Resource interface{}     `json:"resource,omitempty"`
+	Request  *BundleRequest  `json:"request,omitempty"`
+	Response *BundleResponse `json:"response,omitempty"`
+}
+
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	ID           string        `json:"id,omitempty"`
+	Type         string        `json:"type"`
+	Timestamp    string        `json:"timestamp,omitempty"`
+	Total        *int          `json:"total,omitempty"`
+	Entry        []BundleEntry `json:"entry"`
+}
+
+type OperationOutcomeIssue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+type OperationOutcome struct {
+	ResourceType string                  `json:"resourceType"`
+	Issue        []OperationOutcomeIssue `json:"issue"`
+}
+
+func NewOperationOutcome(code, diagnostics string) OperationOutcome {
+	return OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue:        []OperationOutcomeIssue{{Severity: "error", Code: code, Diagnostics: diagnostics}},
+	}
+}
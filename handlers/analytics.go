@@ -0,0 +1,461 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/models"
+	"context"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var analyticsViews = []string{"analytics_chats_daily", "analytics_diagnoses_daily"}
+
+// There is no day bucket: a week minus the days around a suppressed one
+// would give it away.
+var analyticsBuckets = map[string]bool{"week": true, "month": true, "quarter": true, "year": true, "none": true}
+
+// bucketStart truncates t to the start of its bucket, like date_trunc.
+// bucket=none uses weeks.
+func bucketStart(bucket string, t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch bucket {
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case "quarter":
+		return time.Date(y, m-(m-1)%3, 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+}
+
+// checkAnalyticsBound requires from to be the first and to the last day of
+// a bucket. Ranges then always cover whole cells, so comparing two ranges a
+// day apart cannot isolate the chats of a single day.
+func checkAnalyticsBound(bucket, bound string, t time.Time) error {
+	unit := bucket
+	if unit == "none" {
+		unit = "week"
+	}
+	if bound == "to" {
+		t = t.AddDate(0, 0, 1)
+	}
+	if !bucketStart(unit, t).Equal(t) {
+		first, last := "first", "last"
+		if unit == "week" {
+			first, last = "a Monday", "a Sunday"
+		} else {
+			first += " day of a " + unit
+			last += " day of a " + unit
+		}
+		if bound == "from" {
+			return fiber.NewError(fiber.StatusBadRequest, "from must be "+first)
+		}
+		return fiber.NewError(fiber.StatusBadRequest, "to must be "+last)
+	}
+	return nil
+}
+
+// analyticsMinCellSize reads ANALYTICS_MIN_CELL_SIZE, defaulting to 10.
+// Cells with fewer chats are suppressed so small groups cannot be traced
+// back to individual patients.
+func analyticsMinCellSize() int {
+	if n, err := strconv.Atoi(os.Getenv("ANALYTICS_MIN_CELL_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return 10
+}
+
+// analyticsVital is an average computed from a sum and a count column of
+// analytics_chats_daily.
+type analyticsVital struct {
+	sum, n string
+	dest   func(row *models.AnalyticsRow) **float64
+}
+
+var analyticsVitals = []analyticsVital{
+	{"height_sum", "height_n", func(r *models.AnalyticsRow) **float64 { return &r.AvgHeight }},
+	{"weight_sum", "weight_n", func(r *models.AnalyticsRow) **float64 { return &r.AvgWeight }},
+	{"pulse_sum", "pulse_n", func(r *models.AnalyticsRow) **float64 { return &r.AvgPulse }},
+	{"systolic_sum", "blood_pressure_n", func(r *models.AnalyticsRow) **float64 { return &r.AvgSystolic }},
+	{"diastolic_sum", "blood_pressure_n", func(r *models.AnalyticsRow) **float64 { return &r.AvgDiastolic }},
+}
+
+// analyticsRequest is the query common to every analytics endpoint:
+// bucket=week|month|quarter|year|none, group_by=a,b and from/to dates
+// aligned to the bucket.
+type analyticsRequest struct {
+	bucket  string
+	groupBy []string
+	where   []string
+	args    []interface{}
+	// parent is passed to suppressComplementary, nil when no dimension
+	// has totals of its own
+	parent func(dim int, value string) string
+}
+
+func (r *analyticsRequest) arg(v interface{}) string {
+	r.args = append(r.args, v)
+	return "$" + strconv.Itoa(len(r.args))
+}
+
+// dimensions maps the group_by names the endpoint supports to their SQL.
+func parseAnalyticsRequest(c *fiber.Ctx, dimensions map[string]string) (*analyticsRequest, error) {
+	r := &analyticsRequest{bucket: c.Query("bucket", "week")}
+	if !analyticsBuckets[r.bucket] {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "bucket must be one of week, month, quarter, year, none")
+	}
+
+	seen := map[string]bool{}
+	for _, dim := range strings.Split(c.Query("group_by"), ",") {
+		dim = strings.TrimSpace(dim)
+		if dim == "" || seen[dim] {
+			continue
+		}
+		if _, ok := dimensions[dim]; !ok {
+			names := make([]string, 0, len(dimensions))
+			for name := range dimensions {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fiber.NewError(fiber.StatusBadRequest, "group_by supports "+strings.Join(names, ", "))
+		}
+		seen[dim] = true
+		r.groupBy = append(r.groupBy, dim)
+	}
+
+	for _, bound := range []string{"from", "to"} {
+		v := c.Query(bound)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid "+bound+", use YYYY-MM-DD")
+		}
+		if err := checkAnalyticsBound(r.bucket, bound, t); err != nil {
+			return nil, err
+		}
+		if bound == "from" {
+			r.where = append(r.where, "day >= "+r.arg(t))
+		} else {
+			r.where = append(r.where, "day <= "+r.arg(t))
+		}
+	}
+	return r, nil
+}
+
+// query builds the aggregate over view, metrics are appended after the chat
+// count.
+func (r *analyticsRequest) query(view string, dimensions map[string]string, metrics []string) string {
+	var cols, group []string
+	if r.bucket != "none" {
+		cols = append(cols, "date_trunc('"+r.bucket+"', day)::date")
+	}
+	for _, dim := range r.groupBy {
+		cols = append(cols, dimensions[dim])
+	}
+	for i := range cols {
+		group = append(group, strconv.Itoa(i+1))
+	}
+
+	query := "SELECT " + strings.Join(append(append(cols, "COALESCE(SUM(chats), 0)::bigint"), metrics...), ", ") + " FROM " + view
+	if len(r.where) > 0 {
+		query += " WHERE " + strings.Join(r.where, " AND ")
+	}
+	if len(group) > 0 {
+		query += " GROUP BY " + strings.Join(group, ", ") + " ORDER BY " + strings.Join(group, ", ")
+	}
+	return query
+}
+
+// analyticsCell is a result row while suppression is decided: its bucket
+// and group_by values, in query order, and its chat count.
+type analyticsCell struct {
+	key        []string
+	chats      int64
+	suppressed bool
+}
+
+// suppressComplementary hides further cells until no line, the cells that
+// differ in one dimension only, has exactly one hidden cell. The line's
+// total is what a coarser query returns, e.g. bucket=none or one group_by
+// fewer, and minus the shown cells it would give a lone hidden cell away.
+// The smallest shown cell of the line is hidden with it. parent, when set,
+// returns what a value's line also has to share, like the ICD-10 category of
+// a full code, since the category is a total of its own.
+func suppressComplementary(cells []analyticsCell, parent func(dim int, value string) string) {
+	if len(cells) == 0 {
+		return
+	}
+	dims := len(cells[0].key)
+	for changed := true; changed; {
+		changed = false
+		for dim := 0; dim < dims; dim++ {
+			lines := map[string][]int{}
+			var order []string
+			for i, cell := range cells {
+				key := append([]string{}, cell.key...)
+				key[dim] = ""
+				if parent != nil {
+					key[dim] = parent(dim, cell.key[dim])
+				}
+				k := strings.Join(key, "\x00")
+				if _, ok := lines[k]; !ok {
+					order = append(order, k)
+				}
+				lines[k] = append(lines[k], i)
+			}
+			for _, k := range order {
+				hidden, smallest := 0, -1
+				for _, i := range lines[k] {
+					if cells[i].suppressed {
+						hidden++
+					} else if smallest < 0 || cells[i].chats < cells[smallest].chats {
+						smallest = i
+					}
+				}
+				if hidden == 1 && smallest >= 0 {
+					cells[smallest].suppressed = true
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// runAnalytics executes the query and suppresses small cells, plus the
+// cells needed to keep them from being worked out, see
+// suppressComplementary. vitals, when given, are the sum and count columns
+// appended to the query.
+func runAnalytics(c *fiber.Ctx, r *analyticsRequest, view string, dimensions map[string]string, vitals []analyticsVital) error {
+	var metrics []string
+	for _, v := range vitals {
+		metrics = append(metrics, "SUM("+v.sum+")::float8", "COALESCE(SUM("+v.n+"), 0)::bigint")
+	}
+	query := r.query(view, dimensions, metrics)
+
+	rows, err := database.DB.Query(query, r.args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to run analytics query " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	minCell := analyticsMinCellSize()
+	result := models.AnalyticsResult{Bucket: r.bucket, GroupBy: r.groupBy, MinCellSize: minCell, Rows: []models.AnalyticsRow{}}
+	if result.GroupBy == nil {
+		result.GroupBy = []string{}
+	}
+	var cells []analyticsCell
+	var sums [][]*float64
+	var counts [][]int64
+	for rows.Next() {
+		var row models.AnalyticsRow
+		var dest []interface{}
+		if r.bucket != "none" {
+			dest = append(dest, &row.Bucket)
+		}
+		for _, dim := range r.groupBy {
+			switch dim {
+			case "age_band":
+				dest = append(dest, &row.AgeBand)
+			case "gender":
+				dest = append(dest, &row.Gender)
+			case "code":
+				dest = append(dest, &row.Code)
+			}
+		}
+		var chats int64
+		dest = append(dest, &chats)
+		rowSums := make([]*float64, len(vitals))
+		rowCounts := make([]int64, len(vitals))
+		for i := range vitals {
+			dest = append(dest, &rowSums[i], &rowCounts[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan analytics row " + err.Error(),
+			})
+		}
+
+		cell := analyticsCell{chats: chats, suppressed: chats < int64(minCell)}
+		if row.Bucket != nil {
+			cell.key = append(cell.key, row.Bucket.Format("2006-01-02"))
+		}
+		for _, dim := range r.groupBy {
+			cell.key = append(cell.key, analyticsValue(&row, dim))
+		}
+		cells = append(cells, cell)
+		sums = append(sums, rowSums)
+		counts = append(counts, rowCounts)
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read analytics rows " + err.Error(),
+		})
+	}
+
+	suppressComplementary(cells, r.parent)
+	for i := range result.Rows {
+		row := &result.Rows[i]
+		if cells[i].suppressed {
+			row.Suppressed = true
+			continue
+		}
+		row.Chats = &cells[i].chats
+		for j, v := range vitals {
+			// An average over a few readings would reveal them too
+			if sums[i][j] != nil && counts[i][j] >= int64(minCell) {
+				avg := *sums[i][j] / float64(counts[i][j])
+				*v.dest(row) = &avg
+			}
+		}
+	}
+
+	var refreshed time.Time
+	if database.DB.QueryRow("SELECT refreshed_at FROM analytics_refreshes WHERE view_name = $1", view).Scan(&refreshed) == nil {
+		result.RefreshedAt = &refreshed
+	}
+	return c.JSON(result)
+}
+
+// analyticsValue returns a row's group_by value, NULL as "\x00" so it is
+// told apart from an empty string.
+func analyticsValue(row *models.AnalyticsRow, dim string) string {
+	var v *string
+	switch dim {
+	case "age_band":
+		v = row.AgeBand
+	case "gender":
+		v = row.Gender
+	case "code":
+		v = row.Code
+	}
+	if v == nil {
+		return "\x00"
+	}
+	return *v
+}
+
+var icd10Category = regexp.MustCompile(`^[A-Z][0-9]{2}$`)
+
+var chatDimensions = map[string]string{"age_band": "age_band", "gender": "gender"}
+
+// GetChatAnalytics counts chats per time bucket and demographic cell, e.g.
+// age and gender distributions with bucket=none&group_by=age_band,gender.
+func GetChatAnalytics(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+	r, err := parseAnalyticsRequest(c, chatDimensions)
+	if err != nil {
+		return err
+	}
+	return runAnalytics(c, r, "analytics_chats_daily", chatDimensions, nil)
+}
+
+// GetVitalsAnalytics returns average height, weight, pulse and blood
+// pressure per bucket and cell.
+func GetVitalsAnalytics(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+	r, err := parseAnalyticsRequest(c, chatDimensions)
+	if err != nil {
+		return err
+	}
+	return runAnalytics(c, r, "analytics_chats_daily", chatDimensions, analyticsVitals)
+}
+
+// GetDiagnosisAnalytics counts chats per ICD-10 diagnosis. Codes are rolled
+// up to their three character category unless code_level=full; code=E11
+// restricts to one category. Narrower or wider prefixes are refused, their
+// totals would overlap in ways suppression cannot follow. A chat with
+// several diagnoses counts once for each.
+func GetDiagnosisAnalytics(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+	codeExpr := "left(code, 3)"
+	switch c.Query("code_level", "category") {
+	case "category":
+	case "full":
+		codeExpr = "code"
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code_level must be category or full",
+		})
+	}
+	dimensions := map[string]string{"age_band": "age_band", "gender": "gender", "code": codeExpr}
+	r, err := parseAnalyticsRequest(c, dimensions)
+	if err != nil {
+		return err
+	}
+	if category := strings.ToUpper(strings.TrimSpace(c.Query("code"))); category != "" {
+		if !icd10Category.MatchString(category) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "code must be an ICD-10 category like E11",
+			})
+		}
+		r.where = append(r.where, "left(code, 3) = "+r.arg(category))
+	}
+	if codeExpr == "code" {
+		// Full codes are hidden together within their category
+		codeDim := len(r.groupBy)
+		for i, dim := range r.groupBy {
+			if dim == "code" {
+				codeDim = i
+			}
+		}
+		if r.bucket != "none" {
+			codeDim++
+		}
+		r.parent = func(dim int, value string) string {
+			if dim == codeDim && len(value) >= 3 {
+				return value[:3]
+			}
+			return ""
+		}
+	}
+	return runAnalytics(c, r, "analytics_diagnoses_daily", dimensions, nil)
+}
+
+// RefreshAnalytics recomputes the analytics views. It is run by the
+// scheduler and on demand by admins.
+func RefreshAnalytics(ctx context.Context) error {
+	for _, view := range analyticsViews {
+		if _, err := database.DB.ExecContext(ctx, "REFRESH MATERIALIZED VIEW CONCURRENTLY "+view); err != nil {
+			return err
+		}
+		_, err := database.DB.ExecContext(ctx, `
+			INSERT INTO analytics_refreshes (view_name, refreshed_at) VALUES ($1, NOW())
+			ON CONFLICT (view_name) DO UPDATE SET refreshed_at = EXCLUDED.refreshed_at`, view)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func RefreshAnalyticsNow(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+	if err := RefreshAnalytics(c.Context()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh analytics " + err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Analytics refreshed successfully",
+	})
+}
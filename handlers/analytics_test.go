@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckAnalyticsBound(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		bucket, bound, date string
+		ok                  bool
+	}{
+		{"week", "from", "2024-01-01", true}, // Monday
+		{"week", "from", "2024-01-02", false},
+		{"week", "to", "2024-01-07", true}, // Sunday
+		{"week", "to", "2024-01-08", false},
+		{"none", "from", "2024-01-08", true},
+		{"none", "to", "2024-01-13", false},
+		{"month", "from", "2024-02-01", true},
+		{"month", "from", "2024-01-29", false},
+		{"month", "to", "2024-02-29", true},
+		{"month", "to", "2024-02-28", false},
+		{"quarter", "from", "2024-04-01", true},
+		{"quarter", "from", "2024-05-01", false},
+		{"quarter", "to", "2024-06-30", true},
+		{"quarter", "to", "2024-05-31", false},
+		{"year", "from", "2024-01-01", true},
+		{"year", "to", "2024-12-31", true},
+		{"year", "to", "2024-11-30", false},
+	}
+	for _, tt := range tests {
+		err := checkAnalyticsBound(tt.bucket, tt.bound, day(tt.date))
+		if (err == nil) != tt.ok {
+			t.Errorf("checkAnalyticsBound(%s, %s, %s) = %v, want ok %v", tt.bucket, tt.bound, tt.date, err, tt.ok)
+		}
+	}
+}
+
+func TestBucketStartMatchesDateTrunc(t *testing.T) {
+	// Postgres weeks start on Monday; 2024-03-03 is a Sunday
+	sunday := time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)
+	for bucket, want := range map[string]string{
+		"week": "2024-02-26", "month": "2024-03-01", "quarter": "2024-01-01", "year": "2024-01-01",
+	} {
+		if got := bucketStart(bucket, sunday).Format("2006-01-02"); got != want {
+			t.Errorf("bucketStart(%s) = %s, want %s", bucket, got, want)
+		}
+	}
+}
+
+func TestSuppressComplementary(t *testing.T) {
+	cell := func(chats int64, key ...string) analyticsCell {
+		return analyticsCell{key: key, chats: chats, suppressed: chats < 10}
+	}
+	fullCodes := func(dim int, value string) string { return value[:3] }
+	tests := []struct {
+		name   string
+		cells  []analyticsCell
+		parent func(int, string) string
+		hidden []bool
+	}{
+		{"lone small cell takes the next smallest", []analyticsCell{
+			cell(50, "female"), cell(30, "male"), cell(3, "\x00"), cell(40, "other"),
+		}, nil, []bool{false, true, true, false}},
+		{"two small cells are enough", []analyticsCell{
+			cell(50, "female"), cell(4, "male"), cell(3, "\x00"),
+		}, nil, []bool{false, true, true}},
+		{"nothing small", []analyticsCell{cell(50, "female"), cell(30, "male")}, nil, []bool{false, false}},
+		{"single total", []analyticsCell{cell(5)}, nil, []bool{true}},
+		{"every line of a grid", []analyticsCell{
+			cell(3, "2024-01-01", "female"), cell(20, "2024-01-01", "male"),
+			cell(15, "2024-01-08", "female"), cell(40, "2024-01-08", "male"),
+			cell(60, "2024-01-15", "female"), cell(70, "2024-01-15", "male"),
+		}, nil, []bool{true, true, true, true, false, false}},
+		{"full codes within their category", []analyticsCell{
+			cell(3, "E11.9"), cell(20, "E11.6"), cell(15, "I10.0"), cell(12, "I10.1"),
+		}, fullCodes, []bool{true, true, false, false}},
+		{"without categories the smallest anywhere", []analyticsCell{
+			cell(3, "E11.9"), cell(20, "E11.6"), cell(15, "I10.0"), cell(12, "I10.1"),
+		}, nil, []bool{true, false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suppressComplementary(tt.cells, tt.parent)
+			for i, c := range tt.cells {
+				if c.suppressed != tt.hidden[i] {
+					t.Errorf("cell %v suppressed = %v, want %v", c.key, c.suppressed, tt.hidden[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/models"
+	"chat-api/storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Sniffed content types accepted as chat attachments
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+const attachmentURLTTL = 15 * time.Minute
+
+// maxAttachmentBytes reads ATTACHMENT_MAX_BYTES, defaulting to 10 MB. The
+// Fiber BodyLimit must stay above it, see BodyLimit.
+func maxAttachmentBytes() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("ATTACHMENT_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 10 << 20
+}
+
+// Room above the attachment limit for multipart boundaries and form fields
+const multipartOverhead = 1 << 20
+
+// BodyLimit is the request body limit for the Fiber app: BODY_LIMIT_BYTES,
+// defaulting to the attachment limit plus multipart overhead. A configured
+// value too small for an attachment upload is an error.
+func BodyLimit() (int, error) {
+	min := maxAttachmentBytes() + multipartOverhead
+	raw := os.Getenv("BODY_LIMIT_BYTES")
+	if raw == "" {
+		return int(min), nil
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("BODY_LIMIT_BYTES must be a positive number of bytes")
+	}
+	if n < min {
+		return 0, fmt.Errorf("BODY_LIMIT_BYTES (%d) must be at least ATTACHMENT_MAX_BYTES plus %d bytes of multipart overhead (%d)", n, multipartOverhead, min)
+	}
+	return int(n), nil
+}
+
+// attachmentDownloadURL prefers a URL presigned by the storage backend and
+// falls back to our own signed /files/attachments route.
+func attachmentDownloadURL(c *fiber.Ctx, a *models.Attachment) (string, error) {
+	if presigner, ok := storage.Default().(storage.Presigner); ok {
+		return presigner.PresignGet(a.StorageKey, attachmentURLTTL)
+	}
+	return c.BaseURL() + storage.SignPath("/files/attachments/"+a.AttachmentID.String(), attachmentURLTTL), nil
+}
+
+func fetchAttachment(attachmentID uuid.UUID) (models.Attachment, error) {
+	var a models.Attachment
+	err := database.DB.QueryRow(`
+		SELECT attachment_id, chat_id, uploaded_by, filename, content_type, size_bytes, storage_key, created_at
+		FROM chat_attachments WHERE attachment_id = $1`, attachmentID).Scan(
+		&a.AttachmentID, &a.ChatID, &a.UploadedBy, &a.Filename, &a.ContentType, &a.SizeBytes,
+		&a.StorageKey, &a.CreatedAt)
+	return a, err
+}
+
+func UploadAttachment(c *fiber.Ctx) error {
+	td, chatID, _, err := chatWriteAccess(c)
+	if err != nil {
+		return err
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Multipart field file is required",
+		})
+	}
+	if fileHeader.Size > maxAttachmentBytes() {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("File must be at most %d bytes", maxAttachmentBytes()),
+		})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read uploaded file",
+		})
+	}
+	defer file.Close()
+
+	// Trust the bytes, not the client supplied Content-Type
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read uploaded file",
+		})
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !attachmentTypes[contentType] {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Unsupported file type " + contentType,
+		})
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read uploaded file",
+		})
+	}
+
+	attachment := models.Attachment{
+		AttachmentID: uuid.New(),
+		ChatID:       chatID,
+		UploadedBy:   &td.UserID,
+		Filename:     filepath.Base(fileHeader.Filename),
+		ContentType:  contentType,
+		SizeBytes:    fileHeader.Size,
+	}
+	attachment.StorageKey = fmt.Sprintf("attachments/%s/%s", chatID, attachment.AttachmentID)
+
+	err = storage.Default().Put(c.Context(), attachment.StorageKey, file, attachment.SizeBytes, contentType)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store attachment " + err.Error(),
+		})
+	}
+
+	err = database.DB.QueryRow(`
+		INSERT INTO chat_attachments (attachment_id, chat_id, uploaded_by, filename, content_type, size_bytes, storage_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`,
+		attachment.AttachmentID, chatID, td.UserID, attachment.Filename, contentType,
+		attachment.SizeBytes, attachment.StorageKey).Scan(&attachment.CreatedAt)
+	if err != nil {
+		storage.Default().Delete(c.Context(), attachment.StorageKey)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save attachment " + err.Error(),
+		})
+	}
+
+	attachment.DownloadURL, _ = attachmentDownloadURL(c, &attachment)
+	return c.Status(fiber.StatusCreated).JSON(attachment)
+}
+
+func GetAttachments(c *fiber.Ctx) error {
+	_, chatID, _, err := chatAccess(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT attachment_id, chat_id, uploaded_by, filename, content_type, size_bytes, storage_key, created_at
+		FROM chat_attachments WHERE chat_id = $1 ORDER BY created_at`, chatID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch attachments " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	attachments := []models.Attachment{}
+	for rows.Next() {
+		var a models.Attachment
+		err := rows.Scan(&a.AttachmentID, &a.ChatID, &a.UploadedBy, &a.Filename, &a.ContentType,
+			&a.SizeBytes, &a.StorageKey, &a.CreatedAt)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan attachment " + err.Error(),
+			})
+		}
+		if a.DownloadURL, err = attachmentDownloadURL(c, &a); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to sign download URL",
+			})
+		}
+		attachments = append(attachments, a)
+	}
+
+	return c.JSON(attachments)
+}
+
+func DeleteAttachment(c *fiber.Ctx) error {
+	_, chatID, _, err := chatWriteAccess(c)
+	if err != nil {
+		return err
+	}
+	attachmentID, err := uuid.Parse(c.Params("attachmentId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid attachment ID",
+		})
+	}
+
+	attachment, err := fetchAttachment(attachmentID)
+	if err != nil || attachment.ChatID != chatID {
+		if err == nil || err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Attachment not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch attachment",
+		})
+	}
+
+	_, err = database.DB.Exec("DELETE FROM chat_attachments WHERE attachment_id = $1", attachmentID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete attachment",
+		})
+	}
+	if err := storage.Default().Delete(c.Context(), attachment.StorageKey); err != nil {
+		log.Println("Failed to delete stored attachment", attachment.StorageKey, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Attachment deleted successfully",
+	})
+}
+
+// DownloadAttachment serves an attachment to anyone holding a valid signed
+// URL, so it sits outside the JWT protected group.
+func DownloadAttachment(c *fiber.Ctx) error {
+	attachmentID, err := uuid.Parse(c.Params("attachmentId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid attachment ID",
+		})
+	}
+	if !storage.VerifyPath(c.Path(), c.Query("expires"), c.Query("signature")) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid or expired download link",
+		})
+	}
+
+	attachment, err := fetchAttachment(attachmentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Attachment not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch attachment",
+		})
+	}
+
+	reader, err := storage.Default().Get(c.Context(), attachment.StorageKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Attachment content not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read attachment",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, attachment.ContentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", attachment.Filename))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return c.SendStream(reader, int(attachment.SizeBytes))
+}
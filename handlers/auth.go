@@ -6,6 +6,9 @@ import (
 	"chat-api/models"
 	"chat-api/utils"
 	"database/sql"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -60,8 +63,23 @@ func SignUp(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := sendVerificationEmail(c.Context(), publicBaseURL(), userID, input.Email); err != nil {
+		log.Println("Failed to send verification email to", userID, err)
+	}
+	if unverifiedAccess() == "none" {
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"message": "User created successfully, confirm your email address to sign in",
+			"user": fiber.Map{
+				"user_id":        userID,
+				"email":          input.Email,
+				"role":           role,
+				"email_verified": false,
+			},
+		})
+	}
+
 	// Generate JWT
-	token, err := middleware.GenerateJWTToken(userID, input.Email, "user")
+	token, err := issueSessionToken(c, userID, input.Email, "user", "signup")
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
@@ -72,9 +90,10 @@ func SignUp(c *fiber.Ctx) error {
 		"message": "User created successfully",
 		"token":   token,
 		"user": fiber.Map{
-			"user_id": userID,
-			"email":   input.Email,
-			"role":    role,
+			"user_id":        userID,
+			"email":          input.Email,
+			"role":           role,
+			"email_verified": false,
 		},
 	})
 }
@@ -82,21 +101,30 @@ func SignUp(c *fiber.Ctx) error {
 func SignIn(c *fiber.Ctx) error {
 	// Decode JWT
 	var user models.User
+	var emailVerified bool
 	token, tokenEerr := middleware.DecodeJWTTokenFromHeader(c)
-	if tokenEerr == nil {
+	// Like AccountGuard, only tokens of a live session of this user count
+	if tokenEerr == nil && token.SessionID != uuid.Nil {
 		database.DB.QueryRow(`
-		SELECT user_id, email, role
-		FROM users WHERE user_id = $1 AND email = $2`, token.UserID, token.Email).Scan(
-			&user.UserID, &user.Email, &user.Role)
-		if user.UserID != uuid.Nil && user.Email != "" {
+		SELECT user_id, email, role, email_verified
+		FROM users WHERE user_id = $1 AND email = $2
+		  AND (sessions_valid_after IS NULL OR sessions_valid_after < to_timestamp($3))
+		  AND EXISTS (
+		      SELECT 1 FROM sessions
+		      WHERE session_id = $4 AND user_id = $1 AND revoked_at IS NULL AND expires_at > NOW())`,
+			token.UserID, token.Email, token.IssuedAt, token.SessionID).Scan(
+			&user.UserID, &user.Email, &user.Role, &emailVerified)
+		if user.UserID != uuid.Nil && user.Email != "" && (emailVerified || unverifiedAccess() != "none") {
+			database.DB.Exec("UPDATE users SET last_active_at = NOW() WHERE user_id = $1", user.UserID)
 			return c.JSON(fiber.Map{
 				"message": "Login successful",
 				"token":   token,
 				"user": fiber.Map{
-					"user_id": user.UserID,
-					"email":   user.Email,
-					"name":    user.Name,
-					"role":    user.Role,
+					"user_id":        user.UserID,
+					"email":          user.Email,
+					"name":           user.Name,
+					"role":           user.Role,
+					"email_verified": emailVerified,
 				},
 			})
 		}
@@ -109,25 +137,54 @@ func SignIn(c *fiber.Ctx) error {
 		})
 	}
 
+	if err := checkLoginThrottle(c, input.Email, nil); err != nil {
+		return err
+	}
+
+	var mfaEnabledAt *time.Time
 	err := database.DB.QueryRow(`
-		SELECT user_id, email, password, name, role
+		SELECT user_id, email, password, name, role, email_verified, mfa_enabled_at
 		FROM users WHERE email = $1`, input.Email).Scan(
-		&user.UserID, &user.Email, &user.Password, &user.Name, &user.Role)
+		&user.UserID, &user.Email, &user.Password, &user.Name, &user.Role, &emailVerified, &mfaEnabledAt)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid credentials",
-		})
+		utils.CheckPasswordHash(input.Password, dummyPasswordHash())
+		return failedSignIn(c, input.Email, nil, "unknown_email", "Invalid email or password")
 	}
 
 	// Check password
 	if !utils.CheckPasswordHash(input.Password, user.Password) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "wrong password",
+		return failedSignIn(c, input.Email, &user.UserID, "wrong_password", "Invalid email or password")
+	}
+
+	if !emailVerified && unverifiedAccess() == "none" {
+		loginSucceeded(input.Email, c.IP(), false)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Email address not verified, see POST /auth/verify/resend",
 		})
 	}
 
+	// With MFA the password only earns a short-lived challenge, the JWT
+	// comes from POST /auth/mfa
+	// Failures are only forgotten once the second factor passed too
+	if mfaEnabledAt != nil {
+		recordLoginAttempt(input.Email, &user.UserID, c.IP(), true, "mfa_pending")
+		loginSucceeded(input.Email, c.IP(), false)
+		return mfaChallenge(c, user.UserID, "password")
+	}
+
+	recordLoginAttempt(input.Email, &user.UserID, c.IP(), true, "success")
+	loginSucceeded(input.Email, c.IP(), true)
+	return completeSignIn(c, &user, emailVerified, "password")
+}
+
+// completeSignIn starts a session and issues its JWT once every sign-in
+// step has passed. method records how the user signed in.
+func completeSignIn(c *fiber.Ctx, user *models.User, emailVerified bool, method string) error {
+	// Starts the inactivity clock of user retention policies over
+	database.DB.Exec("UPDATE users SET last_active_at = NOW() WHERE user_id = $1", user.UserID)
+
 	// Generate JWT
-	genToken, err := middleware.GenerateJWTToken(user.UserID, user.Email, user.Role)
+	genToken, err := issueSessionToken(c, user.UserID, user.Email, user.Role, method)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
@@ -138,10 +195,59 @@ func SignIn(c *fiber.Ctx) error {
 		"message": "Login successful",
 		"token":   genToken,
 		"user": fiber.Map{
-			"user_id": user.UserID,
-			"email":   user.Email,
-			"name":    user.Name,
-			"role":    user.Role,
+			"user_id":        user.UserID,
+			"email":          user.Email,
+			"name":           user.Name,
+			"role":           user.Role,
+			"email_verified": emailVerified,
 		},
 	})
 }
+
+// AccountGuard runs after the JWT middleware on every protected route and
+// checks what the token alone cannot: that the account still exists, that
+// the token was issued after the last password reset and belongs to a
+// session that was not revoked, that accounts whose role requires MFA have
+// enrolled, and that UNVERIFIED_EMAIL_ACCESS allows the request.
+func AccountGuard() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		td, err := middleware.DecodeJWTToken(c)
+		if err != nil {
+			return err
+		}
+		// Tokens without a session cannot be revoked, so they are not accepted
+		if td.SessionID == uuid.Nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Session has ended, sign in again")
+		}
+		var verified bool
+		var validAfter, mfaEnabledAt *time.Time
+		err = database.DB.QueryRow(`
+			SELECT email_verified, sessions_valid_after, mfa_enabled_at FROM users WHERE user_id = $1`,
+			td.UserID).Scan(&verified, &validAfter, &mfaEnabledAt)
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusUnauthorized, "Account no longer exists")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check account")
+		}
+		if validAfter != nil && td.IssuedAt <= validAfter.Unix() {
+			return fiber.NewError(fiber.StatusUnauthorized, "Session has ended, sign in again")
+		}
+		active, err := touchSession(td.SessionID, td.UserID, c.IP())
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check session")
+		}
+		if !active {
+			return fiber.NewError(fiber.StatusUnauthorized, "Session has ended, sign in again")
+		}
+		if mfaEnabledAt == nil && mfaRequired(td.Role) && !strings.HasPrefix(c.Path(), mfaEnrolmentPath(td.UserID)) {
+			return fiber.NewError(fiber.StatusForbidden, "Your role requires MFA, enrol first with POST /api/users/:id/mfa/totp")
+		}
+
+		mode := unverifiedAccess()
+		if verified || mode == "full" || (mode == "read_only" && (c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead)) {
+			return c.Next()
+		}
+		return fiber.NewError(fiber.StatusForbidden, "Verify your email address first, see POST /auth/verify/resend")
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"chat-api/middleware"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// A token without a sid cannot be revoked, so it is refused before the
+// account is even looked up.
+func TestAccountGuardRefusesTokensWithoutSession(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+	app := fiber.New()
+	app.Get("/api/me", middleware.SetJWtHeaderHandler(), AccountGuard(), func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+
+	td, err := middleware.GenerateJWTToken(uuid.New(), "jane@example.com", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+*td.Token)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401 for a token without a session", resp.StatusCode)
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"chat-api/database"
+	"chat-api/imaging"
+	"chat-api/storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Square sizes generated for every avatar; the first is used as profile_image_url
+var avatarSizes = []int{512, 128, 64}
+
+const maxAvatarBytes = 5 << 20
+
+var avatarTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+func avatarKey(userID, version uuid.UUID, size int) string {
+	return fmt.Sprintf("avatars/%s/%s/%d.jpg", userID, version, size)
+}
+
+func UploadAvatar(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	fileHeader, err := c.FormFile("image")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Multipart field image is required",
+		})
+	}
+	if fileHeader.Size > maxAvatarBytes {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("Image must be at most %d bytes", maxAvatarBytes),
+		})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read uploaded image",
+		})
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarBytes+1))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read uploaded image",
+		})
+	}
+
+	if contentType := http.DetectContentType(data); !avatarTypes[contentType] {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Image must be JPEG, PNG or GIF, got " + contentType,
+		})
+	}
+
+	// Decoding and re-encoding keeps only pixels, so EXIF data is stripped
+	img, _, err := imaging.Decode(data)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid image: " + err.Error(),
+		})
+	}
+
+	var oldVersion *uuid.UUID
+	err = database.DB.QueryRow("SELECT avatar_version FROM users WHERE user_id = $1", userID).Scan(&oldVersion)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load user",
+		})
+	}
+
+	version := uuid.New()
+	urls := fiber.Map{}
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := imaging.EncodeJPEG(&buf, imaging.Thumbnail(img, size)); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to encode image",
+			})
+		}
+		key := avatarKey(userID, version, size)
+		if err := storage.Default().Put(c.Context(), key, &buf, int64(buf.Len()), "image/jpeg"); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to store image " + err.Error(),
+			})
+		}
+		urls[strconv.Itoa(size)] = publicBaseURL() + "/files/" + key
+	}
+
+	profileImageURL := urls[strconv.Itoa(avatarSizes[0])]
+	_, err = database.DB.Exec(
+		"UPDATE users SET profile_image_url = $1, avatar_version = $2 WHERE user_id = $3",
+		profileImageURL, version, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update user " + err.Error(),
+		})
+	}
+
+	if oldVersion != nil {
+		for _, size := range avatarSizes {
+			if err := storage.Default().Delete(c.Context(), avatarKey(userID, *oldVersion, size)); err != nil {
+				log.Println("Failed to delete old avatar", err)
+			}
+		}
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":           "Avatar uploaded successfully",
+		"profile_image_url": profileImageURL,
+		"thumbnails":        urls,
+	})
+}
+
+// ServeAvatar is public: avatar URLs are stored in profile_image_url and
+// contain a random version, so they are not guessable from the user ID.
+func ServeAvatar(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Avatar not found",
+		})
+	}
+	version, err := uuid.Parse(c.Params("version"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Avatar not found",
+		})
+	}
+	size := 0
+	for _, s := range avatarSizes {
+		if c.Params("file") == strconv.Itoa(s)+".jpg" {
+			size = s
+		}
+	}
+	if size == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Avatar not found",
+		})
+	}
+
+	reader, err := storage.Default().Get(c.Context(), avatarKey(userID, version, size))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Avatar not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read avatar",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "image/jpeg")
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	// A new upload gets a new version, so a given URL never changes content
+	c.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+	return c.SendStream(reader)
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/middleware"
+	"chat-api/models"
+	"database/sql"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// isAssignedClinician also requires the patient's consent to sharing with
+// clinicians; without it the care team assignment grants nothing.
+func isAssignedClinician(clinicianID, patientID uuid.UUID) (bool, error) {
+	var assigned bool
+	err := database.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM care_team WHERE clinician_id = $1 AND patient_id = $2)
+		   AND `+consentedSQL("$2", ConsentClinicianSharing),
+		clinicianID, patientID).Scan(&assigned)
+	return assigned, err
+}
+
+// canAccessPatient reports whether the caller may read a patient's records:
+// admins, the patient themself and clinicians on the patient's care team.
+func canAccessPatient(td *middleware.TokenDetails, patientID uuid.UUID) (bool, error) {
+	if td.Role == "admin" || td.UserID == patientID {
+		return true, nil
+	}
+	if td.Role != "clinician" {
+		return false, nil
+	}
+	return isAssignedClinician(td.UserID, patientID)
+}
+
+// patientAccess parses the :id param and applies canAccessPatient to it.
+func patientAccess(c *fiber.Ctx) (*middleware.TokenDetails, uuid.UUID, error) {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, uuid.Nil, fiber.NewError(fiber.StatusBadRequest, "Invalid user ID")
+	}
+	allowed, err := canAccessPatient(td, patientID)
+	if err != nil {
+		return nil, uuid.Nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to verify care team")
+	}
+	if !allowed {
+		return nil, uuid.Nil, fiber.NewError(fiber.StatusForbidden, "You can only access your own or your patients' records")
+	}
+	return td, patientID, nil
+}
+
+// chatAccess parses the chat :id, loads its owner and checks the caller may
+// read the chat. Care team clinicians pass it but may only annotate, see
+// UpdateChat and chatWriteAccess.
+func chatAccess(c *fiber.Ctx) (*middleware.TokenDetails, uuid.UUID, uuid.UUID, error) {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return nil, uuid.Nil, uuid.Nil, err
+	}
+	chatID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, uuid.Nil, uuid.Nil, fiber.NewError(fiber.StatusBadRequest, "Invalid chat ID")
+	}
+
+	var ownerID uuid.UUID
+	err = database.DB.QueryRow("SELECT user_id FROM chats WHERE chat_id = $1", chatID).Scan(&ownerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, uuid.Nil, uuid.Nil, fiber.NewError(fiber.StatusNotFound, "Chat not found")
+		}
+		return nil, uuid.Nil, uuid.Nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to verify chat ownership")
+	}
+
+	allowed, err := canAccessPatient(td, ownerID)
+	if err != nil {
+		return nil, uuid.Nil, uuid.Nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to verify chat access")
+	}
+	if !allowed {
+		return nil, uuid.Nil, uuid.Nil, fiber.NewError(fiber.StatusForbidden, "You can only access your own or your patients' chats")
+	}
+	return td, chatID, ownerID, nil
+}
+
+// chatWriteAccess is chatAccess for changes to the chat's own content, which
+// only its owner or an admin may make.
+func chatWriteAccess(c *fiber.Ctx) (*middleware.TokenDetails, uuid.UUID, uuid.UUID, error) {
+	td, chatID, ownerID, err := chatAccess(c)
+	if err != nil {
+		return nil, uuid.Nil, uuid.Nil, err
+	}
+	if td.Role != "admin" && td.UserID != ownerID {
+		return nil, uuid.Nil, uuid.Nil, fiber.NewError(fiber.StatusForbidden, "Only the chat's owner can change it")
+	}
+	return td, chatID, ownerID, nil
+}
+
+func GetCareTeam(c *fiber.Ctx) error {
+	_, patientID, err := patientAccess(c)
+	if err != nil {
+		return err
+	}
+
+	members, err := fetchCareTeam(patientID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch care team " + err.Error(),
+		})
+	}
+
+	return c.JSON(members)
+}
+
+func fetchCareTeam(patientID uuid.UUID) ([]models.CareTeamMember, error) {
+	rows, err := database.DB.Query(`
+		SELECT ct.clinician_id, ct.patient_id, ct.assigned_by, ct.created_at, u.email, u.name
+		FROM care_team ct JOIN users u ON u.user_id = ct.clinician_id
+		WHERE ct.patient_id = $1 ORDER BY ct.created_at`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.CareTeamMember{}
+	for rows.Next() {
+		var m models.CareTeamMember
+		if err := rows.Scan(&m.ClinicianID, &m.PatientID, &m.AssignedBy, &m.CreatedAt, &m.Email, &m.Name); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func GetClinicianPatients(c *fiber.Ctx) error {
+	td, clinicianID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	if td.Role != "admin" && td.Role != "clinician" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only clinicians have patients",
+		})
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT ct.clinician_id, ct.patient_id, ct.assigned_by, ct.created_at, u.email, u.name
+		FROM care_team ct JOIN users u ON u.user_id = ct.patient_id
+		WHERE ct.clinician_id = $1 AND `+consentedSQL("ct.patient_id", ConsentClinicianSharing)+`
+		ORDER BY ct.created_at`, clinicianID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch patients " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	patients := []models.CareTeamMember{}
+	for rows.Next() {
+		var m models.CareTeamMember
+		if err := rows.Scan(&m.ClinicianID, &m.PatientID, &m.AssignedBy, &m.CreatedAt, &m.Email, &m.Name); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan patients " + err.Error(),
+			})
+		}
+		patients = append(patients, m)
+	}
+
+	return c.JSON(patients)
+}
+
+func AssignClinician(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+	if td.Role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only admins can assign clinicians",
+		})
+	}
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var input models.CareTeamAssign
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if input.ClinicianID == patientID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A user cannot be their own clinician",
+		})
+	}
+
+	var role string
+	err = database.DB.QueryRow("SELECT role FROM users WHERE user_id = $1", input.ClinicianID).Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Clinician not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch clinician",
+		})
+	}
+	if role != "clinician" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "User is not a clinician",
+		})
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO care_team (clinician_id, patient_id, assigned_by) VALUES ($1, $2, $3)
+		ON CONFLICT (clinician_id, patient_id) DO NOTHING`,
+		input.ClinicianID, patientID, td.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to assign clinician " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Clinician assigned successfully",
+	})
+}
+
+func UnassignClinician(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+	if td.Role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only admins can unassign clinicians",
+		})
+	}
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+	clinicianID, err := uuid.Parse(c.Params("clinicianId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid clinician ID",
+		})
+	}
+
+	result, err := database.DB.Exec(
+		"DELETE FROM care_team WHERE clinician_id = $1 AND patient_id = $2", clinicianID, patientID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unassign clinician",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Clinician is not assigned to this patient",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Clinician unassigned successfully",
+	})
+}
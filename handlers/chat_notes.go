@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/middleware"
+	"chat-api/models"
+	"database/sql"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var noteTypes = map[string]bool{"assessment": true, "plan": true, "observation": true, "private": true}
+
+// canSeePrivateNotes hides private notes from the patient the chat belongs to.
+// Callers must already have passed canAccessPatient for the chat owner.
+func canSeePrivateNotes(td *middleware.TokenDetails, ownerID uuid.UUID) bool {
+	return td.Role == "admin" || (td.Role == "clinician" && td.UserID != ownerID)
+}
+
+func fetchChatNotes(chatID uuid.UUID, includePrivate bool) ([]models.ChatNote, error) {
+	query := `
+		SELECT n.note_id, n.chat_id, n.author_id, u.email, n.note_type, n.body, n.created_at
+		FROM chat_notes n LEFT JOIN users u ON u.user_id = n.author_id
+		WHERE n.chat_id = $1`
+	if !includePrivate {
+		query += ` AND n.note_type <> 'private'`
+	}
+	rows, err := database.DB.Query(query+` ORDER BY n.created_at`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []models.ChatNote{}
+	for rows.Next() {
+		var n models.ChatNote
+		err := rows.Scan(&n.NoteID, &n.ChatID, &n.AuthorID, &n.AuthorEmail, &n.NoteType, &n.Body, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+func GetChatNotes(c *fiber.Ctx) error {
+	td, chatID, ownerID, err := chatAccess(c)
+	if err != nil {
+		return err
+	}
+
+	notes, err := fetchChatNotes(chatID, canSeePrivateNotes(td, ownerID))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat notes " + err.Error(),
+		})
+	}
+	return c.JSON(notes)
+}
+
+func CreateChatNote(c *fiber.Ctx) error {
+	td, chatID, ownerID, err := chatAccess(c)
+	if err != nil {
+		return err
+	}
+	if !canSeePrivateNotes(td, ownerID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only admins and assigned clinicians can add notes",
+		})
+	}
+
+	var input models.ChatNoteCreate
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	input.NoteType = strings.ToLower(strings.TrimSpace(input.NoteType))
+	if input.NoteType == "" {
+		input.NoteType = "assessment"
+	}
+	if !noteTypes[input.NoteType] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "note_type must be one of assessment, plan, observation, private",
+		})
+	}
+	if strings.TrimSpace(input.Body) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Note body is required",
+		})
+	}
+
+	noteID := uuid.New()
+	_, err = database.DB.Exec(`
+		INSERT INTO chat_notes (note_id, chat_id, author_id, note_type, body)
+		VALUES ($1, $2, $3, $4, $5)`,
+		noteID, chatID, td.UserID, input.NoteType, input.Body)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create chat note " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Chat note created successfully",
+		"note_id": noteID,
+	})
+}
+
+func DeleteChatNote(c *fiber.Ctx) error {
+	td, chatID, _, err := chatAccess(c)
+	if err != nil {
+		return err
+	}
+	noteID, err := uuid.Parse(c.Params("noteId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid note ID",
+		})
+	}
+
+	var authorID *uuid.UUID
+	err = database.DB.QueryRow(
+		"SELECT author_id FROM chat_notes WHERE note_id = $1 AND chat_id = $2", noteID, chatID).Scan(&authorID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Chat note not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat note",
+		})
+	}
+	if td.Role != "admin" && (authorID == nil || *authorID != td.UserID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only delete your own notes",
+		})
+	}
+
+	_, err = database.DB.Exec("DELETE FROM chat_notes WHERE note_id = $1", noteID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete chat note",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Chat note deleted successfully",
+	})
+}
@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"chat-api/codes"
 	"chat-api/database"
+	"chat-api/interactions"
 	"chat-api/middleware"
 	"chat-api/models"
+	"chat-api/storage"
 	"database/sql"
+	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -12,11 +18,21 @@ import (
 )
 
 func GetChats(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+
+	where, args, err := chatListFilter(c, td)
+	if err != nil {
+		return err
+	}
+
 	rows, err := database.DB.Query(`
 		SELECT chat_id, user_id, created_at, updated_at, disease, text, name, age, height, weight,
 		       blood_pressure, pulse, gender, physical_condition, medical_history,
 			   "L", "O", "D", "C", "R", "A", "F", "T"
-		FROM chats ORDER BY created_at DESC`)
+		FROM chats `+where+` ORDER BY created_at DESC`, args...)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch chats",
@@ -39,10 +55,21 @@ func GetChats(c *fiber.Ctx) error {
 		chats = append(chats, chat)
 	}
 
+	if err := loadChatDiagnoses(chats); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat diagnoses",
+		})
+	}
+
 	return c.JSON(chats)
 }
 
 func GetChat(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+
 	chatID, err := uuid.Parse(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -71,6 +98,36 @@ func GetChat(c *fiber.Ctx) error {
 		})
 	}
 
+	allowed, err := canAccessPatient(td, chat.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify chat access",
+		})
+	}
+	if !allowed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only view your own or your patients' chats",
+		})
+	}
+
+	chats := []models.Chat{chat}
+	if err := loadChatDiagnoses(chats); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat diagnoses",
+		})
+	}
+
+	chat = chats[0]
+	if chat.Medications, chat.Allergies, err = patientRecords(td, chat.UserID); err != nil {
+		return err
+	}
+	chat.Warnings = chatWarnings(chat.Medications, chat.Allergies)
+	if chat.Notes, err = fetchChatNotes(chat.ChatID, canSeePrivateNotes(td, chat.UserID)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat notes",
+		})
+	}
+
 	return c.JSON(chat)
 }
 
@@ -83,41 +140,91 @@ func CreateChat(c *fiber.Ctx) error {
 	userID := td.UserID
 	var input models.ChatCreate
 
+	consented, err := hasConsent(userID, ConsentDataProcessing)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check consent " + err.Error(),
+		})
+	}
+	if !consented {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Consent to data processing is required, see POST /api/users/:id/consents",
+		})
+	}
+
 	if err := c.BodyParser(&input); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid input",
 		})
 	}
 
+	diagnoses, err := resolveDiagnoses(&input)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create chat " + err.Error(),
+		})
+	}
+	defer tx.Rollback()
+
 	chatID := uuid.New()
-	_, err := database.DB.Exec(`
-		INSERT INTO chats (chat_id, user_id, created_at, updated_at, disease, text, name, age, height, weight,
-		                   blood_pressure, pulse, gender, physical_condition, medical_history,
-						   "L", "O", "D", "C", "R", "A", "F", "T")
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`,
-		chatID, userID, time.Now(), time.Now(),
-		input.Disease, input.Text, input.Name, input.Age, input.Height, input.Weight,
-		input.BloodPressure, input.Pulse, input.Gender, input.PhysicalCondition, input.MedicalHistory,
-		input.L, input.O, input.D, input.C, input.R, input.A, input.F, input.T)
+	err = insertChat(tx, chatID, userID, &input, time.Now())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create chat " + err.Error(),
 		})
 	}
 
+	if err := saveChatDiagnoses(tx, chatID, diagnoses); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save chat diagnoses " + err.Error(),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create chat " + err.Error(),
+		})
+	}
+
+	// Safety warnings are advisory, so a failed lookup does not fail the intake
+	var warnings []models.InteractionWarning
+	if names, substances, err := patientSafetyContext(td, userID); err == nil {
+		warnings = interactions.Default().Check(names, substances)
+	}
+
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"message": "Chat created successfully",
-		"chat_id": chatID,
+		"message":   "Chat created successfully",
+		"chat_id":   chatID,
+		"diagnoses": diagnoses,
+		"warnings":  warnings,
 	})
 }
 
+// hasPatientChatFields reports whether the update sets any of the fields
+// the patient fills in.
+func hasPatientChatFields(input *models.ChatCreate) bool {
+	for _, v := range []*string{input.Disease, input.Text, input.Name, input.BloodPressure, input.Gender,
+		input.PhysicalCondition, input.MedicalHistory, input.L, input.O, input.D, input.C, input.R, input.A, input.F, input.T} {
+		if v != nil {
+			return true
+		}
+	}
+	return input.Age != nil || input.Height != nil || input.Weight != nil || input.Pulse != nil
+}
+
 func UpdateChat(c *fiber.Ctx) error {
 	td, err := middleware.DecodeJWTToken(c)
 	if err != nil {
 		return err
 	}
 
-	userID := td.UserID
 	chatID, err := uuid.Parse(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -139,9 +246,16 @@ func UpdateChat(c *fiber.Ctx) error {
 		})
 	}
 
-	if td.Role != "admin" && ownerID != userID {
+	// Assigned clinicians may annotate their patients' chats
+	allowed, err := canAccessPatient(td, ownerID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify chat ownership",
+		})
+	}
+	if !allowed {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "You can only update your own chats",
+			"error": "You can only update your own or your patients' chats",
 		})
 	}
 
@@ -152,22 +266,63 @@ func UpdateChat(c *fiber.Ctx) error {
 		})
 	}
 
-	_, err = database.DB.Exec(`
-		UPDATE chats SET updated_at = $1, disease = $2, text = $3, name = $4, age = $5, height = $6, weight = $7,
-		               blood_pressure = $8, pulse = $9, gender = $10, physical_condition = $11, medical_history = $12,
-		               "L" = $13, "O" = $14, "D" = $15, "C" = $16, "R" = $17, "A" = $18, "F" = $19, "T" = $20
-		WHERE chat_id = $21`,
-		time.Now(), input.Disease, input.Text, input.Name, input.Age, input.Height, input.Weight,
-		input.BloodPressure, input.Pulse, input.Gender, input.PhysicalCondition, input.MedicalHistory,
-		input.L, input.O, input.D, input.C, input.R, input.A, input.F, input.T, chatID)
+	// What the patient entered stays theirs: a clinician's annotation is
+	// the diagnosis coding, anything else goes in a chat note
+	annotateOnly := td.Role == "clinician" && td.UserID != ownerID
+	if annotateOnly && (hasPatientChatFields(&input) || len(input.DiagnosisCodes) == 0) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Clinicians can only set diagnosis_codes on a patient's chat, use POST /api/chats/:id/notes for notes",
+		})
+	}
+
+	diagnoses, err := resolveDiagnoses(&input)
 	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update chat " + err.Error(),
+		})
+	}
+	defer tx.Rollback()
+
+	if annotateOnly {
+		_, err = tx.Exec("UPDATE chats SET updated_at = $1 WHERE chat_id = $2", time.Now(), chatID)
+	} else {
+		_, err = tx.Exec(`
+			UPDATE chats SET updated_at = $1, disease = $2, text = $3, name = $4, age = $5, height = $6, weight = $7,
+			               blood_pressure = $8, pulse = $9, gender = $10, physical_condition = $11, medical_history = $12,
+			               "L" = $13, "O" = $14, "D" = $15, "C" = $16, "R" = $17, "A" = $18, "F" = $19, "T" = $20
+			WHERE chat_id = $21`,
+			time.Now(), input.Disease, input.Text, input.Name, input.Age, input.Height, input.Weight,
+			input.BloodPressure, input.Pulse, input.Gender, input.PhysicalCondition, input.MedicalHistory,
+			input.L, input.O, input.D, input.C, input.R, input.A, input.F, input.T, chatID)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update chat " + err.Error(),
+		})
+	}
+
+	if err := saveChatDiagnoses(tx, chatID, diagnoses); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save chat diagnoses " + err.Error(),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update chat " + err.Error(),
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Chat updated successfully",
+		"message":   "Chat updated successfully",
+		"diagnoses": diagnoses,
 	})
 }
 
@@ -205,6 +360,18 @@ func DeleteChat(c *fiber.Ctx) error {
 		})
 	}
 
+	// Attachment rows cascade with the chat, the stored files do not
+	var storageKeys []string
+	if rows, err := database.DB.Query("SELECT storage_key FROM chat_attachments WHERE chat_id = $1", chatID); err == nil {
+		for rows.Next() {
+			var key string
+			if rows.Scan(&key) == nil {
+				storageKeys = append(storageKeys, key)
+			}
+		}
+		rows.Close()
+	}
+
 	_, err = database.DB.Exec("DELETE FROM chats WHERE chat_id = $1", chatID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -212,6 +379,12 @@ func DeleteChat(c *fiber.Ctx) error {
 		})
 	}
 
+	for _, key := range storageKeys {
+		if err := storage.Default().Delete(c.Context(), key); err != nil {
+			log.Println("Failed to delete stored attachment", key, err)
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"message": "Chat deleted successfully",
 	})
@@ -251,5 +424,128 @@ func GetUserChats(c *fiber.Ctx) error {
 		chats = append(chats, chat)
 	}
 
+	if err := loadChatDiagnoses(chats); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat diagnoses",
+		})
+	}
+
 	return c.JSON(chats)
 }
+
+const chatColumns = `chat_id, user_id, created_at, updated_at, disease, text, name, age, height, weight,
+	blood_pressure, pulse, gender, physical_condition, medical_history,
+	"L", "O", "D", "C", "R", "A", "F", "T"`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanChat(row rowScanner, chat *models.Chat) error {
+	return row.Scan(&chat.ChatID, &chat.UserID, &chat.CreatedAt, &chat.UpdatedAt,
+		&chat.Disease, &chat.Text, &chat.Name, &chat.Age, &chat.Height, &chat.Weight,
+		&chat.BloodPressure, &chat.Pulse, &chat.Gender, &chat.PhysicalCondition, &chat.MedicalHistory,
+		&chat.L, &chat.O, &chat.D, &chat.C, &chat.R, &chat.A, &chat.F, &chat.T)
+}
+
+// chatListFilter builds the WHERE clause for chat listings and exports.
+// Admins see every chat, clinicians their own and their patients' chats,
+// everyone else only their own. On top of that the optional query filters
+// user_id, from and to (created_at, YYYY-MM-DD or RFC 3339, to inclusive)
+// and code (ICD-10) narrow the result.
+func chatListFilter(c *fiber.Ctx, td *middleware.TokenDetails) (string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	switch td.Role {
+	case "admin":
+	case "clinician":
+		p := arg(td.UserID)
+		conds = append(conds, "(user_id = "+p+" OR user_id IN (SELECT patient_id FROM care_team WHERE clinician_id = "+p+
+			" AND "+consentedSQL("patient_id", ConsentClinicianSharing)+"))")
+	default:
+		conds = append(conds, "user_id = "+arg(td.UserID))
+	}
+
+	if v := c.Query("user_id"); v != "" {
+		userID, err := uuid.Parse(v)
+		if err != nil {
+			return "", nil, fiber.NewError(fiber.StatusBadRequest, "Invalid user_id")
+		}
+		conds = append(conds, "user_id = "+arg(userID))
+	}
+	for _, bound := range []string{"from", "to"} {
+		v := c.Query(bound)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		dateOnly := false
+		if err != nil {
+			t, err = time.ParseInLocation("2006-01-02", v, time.Local)
+			dateOnly = true
+		}
+		if err != nil {
+			return "", nil, fiber.NewError(fiber.StatusBadRequest, "Invalid "+bound+", use YYYY-MM-DD or RFC 3339")
+		}
+		if bound == "from" {
+			conds = append(conds, "created_at >= "+arg(t))
+		} else if dateOnly {
+			conds = append(conds, "created_at < "+arg(t.AddDate(0, 0, 1)))
+		} else {
+			conds = append(conds, "created_at <= "+arg(t))
+		}
+	}
+	if v := c.Query("code"); v != "" {
+		code, ok := codes.Lookup(v)
+		if !ok {
+			return "", nil, fiber.NewError(fiber.StatusBadRequest, "Unknown ICD-10 code "+v)
+		}
+		conds = append(conds, "chat_id IN (SELECT chat_id FROM chat_diagnoses WHERE code = "+arg(code.Code)+")")
+	}
+
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// queryChats selects chats with the given WHERE/ORDER BY clause and loads
+// their coded diagnoses.
+func queryChats(clause string, args ...interface{}) ([]models.Chat, error) {
+	rows, err := database.DB.Query(`SELECT `+chatColumns+` FROM chats `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []models.Chat{}
+	for rows.Next() {
+		var chat models.Chat
+		if err := scanChat(rows, &chat); err != nil {
+			return nil, err
+		}
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return chats, loadChatDiagnoses(chats)
+}
+
+func insertChat(tx *sql.Tx, chatID, userID uuid.UUID, input *models.ChatCreate, createdAt time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO chats (chat_id, user_id, created_at, updated_at, disease, text, name, age, height, weight,
+		                   blood_pressure, pulse, gender, physical_condition, medical_history,
+						   "L", "O", "D", "C", "R", "A", "F", "T")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`,
+		chatID, userID, createdAt, createdAt,
+		input.Disease, input.Text, input.Name, input.Age, input.Height, input.Weight,
+		input.BloodPressure, input.Pulse, input.Gender, input.PhysicalCondition, input.MedicalHistory,
+		input.L, input.O, input.D, input.C, input.R, input.A, input.F, input.T)
+	return err
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"chat-api/codes"
+	"chat-api/database"
+	"chat-api/models"
+	"database/sql"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+func SearchICD10(c *fiber.Ctx) error {
+	q := c.Query("q")
+	if q == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Query parameter q is required",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	return c.JSON(codes.Search(q, limit))
+}
+
+// resolveDiagnoses turns the explicit codes of a chat input into diagnoses, or
+// falls back to mapping the free-text disease through the synonym table.
+func resolveDiagnoses(input *models.ChatCreate) ([]models.ChatDiagnosis, error) {
+	return codes.Diagnoses(input.DiagnosisCodes, input.Disease)
+}
+
+// saveChatDiagnoses replaces the coded diagnoses of a chat.
+func saveChatDiagnoses(tx *sql.Tx, chatID uuid.UUID, diagnoses []models.ChatDiagnosis) error {
+	if _, err := tx.Exec("DELETE FROM chat_diagnoses WHERE chat_id = $1", chatID); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, d := range diagnoses {
+		if seen[d.Code] {
+			continue
+		}
+		seen[d.Code] = true
+		_, err := tx.Exec(`
+			INSERT INTO chat_diagnoses (chat_id, code, description, source)
+			VALUES ($1, $2, $3, $4)`, chatID, d.Code, d.Description, d.Source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadChatDiagnoses fills Diagnoses for every chat in the slice with one query.
+func loadChatDiagnoses(chats []models.Chat) error {
+	if len(chats) == 0 {
+		return nil
+	}
+	index := make(map[uuid.UUID]int, len(chats))
+	ids := make([]string, len(chats))
+	for i := range chats {
+		index[chats[i].ChatID] = i
+		ids[i] = chats[i].ChatID.String()
+		chats[i].Diagnoses = []models.ChatDiagnosis{}
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT chat_id, code, description, source, created_at
+		FROM chat_diagnoses WHERE chat_id = ANY($1::uuid[]) ORDER BY created_at, code`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chatID uuid.UUID
+		var d models.ChatDiagnosis
+		if err := rows.Scan(&chatID, &d.Code, &d.Description, &d.Source, &d.CreatedAt); err != nil {
+			return err
+		}
+		i := index[chatID]
+		chats[i].Diagnoses = append(chats[i].Diagnoses, d)
+	}
+	return rows.Err()
+}
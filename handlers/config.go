@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"chat-api/interactions"
+	"chat-api/mail"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configChecks are the settings the handlers cannot run without. They are
+// checked at startup so a missing one stops the server instead of failing
+// the first request that needs it.
+var configChecks = []func() error{
+	checkSecrets,
+	mail.CheckEnv,
+	checkBaseURL,
+	interactions.CheckDataset,
+}
+
+// secrets are the keys that sign or hash something. Each one is required
+// and must be its own, so one leaked key does not also forge what the
+// others protect.
+var secrets = []string{
+	"JWT_SECRET_KEY",         // session tokens
+	"URL_SIGNING_KEY",        // signed file URLs
+	"TOKEN_SIGNING_KEY",      // verification and other emailed tokens
+	"ERASURE_LOG_KEY",        // erasure log hash chain
+	"RESEARCH_PSEUDONYM_KEY", // research pseudonyms
+}
+
+func checkSecrets() error {
+	var problems []string
+	seen := map[string]string{}
+	for _, name := range secrets {
+		v := os.Getenv(name)
+		if v == "" {
+			problems = append(problems, name+" is required")
+			continue
+		}
+		if other, ok := seen[v]; ok {
+			problems = append(problems, fmt.Sprintf("%s must differ from %s", name, other))
+			continue
+		}
+		seen[v] = name
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// CheckConfig runs every config check and reports all the problems found.
+func CheckConfig() error {
+	var problems []string
+	for _, check := range configChecks {
+		if err := check(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
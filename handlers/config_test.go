@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	valid := map[string]string{
+		"JWT_SECRET_KEY":         "jwt",
+		"URL_SIGNING_KEY":        "url",
+		"TOKEN_SIGNING_KEY":      "token",
+		"ERASURE_LOG_KEY":        "erasure",
+		"RESEARCH_PSEUDONYM_KEY": "research",
+		"MAIL_MODE":              "capture",
+		"SMTP_ADDR":              "",
+		"APP_BASE_URL":           "https://chat.example.com/",
+	}
+	tests := []struct {
+		name     string
+		override map[string]string
+		problem  string
+	}{
+		{"valid", nil, ""},
+		{"no erasure key", map[string]string{"ERASURE_LOG_KEY": ""}, "ERASURE_LOG_KEY is required"},
+		{"reused JWT secret", map[string]string{"RESEARCH_PSEUDONYM_KEY": "jwt"}, "RESEARCH_PSEUDONYM_KEY must differ from JWT_SECRET_KEY"},
+		{"shared signing key", map[string]string{"TOKEN_SIGNING_KEY": "url"}, "TOKEN_SIGNING_KEY must differ from URL_SIGNING_KEY"},
+		{"no JWT secret", map[string]string{"JWT_SECRET_KEY": ""}, "JWT_SECRET_KEY is required"},
+		{"no URL signing key", map[string]string{"URL_SIGNING_KEY": ""}, "URL_SIGNING_KEY is required"},
+		{"no mailer", map[string]string{"MAIL_MODE": ""}, "no mailer configured"},
+		{"no base URL", map[string]string{"APP_BASE_URL": ""}, "APP_BASE_URL is required"},
+		{"relative base URL", map[string]string{"APP_BASE_URL": "chat.example.com"}, "absolute http(s) URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range valid {
+				t.Setenv(k, v)
+			}
+			for k, v := range tt.override {
+				t.Setenv(k, v)
+			}
+			err := CheckConfig()
+			if tt.problem == "" {
+				if err != nil {
+					t.Fatalf("CheckConfig = %v, want nil", err)
+				}
+				if got := publicBaseURL(); got != "https://chat.example.com" {
+					t.Errorf("publicBaseURL = %q", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Fatalf("CheckConfig = %v, want %q", err, tt.problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/models"
+	"database/sql"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Consent types. Features that process a user's data for one of these
+// purposes check hasConsent, or filter with consentedSQL, and skip users
+// without an active consent.
+const (
+	ConsentDataProcessing   = "data_processing"   // storing what the user enters, required by CreateChat
+	ConsentResearchUse      = "research_use"      // de-identified research exports
+	ConsentClinicianSharing = "clinician_sharing" // access by clinicians on the care team
+)
+
+// The types that can be granted. Earlier ai_processing consents and their
+// policy are kept as history, nothing processes data automatically so the
+// type is no longer accepted.
+var consentTypes = []string{ConsentDataProcessing, ConsentResearchUse, ConsentClinicianSharing}
+
+func validConsentType(t string) bool {
+	for _, ct := range consentTypes {
+		if ct == t {
+			return true
+		}
+	}
+	return false
+}
+
+// consentedSQL returns a condition that holds when the user in column has
+// an active consent of the given type. consentType must be one of the
+// constants above, it is not escaped.
+func consentedSQL(column, consentType string) string {
+	return "EXISTS (SELECT 1 FROM user_consents uc WHERE uc.user_id = " + column +
+		" AND uc.consent_type = '" + consentType + "' AND uc.withdrawn_at IS NULL)"
+}
+
+func hasConsent(userID uuid.UUID, consentType string) (bool, error) {
+	var ok bool
+	err := database.DB.QueryRow("SELECT "+consentedSQL("$1", consentType), userID).Scan(&ok)
+	return ok, err
+}
+
+// currentConsentPolicies returns the latest version of every policy by type.
+func currentConsentPolicies() (map[string]models.ConsentPolicy, error) {
+	rows, err := database.DB.Query(`
+		SELECT DISTINCT ON (consent_type) consent_type, version, body, created_by, created_at
+		FROM consent_policies ORDER BY consent_type, version DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := map[string]models.ConsentPolicy{}
+	for rows.Next() {
+		var p models.ConsentPolicy
+		if err := rows.Scan(&p.ConsentType, &p.Version, &p.Body, &p.CreatedBy, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		policies[p.ConsentType] = p
+	}
+	return policies, rows.Err()
+}
+
+// GetConsentPolicies returns the policy texts currently in force.
+func GetConsentPolicies(c *fiber.Ctx) error {
+	policies, err := currentConsentPolicies()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch consent policies " + err.Error(),
+		})
+	}
+
+	result := []models.ConsentPolicy{}
+	for _, t := range consentTypes {
+		if p, ok := policies[t]; ok {
+			result = append(result, p)
+		}
+	}
+	return c.JSON(result)
+}
+
+// CreateConsentPolicy publishes a new version of a policy text. Existing
+// consents stay valid but are reported as outdated until granted again.
+func CreateConsentPolicy(c *fiber.Ctx) error {
+	td, err := adminOnly(c)
+	if err != nil {
+		return err
+	}
+	var input models.ConsentPolicyCreate
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if !validConsentType(input.ConsentType) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "consent_type must be one of data_processing, research_use, clinician_sharing",
+		})
+	}
+	if input.Body == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "body is required",
+		})
+	}
+
+	var policy models.ConsentPolicy
+	err = database.DB.QueryRow(`
+		INSERT INTO consent_policies (consent_type, version, body, created_by)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3 FROM consent_policies WHERE consent_type = $1
+		RETURNING consent_type, version, body, created_by, created_at`,
+		input.ConsentType, input.Body, td.UserID).Scan(
+		&policy.ConsentType, &policy.Version, &policy.Body, &policy.CreatedBy, &policy.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create consent policy " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(policy)
+}
+
+const consentColumns = `consent_id, user_id, consent_type, policy_version, granted_at, withdrawn_at, recorded_by, grandfathered`
+
+func scanConsent(row rowScanner, consent *models.Consent) error {
+	return row.Scan(&consent.ConsentID, &consent.UserID, &consent.ConsentType, &consent.PolicyVersion,
+		&consent.GrantedAt, &consent.WithdrawnAt, &consent.RecordedBy, &consent.Grandfathered)
+}
+
+// fetchConsents returns every grant the user made, newest first.
+func fetchConsents(userID uuid.UUID) ([]models.Consent, error) {
+	rows, err := database.DB.Query(`
+		SELECT `+consentColumns+` FROM user_consents WHERE user_id = $1 ORDER BY granted_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := []models.Consent{}
+	for rows.Next() {
+		var consent models.Consent
+		if err := scanConsent(rows, &consent); err != nil {
+			return nil, err
+		}
+		consents = append(consents, consent)
+	}
+	return consents, rows.Err()
+}
+
+// GetConsents returns the user's current state for every consent type and
+// the full grant and withdrawal history.
+func GetConsents(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	policies, err := currentConsentPolicies()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch consent policies " + err.Error(),
+		})
+	}
+
+	history, err := fetchConsents(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch consents " + err.Error(),
+		})
+	}
+	active := map[string]models.Consent{}
+	for _, consent := range history {
+		if consent.WithdrawnAt == nil {
+			active[consent.ConsentType] = consent
+		}
+	}
+
+	statuses := []models.ConsentStatus{}
+	for _, t := range consentTypes {
+		status := models.ConsentStatus{ConsentType: t, CurrentVersion: policies[t].Version}
+		if consent, ok := active[t]; ok {
+			status.Granted = true
+			status.PolicyVersion = &consent.PolicyVersion
+			status.GrantedAt = &consent.GrantedAt
+			status.Outdated = consent.PolicyVersion < status.CurrentVersion || consent.Grandfathered
+		}
+		statuses = append(statuses, status)
+	}
+
+	return c.JSON(fiber.Map{
+		"consents": statuses,
+		"history":  history,
+	})
+}
+
+// GrantConsent records consent to the current policy version. Granting a
+// type that is already active on an older version, or grandfathered,
+// replaces that consent.
+// Admins may record a consent given outside the app, e.g. on paper.
+func GrantConsent(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	var input models.ConsentGrant
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if !validConsentType(input.ConsentType) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "consent_type must be one of data_processing, research_use, clinician_sharing",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	var current int
+	err = tx.QueryRow(`
+		SELECT MAX(version) FROM consent_policies WHERE consent_type = $1`, input.ConsentType).Scan(&current)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch consent policy " + err.Error(),
+		})
+	}
+	if input.PolicyVersion != current {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":           "policy_version is not the current version of the policy",
+			"current_version": current,
+		})
+	}
+
+	var existing models.Consent
+	err = scanConsent(tx.QueryRow(`
+		SELECT `+consentColumns+` FROM user_consents
+		WHERE user_id = $1 AND consent_type = $2 AND withdrawn_at IS NULL FOR UPDATE`,
+		userID, input.ConsentType), &existing)
+	if err == nil && existing.PolicyVersion == current && !existing.Grandfathered {
+		return c.JSON(existing)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch consent " + err.Error(),
+		})
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE user_consents SET withdrawn_at = NOW() WHERE consent_id = $1", existing.ConsentID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to replace consent " + err.Error(),
+			})
+		}
+	}
+
+	var consent models.Consent
+	err = scanConsent(tx.QueryRow(`
+		INSERT INTO user_consents (consent_id, user_id, consent_type, policy_version, recorded_by)
+		VALUES ($1, $2, $3, $4, $5) RETURNING `+consentColumns,
+		uuid.New(), userID, input.ConsentType, current, td.UserID), &consent)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record consent " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(consent)
+}
+
+// WithdrawConsent ends the active consent of a type. Processing that needs
+// it stops from now on; what was done before stays lawful and is kept.
+func WithdrawConsent(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	consentType := c.Params("type")
+	if !validConsentType(consentType) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "consent_type must be one of data_processing, research_use, clinician_sharing",
+		})
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE user_consents SET withdrawn_at = NOW()
+		WHERE user_id = $1 AND consent_type = $2 AND withdrawn_at IS NULL`, userID, consentType)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to withdraw consent " + err.Error(),
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No active consent of this type",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Consent withdrawn successfully",
+	})
+}
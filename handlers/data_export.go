@@ -0,0 +1,661 @@
+package handlers
+
+import (
+	"archive/zip"
+	"chat-api/database"
+	"chat-api/models"
+	"chat-api/storage"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// How long a finished personal data export can be downloaded
+	dataExportTTL = 7 * 24 * time.Hour
+
+	dataExportURLTTL = 15 * time.Minute
+)
+
+// dataExport is everything we hold about a user, as written to the ZIP:
+// their records and the audit trail of their account. Private notes are the
+// care team's working notes and are never part of it.
+type dataExport struct {
+	GeneratedAt   time.Time                `json:"generated_at"`
+	Profile       models.UserResponse      `json:"profile"`
+	Chats         []models.Chat            `json:"chats"`
+	Medications   []models.Medication      `json:"medications"`
+	Allergies     []models.Allergy         `json:"allergies"`
+	CareTeam      []models.CareTeamMember  `json:"care_team"`
+	Consents      []models.Consent         `json:"consents"` // every grant and withdrawal
+	Attachments   []models.Attachment      `json:"attachments"`
+	Notifications []models.Notification    `json:"notifications"`
+	LoginAttempts []models.LoginAttempt    `json:"login_attempts"`
+	Sessions      []models.Session         `json:"sessions"`
+	ErasureLog    []models.ErasureLogEntry `json:"erasure_log"`
+}
+
+func loadDataExport(userID uuid.UUID) (*dataExport, error) {
+	data := &dataExport{GeneratedAt: time.Now()}
+	var err error
+
+	if data.Profile, err = fetchUserResponse(userID); err != nil {
+		return nil, fmt.Errorf("profile: %w", err)
+	}
+	if data.Chats, err = queryChats("WHERE user_id = $1 ORDER BY created_at", userID); err != nil {
+		return nil, fmt.Errorf("chats: %w", err)
+	}
+	for i := range data.Chats {
+		if data.Chats[i].Notes, err = fetchChatNotes(data.Chats[i].ChatID, false); err != nil {
+			return nil, fmt.Errorf("chat notes: %w", err)
+		}
+	}
+	if data.Medications, err = fetchMedications(userID, false); err != nil {
+		return nil, fmt.Errorf("medications: %w", err)
+	}
+	if data.Allergies, err = fetchAllergies(userID); err != nil {
+		return nil, fmt.Errorf("allergies: %w", err)
+	}
+	if data.CareTeam, err = fetchCareTeam(userID); err != nil {
+		return nil, fmt.Errorf("care team: %w", err)
+	}
+	if data.Consents, err = fetchConsents(userID); err != nil {
+		return nil, fmt.Errorf("consents: %w", err)
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT a.attachment_id, a.chat_id, a.uploaded_by, a.filename, a.content_type, a.size_bytes, a.storage_key, a.created_at
+		FROM chat_attachments a JOIN chats c ON c.chat_id = a.chat_id
+		WHERE c.user_id = $1 ORDER BY a.created_at`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("attachments: %w", err)
+	}
+	defer rows.Close()
+	data.Attachments = []models.Attachment{}
+	for rows.Next() {
+		var a models.Attachment
+		err := rows.Scan(&a.AttachmentID, &a.ChatID, &a.UploadedBy, &a.Filename, &a.ContentType,
+			&a.SizeBytes, &a.StorageKey, &a.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("attachments: %w", err)
+		}
+		// Point at the copy inside the archive
+		a.DownloadURL = attachmentArchivePath(&a)
+		data.Attachments = append(data.Attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("attachments: %w", err)
+	}
+
+	nrows, err := database.DB.Query(`
+		SELECT notification_id, user_id, kind, body, link, created_at, read_at
+		FROM user_notifications WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+	defer nrows.Close()
+	data.Notifications = []models.Notification{}
+	for nrows.Next() {
+		var n models.Notification
+		if err := nrows.Scan(&n.NotificationID, &n.UserID, &n.Kind, &n.Body, &n.Link, &n.CreatedAt, &n.ReadAt); err != nil {
+			return nil, fmt.Errorf("notifications: %w", err)
+		}
+		data.Notifications = append(data.Notifications, n)
+	}
+	if err := nrows.Err(); err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+
+	if data.LoginAttempts, err = fetchUserLoginAttempts(userID); err != nil {
+		return nil, fmt.Errorf("login attempts: %w", err)
+	}
+	if data.Sessions, err = fetchUserSessions(userID); err != nil {
+		return nil, fmt.Errorf("sessions: %w", err)
+	}
+	if data.ErasureLog, err = fetchUserErasureLog(userID); err != nil {
+		return nil, fmt.Errorf("erasure log: %w", err)
+	}
+	return data, nil
+}
+
+func fetchUserLoginAttempts(userID uuid.UUID) ([]models.LoginAttempt, error) {
+	rows, err := database.DB.Query(`
+		SELECT attempt_id, email, user_id, ip, success, reason, created_at
+		FROM login_attempts WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []models.LoginAttempt{}
+	for rows.Next() {
+		var a models.LoginAttempt
+		if err := rows.Scan(&a.AttemptID, &a.Email, &a.UserID, &a.IP, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+func fetchUserSessions(userID uuid.UUID) ([]models.Session, error) {
+	rows, err := database.DB.Query(`
+		SELECT session_id, user_id, method, user_agent, ip, last_ip, created_at, last_seen_at, expires_at, revoked_at, revoked_by
+		FROM sessions WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		err := rows.Scan(&s.SessionID, &s.UserID, &s.Method, &s.UserAgent, &s.IP, &s.LastIP,
+			&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.RevokedAt, &s.RevokedBy)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// fetchUserErasureLog returns the entries of the user's earlier erasure
+// requests, such as ones they cancelled or that were rejected.
+func fetchUserErasureLog(userID uuid.UUID) ([]models.ErasureLogEntry, error) {
+	rows, err := database.DB.Query(`
+		SELECT log_id, request_id, user_id, event, actor_id, details, created_at, prev_hash, hash
+		FROM erasure_log WHERE user_id = $1 ORDER BY log_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []models.ErasureLogEntry{}
+	for rows.Next() {
+		var e models.ErasureLogEntry
+		err := rows.Scan(&e.LogID, &e.RequestID, &e.UserID, &e.Event, &e.ActorID, &e.Details, &e.CreatedAt, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func attachmentArchivePath(a *models.Attachment) string {
+	return fmt.Sprintf("attachments/%s/%s-%s", a.ChatID, a.AttachmentID, path.Base(a.Filename))
+}
+
+var dataExportTemplate = template.Must(template.New("export").Funcs(template.FuncMap{
+	"val": func(v interface{}) string {
+		switch v := v.(type) {
+		case *string:
+			if v != nil {
+				return *v
+			}
+		case *int16:
+			if v != nil {
+				return fmt.Sprint(*v)
+			}
+		case *float32:
+			if v != nil {
+				return fmt.Sprintf("%.1f", *v)
+			}
+		case time.Time:
+			return v.Local().Format(reportTimeLayout)
+		case *time.Time:
+			if v != nil {
+				return v.Local().Format(reportTimeLayout)
+			}
+		case string:
+			return v
+		}
+		return "-"
+	},
+	"lodcraft": func(chat models.Chat) [][2]string {
+		rows := make([][2]string, 0, len(models.LODCRAFTKeys))
+		for _, key := range models.LODCRAFTKeys {
+			rows = append(rows, [2]string{models.LODCRAFTLabels[key], orDash(chat.LODCRAFTAnswer(key))})
+		}
+		return rows
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Your data</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; width: 30%; }
+section { margin-bottom: 2em; }
+</style>
+</head>
+<body>
+<h1>Your data</h1>
+<p>Everything we hold about {{.Profile.Email}}, generated {{val .GeneratedAt}}. The same data is in machine readable form in the JSON files of this archive.</p>
+
+<section>
+<h2>Profile</h2>
+<table>
+<tr><th>User ID</th><td>{{.Profile.UserID}}</td></tr>
+<tr><th>Email</th><td>{{.Profile.Email}}</td></tr>
+<tr><th>Role</th><td>{{.Profile.Role}}</td></tr>
+<tr><th>Name</th><td>{{val .Profile.Name}}</td></tr>
+<tr><th>Age</th><td>{{val .Profile.Age}}</td></tr>
+<tr><th>Height (cm)</th><td>{{val .Profile.Height}}</td></tr>
+<tr><th>Weight (kg)</th><td>{{val .Profile.Weight}}</td></tr>
+<tr><th>Gender</th><td>{{val .Profile.Gender}}</td></tr>
+<tr><th>Physical condition</th><td>{{val .Profile.PhysicalCondition}}</td></tr>
+<tr><th>Medical history</th><td>{{val .Profile.MedicalHistory}}</td></tr>
+</table>
+</section>
+
+<section>
+<h2>Chats ({{len .Chats}})</h2>
+{{range .Chats}}
+<h3>{{val .CreatedAt}}</h3>
+<table>
+<tr><th>Chat ID</th><td>{{.ChatID}}</td></tr>
+<tr><th>Last updated</th><td>{{val .UpdatedAt}}</td></tr>
+<tr><th>Disease</th><td>{{val .Disease}}</td></tr>
+<tr><th>Description</th><td>{{val .Text}}</td></tr>
+<tr><th>Name</th><td>{{val .Name}}</td></tr>
+<tr><th>Age</th><td>{{val .Age}}</td></tr>
+<tr><th>Height (cm)</th><td>{{val .Height}}</td></tr>
+<tr><th>Weight (kg)</th><td>{{val .Weight}}</td></tr>
+<tr><th>Blood pressure</th><td>{{val .BloodPressure}}</td></tr>
+<tr><th>Pulse</th><td>{{val .Pulse}}</td></tr>
+<tr><th>Gender</th><td>{{val .Gender}}</td></tr>
+<tr><th>Physical condition</th><td>{{val .PhysicalCondition}}</td></tr>
+<tr><th>Medical history</th><td>{{val .MedicalHistory}}</td></tr>
+{{range lodcraft .}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}{{range .Diagnoses}}<tr><th>Diagnosis {{.Code}}</th><td>{{.Description}}</td></tr>
+{{end}}{{range .Notes}}<tr><th>Note ({{.NoteType}}, {{val .CreatedAt}})</th><td>{{.Body}}</td></tr>
+{{end}}</table>
+{{end}}
+</section>
+
+<section>
+<h2>Medications</h2>
+<table>
+<tr><th>Name</th><th>Dose</th><th>Frequency</th><th>Start</th><th>Stop</th></tr>
+{{range .Medications}}<tr><td>{{.Name}}</td><td>{{val .Dose}}</td><td>{{val .Frequency}}</td><td>{{val .StartDate}}</td><td>{{val .StopDate}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Allergies</h2>
+<table>
+<tr><th>Substance</th><th>Reaction</th><th>Severity</th></tr>
+{{range .Allergies}}<tr><td>{{.Substance}}</td><td>{{val .Reaction}}</td><td>{{val .Severity}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Care team</h2>
+<table>
+<tr><th>Clinician</th><th>Email</th><th>Since</th></tr>
+{{range .CareTeam}}<tr><td>{{val .Name}}</td><td>{{.Email}}</td><td>{{val .CreatedAt}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Consent history</h2>
+<table>
+<tr><th>Consent</th><th>Policy version</th><th>Granted</th><th>Withdrawn</th></tr>
+{{range .Consents}}<tr><td>{{.ConsentType}}</td><td>{{.PolicyVersion}}{{if .Grandfathered}} (grandfathered){{end}}</td><td>{{val .GrantedAt}}</td><td>{{val .WithdrawnAt}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Attachments</h2>
+<table>
+<tr><th>File</th><th>Type</th><th>Uploaded</th></tr>
+{{range .Attachments}}<tr><td><a href="{{.DownloadURL}}">{{.Filename}}</a></td><td>{{.ContentType}}</td><td>{{val .CreatedAt}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Notifications</h2>
+<table>
+<tr><th>Sent</th><th>Message</th></tr>
+{{range .Notifications}}<tr><td>{{val .CreatedAt}}</td><td>{{.Body}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Sign-in attempts</h2>
+<table>
+<tr><th>Time</th><th>Email</th><th>IP address</th><th>Result</th></tr>
+{{range .LoginAttempts}}<tr><td>{{val .CreatedAt}}</td><td>{{.Email}}</td><td>{{.IP}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Sessions</h2>
+<table>
+<tr><th>Signed in</th><th>Method</th><th>Device</th><th>IP address</th><th>Last seen</th><th>Ended</th></tr>
+{{range .Sessions}}<tr><td>{{val .CreatedAt}}</td><td>{{.Method}}</td><td>{{val .UserAgent}}</td><td>{{.IP}}{{if ne .IP .LastIP}}, last {{.LastIP}}{{end}}</td><td>{{val .LastSeenAt}}</td><td>{{val .RevokedAt}}</td></tr>
+{{end}}</table>
+</section>
+
+<section>
+<h2>Erasure requests</h2>
+<table>
+<tr><th>Time</th><th>Request</th><th>Event</th><th>Details</th></tr>
+{{range .ErasureLog}}<tr><td>{{val .CreatedAt}}</td><td>{{.RequestID}}</td><td>{{.Event}}</td><td>{{.Details}}</td></tr>
+{{end}}</table>
+</section>
+</body>
+</html>
+`))
+
+// writeDataExport writes the ZIP: one JSON file per section, index.html and
+// copies of the user's stored files.
+func writeDataExport(ctx context.Context, w io.Writer, data *dataExport, avatarVersion *uuid.UUID) error {
+	archive := zip.NewWriter(w)
+
+	writeJSON := func(name string, v interface{}) error {
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	sections := []struct {
+		name string
+		v    interface{}
+	}{
+		{"profile.json", data.Profile},
+		{"chats.json", data.Chats},
+		{"medications.json", data.Medications},
+		{"allergies.json", data.Allergies},
+		{"care_team.json", data.CareTeam},
+		{"consents.json", data.Consents},
+		{"attachments.json", data.Attachments},
+		{"notifications.json", data.Notifications},
+		{"login_attempts.json", data.LoginAttempts},
+		{"sessions.json", data.Sessions},
+		{"erasure_log.json", data.ErasureLog},
+	}
+	for _, s := range sections {
+		if err := writeJSON(s.name, s.v); err != nil {
+			return err
+		}
+	}
+
+	f, err := archive.Create("index.html")
+	if err != nil {
+		return err
+	}
+	if err := dataExportTemplate.Execute(f, data); err != nil {
+		return err
+	}
+
+	copyFile := func(name, key string) error {
+		reader, err := storage.Default().Get(ctx, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			log.Println("Data export skipped missing file", key)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, reader)
+		return err
+	}
+	for _, a := range data.Attachments {
+		if err := copyFile(a.DownloadURL, a.StorageKey); err != nil {
+			return err
+		}
+	}
+	if avatarVersion != nil {
+		if err := copyFile("avatar.jpg", avatarKey(data.Profile.UserID, *avatarVersion, avatarSizes[0])); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func runDataExport(job models.ExportJob) {
+	ctx := context.Background()
+	userID := *job.SubjectID
+	key := fmt.Sprintf("data-exports/%s/%s.zip", userID, job.JobID)
+
+	err := func() error {
+		if _, err := database.DB.Exec("UPDATE export_jobs SET status = 'running' WHERE job_id = $1", job.JobID); err != nil {
+			return err
+		}
+		data, err := loadDataExport(userID)
+		if err != nil {
+			return err
+		}
+		var avatarVersion *uuid.UUID
+		if err := database.DB.QueryRow("SELECT avatar_version FROM users WHERE user_id = $1", userID).Scan(&avatarVersion); err != nil {
+			return err
+		}
+
+		tmp, err := os.CreateTemp("", "data-export-*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if err := writeDataExport(ctx, tmp, data, avatarVersion); err != nil {
+			return err
+		}
+		size, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return storage.Default().Put(ctx, key, tmp, size, "application/zip")
+	}()
+
+	if err != nil {
+		log.Println("Data export", job.JobID, "failed:", err)
+		_, err = database.DB.Exec(`
+			UPDATE export_jobs SET status = 'failed', error = $1, finished_at = NOW() WHERE job_id = $2`,
+			err.Error(), job.JobID)
+		if err == nil {
+			notifyUser(userID, "data_export_failed", "Your data export could not be created. Please request it again.", nil)
+		}
+	} else {
+		_, err = database.DB.Exec(`
+			UPDATE export_jobs SET status = 'done', storage_key = $1, finished_at = NOW(), expires_at = $2
+			WHERE job_id = $3`, key, time.Now().Add(dataExportTTL), job.JobID)
+		if err == nil {
+			link := fmt.Sprintf("/api/users/%s/data-export/%s", userID, job.JobID)
+			notifyUser(userID, "data_export_ready",
+				fmt.Sprintf("Your data export is ready to download until %s.", time.Now().Add(dataExportTTL).Format(reportTimeLayout)),
+				&link)
+		}
+	}
+	if err != nil {
+		log.Println("Failed to update data export", job.JobID, err)
+	}
+}
+
+// CreateDataExport starts assembling a ZIP of everything held about the
+// user. Only one export per user runs at a time.
+func CreateDataExport(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fetchUserResponse(userID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch user",
+		})
+	}
+
+	var running bool
+	err = database.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM export_jobs
+		               WHERE subject_id = $1 AND kind = 'user_data' AND status IN ('pending', 'running'))`,
+		userID).Scan(&running)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check running exports",
+		})
+	}
+	if running {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A data export for this user is already in progress",
+		})
+	}
+
+	// The export is the user's own copy, so private notes stay out of it
+	// even when an admin requests it on their behalf
+	params, _ := json.Marshal(fiber.Map{"include_private_notes": false})
+
+	job := models.ExportJob{
+		JobID: uuid.New(), Kind: "user_data", RequestedBy: &td.UserID, Format: "zip",
+		Params: params, Status: "pending", SubjectID: &userID,
+	}
+	err = database.DB.QueryRow(`
+		INSERT INTO export_jobs (job_id, kind, requested_by, format, params, subject_id)
+		VALUES ($1, 'user_data', $2, 'zip', $3, $4) RETURNING created_at`,
+		job.JobID, td.UserID, string(params), userID).Scan(&job.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create data export " + err.Error(),
+		})
+	}
+
+	go runDataExport(job)
+
+	c.Location(fmt.Sprintf("/api/users/%s/data-export/%s", userID, job.JobID))
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+func dataExportDownloadURL(c *fiber.Ctx, job *models.ExportJob) (string, error) {
+	if presigner, ok := storage.Default().(storage.Presigner); ok {
+		return presigner.PresignGet(*job.StorageKey, dataExportURLTTL)
+	}
+	return c.BaseURL() + storage.SignPath("/files/data-exports/"+job.JobID.String(), dataExportURLTTL), nil
+}
+
+func fetchDataExport(jobID uuid.UUID) (models.ExportJob, error) {
+	job, err := fetchExportJob(jobID)
+	if err == nil && (job.Kind != "user_data" || job.SubjectID == nil) {
+		err = sql.ErrNoRows
+	}
+	return job, err
+}
+
+// GetDataExport reports the export's status and, once it is done and until
+// it expires, a short-lived download URL.
+func GetDataExport(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	jobID, err := uuid.Parse(c.Params("jobId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid export ID",
+		})
+	}
+
+	job, err := fetchDataExport(jobID)
+	if err != nil || *job.SubjectID != userID {
+		if err == nil || err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Data export not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch data export",
+		})
+	}
+
+	if job.Status == "done" && job.StorageKey != nil && job.ExpiresAt != nil && time.Now().Before(*job.ExpiresAt) {
+		if job.DownloadURL, err = dataExportDownloadURL(c, &job); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to sign download URL",
+			})
+		}
+	}
+	return c.JSON(job)
+}
+
+// DownloadDataExport serves the ZIP to anyone holding a valid signed URL,
+// so it sits outside the JWT protected group.
+func DownloadDataExport(c *fiber.Ctx) error {
+	jobID, err := uuid.Parse(c.Params("jobId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid export ID",
+		})
+	}
+	if !storage.VerifyPath(c.Path(), c.Query("expires"), c.Query("signature")) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid or expired download link",
+		})
+	}
+
+	job, err := fetchDataExport(jobID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Data export not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch data export",
+		})
+	}
+	if job.Status != "done" || job.StorageKey == nil || job.ExpiresAt == nil || time.Now().After(*job.ExpiresAt) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Data export has expired",
+		})
+	}
+
+	reader, err := storage.Default().Get(c.Context(), *job.StorageKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error": "Data export has expired",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read data export",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", "data-export-"+job.JobID.String()+".zip"))
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return c.SendStream(reader)
+}
@@ -0,0 +1,579 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/middleware"
+	"chat-api/models"
+	"chat-api/storage"
+	"chat-api/utils"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// erasureGracePeriod reads ERASURE_GRACE_DAYS, defaulting to 14 days. The
+// user can cancel until it ends and nothing is erased before.
+func erasureGracePeriod() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("ERASURE_GRACE_DAYS")); err == nil && n >= 0 {
+		return time.Duration(n) * 24 * time.Hour
+	}
+	return 14 * 24 * time.Hour
+}
+
+// erasureLogKey keys the erasure log hashes, so rewriting the whole chain
+// also needs the secret. ERASURE_LOG_KEY is required, see CheckConfig.
+func erasureLogKey() []byte {
+	return []byte(os.Getenv("ERASURE_LOG_KEY"))
+}
+
+func erasureLogHash(e *models.ErasureLogEntry) string {
+	actor := ""
+	if e.ActorID != nil {
+		actor = e.ActorID.String()
+	}
+	h := hmac.New(sha256.New, erasureLogKey())
+	h.Write([]byte(strings.Join([]string{
+		e.PrevHash, e.RequestID.String(), e.UserID.String(), e.Event, actor, e.Details,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}, "\n")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// appendErasureLog adds an entry to the hash chain. The table lock keeps
+// concurrent writers from forking the chain.
+func appendErasureLog(tx *sql.Tx, requestID, userID uuid.UUID, event string, actorID *uuid.UUID, details string) error {
+	if len(erasureLogKey()) == 0 {
+		return errors.New("ERASURE_LOG_KEY is not set")
+	}
+	if _, err := tx.Exec("LOCK TABLE erasure_log IN EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+	entry := models.ErasureLogEntry{
+		RequestID: requestID, UserID: userID, Event: event, ActorID: actorID, Details: details,
+		// Postgres keeps microseconds, hash what will be stored
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err := tx.QueryRow("SELECT hash FROM erasure_log ORDER BY log_id DESC LIMIT 1").Scan(&entry.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	entry.Hash = erasureLogHash(&entry)
+	_, err = tx.Exec(`
+		INSERT INTO erasure_log (request_id, user_id, event, actor_id, details, created_at, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		entry.RequestID, entry.UserID, entry.Event, entry.ActorID, entry.Details, entry.CreatedAt, entry.PrevHash, entry.Hash)
+	return err
+}
+
+const erasureRequestColumns = `request_id, user_id, requested_by, reason, status, grace_until, decided_by,
+	decided_at, completed_at, created_at`
+
+func scanErasureRequest(row rowScanner, r *models.ErasureRequest) error {
+	return row.Scan(&r.RequestID, &r.UserID, &r.RequestedBy, &r.Reason, &r.Status, &r.GraceUntil,
+		&r.DecidedBy, &r.DecidedAt, &r.CompletedAt, &r.CreatedAt)
+}
+
+// RequestErasure opens an erasure request for the user. It waits for admin
+// approval and the grace period before anything is erased.
+func RequestErasure(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	var input models.ErasureRequestCreate
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid input",
+			})
+		}
+	}
+
+	var erasedAt *time.Time
+	err = database.DB.QueryRow("SELECT erased_at FROM users WHERE user_id = $1", userID).Scan(&erasedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch user",
+		})
+	}
+	if erasedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User has already been erased",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	var request models.ErasureRequest
+	err = scanErasureRequest(tx.QueryRow(`
+		INSERT INTO erasure_requests (request_id, user_id, requested_by, reason, grace_until)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'approved') DO NOTHING
+		RETURNING `+erasureRequestColumns,
+		uuid.New(), userID, td.UserID, input.Reason, time.Now().Add(erasureGracePeriod())), &request)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An erasure request for this user is already open",
+		})
+	}
+	if err == nil {
+		err = appendErasureLog(tx, request.RequestID, userID, "requested", &td.UserID, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create erasure request " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(request)
+}
+
+func GetErasureRequest(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	var request models.ErasureRequest
+	err = scanErasureRequest(database.DB.QueryRow(`
+		SELECT `+erasureRequestColumns+` FROM erasure_requests
+		WHERE user_id = $1 ORDER BY created_at DESC LIMIT 1`, userID), &request)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No erasure request for this user",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch erasure request",
+		})
+	}
+	return c.JSON(request)
+}
+
+// CancelErasure withdraws the open request, which is possible until the
+// grace period ends, whether or not an admin has approved it.
+func CancelErasure(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	var requestID uuid.UUID
+	err = tx.QueryRow(`
+		UPDATE erasure_requests SET status = 'cancelled', decided_by = $1, decided_at = NOW()
+		WHERE user_id = $2 AND status IN ('pending', 'approved') AND grace_until > NOW()
+		RETURNING request_id`, td.UserID, userID).Scan(&requestID)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "No erasure request that can still be cancelled",
+		})
+	}
+	if err == nil {
+		err = appendErasureLog(tx, requestID, userID, "cancelled", &td.UserID, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel erasure request " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Erasure request cancelled successfully",
+	})
+}
+
+func GetErasureRequests(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+
+	query := `SELECT ` + erasureRequestColumns + ` FROM erasure_requests`
+	args := []interface{}{}
+	if status := c.Query("status"); status != "" {
+		query += ` WHERE status = $1`
+		args = append(args, status)
+	}
+	rows, err := database.DB.Query(query+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch erasure requests " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	requests := []models.ErasureRequest{}
+	for rows.Next() {
+		var r models.ErasureRequest
+		if err := scanErasureRequest(rows, &r); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan erasure request " + err.Error(),
+			})
+		}
+		requests = append(requests, r)
+	}
+	return c.JSON(requests)
+}
+
+// decideErasure moves a pending request to approved or rejected.
+func decideErasure(c *fiber.Ctx, status string) (*middleware.TokenDetails, models.ErasureRequest, error) {
+	var request models.ErasureRequest
+	td, err := adminOnly(c)
+	if err != nil {
+		return nil, request, err
+	}
+	requestID, err := uuid.Parse(c.Params("requestId"))
+	if err != nil {
+		return nil, request, fiber.NewError(fiber.StatusBadRequest, "Invalid request ID")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, request, fiber.NewError(fiber.StatusInternalServerError, "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	err = scanErasureRequest(tx.QueryRow(`
+		UPDATE erasure_requests SET status = $1, decided_by = $2, decided_at = NOW()
+		WHERE request_id = $3 AND status = 'pending'
+		RETURNING `+erasureRequestColumns, status, td.UserID, requestID), &request)
+	if err == sql.ErrNoRows {
+		return nil, request, fiber.NewError(fiber.StatusConflict, "Erasure request is not pending")
+	}
+	if err == nil {
+		err = appendErasureLog(tx, request.RequestID, request.UserID, status, &td.UserID, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return nil, request, fiber.NewError(fiber.StatusInternalServerError, "Failed to update erasure request")
+	}
+	return td, request, nil
+}
+
+// ApproveErasure approves a pending request. It is carried out as soon as
+// the grace period has passed, right away if it already has.
+func ApproveErasure(c *fiber.Ctx) error {
+	_, request, err := decideErasure(c, "approved")
+	if err != nil {
+		return err
+	}
+	if !request.GraceUntil.After(time.Now()) {
+		if err := performErasure(c.Context(), request.RequestID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Erasure approved but failed, it will be retried: " + err.Error(),
+			})
+		}
+		request.Status = "completed"
+	}
+	return c.JSON(request)
+}
+
+func RejectErasure(c *fiber.Ctx) error {
+	_, request, err := decideErasure(c, "rejected")
+	if err != nil {
+		return err
+	}
+	return c.JSON(request)
+}
+
+// performErasure anonymises the user of an approved request whose grace
+// period is over. Direct identifiers and free text that may hold PHI are
+// removed; vitals, age, gender, coded diagnoses and structured medication
+// and allergy data stay, no longer linked to a person, for statistics.
+// Stored files are deleted after the database commit.
+func performErasure(ctx context.Context, requestID uuid.UUID) error {
+	tx, err := database.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	err = tx.QueryRow(`
+		SELECT user_id FROM erasure_requests
+		WHERE request_id = $1 AND status = 'approved' AND grace_until <= NOW()
+		FOR UPDATE SKIP LOCKED`, requestID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	collect := func(query string) error {
+		rows, err := tx.Query(query, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	}
+	if err := collect(`
+		SELECT a.storage_key FROM chat_attachments a JOIN chats c ON c.chat_id = a.chat_id
+		WHERE c.user_id = $1`); err != nil {
+		return err
+	}
+	if err := collect(`
+		SELECT storage_key FROM export_jobs WHERE subject_id = $1 AND storage_key IS NOT NULL`); err != nil {
+		return err
+	}
+	var avatarVersion *uuid.UUID
+	if err := tx.QueryRow("SELECT avatar_version FROM users WHERE user_id = $1", userID).Scan(&avatarVersion); err != nil {
+		return err
+	}
+	if avatarVersion != nil {
+		for _, size := range avatarSizes {
+			keys = append(keys, avatarKey(userID, *avatarVersion, size))
+		}
+	}
+
+	password, err := utils.UnusablePasswordHash()
+	if err != nil {
+		return err
+	}
+
+	counts := []string{}
+	steps := []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		// Before users and hl7_patient_identifiers, which it matches on:
+		// messages that name the user by email or PID-3 identifier
+		{"hl7_dead_letters", `
+			UPDATE hl7_dead_letters d SET raw_message = '[erased]'
+			FROM users u
+			WHERE u.user_id = $1 AND d.raw_message <> '[erased]'
+			  AND (position(lower(u.email) IN lower(d.raw_message)) > 0
+			       OR EXISTS (SELECT 1 FROM hl7_patient_identifiers i
+			                  WHERE i.user_id = u.user_id
+			                    AND (position('|' || i.identifier || '^' IN d.raw_message) > 0
+			                         OR position('|' || i.identifier || '|' IN d.raw_message) > 0
+			                         OR position('~' || i.identifier || '^' IN d.raw_message) > 0)))`,
+			[]interface{}{userID}},
+		// Also before users: attempts at the address that did not match the
+		// account at the time, and the address's throttle
+		{"login_attempts_by_email", `
+			DELETE FROM login_attempts a USING users u
+			WHERE u.user_id = $1 AND a.user_id IS NULL AND lower(a.email) = lower(u.email)`, []interface{}{userID}},
+		{"login_throttles", `
+			DELETE FROM login_throttles t USING users u
+			WHERE u.user_id = $1 AND t.key = 'email:' || lower(u.email)`, []interface{}{userID}},
+		{"users", `
+			UPDATE users SET email = 'erased-' || user_id || '@erased.invalid', password = $2, name = NULL,
+			       profile_image_url = NULL, avatar_version = NULL, physical_condition = NULL,
+			       medical_history = NULL, mfa_secret = NULL, mfa_enabled_at = NULL, erased_at = NOW(),
+			       sessions_valid_after = NOW()
+			WHERE user_id = $1`, []interface{}{userID, password}},
+		{"chats", `
+			UPDATE chats SET name = NULL, text = NULL, disease = NULL, physical_condition = NULL, medical_history = NULL,
+			       "L" = NULL, "O" = NULL, "D" = NULL, "C" = NULL, "R" = NULL, "A" = NULL, "F" = NULL, "T" = NULL
+			WHERE user_id = $1`, []interface{}{userID}},
+		{"chat_notes", `
+			UPDATE chat_notes SET body = '[erased]'
+			WHERE chat_id IN (SELECT chat_id FROM chats WHERE user_id = $1)`, []interface{}{userID}},
+		{"chat_attachments", `
+			DELETE FROM chat_attachments WHERE chat_id IN (SELECT chat_id FROM chats WHERE user_id = $1)`, []interface{}{userID}},
+		{"user_allergies", `UPDATE user_allergies SET reaction = NULL WHERE user_id = $1`, []interface{}{userID}},
+		{"care_team", `DELETE FROM care_team WHERE patient_id = $1 OR clinician_id = $1`, []interface{}{userID}},
+		{"hl7_patient_identifiers", `DELETE FROM hl7_patient_identifiers WHERE user_id = $1`, []interface{}{userID}},
+		{"export_jobs", `DELETE FROM export_jobs WHERE subject_id = $1`, []interface{}{userID}},
+		{"user_notifications", `DELETE FROM user_notifications WHERE user_id = $1`, []interface{}{userID}},
+		{"mfa_recovery_codes", `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, []interface{}{userID}},
+		{"user_identities", `DELETE FROM user_identities WHERE user_id = $1`, []interface{}{userID}},
+		// Revoked rather than deleted, so the sign-out is on record
+		{"sessions", `
+			UPDATE sessions SET revoked_at = COALESCE(revoked_at, NOW()), user_agent = NULL, ip = '[erased]', last_ip = '[erased]'
+			WHERE user_id = $1`, []interface{}{userID}},
+		{"login_attempts", `DELETE FROM login_attempts WHERE user_id = $1`, []interface{}{userID}},
+		{"email_verifications", `DELETE FROM email_verifications WHERE user_id = $1`, []interface{}{userID}},
+		{"password_resets", `DELETE FROM password_resets WHERE user_id = $1`, []interface{}{userID}},
+		// The requests themselves stay as the record of the erasure
+		{"erasure_requests", `UPDATE erasure_requests SET reason = NULL WHERE user_id = $1`, []interface{}{userID}},
+	}
+	for _, step := range steps {
+		result, err := tx.ExecContext(ctx, step.query, step.args...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+		n, _ := result.RowsAffected()
+		counts = append(counts, fmt.Sprintf("%s=%d", step.name, n))
+	}
+
+	_, err = tx.Exec(`
+		UPDATE erasure_requests SET status = 'completed', completed_at = NOW() WHERE request_id = $1`, requestID)
+	if err != nil {
+		return err
+	}
+	if err := appendErasureLog(tx, requestID, userID, "completed", nil, strings.Join(counts, " ")); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := storage.Default().Delete(ctx, key); err != nil {
+			log.Println("Failed to delete stored file of erased user", key, err)
+		}
+	}
+	return nil
+}
+
+// ProcessDueErasures carries out every approved request whose grace period
+// has ended. It is run by the scheduler.
+func ProcessDueErasures(ctx context.Context) error {
+	rows, err := database.DB.QueryContext(ctx, `
+		SELECT request_id FROM erasure_requests WHERE status = 'approved' AND grace_until <= NOW()`)
+	if err != nil {
+		return err
+	}
+	var due []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, id := range due {
+		if err := performErasure(ctx, id); err != nil {
+			log.Println("Erasure", id, "failed:", err)
+		}
+	}
+	return nil
+}
+
+// eraseNow approves an erasure of the user without a grace period, reusing
+// the open request if there is one, and carries it out.
+func eraseNow(ctx context.Context, userID, adminID uuid.UUID, reason string) error {
+	tx, err := database.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var requestID uuid.UUID
+	err = tx.QueryRow(`
+		UPDATE erasure_requests SET status = 'approved', grace_until = NOW(), decided_by = $1, decided_at = NOW()
+		WHERE user_id = $2 AND status IN ('pending', 'approved')
+		RETURNING request_id`, adminID, userID).Scan(&requestID)
+	if err == sql.ErrNoRows {
+		requestID = uuid.New()
+		_, err = tx.Exec(`
+			INSERT INTO erasure_requests (request_id, user_id, requested_by, reason, status, grace_until, decided_by, decided_at)
+			VALUES ($1, $2, $3, $4, 'approved', NOW(), $3, NOW())`,
+			requestID, userID, adminID, reason)
+		if err == nil {
+			err = appendErasureLog(tx, requestID, userID, "requested", &adminID, reason)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := appendErasureLog(tx, requestID, userID, "approved", &adminID, reason); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return performErasure(ctx, requestID)
+}
+
+// GetErasureLog returns the erasure record and whether its hash chain is
+// intact. broken_at is the first entry that does not verify.
+func GetErasureLog(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+	if len(erasureLogKey()) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "ERASURE_LOG_KEY is not set",
+		})
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT log_id, request_id, user_id, event, actor_id, details, created_at, prev_hash, hash
+		FROM erasure_log ORDER BY log_id`)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch erasure log " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	entries := []models.ErasureLogEntry{}
+	var brokenAt *int64
+	prev := ""
+	for rows.Next() {
+		var e models.ErasureLogEntry
+		err := rows.Scan(&e.LogID, &e.RequestID, &e.UserID, &e.Event, &e.ActorID, &e.Details, &e.CreatedAt, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan erasure log " + err.Error(),
+			})
+		}
+		if brokenAt == nil && (e.PrevHash != prev || !hmac.Equal([]byte(e.Hash), []byte(erasureLogHash(&e)))) {
+			id := e.LogID
+			brokenAt = &id
+		}
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+
+	return c.JSON(fiber.Map{
+		"valid":     brokenAt == nil,
+		"broken_at": brokenAt,
+		"entries":   entries,
+	})
+}
@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"bufio"
+	"chat-api/database"
+	"chat-api/middleware"
+	"chat-api/models"
+	"chat-api/storage"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// exportColumns are the columns a chat export may select, in default order,
+// with the SQL that produces each. Only names from this list reach the query.
+var exportColumns = []struct {
+	name string
+	sql  string
+}{
+	{"chat_id", "chat_id"},
+	{"user_id", "user_id"},
+	{"created_at", "created_at"},
+	{"updated_at", "updated_at"},
+	{"disease", "disease"},
+	{"text", "text"},
+	{"name", "name"},
+	{"age", "age"},
+	{"height", "height"},
+	{"weight", "weight"},
+	{"blood_pressure", "blood_pressure"},
+	{"pulse", "pulse"},
+	{"gender", "gender"},
+	{"physical_condition", "physical_condition"},
+	{"medical_history", "medical_history"},
+	{"L", `"L"`},
+	{"O", `"O"`},
+	{"D", `"D"`},
+	{"C", `"C"`},
+	{"R", `"R"`},
+	{"A", `"A"`},
+	{"F", `"F"`},
+	{"T", `"T"`},
+	{"diagnosis_codes", "(SELECT string_agg(d.code, ';' ORDER BY d.code) FROM chat_diagnoses d WHERE d.chat_id = chats.chat_id)"},
+	// Private notes never leave the care team, so only shared notes are exported.
+	{"notes", `(SELECT string_agg(n.note_type || ': ' || n.body, E'\n' ORDER BY n.created_at) FROM chat_notes n WHERE n.chat_id = chats.chat_id AND n.note_type <> 'private')`},
+}
+
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+// Rows between flushes of a streamed export
+const exportFlushRows = 500
+
+// exportSelection validates the columns query param (comma separated,
+// default all) and returns the names and SQL select list.
+func exportSelection(param string) ([]string, string, error) {
+	byName := map[string]string{}
+	var names []string
+	for _, col := range exportColumns {
+		byName[col.name] = col.sql
+		names = append(names, col.name)
+	}
+	if strings.TrimSpace(param) != "" {
+		names = nil
+		seen := map[string]bool{}
+		for _, name := range strings.Split(param, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := byName[name]; !ok {
+				return nil, "", fmt.Errorf("unknown column %q", name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	exprs := make([]string, len(names))
+	for i, name := range names {
+		exprs[i] = byName[name]
+	}
+	return names, strings.Join(exprs, ", "), nil
+}
+
+// exportValue turns a driver value into its export representation.
+func exportValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
+
+func csvValue(v interface{}) string {
+	switch v := exportValue(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// streamChatExport writes rows to w one at a time, flushing every
+// exportFlushRows rows when w can flush, so memory use does not grow with
+// the size of the export. It closes rows.
+func streamChatExport(rows *sql.Rows, w io.Writer, format string, columns []string) (int64, error) {
+	defer rows.Close()
+	flusher, _ := w.(interface{ Flush() error })
+
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write(columns); err != nil {
+			return 0, err
+		}
+	}
+	keys := make([][]byte, len(columns))
+	for i, col := range columns {
+		keys[i], _ = json.Marshal(col)
+	}
+
+	var count int64
+	record := make([]string, len(columns))
+	var line []byte
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return count, err
+		}
+
+		if csvWriter != nil {
+			for i, v := range values {
+				record[i] = csvValue(v)
+			}
+			if err := csvWriter.Write(record); err != nil {
+				return count, err
+			}
+		} else {
+			// Built by hand to keep the selected column order
+			line = append(line[:0], '{')
+			for i, v := range values {
+				if i > 0 {
+					line = append(line, ',')
+				}
+				encoded, err := json.Marshal(exportValue(v))
+				if err != nil {
+					return count, err
+				}
+				line = append(append(append(line, keys[i]...), ':'), encoded...)
+			}
+			line = append(line, '}', '\n')
+			if _, err := w.Write(line); err != nil {
+				return count, err
+			}
+		}
+
+		count++
+		if count%exportFlushRows == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				if err := flusher.Flush(); err != nil {
+					return count, err
+				}
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return count, err
+		}
+	}
+	if flusher != nil {
+		return count, flusher.Flush()
+	}
+	return count, nil
+}
+
+// exportRequest reads the format, columns and listing filters shared by the
+// streamed and the background export.
+func exportRequest(c *fiber.Ctx, td *middleware.TokenDetails) (format string, columns []string, query string, args []interface{}, err error) {
+	format = c.Query("format", "csv")
+	if _, ok := exportContentTypes[format]; !ok {
+		return "", nil, "", nil, fiber.NewError(fiber.StatusBadRequest, "format must be csv or ndjson")
+	}
+	columns, selectList, err := exportSelection(c.Query("columns"))
+	if err != nil {
+		return "", nil, "", nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	where, args, err := chatListFilter(c, td)
+	if err != nil {
+		return "", nil, "", nil, err
+	}
+	query = "SELECT " + selectList + " FROM chats " + where + " ORDER BY created_at, chat_id"
+	return format, columns, query, args, nil
+}
+
+// ExportChats streams every chat matching the listing filters as CSV or
+// NDJSON straight from the database cursor.
+func ExportChats(c *fiber.Ctx) error {
+	td, err := adminOnly(c)
+	if err != nil {
+		return err
+	}
+	format, columns, query, args, err := exportRequest(c, td)
+	if err != nil {
+		return err
+	}
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to query chats " + err.Error(),
+		})
+	}
+
+	filename := fmt.Sprintf("chats-%s.%s", time.Now().Format("20060102-150405"), format)
+	c.Set(fiber.HeaderContentType, exportContentTypes[format])
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// Headers are gone by now, a failure can only cut the body short
+		if n, err := streamChatExport(rows, w, format, columns); err != nil {
+			log.Printf("Chat export stopped after %d rows: %v", n, err)
+		}
+	})
+	return nil
+}
+
+// CreateChatExportJob runs the same export in the background and writes it
+// to storage, for exports too large to hold a request open for.
+func CreateChatExportJob(c *fiber.Ctx) error {
+	td, err := adminOnly(c)
+	if err != nil {
+		return err
+	}
+	format, columns, query, args, err := exportRequest(c, td)
+	if err != nil {
+		return err
+	}
+
+	params := map[string]string{}
+	c.Context().QueryArgs().VisitAll(func(k, v []byte) {
+		params[string(k)] = string(v)
+	})
+	paramsJSON, _ := json.Marshal(params)
+
+	job := models.ExportJob{JobID: uuid.New(), Kind: "chats", RequestedBy: &td.UserID, Format: format, Params: paramsJSON, Status: "pending"}
+	err = database.DB.QueryRow(`
+		INSERT INTO export_jobs (job_id, kind, requested_by, format, params) VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`,
+		job.JobID, job.Kind, td.UserID, format, string(paramsJSON)).Scan(&job.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create export job " + err.Error(),
+		})
+	}
+
+	go runChatExportJob(job.JobID, format, columns, query, args)
+
+	c.Location("/api/admin/exports/" + job.JobID.String())
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// runChatExportJob spools the export to a temporary file, since object
+// stores want the size up front, then moves it into storage.
+func runChatExportJob(jobID uuid.UUID, format string, columns []string, query string, args []interface{}) {
+	ctx := context.Background()
+	key := fmt.Sprintf("exports/%s.%s", jobID, format)
+
+	count, err := func() (int64, error) {
+		if _, err := database.DB.Exec("UPDATE export_jobs SET status = 'running' WHERE job_id = $1", jobID); err != nil {
+			return 0, err
+		}
+		tmp, err := os.CreateTemp("", "chat-export-*")
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		rows, err := database.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		buffered := bufio.NewWriter(tmp)
+		count, err := streamChatExport(rows, buffered, format, columns)
+		if err != nil {
+			return count, err
+		}
+		size, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return count, err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return count, err
+		}
+		return count, storage.Default().Put(ctx, key, tmp, size, exportContentTypes[format])
+	}()
+
+	if err != nil {
+		log.Println("Chat export job", jobID, "failed:", err)
+		_, err = database.DB.Exec(`
+			UPDATE export_jobs SET status = 'failed', error = $1, row_count = $2, finished_at = NOW()
+			WHERE job_id = $3`, err.Error(), count, jobID)
+	} else {
+		_, err = database.DB.Exec(`
+			UPDATE export_jobs SET status = 'done', storage_key = $1, row_count = $2, finished_at = NOW()
+			WHERE job_id = $3`, key, count, jobID)
+	}
+	if err != nil {
+		log.Println("Failed to update export job", jobID, err)
+	}
+}
+
+func fetchExportJob(jobID uuid.UUID) (models.ExportJob, error) {
+	var job models.ExportJob
+	var params, report []byte
+	err := database.DB.QueryRow(`
+		SELECT job_id, kind, requested_by, format, params, status, row_count, storage_key, error, created_at,
+		       finished_at, subject_id, expires_at, report
+		FROM export_jobs WHERE job_id = $1`, jobID).Scan(
+		&job.JobID, &job.Kind, &job.RequestedBy, &job.Format, &params, &job.Status, &job.RowCount,
+		&job.StorageKey, &job.Error, &job.CreatedAt, &job.FinishedAt, &job.SubjectID, &job.ExpiresAt, &report)
+	job.Params = params
+	job.Report = report
+	return job, err
+}
+
+// exportJobParam loads the :jobId chat or research export job for an admin.
+func exportJobParam(c *fiber.Ctx) (models.ExportJob, error) {
+	if _, err := adminOnly(c); err != nil {
+		return models.ExportJob{}, err
+	}
+	jobID, err := uuid.Parse(c.Params("jobId"))
+	if err != nil {
+		return models.ExportJob{}, fiber.NewError(fiber.StatusBadRequest, "Invalid job ID")
+	}
+	job, err := fetchExportJob(jobID)
+	if err != nil || (job.Kind != "chats" && job.Kind != "research") {
+		if err == nil || err == sql.ErrNoRows {
+			return job, fiber.NewError(fiber.StatusNotFound, "Export job not found")
+		}
+		return job, fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch export job")
+	}
+	return job, nil
+}
+
+func GetExportJob(c *fiber.Ctx) error {
+	job, err := exportJobParam(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(job)
+}
+
+func DownloadExportJob(c *fiber.Ctx) error {
+	job, err := exportJobParam(c)
+	if err != nil {
+		return err
+	}
+	if job.Status != "done" || job.StorageKey == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Export is " + job.Status,
+		})
+	}
+
+	reader, err := storage.Default().Get(c.Context(), *job.StorageKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error": "Export file no longer exists",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read export",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, exportContentTypes[job.Format])
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", job.Kind+"-"+job.JobID.String()+"."+job.Format))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.SendStream(reader)
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/fhir"
+	"chat-api/middleware"
+	"chat-api/models"
+	"database/sql"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const fhirContentType = "application/fhir+json"
+
+func fhirJSON(c *fiber.Ctx, status int, body interface{}) error {
+	c.Status(status)
+	if err := c.JSON(body); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, fhirContentType)
+	return nil
+}
+
+func fhirError(c *fiber.Ctx, status int, code, diagnostics string) error {
+	return fhirJSON(c, status, fhir.NewOperationOutcome(code, diagnostics))
+}
+
+func fetchUserResponse(userID uuid.UUID) (models.UserResponse, error) {
+	var user models.UserResponse
+	err := database.DB.QueryRow(`
+		SELECT user_id, email, role, name, age, height, weight, gender,
+		       physical_condition, medical_history, profile_image_url
+		FROM users WHERE user_id = $1`, userID).Scan(
+		&user.UserID, &user.Email, &user.Role, &user.Name, &user.Age,
+		&user.Height, &user.Weight, &user.Gender, &user.PhysicalCondition,
+		&user.MedicalHistory, &user.ProfileImageUrl)
+	return user, err
+}
+
+// fhirPatientID reads a patient id given either as a bare id or as a
+// "Patient/<id>" reference, then checks the caller may see that patient. When
+// it returns uuid.Nil an OperationOutcome has already been written.
+func fhirPatientID(c *fiber.Ctx, raw string) (uuid.UUID, error) {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if raw == "" {
+		return uuid.Nil, fhirError(c, fiber.StatusBadRequest, "required", "patient search parameter is required")
+	}
+	patientID, err := uuid.Parse(strings.TrimPrefix(raw, "Patient/"))
+	if err != nil {
+		return uuid.Nil, fhirError(c, fiber.StatusBadRequest, "value", "Invalid patient id")
+	}
+	allowed, err := canAccessPatient(td, patientID)
+	if err != nil {
+		return uuid.Nil, fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to verify care team")
+	}
+	if !allowed {
+		return uuid.Nil, fhirError(c, fiber.StatusForbidden, "forbidden", "You can only access your own or your patients' records")
+	}
+	return patientID, nil
+}
+
+func FHIRPatient(c *fiber.Ctx) error {
+	patientID, err := fhirPatientID(c, c.Params("id"))
+	if err != nil || patientID == uuid.Nil {
+		return err
+	}
+
+	user, err := fetchUserResponse(patientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fhirError(c, fiber.StatusNotFound, "not-found", "Patient not found")
+		}
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch patient")
+	}
+	return fhirJSON(c, fiber.StatusOK, fhir.FromUser(user))
+}
+
+// fhirSearch runs a patient-scoped search, mapping each of the patient's
+// chats to resources.
+func fhirSearch(c *fiber.Ctx, mapChat func(models.Chat) []interface{}) error {
+	patientID, err := fhirPatientID(c, c.Query("patient", c.Query("subject")))
+	if err != nil || patientID == uuid.Nil {
+		return err
+	}
+
+	chats, err := queryChats("WHERE user_id = $1 ORDER BY created_at", patientID)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch chats")
+	}
+	resources := []interface{}{}
+	for _, chat := range chats {
+		resources = append(resources, mapChat(chat)...)
+	}
+	return fhirJSON(c, fiber.StatusOK, fhir.NewBundle("searchset", publicBaseURL()+"/fhir", resources))
+}
+
+func observationResources(chat models.Chat) []interface{} {
+	var out []interface{}
+	for _, o := range fhir.ObservationsFromChat(chat) {
+		out = append(out, o)
+	}
+	return out
+}
+
+func conditionResources(chat models.Chat) []interface{} {
+	var out []interface{}
+	for _, cond := range fhir.ConditionsFromChat(chat) {
+		out = append(out, cond)
+	}
+	return out
+}
+
+func questionnaireResponseResources(chat models.Chat) []interface{} {
+	if qr, ok := fhir.QuestionnaireResponseFromChat(chat); ok {
+		return []interface{}{qr}
+	}
+	return nil
+}
+
+func FHIRObservations(c *fiber.Ctx) error {
+	return fhirSearch(c, observationResources)
+}
+
+func FHIRConditions(c *fiber.Ctx) error {
+	return fhirSearch(c, conditionResources)
+}
+
+func FHIRQuestionnaireResponses(c *fiber.Ctx) error {
+	return fhirSearch(c, questionnaireResponseResources)
+}
+
+// FHIRPatientEverything implements Patient/$everything: the Patient followed
+// by every Observation, Condition and QuestionnaireResponse from their chats.
+func FHIRPatientEverything(c *fiber.Ctx) error {
+	patientID, err := fhirPatientID(c, c.Params("id"))
+	if err != nil || patientID == uuid.Nil {
+		return err
+	}
+
+	user, err := fetchUserResponse(patientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fhirError(c, fiber.StatusNotFound, "not-found", "Patient not found")
+		}
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch patient")
+	}
+	chats, err := queryChats("WHERE user_id = $1 ORDER BY created_at", patientID)
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to fetch chats")
+	}
+
+	resources := []interface{}{fhir.FromUser(user)}
+	for _, chat := range chats {
+		resources = append(resources, observationResources(chat)...)
+		resources = append(resources, conditionResources(chat)...)
+		resources = append(resources, questionnaireResponseResources(chat)...)
+	}
+	return fhirJSON(c, fiber.StatusOK, fhir.NewBundle("searchset", publicBaseURL()+"/fhir", resources))
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/fhir"
+	"chat-api/middleware"
+	"chat-api/models"
+	"chat-api/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// chatImport gathers the Observations and Conditions that become one chat:
+// those for the same patient recorded at the same time.
+type chatImport struct {
+	patientID  uuid.UUID
+	at         time.Time
+	vitals     fhir.Vitals
+	conditions []string
+	codes      []string
+	entries    []int
+}
+
+func patientDemographics(p *fhir.Patient) (name, gender *string, age *int16) {
+	if n := p.DisplayName(); n != "" {
+		name = &n
+	}
+	if p.Gender != "" {
+		gender = &p.Gender
+	}
+	if a, ok := p.Age(time.Now()); ok {
+		v := int16(a)
+		age = &v
+	}
+	return name, gender, age
+}
+
+// updatePatient overwrites the demographics the Patient carries and keeps
+// the rest of the user's profile.
+func updatePatient(tx *sql.Tx, userID uuid.UUID, p *fhir.Patient) error {
+	name, gender, age := patientDemographics(p)
+	_, err := tx.Exec(`
+		UPDATE users SET name = COALESCE($1, name), age = COALESCE($2, age), gender = COALESCE($3, gender)
+		WHERE user_id = $4`, name, age, gender, userID)
+	return err
+}
+
+// save stores the gathered vitals and conditions as a new chat.
+func (g *chatImport) save(tx *sql.Tx) (uuid.UUID, error) {
+	input := models.ChatCreate{
+		Height:         g.vitals.Height,
+		Weight:         g.vitals.Weight,
+		Pulse:          g.vitals.Pulse,
+		DiagnosisCodes: g.codes,
+	}
+	if g.vitals.Systolic != nil && g.vitals.Diastolic != nil {
+		bp := fmt.Sprintf("%d/%d", *g.vitals.Systolic, *g.vitals.Diastolic)
+		input.BloodPressure = &bp
+	}
+	if len(g.conditions) > 0 {
+		disease := strings.Join(g.conditions, ", ")
+		input.Disease = &disease
+	}
+
+	chatID := uuid.New()
+	diagnoses, err := resolveDiagnoses(&input)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if err := insertChat(tx, chatID, g.patientID, &input, g.at); err != nil {
+		return uuid.Nil, err
+	}
+	return chatID, saveChatDiagnoses(tx, chatID, diagnoses)
+}
+
+// importPatient creates a user for the Patient, or updates the demographics
+// of the user that already has its email. Imported users get an unusable
+// random password and must reset it before signing in.
+func importPatient(tx *sql.Tx, p *fhir.Patient) (uuid.UUID, bool, error) {
+	email := strings.ToLower(p.Email())
+	if email == "" {
+		return uuid.Nil, false, fmt.Errorf("Patient needs an email in telecom")
+	}
+
+	var userID uuid.UUID
+	err := tx.QueryRow("SELECT user_id FROM users WHERE lower(email) = $1 FOR UPDATE", email).Scan(&userID)
+	if err == nil {
+		return userID, false, updatePatient(tx, userID, p)
+	}
+	if err != sql.ErrNoRows {
+		return uuid.Nil, false, err
+	}
+	userID, err = createPatient(tx, email, p, "fhir")
+	return userID, true, err
+}
+
+// createPatient inserts a user for an imported Patient, recording which
+// import created it in created_via.
+func createPatient(tx *sql.Tx, email string, p *fhir.Patient, createdVia string) (uuid.UUID, error) {
+	hashedPassword, err := utils.UnusablePasswordHash()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	name, gender, age := patientDemographics(p)
+	var userID uuid.UUID
+	err = tx.QueryRow(`
+		INSERT INTO users (email, password, role, name, age, gender, created_via)
+		VALUES ($1, $2, 'user', $3, $4, $5, $6) RETURNING user_id`,
+		email, hashedPassword, name, age, gender, createdVia).Scan(&userID)
+	return userID, err
+}
+
+// resolveSubject maps a reference to a Patient in this Bundle (by fullUrl or
+// id) or to an existing user ("Patient/<user_id>").
+func resolveSubject(tx *sql.Tx, ref string, patients map[string]uuid.UUID) (uuid.UUID, error) {
+	if ref == "" {
+		return uuid.Nil, fmt.Errorf("subject reference is required")
+	}
+	if id, ok := patients[ref]; ok {
+		return id, nil
+	}
+	id, err := uuid.Parse(strings.TrimPrefix(ref, "Patient/"))
+	if err != nil || !strings.HasPrefix(ref, "Patient/") {
+		return uuid.Nil, fmt.Errorf("subject %s is not a Patient in this Bundle", ref)
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE user_id = $1)", id).Scan(&exists); err != nil {
+		return uuid.Nil, err
+	}
+	if !exists {
+		return uuid.Nil, fmt.Errorf("subject %s does not exist", ref)
+	}
+	return id, nil
+}
+
+// inSavepoint runs fn inside a savepoint, so a failed statement undoes only
+// that entry's work and the transaction stays usable for the entries after it.
+func inSavepoint(tx *sql.Tx, fn func() error) error {
+	if _, err := tx.Exec("SAVEPOINT fhir_entry"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT fhir_entry"); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	_, err := tx.Exec("RELEASE SAVEPOINT fhir_entry")
+	return err
+}
+
+// FHIRImportBundle processes a transaction Bundle of Patient, Observation and
+// Condition resources all-or-nothing and reports the outcome of every entry.
+func FHIRImportBundle(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+	if td.Role != "admin" {
+		return fhirError(c, fiber.StatusForbidden, "forbidden", "Only admins can import bundles")
+	}
+
+	entries, entryErrs, err := fhir.ParseTransaction(c.Body())
+	if err != nil {
+		return fhirError(c, fiber.StatusBadRequest, "invalid", err.Error())
+	}
+
+	responses := make([]fhir.BundleEntry, len(entries))
+	failed := false
+	fail := func(i int, err error) {
+		failed = true
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) || errors.Is(err, sql.ErrTxDone) || errors.Is(err, sql.ErrConnDone) {
+			log.Println("FHIR import entry", i, "failed:", err)
+			outcome := fhir.NewOperationOutcome("exception", "Failed to store entry")
+			responses[i].Response = &fhir.BundleResponse{Status: "500 Internal Server Error", Outcome: &outcome}
+			return
+		}
+		outcome := fhir.NewOperationOutcome("invalid", err.Error())
+		responses[i].Response = &fhir.BundleResponse{Status: "400 Bad Request", Outcome: &outcome}
+	}
+	for i, e := range entryErrs {
+		if e != nil {
+			fail(i, e)
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	// Patients first so Observations and Conditions can reference them
+	patients := map[string]uuid.UUID{}
+	for i, e := range entries {
+		if e.Patient == nil || entryErrs[i] != nil {
+			continue
+		}
+		var userID uuid.UUID
+		var created bool
+		err := inSavepoint(tx, func() (err error) {
+			userID, created, err = importPatient(tx, e.Patient)
+			return err
+		})
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		if e.FullURL != "" {
+			patients[e.FullURL] = userID
+		}
+		if e.Patient.ID != "" {
+			patients["Patient/"+e.Patient.ID] = userID
+		}
+		status := "200 OK"
+		if created {
+			status = "201 Created"
+		}
+		responses[i].Response = &fhir.BundleResponse{Status: status, Location: "Patient/" + userID.String()}
+	}
+
+	now := time.Now()
+	groups := map[string]*chatImport{}
+	var order []*chatImport
+	group := func(patientID uuid.UUID, at time.Time) *chatImport {
+		key := patientID.String() + "|" + at.UTC().Format(time.RFC3339)
+		g, ok := groups[key]
+		if !ok {
+			g = &chatImport{patientID: patientID, at: at}
+			groups[key] = g
+			order = append(order, g)
+		}
+		return g
+	}
+
+	for i, e := range entries {
+		if entryErrs[i] != nil {
+			continue
+		}
+		switch {
+		case e.Observation != nil:
+			var patientID uuid.UUID
+			err := inSavepoint(tx, func() (err error) {
+				patientID, err = resolveSubject(tx, refOf(e.Observation.Subject), patients)
+				return err
+			})
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			g := group(patientID, fhir.ObservationTime(e.Observation, now))
+			if err := fhir.ApplyObservation(e.Observation, &g.vitals); err != nil {
+				fail(i, err)
+				continue
+			}
+			g.entries = append(g.entries, i)
+		case e.Condition != nil:
+			var patientID uuid.UUID
+			err := inSavepoint(tx, func() (err error) {
+				patientID, err = resolveSubject(tx, e.Condition.Subject.Reference, patients)
+				return err
+			})
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			if e.Condition.Text() == "" && len(e.Condition.ICD10Codes()) == 0 {
+				fail(i, fmt.Errorf("Condition needs code.text or an ICD-10 coding"))
+				continue
+			}
+			g := group(patientID, fhir.ConditionTime(e.Condition, now))
+			if text := e.Condition.Text(); text != "" {
+				g.conditions = append(g.conditions, text)
+			}
+			g.codes = append(g.codes, e.Condition.ICD10Codes()...)
+			g.entries = append(g.entries, i)
+		}
+	}
+
+	for _, g := range order {
+		if len(g.entries) == 0 {
+			continue
+		}
+		var chatID uuid.UUID
+		err := inSavepoint(tx, func() (err error) {
+			chatID, err = g.save(tx)
+			return err
+		})
+		for _, i := range g.entries {
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			location := "Condition/" + fhir.ConditionID(chatID.String(), entries[i].Condition)
+			if entries[i].Observation != nil {
+				location = "Observation/" + fhir.ObservationID(chatID.String(), entries[i].Observation)
+			}
+			responses[i].Response = &fhir.BundleResponse{Status: "201 Created", Location: location}
+		}
+	}
+
+	result := fhir.Bundle{
+		ResourceType: "Bundle",
+		Type:         "transaction-response",
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		Entry:        responses,
+	}
+
+	if failed {
+		rolledBack := fhir.NewOperationOutcome("processing", "Not committed because another entry in the transaction failed")
+		for i := range responses {
+			if responses[i].Response == nil || responses[i].Response.Outcome == nil {
+				responses[i].Response = &fhir.BundleResponse{Status: "424 Failed Dependency", Outcome: &rolledBack}
+			}
+		}
+		return fhirJSON(c, fiber.StatusBadRequest, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Failed to commit FHIR import:", err)
+		return fhirError(c, fiber.StatusInternalServerError, "exception", "Failed to commit import")
+	}
+	return fhirJSON(c, fiber.StatusOK, result)
+}
+
+func refOf(r *fhir.Reference) string {
+	if r == nil {
+		return ""
+	}
+	return r.Reference
+}
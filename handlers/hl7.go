@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/fhir"
+	"chat-api/hl7"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HL7Message handles messages from the MLLP listener. ADT^A04 and ADT^A08
+// upsert the patient in PID, ORU^R01 stores the reported vital signs as a
+// chat. Each message is applied in its own transaction.
+func HL7Message(ctx context.Context, msg *hl7.Message) error {
+	tx, err := database.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	switch msg.MessageType() {
+	case "ADT^A04", "ADT^A08":
+		_, err = hl7Patient(tx, msg)
+	case "ORU^R01":
+		err = hl7Results(tx, msg, time.Now())
+	default:
+		return fmt.Errorf("unsupported message type %s", msg.MessageType())
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HL7DeadLetter keeps messages we could not parse or apply so they can be
+// inspected and replayed.
+func HL7DeadLetter(remoteAddr, raw string, msg *hl7.Message, err error) {
+	var messageType, controlID *string
+	if msg != nil {
+		t, id := msg.MessageType(), msg.ControlID()
+		messageType, controlID = &t, &id
+	}
+	_, dbErr := database.DB.Exec(`
+		INSERT INTO hl7_dead_letters (dead_letter_id, remote_addr, message_type, control_id, raw_message, error)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		uuid.New(), remoteAddr, messageType, controlID, raw, err.Error())
+	if dbErr != nil {
+		log.Println("Failed to record HL7 dead letter", dbErr)
+	}
+}
+
+type hl7Identifier struct {
+	authority string
+	value     string
+}
+
+// pidIdentifiers reads PID-3. Identifiers without an assigning authority are
+// scoped to the sending facility so two partners' MRNs cannot collide.
+func pidIdentifiers(msg *hl7.Message) []hl7Identifier {
+	facility := msg.Component(msg.Field("MSH", 4), 1)
+	var ids []hl7Identifier
+	for _, rep := range msg.Repetitions(msg.Field("PID", 3)) {
+		value := strings.TrimSpace(msg.Component(rep, 1))
+		if value == "" {
+			continue
+		}
+		authority := msg.Subcomponent(rep, 4, 1)
+		if authority == "" {
+			authority = facility
+		}
+		ids = append(ids, hl7Identifier{authority: authority, value: value})
+	}
+	return ids
+}
+
+// pidPatient maps PID demographics onto a FHIR Patient so HL7 and FHIR
+// imports share the same user upsert.
+func pidPatient(msg *hl7.Message) *fhir.Patient {
+	p := &fhir.Patient{ResourceType: "Patient"}
+
+	pid5 := msg.Field("PID", 5)
+	name := fhir.HumanName{Family: msg.Component(pid5, 1)}
+	for _, given := range []string{msg.Component(pid5, 2), msg.Component(pid5, 3)} {
+		if given != "" {
+			name.Given = append(name.Given, given)
+		}
+	}
+	if name.Family != "" || len(name.Given) > 0 {
+		p.Name = []fhir.HumanName{name}
+	}
+
+	if birth := msg.Field("PID", 7); len(birth) >= 8 {
+		if t, err := hl7.ParseTime(birth[:8]); err == nil {
+			p.BirthDate = t.Format("2006-01-02")
+		}
+	}
+
+	switch sex := strings.ToUpper(msg.Field("PID", 8)); sex {
+	case "":
+	case "U":
+		p.Gender = "unknown"
+	default:
+		p.Gender = fhir.Gender(&sex)
+	}
+
+	// PID-13 XTN: the email is in component 4, older senders put it in 1
+	for _, rep := range msg.Repetitions(msg.Field("PID", 13)) {
+		for _, c := range []int{4, 1} {
+			if v := strings.TrimSpace(msg.Component(rep, c)); strings.Contains(v, "@") {
+				p.Telecom = append(p.Telecom, fhir.ContactPoint{System: "email", Value: v})
+				break
+			}
+		}
+	}
+	return p
+}
+
+// hl7Patient finds the user for PID by a known identifier, then by email,
+// creating the user when neither matches, and remembers the identifiers.
+// Only users the feed created itself are updated or linked, so a message
+// cannot rewrite the profile of an account that signed up or was created
+// by an admin.
+func hl7Patient(tx *sql.Tx, msg *hl7.Message) (uuid.UUID, error) {
+	if _, ok := msg.Segment("PID"); !ok {
+		return uuid.Nil, fmt.Errorf("PID segment is required")
+	}
+	p := pidPatient(msg)
+	ids := pidIdentifiers(msg)
+
+	userID := uuid.Nil
+	for _, id := range ids {
+		err := tx.QueryRow(`
+			SELECT user_id FROM hl7_patient_identifiers WHERE assigning_authority = $1 AND identifier = $2`,
+			id.authority, id.value).Scan(&userID)
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows {
+			return uuid.Nil, err
+		}
+	}
+
+	created := false
+	if userID == uuid.Nil {
+		email := strings.ToLower(p.Email())
+		if email == "" {
+			return uuid.Nil, fmt.Errorf("unknown patient: PID-3 does not match and PID-13 has no email")
+		}
+		err := tx.QueryRow("SELECT user_id FROM users WHERE lower(email) = $1", email).Scan(&userID)
+		if err == sql.ErrNoRows {
+			if userID, err = createPatient(tx, email, p, "hl7"); err != nil {
+				return uuid.Nil, err
+			}
+			created = true
+		} else if err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	if !created {
+		var createdVia sql.NullString
+		err := tx.QueryRow("SELECT created_via FROM users WHERE user_id = $1 FOR UPDATE", userID).Scan(&createdVia)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if createdVia.String != "hl7" {
+			return uuid.Nil, fmt.Errorf("PID matches an account that is not managed by the HL7 feed")
+		}
+		if err := updatePatient(tx, userID, p); err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	for _, id := range ids {
+		_, err := tx.Exec(`
+			INSERT INTO hl7_patient_identifiers (assigning_authority, identifier, user_id) VALUES ($1, $2, $3)
+			ON CONFLICT (assigning_authority, identifier) DO NOTHING`,
+			id.authority, id.value, userID)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+	return userID, nil
+}
+
+// obxObservation maps an OBX segment onto a FHIR Observation so the unit
+// handling in fhir.ApplyObservation applies to both import paths.
+func obxObservation(msg *hl7.Message, obx hl7.Segment) *fhir.Observation {
+	o := &fhir.Observation{ResourceType: "Observation", Status: "final"}
+
+	code := obx.Field(3)
+	system := msg.Component(code, 3)
+	if system == "LN" || strings.EqualFold(system, "LOINC") {
+		o.Code.Coding = []fhir.Coding{{System: fhir.SystemLOINC, Code: msg.Component(code, 1)}}
+	}
+	o.Code.Text = msg.Component(code, 2)
+
+	value := strings.TrimSpace(msg.Component(obx.Field(5), 1))
+	if obx.Field(2) == "NM" {
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			unit := msg.Component(obx.Field(6), 1)
+			o.ValueQuantity = &fhir.Quantity{Value: &v, Unit: unit, Code: unit}
+		}
+	} else if value != "" {
+		o.ValueString = &value
+	}
+	return o
+}
+
+// hl7Results stores the vital signs of an ORU^R01 as chats, one per
+// observation time. OBX without a time use the preceding OBR-7.
+func hl7Results(tx *sql.Tx, msg *hl7.Message, now time.Time) error {
+	patientID, err := hl7Patient(tx, msg)
+	if err != nil {
+		return err
+	}
+
+	fallback := now
+	if t, err := hl7.ParseTime(msg.Field("MSH", 7)); err == nil {
+		fallback = t
+	}
+
+	groups := map[string]*chatImport{}
+	var order []*chatImport
+	observed := fallback
+	for i, seg := range msg.Segments {
+		switch seg.Name {
+		case "OBR":
+			observed = fallback
+			if t, err := hl7.ParseTime(seg.Field(7)); err == nil {
+				observed = t
+			}
+		case "OBX":
+			// W: wrong result replaced by a later one, X/D: no result
+			if status := seg.Field(11); status == "W" || status == "X" || status == "D" {
+				continue
+			}
+			o := obxObservation(msg, seg)
+			if !fhir.IsVitalSign(o) {
+				continue
+			}
+			at := observed
+			if t, err := hl7.ParseTime(seg.Field(14)); err == nil {
+				at = t
+			}
+
+			key := at.UTC().Format(time.RFC3339)
+			g, ok := groups[key]
+			if !ok {
+				g = &chatImport{patientID: patientID, at: at}
+				groups[key] = g
+				order = append(order, g)
+			}
+			if err := fhir.ApplyObservation(o, &g.vitals); err != nil {
+				return fmt.Errorf("OBX-%s %s: %w", seg.Field(1), o.Code.Text, err)
+			}
+			g.entries = append(g.entries, i)
+		}
+	}
+	if len(order) == 0 {
+		return fmt.Errorf("ORU^R01 has no supported vital sign OBX segments")
+	}
+
+	for _, g := range order {
+		if _, err := g.save(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
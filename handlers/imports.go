@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"bytes"
+	"chat-api/database"
+	"chat-api/importer"
+	"chat-api/models"
+	"chat-api/storage"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Row errors returned inline by a dry run; all of them are in the error file
+const maxInlineImportErrors = 100
+
+func fetchImportJob(jobID uuid.UUID) (models.ImportJob, error) {
+	var job models.ImportJob
+	err := database.DB.QueryRow(`
+		SELECT job_id, kind, requested_by, filename, dry_run, status, total_rows, processed_rows,
+		       error_count, error_key, error, created_at, finished_at
+		FROM import_jobs WHERE job_id = $1`, jobID).Scan(
+		&job.JobID, &job.Kind, &job.RequestedBy, &job.Filename, &job.DryRun, &job.Status, &job.TotalRows,
+		&job.ProcessedRows, &job.ErrorCount, &job.ErrorKey, &job.Error, &job.CreatedAt, &job.FinishedAt)
+	return job, err
+}
+
+// finishImportJob records the outcome of a run and stores its row errors as
+// a CSV error file. A dry run that found invalid rows still completed, so it
+// is done rather than failed.
+func finishImportJob(ctx context.Context, job models.ImportJob, result importer.Result, runErr error) {
+	jobID := job.JobID
+	var errorKey, message *string
+	if len(result.Errors) > 0 {
+		var buf bytes.Buffer
+		importer.WriteErrors(&buf, result.Errors)
+		key := fmt.Sprintf("imports/%s/errors.csv", jobID)
+		if err := storage.Default().Put(ctx, key, &buf, int64(buf.Len()), "text/csv; charset=utf-8"); err != nil {
+			log.Println("Failed to store import errors for job", jobID, err)
+		} else {
+			errorKey = &key
+		}
+	}
+
+	status := "done"
+	if runErr != nil && !(job.DryRun && errors.Is(runErr, importer.ErrInvalidRows)) {
+		status = "failed"
+		msg := runErr.Error()
+		if errors.Is(runErr, importer.ErrInvalidRows) {
+			msg = fmt.Sprintf("%d validation errors, nothing was imported", len(result.Errors))
+		}
+		message = &msg
+	}
+
+	_, err := database.DB.Exec(`
+		UPDATE import_jobs SET status = $1, total_rows = $2, processed_rows = $3, error_count = $4,
+		       error_key = $5, error = $6, finished_at = NOW()
+		WHERE job_id = $7`,
+		status, result.Rows, result.Imported, len(result.Errors), errorKey, message, jobID)
+	if err != nil {
+		log.Println("Failed to update import job", jobID, err)
+	}
+}
+
+// CreateImportJob accepts a CSV upload (multipart field file) with kind,
+// an optional JSON mapping of CSV headers to fields and dry_run. Dry runs
+// validate synchronously and return the row errors; real imports run in the
+// background and are all-or-nothing.
+func CreateImportJob(c *fiber.Ctx) error {
+	td, err := adminOnly(c)
+	if err != nil {
+		return err
+	}
+
+	kind := c.FormValue("kind")
+	if _, err := importer.Fields(kind); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	var mapping map[string]string
+	if raw := c.FormValue("mapping"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "mapping must be a JSON object of CSV header to field",
+			})
+		}
+	}
+	dryRun := c.FormValue("dry_run") == "true"
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Multipart field file is required",
+		})
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read uploaded file",
+		})
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read uploaded file",
+		})
+	}
+
+	job := models.ImportJob{
+		JobID: uuid.New(), Kind: kind, RequestedBy: &td.UserID, Filename: filepath.Base(fileHeader.Filename),
+		DryRun: dryRun, Status: "running",
+	}
+	err = database.DB.QueryRow(`
+		INSERT INTO import_jobs (job_id, kind, requested_by, filename, dry_run, status)
+		VALUES ($1, $2, $3, $4, $5, 'running') RETURNING created_at`,
+		job.JobID, kind, td.UserID, job.Filename, dryRun).Scan(&job.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create import job " + err.Error(),
+		})
+	}
+
+	opts := importer.Options{Kind: kind, Mapping: mapping, DryRun: dryRun}
+
+	if dryRun {
+		result, runErr := importer.Run(c.Context(), database.DB, bytes.NewReader(data), opts)
+		finishImportJob(c.Context(), job, result, runErr)
+		if runErr != nil && !errors.Is(runErr, importer.ErrInvalidRows) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":  runErr.Error(),
+				"job_id": job.JobID,
+			})
+		}
+		rowErrors := result.Errors
+		if len(rowErrors) > maxInlineImportErrors {
+			rowErrors = rowErrors[:maxInlineImportErrors]
+		}
+		return c.JSON(fiber.Map{
+			"job_id":      job.JobID,
+			"valid":       len(result.Errors) == 0,
+			"rows":        result.Rows,
+			"error_count": len(result.Errors),
+			"errors":      rowErrors,
+		})
+	}
+
+	go func() {
+		ctx := context.Background()
+		opts.Progress = func(processed, total int) {
+			database.DB.Exec("UPDATE import_jobs SET processed_rows = $1, total_rows = $2 WHERE job_id = $3",
+				processed, total, job.JobID)
+		}
+		result, runErr := importer.Run(ctx, database.DB, bytes.NewReader(data), opts)
+		if runErr != nil {
+			log.Println("Import job", job.JobID, "failed:", runErr)
+		}
+		finishImportJob(ctx, job, result, runErr)
+	}()
+
+	c.Location("/api/admin/imports/" + job.JobID.String())
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// importJobParam loads the :jobId import job for an admin.
+func importJobParam(c *fiber.Ctx) (models.ImportJob, error) {
+	if _, err := adminOnly(c); err != nil {
+		return models.ImportJob{}, err
+	}
+	jobID, err := uuid.Parse(c.Params("jobId"))
+	if err != nil {
+		return models.ImportJob{}, fiber.NewError(fiber.StatusBadRequest, "Invalid job ID")
+	}
+	job, err := fetchImportJob(jobID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return job, fiber.NewError(fiber.StatusNotFound, "Import job not found")
+		}
+		return job, fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch import job")
+	}
+	return job, nil
+}
+
+func GetImportJob(c *fiber.Ctx) error {
+	job, err := importJobParam(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(job)
+}
+
+// DownloadImportErrors serves the row,column,error CSV of an import.
+func DownloadImportErrors(c *fiber.Ctx) error {
+	job, err := importJobParam(c)
+	if err != nil {
+		return err
+	}
+	if job.ErrorKey == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Import has no error file",
+		})
+	}
+
+	reader, err := storage.Default().Get(c.Context(), *job.ErrorKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error": "Error file no longer exists",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read error file",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", "import-"+job.JobID.String()+"-errors.csv"))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.SendStream(reader)
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"chat-api/interactions"
+	"chat-api/middleware"
+	"chat-api/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// safetyInputs reduces medication and allergy records to the names an
+// interaction check works on.
+func safetyInputs(medications []models.Medication, allergies []models.Allergy) ([]string, []string) {
+	names := make([]string, len(medications))
+	for i, m := range medications {
+		names[i] = m.Name
+	}
+	substances := make([]string, len(allergies))
+	for i, a := range allergies {
+		substances[i] = a.Substance
+	}
+	return names, substances
+}
+
+// patientSafetyContext returns the names of a patient's active medications
+// and their allergy substances, with the access check of patientRecords.
+func patientSafetyContext(td *middleware.TokenDetails, patientID uuid.UUID) ([]string, []string, error) {
+	medications, allergies, err := patientRecords(td, patientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	names, substances := safetyInputs(medications, allergies)
+	return names, substances, nil
+}
+
+// chatWarnings checks the patient context already loaded for a chat.
+func chatWarnings(medications []models.Medication, allergies []models.Allergy) []models.InteractionWarning {
+	return interactions.Default().Check(safetyInputs(medications, allergies))
+}
+
+func CheckInteractions(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+
+	var input models.InteractionCheck
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+
+	medications, allergies := input.Medications, input.Allergies
+	if input.UserID != nil {
+		names, substances, err := patientSafetyContext(td, *input.UserID)
+		if err != nil {
+			return err
+		}
+		medications = append(medications, names...)
+		allergies = append(allergies, substances...)
+	}
+
+	if len(medications) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one medication is required",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"medications": medications,
+		"allergies":   allergies,
+		"warnings":    interactions.Default().Check(medications, allergies),
+	})
+}
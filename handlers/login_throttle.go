@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/models"
+	"chat-api/utils"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// loginLimit is how many consecutive failures a throttle key tolerates.
+// After free failures every further attempt has to wait twice as long as
+// the one before; at max the key is locked out. Failures older than the
+// lockout no longer count.
+type loginLimit struct {
+	free    int
+	max     int
+	lockout time.Duration
+}
+
+func loginLockout() time.Duration {
+	return time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+}
+
+func accountLoginLimit() loginLimit {
+	return loginLimit{free: 2, max: envInt("LOGIN_MAX_FAILURES", 5), lockout: loginLockout()}
+}
+
+// One address may serve many users (a hospital NAT), so IPs get more room
+func ipLoginLimit() loginLimit {
+	return loginLimit{free: 10, max: envInt("LOGIN_IP_MAX_FAILURES", 30), lockout: loginLockout()}
+}
+
+func (l loginLimit) backoff(failures int) time.Duration {
+	if failures <= l.free {
+		return 0
+	}
+	d := time.Duration(math.Pow(2, float64(failures-l.free-1))) * time.Second
+	if d > l.lockout {
+		return l.lockout
+	}
+	return d
+}
+
+func accountThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func throttleLimit(key string) loginLimit {
+	if strings.HasPrefix(key, "email:") {
+		return accountLoginLimit()
+	}
+	return ipLoginLimit()
+}
+
+func loginThrottleKeys(email, ip string) []string {
+	return []string{accountThrottleKey(email), ipThrottleKey(ip)}
+}
+
+// reserveLoginAttempt returns how long an attempt for email from ip has to
+// wait, or counts it as a failure up front and returns 0 when it may go
+// ahead. The keys are locked while this happens, so concurrent attempts
+// see each other and cannot all pass before the first one failed.
+// loginSucceeded takes the failure back.
+func reserveLoginAttempt(email, ip string) (time.Duration, error) {
+	keys := loginThrottleKeys(email, ip)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO login_throttles (key, failures, last_failure_at) SELECT unnest($1::text[]), 0, NOW()
+		ON CONFLICT (key) DO NOTHING`, pq.Array(keys))
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`
+		SELECT key, failures, last_failure_at, locked_until FROM login_throttles WHERE key = ANY($1)
+		ORDER BY key FOR UPDATE`, pq.Array(keys))
+	if err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	for rows.Next() {
+		var key string
+		var failures int
+		var lastFailure time.Time
+		var lockedUntil *time.Time
+		if err := rows.Scan(&key, &failures, &lastFailure, &lockedUntil); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		until := lastFailure.Add(throttleLimit(key).backoff(failures))
+		if lockedUntil != nil && lockedUntil.After(until) {
+			until = *lockedUntil
+		}
+		if d := time.Until(until); d > wait {
+			wait = d
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if wait > 0 {
+		return wait, tx.Commit()
+	}
+
+	for _, key := range keys {
+		_, err := tx.Exec(`
+			UPDATE login_throttles SET
+			    failures = CASE WHEN last_failure_at < NOW() - make_interval(secs => $2) THEN 1 ELSE failures + 1 END,
+			    last_failure_at = NOW()
+			WHERE key = $1`, key, throttleLimit(key).lockout.Seconds())
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, tx.Commit()
+}
+
+// lockExhaustedKeys locks whichever of the email and IP reached its limit
+// after a failed attempt. A lock starts the count over.
+func lockExhaustedKeys(email, ip string) error {
+	for _, key := range loginThrottleKeys(email, ip) {
+		limit := throttleLimit(key)
+		result, err := database.DB.Exec(`
+			UPDATE login_throttles SET failures = 0, locked_until = NOW() + make_interval(secs => $3)
+			WHERE key = $1 AND failures >= $2`, key, limit.max, limit.lockout.Seconds())
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Println("Sign-in locked for", limit.lockout, "after", limit.max, "failures:", key)
+		}
+	}
+	return nil
+}
+
+// loginSucceeded takes back the failure reserveLoginAttempt counted. With
+// forget, as after a full sign-in, the email's failures are cleared too.
+// The IP's are kept: one working account must not reset them.
+func loginSucceeded(email, ip string, forget bool) {
+	keys := loginThrottleKeys(email, ip)
+	if forget {
+		if _, err := database.DB.Exec("DELETE FROM login_throttles WHERE key = $1", keys[0]); err != nil {
+			log.Println("Failed to clear sign-in failures", err)
+		}
+		keys = keys[1:]
+	}
+	_, err := database.DB.Exec(`
+		UPDATE login_throttles SET failures = GREATEST(failures - 1, 0) WHERE key = ANY($1)`, pq.Array(keys))
+	if err != nil {
+		log.Println("Failed to take back sign-in attempt", err)
+	}
+}
+
+func recordLoginAttempt(email string, userID *uuid.UUID, ip string, success bool, reason string) {
+	_, err := database.DB.Exec(`
+		INSERT INTO login_attempts (attempt_id, email, user_id, ip, success, reason) VALUES ($1, $2, $3, $4, $5, $6)`,
+		uuid.New(), email, userID, ip, success, reason)
+	if err != nil {
+		log.Println("Failed to record sign-in attempt", err)
+	}
+}
+
+// failedSignIn records the failure and gives the one answer every wrong
+// email, password or code gets, so callers learn nothing about accounts.
+// The failure itself was counted by checkLoginThrottle.
+func failedSignIn(c *fiber.Ctx, email string, userID *uuid.UUID, reason, message string) error {
+	recordLoginAttempt(email, userID, c.IP(), false, reason)
+	if err := lockExhaustedKeys(email, c.IP()); err != nil {
+		log.Println("Failed to record sign-in failure", err)
+	}
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": message,
+	})
+}
+
+// checkLoginThrottle answers 429 with Retry-After when the email or IP has
+// to wait. It returns nil when the attempt may go ahead, which then counts
+// as failed until the caller reports success with loginSucceeded.
+func checkLoginThrottle(c *fiber.Ctx, email string, userID *uuid.UUID) error {
+	wait, err := reserveLoginAttempt(email, c.IP())
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check sign-in attempts")
+	}
+	if wait <= 0 {
+		return nil
+	}
+	recordLoginAttempt(email, userID, c.IP(), false, "throttled")
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":       "Too many failed sign-in attempts, try again later",
+		"retry_after": seconds,
+	})
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash is checked against when the email has no account, so
+// the answer takes as long as for a wrong password.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = utils.UnusablePasswordHash()
+	})
+	return dummyHash
+}
+
+// UnlockAccount lifts a sign-in lockout of a user, and of an IP address
+// when ip is given.
+func UnlockAccount(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+	var email string
+	if err := database.DB.QueryRow("SELECT email FROM users WHERE user_id = $1", userID).Scan(&email); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch user " + err.Error(),
+		})
+	}
+
+	keys := []string{accountThrottleKey(email)}
+	if ip := c.Query("ip"); ip != "" {
+		keys = append(keys, ipThrottleKey(ip))
+	}
+	result, err := database.DB.Exec("DELETE FROM login_throttles WHERE key = ANY($1)", pq.Array(keys))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlock account " + err.Error(),
+		})
+	}
+	n, _ := result.RowsAffected()
+	return c.JSON(fiber.Map{
+		"message": "Account unlocked successfully",
+		"cleared": n,
+	})
+}
+
+// GetLoginAttempts lists sign-in attempts, newest first.
+func GetLoginAttempts(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if email := c.Query("email"); email != "" {
+		add("lower(email) = lower($%d)", email)
+	}
+	if ip := c.Query("ip"); ip != "" {
+		add("ip = $%d", ip)
+	}
+	if v := c.Query("user_id"); v != "" {
+		userID, err := uuid.Parse(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid user_id",
+			})
+		}
+		add("user_id = $%d", userID)
+	}
+	if v := c.Query("success"); v != "" {
+		success, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "success must be true or false",
+			})
+		}
+		add("success = $%d", success)
+	}
+	for _, bound := range []struct{ param, cond string }{{"from", "created_at >= $%d"}, {"to", "created_at < $%d"}} {
+		if v := c.Query(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": bound.param + " must be an RFC 3339 time",
+				})
+			}
+			add(bound.cond, t)
+		}
+	}
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	query := "SELECT attempt_id, email, user_id, ip, success, reason, created_at FROM login_attempts"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC LIMIT " + strconv.Itoa(limit)
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch login attempts " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	attempts := []models.LoginAttempt{}
+	for rows.Next() {
+		var a models.LoginAttempt
+		if err := rows.Scan(&a.AttemptID, &a.Email, &a.UserID, &a.IP, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan login attempt " + err.Error(),
+			})
+		}
+		attempts = append(attempts, a)
+	}
+	return c.JSON(attempts)
+}
@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/middleware"
+	"chat-api/models"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var allergySeverities = map[string]bool{"mild": true, "moderate": true, "severe": true}
+
+func validateMedication(input *models.MedicationInput) error {
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		return fmt.Errorf("Medication name is required")
+	}
+	var start, stop time.Time
+	var err error
+	if input.StartDate != nil {
+		if start, err = time.Parse("2006-01-02", *input.StartDate); err != nil {
+			return fmt.Errorf("start_date must be YYYY-MM-DD")
+		}
+	}
+	if input.StopDate != nil {
+		if stop, err = time.Parse("2006-01-02", *input.StopDate); err != nil {
+			return fmt.Errorf("stop_date must be YYYY-MM-DD")
+		}
+	}
+	if input.StartDate != nil && input.StopDate != nil && stop.Before(start) {
+		return fmt.Errorf("stop_date must not be before start_date")
+	}
+	return nil
+}
+
+func validateAllergy(input *models.AllergyInput) error {
+	input.Substance = strings.TrimSpace(input.Substance)
+	if input.Substance == "" {
+		return fmt.Errorf("Allergy substance is required")
+	}
+	if input.Severity != nil {
+		severity := strings.ToLower(*input.Severity)
+		if !allergySeverities[severity] {
+			return fmt.Errorf("severity must be one of mild, moderate, severe")
+		}
+		input.Severity = &severity
+	}
+	return nil
+}
+
+// patientRecords returns a patient's active medications and allergies for
+// display next to other data, after checking the caller may see that
+// patient. Handlers that show or check these records for a patient go
+// through here, directly or via patientSafetyContext; only the data export,
+// which runs for the account holder after selfOrAdmin, reads them itself.
+func patientRecords(td *middleware.TokenDetails, patientID uuid.UUID) ([]models.Medication, []models.Allergy, error) {
+	allowed, err := canAccessPatient(td, patientID)
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to verify care team")
+	}
+	if !allowed {
+		return nil, nil, fiber.NewError(fiber.StatusForbidden, "You can only access your own or your patients' records")
+	}
+	medications, err := fetchMedications(patientID, true)
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch patient medications")
+	}
+	allergies, err := fetchAllergies(patientID)
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch patient allergies")
+	}
+	return medications, allergies, nil
+}
+
+const medicationColumns = `medication_id, user_id, name, dose, frequency,
+	to_char(start_date, 'YYYY-MM-DD'), to_char(stop_date, 'YYYY-MM-DD'), created_at, updated_at`
+
+// fetchMedications returns a user's medications; activeOnly drops the ones
+// whose stop date has passed.
+func fetchMedications(userID uuid.UUID, activeOnly bool) ([]models.Medication, error) {
+	query := `SELECT ` + medicationColumns + ` FROM user_medications WHERE user_id = $1`
+	if activeOnly {
+		query += ` AND (stop_date IS NULL OR stop_date >= CURRENT_DATE)`
+	}
+	rows, err := database.DB.Query(query+` ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	medications := []models.Medication{}
+	for rows.Next() {
+		var m models.Medication
+		err := rows.Scan(&m.MedicationID, &m.UserID, &m.Name, &m.Dose, &m.Frequency,
+			&m.StartDate, &m.StopDate, &m.CreatedAt, &m.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		medications = append(medications, m)
+	}
+	return medications, rows.Err()
+}
+
+func fetchAllergies(userID uuid.UUID) ([]models.Allergy, error) {
+	rows, err := database.DB.Query(`
+		SELECT allergy_id, user_id, substance, reaction, severity, created_at, updated_at
+		FROM user_allergies WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allergies := []models.Allergy{}
+	for rows.Next() {
+		var a models.Allergy
+		err := rows.Scan(&a.AllergyID, &a.UserID, &a.Substance, &a.Reaction, &a.Severity,
+			&a.CreatedAt, &a.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		allergies = append(allergies, a)
+	}
+	return allergies, rows.Err()
+}
+
+func GetMedications(c *fiber.Ctx) error {
+	_, userID, err := patientAccess(c)
+	if err != nil {
+		return err
+	}
+
+	medications, err := fetchMedications(userID, c.QueryBool("active"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch medications " + err.Error(),
+		})
+	}
+	return c.JSON(medications)
+}
+
+func CreateMedication(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	var input models.MedicationInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if err := validateMedication(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	medicationID := uuid.New()
+	_, err = database.DB.Exec(`
+		INSERT INTO user_medications (medication_id, user_id, name, dose, frequency, start_date, stop_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		medicationID, userID, input.Name, input.Dose, input.Frequency, input.StartDate, input.StopDate)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create medication " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":       "Medication created successfully",
+		"medication_id": medicationID,
+	})
+}
+
+func UpdateMedication(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	medicationID, err := uuid.Parse(c.Params("medicationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid medication ID",
+		})
+	}
+
+	var input models.MedicationInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if err := validateMedication(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE user_medications SET name = $1, dose = $2, frequency = $3, start_date = $4, stop_date = $5,
+		                            updated_at = NOW()
+		WHERE medication_id = $6 AND user_id = $7`,
+		input.Name, input.Dose, input.Frequency, input.StartDate, input.StopDate, medicationID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update medication " + err.Error(),
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Medication not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Medication updated successfully",
+	})
+}
+
+func DeleteMedication(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	medicationID, err := uuid.Parse(c.Params("medicationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid medication ID",
+		})
+	}
+
+	result, err := database.DB.Exec(
+		"DELETE FROM user_medications WHERE medication_id = $1 AND user_id = $2", medicationID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete medication",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Medication not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Medication deleted successfully",
+	})
+}
+
+func GetAllergies(c *fiber.Ctx) error {
+	_, userID, err := patientAccess(c)
+	if err != nil {
+		return err
+	}
+
+	allergies, err := fetchAllergies(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch allergies " + err.Error(),
+		})
+	}
+	return c.JSON(allergies)
+}
+
+func CreateAllergy(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	var input models.AllergyInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if err := validateAllergy(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	allergyID := uuid.New()
+	_, err = database.DB.Exec(`
+		INSERT INTO user_allergies (allergy_id, user_id, substance, reaction, severity)
+		VALUES ($1, $2, $3, $4, $5)`,
+		allergyID, userID, input.Substance, input.Reaction, input.Severity)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create allergy " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":    "Allergy created successfully",
+		"allergy_id": allergyID,
+	})
+}
+
+func UpdateAllergy(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	allergyID, err := uuid.Parse(c.Params("allergyId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid allergy ID",
+		})
+	}
+
+	var input models.AllergyInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if err := validateAllergy(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE user_allergies SET substance = $1, reaction = $2, severity = $3, updated_at = NOW()
+		WHERE allergy_id = $4 AND user_id = $5`,
+		input.Substance, input.Reaction, input.Severity, allergyID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update allergy " + err.Error(),
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Allergy not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Allergy updated successfully",
+	})
+}
+
+func DeleteAllergy(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	allergyID, err := uuid.Parse(c.Params("allergyId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid allergy ID",
+		})
+	}
+
+	result, err := database.DB.Exec(
+		"DELETE FROM user_allergies WHERE allergy_id = $1 AND user_id = $2", allergyID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete allergy",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Allergy not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Allergy deleted successfully",
+	})
+}
@@ -0,0 +1,455 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/models"
+	"chat-api/utils"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	mfaChallengePurpose = "mfa-challenge"
+	// How long the second sign-in step may take after the password step
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// mfaRequired reports whether MFA_REQUIRED_ROLES (comma separated, admin by
+// default) makes a second factor mandatory for the role.
+func mfaRequired(role string) bool {
+	roles, ok := os.LookupEnv("MFA_REQUIRED_ROLES")
+	if !ok {
+		roles = "admin"
+	}
+	for _, r := range strings.Split(roles, ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mfaEnrolmentPath is the prefix AccountGuard still lets through for
+// accounts that must enrol before doing anything else.
+func mfaEnrolmentPath(userID uuid.UUID) string {
+	return "/api/users/" + userID.String() + "/mfa"
+}
+
+func mfaIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Chat API"
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// replaceRecoveryCodes drops the user's recovery codes and issues a new
+// set, returned in the XXXX-XXXX form shown to the user once.
+func replaceRecoveryCodes(tx *sql.Tx, userID uuid.UUID) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(raw)
+		codes[i] = code[:4] + "-" + code[4:]
+		_, err := tx.Exec("INSERT INTO mfa_recovery_codes (code_hash, user_id) VALUES ($1, $2)", hashRecoveryCode(code), userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// checkSecondFactor accepts a TOTP code from secret, each at most once, or
+// else an unused recovery code, which it uses up.
+func checkSecondFactor(userID uuid.UUID, secret string, input models.MFACode) (bool, error) {
+	if input.Code != "" {
+		step, ok := utils.ValidateTOTP(secret, input.Code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		result, err := database.DB.Exec(`
+			UPDATE users SET mfa_last_step = $1
+			WHERE user_id = $2 AND (mfa_last_step IS NULL OR mfa_last_step < $1)`, step, userID)
+		if err != nil {
+			return false, err
+		}
+		n, _ := result.RowsAffected()
+		return n == 1, nil
+	}
+	if input.RecoveryCode != "" {
+		result, err := database.DB.Exec(`
+			UPDATE mfa_recovery_codes SET used_at = NOW()
+			WHERE code_hash = $1 AND user_id = $2 AND used_at IS NULL`, hashRecoveryCode(input.RecoveryCode), userID)
+		if err != nil {
+			return false, err
+		}
+		n, _ := result.RowsAffected()
+		return n == 1, nil
+	}
+	return false, nil
+}
+
+// mfaOwner parses the :id param and checks it is the caller: enrolling an
+// authenticator is something only the account holder can do.
+func mfaOwner(c *fiber.Ctx) (uuid.UUID, error) {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if td.UserID != userID {
+		return uuid.Nil, fiber.NewError(fiber.StatusForbidden, "Only the account holder can manage their authenticator")
+	}
+	return userID, nil
+}
+
+func fetchMFASecret(userID uuid.UUID) (secret *string, enabledAt *time.Time, err error) {
+	err = database.DB.QueryRow("SELECT mfa_secret, mfa_enabled_at FROM users WHERE user_id = $1", userID).Scan(&secret, &enabledAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, "User not found")
+	}
+	return secret, enabledAt, err
+}
+
+func GetMFAStatus(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	var status models.MFAStatus
+	var role string
+	err = database.DB.QueryRow(`
+		SELECT u.role, u.mfa_enabled_at,
+		       (SELECT COUNT(*) FROM mfa_recovery_codes r WHERE r.user_id = u.user_id AND r.used_at IS NULL)
+		FROM users u WHERE u.user_id = $1`, userID).Scan(&role, &status.EnabledAt, &status.RecoveryCodesRemaining)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch MFA status " + err.Error(),
+		})
+	}
+	status.Enabled = status.EnabledAt != nil
+	status.Required = mfaRequired(role)
+	return c.JSON(status)
+}
+
+// StartMFAEnrolment generates a new TOTP secret for the caller. It only
+// takes effect once ConfirmMFAEnrolment sees a code from it.
+func StartMFAEnrolment(c *fiber.Ctx) error {
+	userID, err := mfaOwner(c)
+	if err != nil {
+		return err
+	}
+	secret, err := utils.NewTOTPSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate secret",
+		})
+	}
+
+	var email string
+	err = database.DB.QueryRow(`
+		UPDATE users SET mfa_secret = $1, mfa_last_step = NULL
+		WHERE user_id = $2 AND mfa_enabled_at IS NULL
+		RETURNING email`, secret, userID).Scan(&email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "MFA is already enabled, disable it before enrolling a new authenticator",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start enrolment " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.MFAEnrolment{
+		Secret:          secret,
+		ProvisioningURI: utils.TOTPURI(mfaIssuer(), email, secret),
+	})
+}
+
+// ConfirmMFAEnrolment turns MFA on with the first code from the new
+// authenticator and returns the recovery codes, which are not shown again.
+func ConfirmMFAEnrolment(c *fiber.Ctx) error {
+	userID, err := mfaOwner(c)
+	if err != nil {
+		return err
+	}
+	var input models.MFACode
+	if err := c.BodyParser(&input); err != nil || input.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code is required",
+		})
+	}
+
+	secret, enabledAt, err := fetchMFASecret(userID)
+	if err != nil {
+		return err
+	}
+	if enabledAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "MFA is already enabled",
+		})
+	}
+	if secret == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Start enrolment first with POST /api/users/:id/mfa/totp",
+		})
+	}
+	ok, err := checkSecondFactor(userID, *secret, models.MFACode{Code: input.Code})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check code " + err.Error(),
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE users SET mfa_enabled_at = NOW() WHERE user_id = $1", userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to enable MFA " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "MFA enabled successfully, keep the recovery codes somewhere safe",
+		"recovery_codes": codes,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes, which
+// takes a current code from the authenticator.
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	userID, err := mfaOwner(c)
+	if err != nil {
+		return err
+	}
+	var input models.MFACode
+	if err := c.BodyParser(&input); err != nil || input.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code is required",
+		})
+	}
+
+	secret, enabledAt, err := fetchMFASecret(userID)
+	if err != nil {
+		return err
+	}
+	if enabledAt == nil || secret == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "MFA is not enabled",
+		})
+	}
+	ok, err := checkSecondFactor(userID, *secret, models.MFACode{Code: input.Code})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check code " + err.Error(),
+		})
+	}
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create recovery codes " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Recovery codes created successfully, the old ones no longer work",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA removes the authenticator and recovery codes. The account
+// holder confirms with a code or recovery code; an admin can reset someone
+// else's without one, for a lost device, which also ends that user's
+// sessions.
+func DisableMFA(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	reset := td.UserID != userID
+	if !reset {
+		var input models.MFACode
+		if err := c.BodyParser(&input); err != nil || (input.Code == "" && input.RecoveryCode == "") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "code or recovery_code is required",
+			})
+		}
+		secret, enabledAt, err := fetchMFASecret(userID)
+		if err != nil {
+			return err
+		}
+		if enabledAt == nil || secret == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "MFA is not enabled",
+			})
+		}
+		ok, err := checkSecondFactor(userID, *secret, input)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check code " + err.Error(),
+			})
+		}
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid code",
+			})
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET mfa_secret = NULL, mfa_enabled_at = NULL, mfa_last_step = NULL,
+		       sessions_valid_after = CASE WHEN $2::boolean THEN NOW() ELSE sessions_valid_after END
+		WHERE user_id = $1`, userID, reset)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID)
+	}
+	if err == nil && reset {
+		err = revokeUserSessions(tx, userID, &td.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable MFA " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "MFA disabled successfully",
+	})
+}
+
+// mfaChallenge answers a sign-in whose first step (method) passed with the
+// token VerifyMFAChallenge takes in place of the JWT.
+func mfaChallenge(c *fiber.Ctx, userID uuid.UUID, method string) error {
+	return c.JSON(fiber.Map{
+		"message":      "Enter the code from your authenticator app",
+		"mfa_required": true,
+		"mfa_token":    utils.SignToken(mfaChallengePurpose, mfaChallengeTTL, userID.String(), method),
+	})
+}
+
+// VerifyMFAChallenge is the second sign-in step for accounts with MFA: it
+// takes the mfa_token SignIn returned after the password and a code from
+// the authenticator (or a recovery code), and issues the JWT.
+func VerifyMFAChallenge(c *fiber.Ctx) error {
+	var input models.MFAChallenge
+	if err := c.BodyParser(&input); err != nil || input.MFAToken == "" || (input.Code == "" && input.RecoveryCode == "") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "mfa_token and code or recovery_code are required",
+		})
+	}
+
+	fields, err := utils.VerifyToken(mfaChallengePurpose, input.MFAToken)
+	var userID uuid.UUID
+	if err == nil && len(fields) == 2 {
+		userID, err = uuid.Parse(fields[0])
+	}
+	if err != nil || userID == uuid.Nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired mfa_token, sign in again",
+		})
+	}
+
+	var user models.User
+	var emailVerified bool
+	var secret *string
+	err = database.DB.QueryRow(`
+		SELECT user_id, email, name, role, email_verified, mfa_secret
+		FROM users WHERE user_id = $1 AND mfa_enabled_at IS NOT NULL`, userID).Scan(
+		&user.UserID, &user.Email, &user.Name, &user.Role, &emailVerified, &secret)
+	if err != nil || secret == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired mfa_token, sign in again",
+		})
+	}
+
+	// Wrong codes count against the account like wrong passwords
+	if err := checkLoginThrottle(c, user.Email, &user.UserID); err != nil {
+		return err
+	}
+	ok, err := checkSecondFactor(userID, *secret, models.MFACode{Code: input.Code, RecoveryCode: input.RecoveryCode})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check code",
+		})
+	}
+	if !ok {
+		return failedSignIn(c, user.Email, &user.UserID, "mfa_failed", "Invalid code")
+	}
+
+	recordLoginAttempt(user.Email, &user.UserID, c.IP(), true, "success")
+	loginSucceeded(user.Email, c.IP(), true)
+	return completeSignIn(c, &user, emailVerified, fields[1]+"+mfa")
+}
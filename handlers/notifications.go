@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/models"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// notifyUser stores an in-app notification. Failures are logged, never
+// returned, so a notification can not fail the work it reports on.
+func notifyUser(userID uuid.UUID, kind, body string, link *string) {
+	_, err := database.DB.Exec(`
+		INSERT INTO user_notifications (notification_id, user_id, kind, body, link) VALUES ($1, $2, $3, $4, $5)`,
+		uuid.New(), userID, kind, body, link)
+	if err != nil {
+		log.Println("Failed to notify user", userID, err)
+	}
+}
+
+func GetNotifications(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		SELECT notification_id, user_id, kind, body, link, created_at, read_at
+		FROM user_notifications WHERE user_id = $1`
+	if c.Query("unread") == "true" {
+		query += ` AND read_at IS NULL`
+	}
+	rows, err := database.DB.Query(query+` ORDER BY created_at DESC LIMIT 100`, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch notifications " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	notifications := []models.Notification{}
+	for rows.Next() {
+		var n models.Notification
+		if err := rows.Scan(&n.NotificationID, &n.UserID, &n.Kind, &n.Body, &n.Link, &n.CreatedAt, &n.ReadAt); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan notification " + err.Error(),
+			})
+		}
+		notifications = append(notifications, n)
+	}
+
+	return c.JSON(notifications)
+}
+
+func MarkNotificationRead(c *fiber.Ctx) error {
+	_, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	notificationID, err := uuid.Parse(c.Params("notificationId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid notification ID",
+		})
+	}
+
+	result, err := database.DB.Exec(`
+		UPDATE user_notifications SET read_at = COALESCE(read_at, NOW())
+		WHERE notification_id = $1 AND user_id = $2`, notificationID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update notification",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Notification not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Notification marked as read",
+	})
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/models"
+	"chat-api/oidc"
+	"chat-api/utils"
+	"crypto/subtle"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// How long the user has at the identity provider before the sign-in must
+// be started again
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcLoginCookie holds the state and nonce of a sign-in in the browser
+// that started it, so a callback URL sent to someone else does not sign
+// them in.
+const oidcLoginCookie = "oidc_login"
+
+func oidcCookiePath(provider *oidc.Provider) string {
+	return "/auth/oidc/" + provider.Name
+}
+
+func oidcProvider(c *fiber.Ctx) (*oidc.Provider, error) {
+	provider, ok := oidc.Lookup(c.Params("provider"))
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Unknown identity provider")
+	}
+	return provider, nil
+}
+
+func oidcRedirectURI(provider *oidc.Provider) string {
+	return publicBaseURL() + "/auth/oidc/" + provider.Name + "/callback"
+}
+
+// OIDCLogin starts a sign-in with an external identity provider and
+// redirects the browser there.
+func OIDCLogin(c *fiber.Ctx) error {
+	provider, err := oidcProvider(c)
+	if err != nil {
+		return err
+	}
+	state, nonce, verifier, err := oidc.NewLogin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start sign-in",
+		})
+	}
+	authURL, err := provider.AuthCodeURL(c.Context(), oidcRedirectURI(provider), state, nonce, verifier)
+	if err != nil {
+		log.Println("OIDC provider", provider.Name, "unavailable:", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Identity provider is unavailable",
+		})
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO oidc_logins (state, provider, nonce, code_verifier, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		state, provider.Name, nonce, verifier, time.Now().Add(oidcLoginTTL))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start sign-in " + err.Error(),
+		})
+	}
+	database.DB.Exec("DELETE FROM oidc_logins WHERE expires_at < NOW()")
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    state + "." + nonce,
+		Path:     oidcCookiePath(provider),
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		Secure:   strings.HasPrefix(publicBaseURL(), "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// linkIdentity finds the user an external identity belongs to. An identity
+// seen for the first time is linked to the user with the same email, or a
+// new user, but only when the provider vouches for the address. New users
+// get role; existing users only when it came from a role mapping, so the
+// default role never demotes anyone.
+func linkIdentity(tx *sql.Tx, provider *oidc.Provider, claims *oidc.Claims, role string, mapped bool) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := tx.QueryRow(`
+		SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`,
+		provider.Name, claims.Subject).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return uuid.Nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		if claims.Email == "" || !claims.EmailVerified {
+			return uuid.Nil, fiber.NewError(fiber.StatusForbidden,
+				"The identity provider did not confirm an email address, the account cannot be linked")
+		}
+		err = tx.QueryRow(`
+			SELECT user_id FROM users WHERE lower(email) = lower($1) AND erased_at IS NULL FOR UPDATE`,
+			claims.Email).Scan(&userID)
+		if err == sql.ErrNoRows {
+			password, hashErr := utils.UnusablePasswordHash()
+			if hashErr != nil {
+				return uuid.Nil, hashErr
+			}
+			var name *string
+			if claims.Name != "" {
+				name = &claims.Name
+			}
+			err = tx.QueryRow(`
+				INSERT INTO users (email, password, role, name, email_verified)
+				VALUES ($1, $2, $3, $4, TRUE) RETURNING user_id`,
+				claims.Email, password, role, name).Scan(&userID)
+		}
+		if err != nil {
+			return uuid.Nil, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)`,
+			provider.Name, claims.Subject, userID, claims.Email)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE user_identities SET last_login_at = NOW(), email = COALESCE(NULLIF($3, ''), email)
+		WHERE provider = $1 AND subject = $2`, provider.Name, claims.Subject, claims.Email)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE users SET role = CASE WHEN $5::boolean THEN $2 ELSE role END,
+		       email_verified = email_verified OR (lower(email) = lower($3) AND $4::boolean)
+		WHERE user_id = $1`, userID, role, claims.Email, claims.EmailVerified, mapped)
+	return userID, err
+}
+
+// OIDCCallback finishes a sign-in: it checks the state against the
+// database and the browser's sign-in cookie, redeems the code
+// with the PKCE verifier, verifies the ID token and signs the linked user
+// in like SignIn, including the MFA step when the user has it enabled.
+func OIDCCallback(c *fiber.Ctx) error {
+	provider, err := oidcProvider(c)
+	if err != nil {
+		return err
+	}
+	if reason := c.Query("error"); reason != "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "The identity provider refused the sign-in: " + reason,
+		})
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "state and code are required",
+		})
+	}
+	cookieState, cookieNonce, _ := strings.Cut(c.Cookies(oidcLoginCookie), ".")
+	c.Cookie(&fiber.Cookie{Name: oidcLoginCookie, Path: oidcCookiePath(provider), MaxAge: -1, HTTPOnly: true})
+	if subtle.ConstantTimeCompare([]byte(cookieState), []byte(state)) != 1 || cookieNonce == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Sign-in was not started in this browser, start again",
+		})
+	}
+
+	var nonce, verifier string
+	err = database.DB.QueryRow(`
+		DELETE FROM oidc_logins WHERE state = $1 AND provider = $2 AND expires_at > NOW()
+		RETURNING nonce, code_verifier`, state, provider.Name).Scan(&nonce, &verifier)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid or expired sign-in, start again",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check sign-in state",
+		})
+	}
+
+	claims, err := provider.Exchange(c.Context(), code, oidcRedirectURI(provider), verifier)
+	if err == nil && (claims.Nonce != nonce || subtle.ConstantTimeCompare([]byte(cookieNonce), []byte(nonce)) != 1) {
+		err = fiber.NewError(fiber.StatusUnauthorized, "nonce mismatch")
+	}
+	if err != nil {
+		log.Println("OIDC sign-in with", provider.Name, "failed:", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Sign-in with the identity provider failed",
+		})
+	}
+	role, mapped := provider.Role(claims)
+	if !validRoles[role] {
+		log.Println("OIDC provider", provider.Name, "maps to unknown role", role)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "The identity provider's role mapping is misconfigured",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	userID, err := linkIdentity(tx, provider, claims, role, mapped)
+	if err != nil {
+		if e, ok := err.(*fiber.Error); ok {
+			return e
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link account " + err.Error(),
+		})
+	}
+	var user models.User
+	var emailVerified bool
+	var mfaEnabledAt *time.Time
+	err = tx.QueryRow(`
+		SELECT user_id, email, name, role, email_verified, mfa_enabled_at FROM users WHERE user_id = $1`,
+		userID).Scan(&user.UserID, &user.Email, &user.Name, &user.Role, &emailVerified, &mfaEnabledAt)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to sign in " + err.Error(),
+		})
+	}
+
+	method := "oidc:" + provider.Name
+	if mfaEnabledAt != nil {
+		return mfaChallenge(c, user.UserID, method)
+	}
+	return completeSignIn(c, &user, emailVerified, method)
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The browser check runs before anything touches the database, so a
+// callback URL opened in another browser is refused outright.
+func TestOIDCCallbackRequiresTheLoginCookie(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "mock")
+	t.Setenv("OIDC_MOCK_ISSUER", "https://idp.example.com")
+	t.Setenv("OIDC_MOCK_CLIENT_ID", "chat-api")
+	t.Setenv("APP_BASE_URL", "https://chat.example.com")
+
+	app := fiber.New()
+	app.Get("/auth/oidc/:provider/callback", OIDCCallback)
+
+	tests := []struct {
+		name, cookie string
+	}{
+		{"no cookie", ""},
+		{"other state", "other-state.nonce"},
+		{"no nonce", "the-state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth/oidc/mock/callback?state=the-state&code=abc", nil)
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", oidcLoginCookie+"="+tt.cookie)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body map[string]string
+			json.NewDecoder(resp.Body).Decode(&body)
+			if resp.StatusCode != fiber.StatusBadRequest || !strings.Contains(body["error"], "not started in this browser") {
+				t.Fatalf("status %d %v, want the browser check to refuse", resp.StatusCode, body)
+			}
+			if cleared := resp.Header.Get("Set-Cookie"); !strings.HasPrefix(cleared, oidcLoginCookie+"=;") {
+				t.Errorf("Set-Cookie = %q, want the login cookie cleared", cleared)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/mail"
+	"chat-api/utils"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	// At most this many reset emails per account per hour, whoever asks
+	passwordResetsPerHour = 3
+	// Reset requests wait in a queue this long for this many workers;
+	// when it is full further requests are dropped
+	passwordResetQueueSize = 100
+	passwordResetWorkers   = 2
+)
+
+type passwordResetRequest struct {
+	email, ip string
+}
+
+var (
+	passwordResetQueue     = make(chan passwordResetRequest, passwordResetQueueSize)
+	passwordResetQueueOnce sync.Once
+)
+
+// queuePasswordReset hands the request to the reset workers, starting them
+// on first use, and reports whether there was room for it.
+func queuePasswordReset(req passwordResetRequest) bool {
+	passwordResetQueueOnce.Do(func() {
+		for i := 0; i < passwordResetWorkers; i++ {
+			go func() {
+				for req := range passwordResetQueue {
+					processPasswordReset(req)
+				}
+			}()
+		}
+	})
+	select {
+	case passwordResetQueue <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// processPasswordReset mails a reset link if the address has an account.
+func processPasswordReset(req passwordResetRequest) {
+	var userID uuid.UUID
+	var address string
+	err := database.DB.QueryRow(`
+		SELECT user_id, email FROM users WHERE lower(email) = lower($1) AND erased_at IS NULL`, req.email).Scan(&userID, &address)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		err = sendPasswordReset(ctx, publicBaseURL(), userID, address, req.ip)
+	}
+	if err != nil {
+		log.Println("Failed to send password reset", err)
+	}
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendPasswordReset issues a reset token for the user and mails it, unless
+// the account has had too many recently.
+func sendPasswordReset(ctx context.Context, baseURL string, userID uuid.UUID, email, ip string) error {
+	var recent int
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM password_resets WHERE user_id = $1 AND created_at > NOW() - INTERVAL '1 hour'`,
+		userID).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent >= passwordResetsPerHour {
+		log.Println("Password reset for", userID, "skipped, hourly limit reached")
+		return nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	_, err = database.DB.Exec(`
+		INSERT INTO password_resets (token_hash, user_id, expires_at, requested_ip, email) VALUES ($1, $2, $3, $4, $5)`,
+		hashResetToken(token), userID, time.Now().Add(passwordResetTTL), ip, email)
+	if err != nil {
+		return err
+	}
+
+	return mail.Default().Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Someone asked to reset the password of your account. To choose a new password, "+
+			"open this link within %d minutes:\n\n%s/reset-password?token=%s\n\n"+
+			"If it wasn't you, ignore this email; your password stays as it is.",
+			int(passwordResetTTL.Minutes()), baseURL, token),
+	})
+}
+
+// ForgotPassword emails a reset link. The answer is the same whether or
+// not the address has an account, and the email goes out in the
+// background so response times do not tell either.
+func ForgotPassword(c *fiber.Ctx) error {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&input); err != nil || strings.TrimSpace(input.Email) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "email is required",
+		})
+	}
+
+	if !queuePasswordReset(passwordResetRequest{email: strings.TrimSpace(input.Email), ip: c.IP()}) {
+		log.Println("Password reset queue full, request dropped")
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If the address belongs to an account, a password reset link is on its way",
+	})
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword. The
+// token works once; using it also retires the account's other reset
+// tokens, ends every signed in session and, as it proves access to the
+// mailbox, verifies the email address if the link was mailed to the
+// account's current one.
+func ResetPassword(c *fiber.Ctx) error {
+	var input struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&input); err != nil || input.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "token and password are required",
+		})
+	}
+	if len(input.Password) < 6 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Password must be at least 6 characters long",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	var email string
+	var mailedTo *string
+	err = tx.QueryRow(`
+		SELECT r.user_id, u.email, r.email FROM password_resets r JOIN users u ON u.user_id = r.user_id
+		WHERE r.token_hash = $1 AND r.used_at IS NULL AND r.expires_at > NOW()
+		FOR UPDATE OF r, u`, hashResetToken(input.Token)).Scan(&userID, &email, &mailedTo)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid or expired reset token",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check reset token",
+		})
+	}
+
+	hashedPassword, err := utils.HashPassword(input.Password)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+	verified := mailedTo != nil && *mailedTo == email
+	_, err = tx.Exec(`
+		UPDATE users SET password = $1, email_verified = email_verified OR $2, sessions_valid_after = NOW()
+		WHERE user_id = $3`,
+		hashedPassword, verified, userID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL", userID)
+	}
+	if err == nil {
+		err = revokeUserSessions(tx, userID, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset password " + err.Error(),
+		})
+	}
+
+	err = mail.Default().Send(c.Context(), mail.Message{
+		To:      email,
+		Subject: "Your password was changed",
+		Text:    "The password of your account was just reset and all sessions were signed out. If this wasn't you, contact support.",
+	})
+	if err != nil {
+		log.Println("Failed to send password change notice to", userID, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Password reset successfully, sign in with the new password",
+	})
+}
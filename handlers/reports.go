@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bytes"
+	"chat-api/models"
+	"chat-api/pdf"
+	"chat-api/utils"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const reportTimeLayout = "2 Jan 2006 15:04 MST"
+
+func orDash(s *string) string {
+	if s == nil || strings.TrimSpace(*s) == "" {
+		return "-"
+	}
+	return *s
+}
+
+// firstOf returns the chat's intake value, falling back to the profile.
+func firstOf(chat, profile *string) *string {
+	if chat != nil && strings.TrimSpace(*chat) != "" {
+		return chat
+	}
+	return profile
+}
+
+func reportVitals(chat *models.Chat) [][]string {
+	rows := [][]string{}
+	if chat.Height != nil {
+		rows = append(rows, []string{"Height", fmt.Sprintf("%.1f cm", *chat.Height), ""})
+	}
+	if chat.Weight != nil {
+		rows = append(rows, []string{"Weight", fmt.Sprintf("%.1f kg", *chat.Weight), ""})
+	}
+	if bmi := utils.BMI(chat.Height, chat.Weight); bmi != nil {
+		rows = append(rows, []string{"BMI", fmt.Sprintf("%.1f kg/m2", *bmi), "Derived, " + utils.BMICategory(*bmi)})
+	}
+	if chat.BloodPressure != nil && *chat.BloodPressure != "" {
+		rows = append(rows, []string{"Blood pressure", *chat.BloodPressure + " mmHg", ""})
+		if sys, dia, ok := utils.ParseBloodPressure(*chat.BloodPressure); ok {
+			rows = append(rows, []string{"Mean arterial pressure",
+				fmt.Sprintf("%.0f mmHg", utils.MeanArterialPressure(sys, dia)), "Derived"})
+		}
+	}
+	if chat.Pulse != nil {
+		rows = append(rows, []string{"Pulse", fmt.Sprintf("%d beats/min", *chat.Pulse), ""})
+	}
+	return rows
+}
+
+// GetChatReport renders a printable intake summary of a chat as a PDF.
+// Private notes are never printed, whatever the caller's role.
+func GetChatReport(c *fiber.Ctx) error {
+	td, chatID, ownerID, err := chatAccess(c)
+	if err != nil {
+		return err
+	}
+
+	chats, err := queryChats("WHERE chat_id = $1", chatID)
+	if err != nil || len(chats) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat",
+		})
+	}
+	chat := chats[0]
+
+	user, err := fetchUserResponse(ownerID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch patient",
+		})
+	}
+	medications, allergies, err := patientRecords(td, ownerID)
+	if err != nil {
+		return err
+	}
+	notes, err := fetchChatNotes(chatID, false)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch chat notes",
+		})
+	}
+
+	doc := pdf.New("Intake summary " + chat.ChatID.String())
+	doc.Title("Intake summary")
+	doc.Paragraph(fmt.Sprintf("Chat %s, generated %s", chat.ChatID, time.Now().Format(reportTimeLayout)), pdf.Regular, 9)
+
+	age := "-"
+	if chat.Age != nil {
+		age = fmt.Sprint(*chat.Age)
+	} else if user.Age != nil {
+		age = fmt.Sprint(*user.Age)
+	}
+	doc.Heading("Patient")
+	doc.Fields([][2]string{
+		{"Name", orDash(firstOf(chat.Name, user.Name))},
+		{"Age", age},
+		{"Gender", orDash(firstOf(chat.Gender, user.Gender))},
+		{"Email", user.Email},
+		{"Patient ID", user.UserID.String()},
+	})
+
+	doc.Heading("Timestamps")
+	doc.Fields([][2]string{
+		{"Created", chat.CreatedAt.Local().Format(reportTimeLayout)},
+		{"Last updated", chat.UpdatedAt.Local().Format(reportTimeLayout)},
+	})
+
+	doc.Heading("Vital signs")
+	if vitals := reportVitals(&chat); len(vitals) > 0 {
+		doc.Table([]float64{0.35, 0.3, 0.35}, []string{"Measurement", "Value", "Note"}, vitals)
+	} else {
+		doc.Paragraph("No vital signs recorded.", pdf.Regular, 10)
+	}
+
+	doc.Heading("Presenting complaint")
+	doc.Fields([][2]string{
+		{"Disease", orDash(chat.Disease)},
+		{"Description", orDash(chat.Text)},
+		{"Physical condition", orDash(firstOf(chat.PhysicalCondition, user.PhysicalCondition))},
+	})
+
+	doc.Heading("Symptom history (LODCRAFT)")
+	symptoms := make([][]string, 0, len(models.LODCRAFTKeys))
+	for _, key := range models.LODCRAFTKeys {
+		symptoms = append(symptoms, []string{models.LODCRAFTLabels[key], orDash(chat.LODCRAFTAnswer(key))})
+	}
+	doc.Table([]float64{0.35, 0.65}, []string{"Question", "Answer"}, symptoms)
+
+	doc.Heading("Medical history")
+	doc.Paragraph(orDash(firstOf(chat.MedicalHistory, user.MedicalHistory)), pdf.Regular, 10)
+
+	if len(chat.Diagnoses) > 0 {
+		doc.Heading("Diagnoses")
+		rows := make([][]string, len(chat.Diagnoses))
+		for i, d := range chat.Diagnoses {
+			rows[i] = []string{d.Code, d.Description, d.Source}
+		}
+		doc.Table([]float64{0.15, 0.65, 0.2}, []string{"ICD-10", "Description", "Source"}, rows)
+	}
+
+	doc.Heading("Active medications")
+	if len(medications) > 0 {
+		rows := make([][]string, len(medications))
+		for i, m := range medications {
+			rows[i] = []string{m.Name, orDash(m.Dose), orDash(m.Frequency), orDash(m.StartDate)}
+		}
+		doc.Table([]float64{0.35, 0.2, 0.25, 0.2}, []string{"Medication", "Dose", "Frequency", "Since"}, rows)
+	} else {
+		doc.Paragraph("None recorded.", pdf.Regular, 10)
+	}
+
+	doc.Heading("Allergies")
+	if len(allergies) > 0 {
+		rows := make([][]string, len(allergies))
+		for i, a := range allergies {
+			rows[i] = []string{a.Substance, orDash(a.Reaction), orDash(a.Severity)}
+		}
+		doc.Table([]float64{0.35, 0.45, 0.2}, []string{"Substance", "Reaction", "Severity"}, rows)
+	} else {
+		doc.Paragraph("None recorded.", pdf.Regular, 10)
+	}
+
+	if warnings := chatWarnings(medications, allergies); len(warnings) > 0 {
+		doc.Heading("Safety warnings")
+		rows := make([][]string, len(warnings))
+		for i, w := range warnings {
+			rows[i] = []string{w.Severity, strings.Join(w.Subjects, " + "), w.Description}
+		}
+		doc.Table([]float64{0.18, 0.32, 0.5}, []string{"Severity", "Between", "Description"}, rows)
+	}
+
+	if len(notes) > 0 {
+		doc.Heading("Clinician notes")
+		rows := make([][]string, len(notes))
+		for i, n := range notes {
+			rows[i] = []string{n.CreatedAt.Local().Format(reportTimeLayout), n.NoteType, orDash(n.AuthorEmail), n.Body}
+		}
+		doc.Table([]float64{0.2, 0.13, 0.22, 0.45}, []string{"Time", "Type", "Author", "Note"}, rows)
+	}
+
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to render report",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", "chat-"+chat.ChatID.String()+".pdf"))
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return c.Send(buf.Bytes())
+}
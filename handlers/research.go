@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"bufio"
+	"chat-api/database"
+	"chat-api/deid"
+	"chat-api/models"
+	"chat-api/storage"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// researchPseudonymKey reads RESEARCH_PSEUDONYM_KEY, which is required, see
+// CheckConfig. Changing it changes every pseudonym.
+func researchPseudonymKey() []byte {
+	return []byte(os.Getenv("RESEARCH_PSEUDONYM_KEY"))
+}
+
+// envInt reads a positive integer setting.
+func envInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// Research dataset columns. Age, gender, height and weight are the
+// quasi-identifiers the k-anonymity check groups by.
+var researchColumns = []string{
+	"patient", "chat", "date", "age_band", "gender", "height_cm", "weight_kg", "pulse", "blood_pressure", "diagnosis_codes",
+}
+
+type researchOptions struct {
+	Format         string  `json:"format"`
+	K              int     `json:"k"`
+	MaxSuppression float64 `json:"max_suppression"`
+	Project        string  `json:"project"`
+	DateShiftDays  int     `json:"date_shift_days"`
+}
+
+type researchRecord struct {
+	userID, consentID uuid.UUID
+	chatID            uuid.UUID
+	createdAt         time.Time
+	age               *int16
+	gender            string
+	height, weight    *float32
+	pulse             *int16
+	bloodPressure     *string
+	codes             string
+}
+
+// loadResearchRecords returns the chats of users with an active research
+// consent. Erased users are left out even if their consent is still on
+// record. Free text is never selected.
+func loadResearchRecords(ctx context.Context) ([]researchRecord, error) {
+	rows, err := database.DB.QueryContext(ctx, `
+		SELECT c.user_id, uc.consent_id, c.chat_id, c.created_at, c.age, analytics_gender(c.gender),
+		       c.height, c.weight, c.pulse, c.blood_pressure,
+		       COALESCE((SELECT string_agg(d.code, ';' ORDER BY d.code) FROM chat_diagnoses d WHERE d.chat_id = c.chat_id), '')
+		FROM chats c
+		JOIN users u ON u.user_id = c.user_id AND u.erased_at IS NULL
+		JOIN user_consents uc ON uc.user_id = c.user_id AND uc.consent_type = $1 AND uc.withdrawn_at IS NULL
+		ORDER BY c.user_id, c.created_at`, ConsentResearchUse)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []researchRecord
+	for rows.Next() {
+		var r researchRecord
+		err := rows.Scan(&r.userID, &r.consentID, &r.chatID, &r.createdAt, &r.age, &r.gender,
+			&r.height, &r.weight, &r.pulse, &r.bloodPressure, &r.codes)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// deidentify turns the records into dataset rows, their quasi-identifiers
+// and the patient pseudonym of each.
+func deidentify(records []researchRecord, opts researchOptions) (rows, quasi [][]string, subjects []string) {
+	p := deid.NewPseudonymizer(researchPseudonymKey(), opts.Project)
+	for _, r := range records {
+		shift := p.DateShift(r.userID.String(), opts.DateShiftDays)
+		q := []string{deid.AgeBand(r.age), r.gender, deid.Range(r.height, 10), deid.Range(r.weight, 10)}
+		row := []string{
+			p.ID("patient", r.userID.String()),
+			p.ID("chat", r.chatID.String()),
+			r.createdAt.UTC().AddDate(0, 0, shift).Format("2006-01-02"),
+		}
+		row = append(row, q...)
+		row = append(row, "", "", r.codes)
+		if r.pulse != nil {
+			row[7] = strconv.Itoa(int(*r.pulse))
+		}
+		if r.bloodPressure != nil {
+			row[8] = *r.bloodPressure
+		}
+		rows = append(rows, row)
+		quasi = append(quasi, q)
+		subjects = append(subjects, row[0])
+	}
+	return rows, quasi, subjects
+}
+
+func writeResearchRows(w io.Writer, format string, rows [][]string, keep []bool) error {
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(researchColumns); err != nil {
+			return err
+		}
+		for i, row := range rows {
+			if keep[i] {
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	enc := json.NewEncoder(w)
+	for i, row := range rows {
+		if !keep[i] {
+			continue
+		}
+		record := make(map[string]interface{}, len(row))
+		for j, v := range row {
+			record[researchColumns[j]] = v
+			if v == "" || v == "unknown" {
+				record[researchColumns[j]] = nil
+			}
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateResearchExport starts a de-identified dataset export of consented
+// users. Records whose quasi-identifiers are shared by fewer than k records
+// are suppressed; if that would drop more than max_suppression of them the
+// export fails instead of being released.
+func CreateResearchExport(c *fiber.Ctx) error {
+	td, err := adminOnly(c)
+	if err != nil {
+		return err
+	}
+
+	opts := researchOptions{
+		Format:        c.Query("format", "csv"),
+		K:             c.QueryInt("k", envInt("RESEARCH_K_ANONYMITY", 5)),
+		Project:       c.Query("project"),
+		DateShiftDays: envInt("RESEARCH_DATE_SHIFT_DAYS", 180),
+	}
+	if _, ok := exportContentTypes[opts.Format]; !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "format must be csv or ndjson",
+		})
+	}
+	if opts.K < 2 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "k must be at least 2",
+		})
+	}
+	opts.MaxSuppression, err = strconv.ParseFloat(c.Query("max_suppression", "0.05"), 64)
+	if err != nil || opts.MaxSuppression < 0 || opts.MaxSuppression > 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "max_suppression must be between 0 and 1",
+		})
+	}
+
+	params, _ := json.Marshal(opts)
+	job := models.ExportJob{JobID: uuid.New(), Kind: "research", RequestedBy: &td.UserID, Format: opts.Format, Params: params, Status: "pending"}
+	err = database.DB.QueryRow(`
+		INSERT INTO export_jobs (job_id, kind, requested_by, format, params) VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`,
+		job.JobID, job.Kind, td.UserID, job.Format, string(params)).Scan(&job.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create research export " + err.Error(),
+		})
+	}
+
+	go runResearchExport(job.JobID, opts)
+
+	c.Location("/api/admin/exports/" + job.JobID.String())
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+func runResearchExport(jobID uuid.UUID, opts researchOptions) {
+	ctx := context.Background()
+	key := fmt.Sprintf("exports/research-%s.%s", jobID, opts.Format)
+
+	var report *deid.Report
+	err := func() error {
+		if _, err := database.DB.Exec("UPDATE export_jobs SET status = 'running' WHERE job_id = $1", jobID); err != nil {
+			return err
+		}
+		if len(researchPseudonymKey()) == 0 {
+			return errors.New("RESEARCH_PSEUDONYM_KEY is not set")
+		}
+		records, err := loadResearchRecords(ctx)
+		if err != nil {
+			return err
+		}
+		rows, quasi, subjects := deidentify(records, opts)
+		keep, r := deid.EnforceK(quasi, subjects, opts.K)
+		report = &r
+		if r.SuppressionRate() > opts.MaxSuppression {
+			return fmt.Errorf("k-anonymity with k=%d needs %d of %d records suppressed (%.1f%%), more than max_suppression allows",
+				opts.K, r.Suppressed, r.Records, 100*r.SuppressionRate())
+		}
+
+		tmp, err := os.CreateTemp("", "research-export-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		buffered := bufio.NewWriter(tmp)
+		if err := writeResearchRows(buffered, opts.Format, rows, keep); err != nil {
+			return err
+		}
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+		size, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := storage.Default().Put(ctx, key, tmp, size, exportContentTypes[opts.Format]); err != nil {
+			return err
+		}
+
+		// Record who was released, under which consent, with the job
+		included := map[uuid.UUID]*models.ResearchExportSubject{}
+		for i, rec := range records {
+			if !keep[i] {
+				continue
+			}
+			s, ok := included[rec.userID]
+			if !ok {
+				userID, consentID, pseudonym := rec.userID, rec.consentID, subjects[i]
+				s = &models.ResearchExportSubject{UserID: &userID, ConsentID: &consentID, Pseudonym: &pseudonym}
+				included[rec.userID] = s
+			}
+			s.Records++
+		}
+		tx, err := database.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, s := range included {
+			_, err := tx.Exec(`
+				INSERT INTO research_export_subjects (job_id, user_id, consent_id, pseudonym, records)
+				VALUES ($1, $2, $3, $4, $5)`,
+				jobID, s.UserID, s.ConsentID, s.Pseudonym, s.Records)
+			if err != nil {
+				return err
+			}
+		}
+		reportJSON, _ := json.Marshal(report)
+		_, err = tx.Exec(`
+			UPDATE export_jobs SET status = 'done', storage_key = $1, row_count = $2, report = $3, finished_at = NOW()
+			WHERE job_id = $4`, key, r.Records-r.Suppressed, string(reportJSON), jobID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+
+	if err != nil {
+		log.Println("Research export", jobID, "failed:", err)
+		var reportJSON *string
+		if report != nil {
+			b, _ := json.Marshal(report)
+			s := string(b)
+			reportJSON = &s
+		}
+		_, err = database.DB.Exec(`
+			UPDATE export_jobs SET status = 'failed', error = $1, report = $2, finished_at = NOW()
+			WHERE job_id = $3`, err.Error(), reportJSON, jobID)
+		if err != nil {
+			log.Println("Failed to update export job", jobID, err)
+		}
+	}
+}
+
+// GetResearchExportSubjects lists the users whose data a research export
+// contains, for answering consent and access requests.
+func GetResearchExportSubjects(c *fiber.Ctx) error {
+	job, err := exportJobParam(c)
+	if err != nil {
+		return err
+	}
+	if job.Kind != "research" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Research export not found",
+		})
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT user_id, consent_id, pseudonym, records FROM research_export_subjects
+		WHERE job_id = $1 ORDER BY pseudonym, user_id`, job.JobID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch research export subjects " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	subjects := []models.ResearchExportSubject{}
+	for rows.Next() {
+		var s models.ResearchExportSubject
+		if err := rows.Scan(&s.UserID, &s.ConsentID, &s.Pseudonym, &s.Records); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan research export subject " + err.Error(),
+			})
+		}
+		subjects = append(subjects, s)
+	}
+	return c.JSON(subjects)
+}
@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/middleware"
+	"chat-api/models"
+	"chat-api/scheduler"
+	"chat-api/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// retentionResource describes how to find and delete expired records of
+// one kind. The from table is always aliased r; ids are UUIDs.
+type retentionResource struct {
+	from  string
+	id    string
+	age   string
+	owner string // column of the owning user, "" when records have none
+	where string // extra condition, may use the cutoff as $1
+	// files returns the stored files of the given records, deleted once the
+	// rows are gone
+	files func(tx *sql.Tx, ids []uuid.UUID) ([]string, error)
+}
+
+func storageKeys(query string) func(tx *sql.Tx, ids []uuid.UUID) ([]string, error) {
+	return func(tx *sql.Tx, ids []uuid.UUID) ([]string, error) {
+		rows, err := tx.Query(query, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var keys []string
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		return keys, rows.Err()
+	}
+}
+
+var retentionResources = map[string]retentionResource{
+	"chats": {
+		from: "chats r", id: "r.chat_id", age: "r.updated_at", owner: "r.user_id",
+		files: storageKeys("SELECT storage_key FROM chat_attachments WHERE chat_id = ANY($1::uuid[])"),
+	},
+	"users": {
+		from: "users r", id: "r.user_id", age: "r.last_active_at", owner: "r.user_id",
+		// Admins are never purged, erased users are kept for their erasure
+		// record and a chat updated after the cutoff counts as activity
+		where: `r.role <> 'admin'
+			AND NOT EXISTS (SELECT 1 FROM erasure_requests er WHERE er.user_id = r.user_id)
+			AND NOT EXISTS (SELECT 1 FROM chats c WHERE c.user_id = r.user_id AND c.updated_at >= $1)`,
+		files: func(tx *sql.Tx, ids []uuid.UUID) ([]string, error) {
+			keys, err := storageKeys(`
+				SELECT a.storage_key FROM chat_attachments a JOIN chats c ON c.chat_id = a.chat_id
+				WHERE c.user_id = ANY($1::uuid[])
+				UNION ALL
+				SELECT storage_key FROM export_jobs WHERE subject_id = ANY($1::uuid[]) AND storage_key IS NOT NULL`)(tx, ids)
+			if err != nil {
+				return nil, err
+			}
+			rows, err := tx.Query(`
+				SELECT user_id, avatar_version FROM users
+				WHERE user_id = ANY($1::uuid[]) AND avatar_version IS NOT NULL`, pq.Array(ids))
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var userID, version uuid.UUID
+				if err := rows.Scan(&userID, &version); err != nil {
+					return nil, err
+				}
+				for _, size := range avatarSizes {
+					keys = append(keys, avatarKey(userID, version, size))
+				}
+			}
+			return keys, rows.Err()
+		},
+	},
+	"notifications": {
+		from: "user_notifications r", id: "r.notification_id", age: "r.created_at", owner: "r.user_id",
+	},
+	"export_jobs": {
+		from: "export_jobs r", id: "r.job_id", age: "r.created_at", owner: "r.requested_by",
+		where: "r.status IN ('done', 'failed')",
+		files: storageKeys("SELECT storage_key FROM export_jobs WHERE job_id = ANY($1::uuid[]) AND storage_key IS NOT NULL"),
+	},
+	"import_jobs": {
+		from: "import_jobs r", id: "r.job_id", age: "r.created_at", owner: "r.requested_by",
+		where: "r.status IN ('done', 'failed')",
+		files: storageKeys("SELECT error_key FROM import_jobs WHERE job_id = ANY($1::uuid[]) AND error_key IS NOT NULL"),
+	},
+	"hl7_dead_letters": {
+		from: "hl7_dead_letters r", id: "r.dead_letter_id", age: "r.received_at",
+	},
+	"login_attempts": {
+		from: "login_attempts r", id: "r.attempt_id", age: "r.created_at",
+	},
+	"sessions": {
+		from: "sessions r", id: "r.session_id", age: "r.created_at", owner: "r.user_id",
+		where: "(r.revoked_at IS NOT NULL OR r.expires_at < NOW())",
+	},
+}
+
+const (
+	retentionBatchSize  = 500
+	retentionSampleSize = 20
+)
+
+// matchRetention returns the IDs of the records the policy would delete.
+func matchRetention(ctx context.Context, res retentionResource, policy *models.RetentionPolicy, cutoff time.Time) ([]uuid.UUID, error) {
+	query := "SELECT " + res.id + " FROM " + res.from
+	args := []interface{}{cutoff}
+	if policy.Role != nil {
+		query += " JOIN users o ON o.user_id = " + res.owner
+	}
+	query += " WHERE " + res.age + " < $1"
+	if policy.Role != nil {
+		query += " AND o.role = $2"
+		args = append(args, *policy.Role)
+	}
+	if res.where != "" {
+		query += " AND " + res.where
+	}
+
+	rows, err := database.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// purgeRetentionBatch deletes one batch of records and then their files.
+func purgeRetentionBatch(ctx context.Context, res retentionResource, ids []uuid.UUID) (int, error) {
+	tx, err := database.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var keys []string
+	if res.files != nil {
+		if keys, err = res.files(tx, ids); err != nil {
+			return 0, err
+		}
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM "+res.from+" WHERE "+res.id+" = ANY($1::uuid[])", pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		if err := storage.Default().Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Println("Failed to delete stored file during retention purge", key, err)
+		}
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
+// runRetentionPolicy applies one policy, or only counts what it would delete
+// when dryRun is set, and records the run.
+func runRetentionPolicy(ctx context.Context, policy *models.RetentionPolicy, dryRun bool, triggeredBy *uuid.UUID) (models.RetentionRun, error) {
+	run := models.RetentionRun{
+		RunID: uuid.New(), PolicyID: policy.PolicyID, Resource: policy.Resource, Role: policy.Role,
+		MaxAgeDays: policy.MaxAgeDays, DryRun: dryRun, TriggeredBy: triggeredBy, StartedAt: time.Now(),
+	}
+	run.Cutoff = run.StartedAt.AddDate(0, 0, -policy.MaxAgeDays)
+
+	var runErr error
+	res, ok := retentionResources[policy.Resource]
+	if !ok {
+		runErr = fmt.Errorf("unknown resource %s", policy.Resource)
+	}
+	var ids []uuid.UUID
+	if runErr == nil {
+		ids, runErr = matchRetention(ctx, res, policy, run.Cutoff)
+		run.Matched = len(ids)
+	}
+	if runErr == nil && dryRun {
+		run.Sample = ids
+		if len(ids) > retentionSampleSize {
+			run.Sample = ids[:retentionSampleSize]
+		}
+	}
+	for start := 0; runErr == nil && !dryRun && start < len(ids); start += retentionBatchSize {
+		end := start + retentionBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var n int
+		n, runErr = purgeRetentionBatch(ctx, res, ids[start:end])
+		run.Deleted += n
+	}
+	if runErr != nil {
+		msg := runErr.Error()
+		run.Error = &msg
+	}
+	run.FinishedAt = time.Now()
+
+	_, err := database.DB.Exec(`
+		INSERT INTO retention_runs (run_id, policy_id, resource, role, max_age_days, cutoff, dry_run, triggered_by,
+		                            matched, deleted, error, started_at, finished_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		run.RunID, run.PolicyID, run.Resource, run.Role, run.MaxAgeDays, run.Cutoff, run.DryRun, run.TriggeredBy,
+		run.Matched, run.Deleted, run.Error, run.StartedAt, run.FinishedAt)
+	if err != nil {
+		log.Println("Failed to record retention run", run.RunID, err)
+	}
+	return run, runErr
+}
+
+const retentionPolicyColumns = `policy_id, resource, role, max_age_days, enabled, description, created_by, created_at, updated_at`
+
+func scanRetentionPolicy(row rowScanner, p *models.RetentionPolicy) error {
+	return row.Scan(&p.PolicyID, &p.Resource, &p.Role, &p.MaxAgeDays, &p.Enabled, &p.Description,
+		&p.CreatedBy, &p.CreatedAt, &p.UpdatedAt)
+}
+
+// RetentionJob is the scheduler job name of RunRetentionPolicies. Manual
+// runs take the same advisory lock, so they never overlap a scheduled one.
+const RetentionJob = "retention"
+
+// RunRetentionPolicies applies every enabled policy. It is run by the
+// scheduler.
+func RunRetentionPolicies(ctx context.Context) error {
+	rows, err := database.DB.QueryContext(ctx, `
+		SELECT `+retentionPolicyColumns+` FROM retention_policies WHERE enabled ORDER BY created_at`)
+	if err != nil {
+		return err
+	}
+	var policies []models.RetentionPolicy
+	for rows.Next() {
+		var p models.RetentionPolicy
+		if err := scanRetentionPolicy(rows, &p); err != nil {
+			rows.Close()
+			return err
+		}
+		policies = append(policies, p)
+	}
+	rows.Close()
+
+	var errs []error
+	for i := range policies {
+		run, err := runRetentionPolicy(ctx, &policies[i], false, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy %s: %w", policies[i].PolicyID, err))
+		} else if run.Deleted > 0 {
+			log.Printf("Retention policy %s deleted %d %s", run.PolicyID, run.Deleted, run.Resource)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PurgeExpiredDataExports deletes the ZIPs of personal data exports past
+// their expiry. The job row stays as a record that the export happened.
+func PurgeExpiredDataExports(ctx context.Context) error {
+	rows, err := database.DB.QueryContext(ctx, `
+		SELECT job_id, storage_key FROM export_jobs
+		WHERE kind = 'user_data' AND expires_at < NOW() AND storage_key IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	type expired struct {
+		jobID uuid.UUID
+		key   string
+	}
+	var jobs []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.jobID, &e.key); err != nil {
+			rows.Close()
+			return err
+		}
+		jobs = append(jobs, e)
+	}
+	rows.Close()
+
+	for _, e := range jobs {
+		if err := storage.Default().Delete(ctx, e.key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		if _, err := database.DB.ExecContext(ctx, "UPDATE export_jobs SET storage_key = NULL WHERE job_id = $1", e.jobID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportJobTimeout is how long an export may stay pending or running. Exports
+// run in a goroutine of the instance that accepted them, so one still
+// unfinished after this was lost to a restart or crash.
+const exportJobTimeout = 6 * time.Hour
+
+// FailStaleExports marks lost exports failed, so they stop blocking new
+// personal data exports and show up as failed instead of in progress.
+func FailStaleExports(ctx context.Context) error {
+	res, err := database.DB.ExecContext(ctx, `
+		UPDATE export_jobs SET status = 'failed', error = 'Export was interrupted, please start it again', finished_at = NOW()
+		WHERE status IN ('pending', 'running') AND created_at < $1`,
+		time.Now().Add(-exportJobTimeout))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Marked %d interrupted exports failed", n)
+	}
+	return nil
+}
+
+// validateRetentionPolicy checks the input and fills defaults.
+func validateRetentionPolicy(input *models.RetentionPolicyInput) error {
+	res, ok := retentionResources[input.Resource]
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest,
+			"resource must be one of chats, users, notifications, export_jobs, import_jobs, hl7_dead_letters, login_attempts, sessions")
+	}
+	if input.Role != nil && *input.Role == "" {
+		input.Role = nil
+	}
+	if input.Role != nil {
+		if !validRoles[*input.Role] {
+			return fiber.NewError(fiber.StatusBadRequest, "role must be one of user, clinician, admin")
+		}
+		if res.owner == "" {
+			return fiber.NewError(fiber.StatusBadRequest, input.Resource+" have no owner, role must be empty")
+		}
+	}
+	if input.MaxAgeDays <= 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "max_age_days must be positive")
+	}
+	return nil
+}
+
+func GetRetentionPolicies(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+
+	rows, err := database.DB.Query(`SELECT ` + retentionPolicyColumns + ` FROM retention_policies ORDER BY created_at`)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch retention policies " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	policies := []models.RetentionPolicy{}
+	for rows.Next() {
+		var p models.RetentionPolicy
+		if err := scanRetentionPolicy(rows, &p); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan retention policy " + err.Error(),
+			})
+		}
+		policies = append(policies, p)
+	}
+	return c.JSON(policies)
+}
+
+func CreateRetentionPolicy(c *fiber.Ctx) error {
+	td, err := adminOnly(c)
+	if err != nil {
+		return err
+	}
+	var input models.RetentionPolicyInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if err := validateRetentionPolicy(&input); err != nil {
+		return err
+	}
+	enabled := input.Enabled == nil || *input.Enabled
+
+	var policy models.RetentionPolicy
+	err = scanRetentionPolicy(database.DB.QueryRow(`
+		INSERT INTO retention_policies (policy_id, resource, role, max_age_days, enabled, description, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+retentionPolicyColumns,
+		uuid.New(), input.Resource, input.Role, input.MaxAgeDays, enabled, input.Description, td.UserID), &policy)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create retention policy " + err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(policy)
+}
+
+func retentionPolicyParam(c *fiber.Ctx) (*middleware.TokenDetails, uuid.UUID, error) {
+	td, err := adminOnly(c)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	policyID, err := uuid.Parse(c.Params("policyId"))
+	if err != nil {
+		return nil, uuid.Nil, fiber.NewError(fiber.StatusBadRequest, "Invalid policy ID")
+	}
+	return td, policyID, nil
+}
+
+func UpdateRetentionPolicy(c *fiber.Ctx) error {
+	_, policyID, err := retentionPolicyParam(c)
+	if err != nil {
+		return err
+	}
+	var input models.RetentionPolicyInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+		})
+	}
+	if err := validateRetentionPolicy(&input); err != nil {
+		return err
+	}
+	enabled := input.Enabled == nil || *input.Enabled
+
+	var policy models.RetentionPolicy
+	err = scanRetentionPolicy(database.DB.QueryRow(`
+		UPDATE retention_policies SET resource = $1, role = $2, max_age_days = $3, enabled = $4, description = $5,
+		       updated_at = NOW()
+		WHERE policy_id = $6 RETURNING `+retentionPolicyColumns,
+		input.Resource, input.Role, input.MaxAgeDays, enabled, input.Description, policyID), &policy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Retention policy not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update retention policy " + err.Error(),
+		})
+	}
+	return c.JSON(policy)
+}
+
+func DeleteRetentionPolicy(c *fiber.Ctx) error {
+	_, policyID, err := retentionPolicyParam(c)
+	if err != nil {
+		return err
+	}
+	result, err := database.DB.Exec("DELETE FROM retention_policies WHERE policy_id = $1", policyID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete retention policy",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Retention policy not found",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Retention policy deleted successfully",
+	})
+}
+
+// RunRetentionPolicy applies a policy now, enabled or not. With
+// dry_run=true it only reports how many records match and a sample of them.
+func RunRetentionPolicy(c *fiber.Ctx) error {
+	td, policyID, err := retentionPolicyParam(c)
+	if err != nil {
+		return err
+	}
+
+	var policy models.RetentionPolicy
+	err = scanRetentionPolicy(database.DB.QueryRow(`
+		SELECT `+retentionPolicyColumns+` FROM retention_policies WHERE policy_id = $1`, policyID), &policy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Retention policy not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch retention policy",
+		})
+	}
+
+	dryRun := c.QueryBool("dry_run")
+	var run models.RetentionRun
+	ran, err := scheduler.New(database.DB).RunOnce(c.Context(), scheduler.Job{
+		Name: RetentionJob,
+		Run: func(ctx context.Context) (err error) {
+			run, err = runRetentionPolicy(ctx, &policy, dryRun, &td.UserID)
+			return err
+		},
+	})
+	if !ran {
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to start retention run",
+			})
+		}
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A retention run is already in progress, try again later",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(run)
+	}
+	return c.JSON(run)
+}
+
+// GetRetentionRuns returns the purge audit, newest first.
+func GetRetentionRuns(c *fiber.Ctx) error {
+	if _, err := adminOnly(c); err != nil {
+		return err
+	}
+
+	query := `
+		SELECT run_id, policy_id, resource, role, max_age_days, cutoff, dry_run, triggered_by, matched, deleted,
+		       error, started_at, finished_at
+		FROM retention_runs`
+	args := []interface{}{}
+	if v := c.Query("policy_id"); v != "" {
+		policyID, err := uuid.Parse(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid policy_id",
+			})
+		}
+		query += ` WHERE policy_id = $1`
+		args = append(args, policyID)
+	}
+	rows, err := database.DB.Query(query+` ORDER BY started_at DESC LIMIT 200`, args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch retention runs " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	runs := []models.RetentionRun{}
+	for rows.Next() {
+		var r models.RetentionRun
+		err := rows.Scan(&r.RunID, &r.PolicyID, &r.Resource, &r.Role, &r.MaxAgeDays, &r.Cutoff, &r.DryRun,
+			&r.TriggeredBy, &r.Matched, &r.Deleted, &r.Error, &r.StartedAt, &r.FinishedAt)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan retention run " + err.Error(),
+			})
+		}
+		runs = append(runs, r)
+	}
+	return c.JSON(runs)
+}
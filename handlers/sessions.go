@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/middleware"
+	"chat-api/models"
+	"database/sql"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// last_seen_at is written at most this often per session, not on
+	// every request
+	sessionTouchInterval = "1 minute"
+	maxUserAgentLength   = 512
+)
+
+// issueSessionToken records a new session for the user and returns a JWT
+// bound to it.
+func issueSessionToken(c *fiber.Ctx, userID uuid.UUID, email, role, method string) (*middleware.TokenDetails, error) {
+	sessionID := uuid.New()
+	td, err := middleware.GenerateSessionJWTToken(sessionID, userID, email, role)
+	if err != nil {
+		return nil, err
+	}
+	var userAgent *string
+	if ua := c.Get(fiber.HeaderUserAgent); ua != "" {
+		if len(ua) > maxUserAgentLength {
+			ua = ua[:maxUserAgentLength]
+		}
+		userAgent = &ua
+	}
+	_, err = database.DB.Exec(`
+		INSERT INTO sessions (session_id, user_id, method, user_agent, ip, last_ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $5, to_timestamp($6))`,
+		sessionID, userID, method, userAgent, c.IP(), *td.ExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	return td, nil
+}
+
+// touchSession reports whether the session is still open and records
+// that it was just used, from ip.
+func touchSession(sessionID, userID uuid.UUID, ip string) (bool, error) {
+	var active, stale bool
+	err := database.DB.QueryRow(`
+		SELECT revoked_at IS NULL AND expires_at > NOW(), last_seen_at < NOW() - $3::interval
+		FROM sessions WHERE session_id = $1 AND user_id = $2`, sessionID, userID, sessionTouchInterval).Scan(&active, &stale)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil || !active {
+		return false, err
+	}
+	if stale {
+		_, err = database.DB.Exec("UPDATE sessions SET last_seen_at = NOW(), last_ip = $2 WHERE session_id = $1", sessionID, ip)
+	}
+	return true, err
+}
+
+// revokeUserSessions ends every open session of the user, e.g. with a
+// password reset.
+func revokeUserSessions(tx *sql.Tx, userID uuid.UUID, by *uuid.UUID) error {
+	_, err := tx.Exec(`
+		UPDATE sessions SET revoked_at = NOW(), revoked_by = $2
+		WHERE user_id = $1 AND revoked_at IS NULL`, userID, by)
+	return err
+}
+
+// listSessions answers with the user's open sessions, or with all=true
+// also the ended ones as sign-in history.
+func listSessions(c *fiber.Ctx, userID, current uuid.UUID) error {
+	query := `
+		SELECT session_id, user_id, method, user_agent, ip, last_ip, created_at, last_seen_at, expires_at, revoked_at, revoked_by
+		FROM sessions WHERE user_id = $1`
+	if !c.QueryBool("all") {
+		query += " AND revoked_at IS NULL AND expires_at > NOW()"
+	}
+	rows, err := database.DB.Query(query+" ORDER BY created_at DESC LIMIT 100", userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch sessions " + err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		err := rows.Scan(&s.SessionID, &s.UserID, &s.Method, &s.UserAgent, &s.IP, &s.LastIP,
+			&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.RevokedAt, &s.RevokedBy)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan session " + err.Error(),
+			})
+		}
+		s.Current = s.SessionID == current
+		sessions = append(sessions, s)
+	}
+	return c.JSON(sessions)
+}
+
+func revokeSession(c *fiber.Ctx, userID uuid.UUID, by uuid.UUID) error {
+	sessionID, err := uuid.Parse(c.Params("sessionId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid session ID",
+		})
+	}
+	result, err := database.DB.Exec(`
+		UPDATE sessions SET revoked_at = NOW(), revoked_by = $3
+		WHERE session_id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()`,
+		sessionID, userID, by)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session " + err.Error(),
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Session not found or already ended",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Session revoked successfully",
+	})
+}
+
+// revokeSessionsExcept ends the user's open sessions other than keep.
+func revokeSessionsExcept(c *fiber.Ctx, userID, keep, by uuid.UUID) error {
+	result, err := database.DB.Exec(`
+		UPDATE sessions SET revoked_at = NOW(), revoked_by = $3
+		WHERE user_id = $1 AND session_id <> $2 AND revoked_at IS NULL AND expires_at > NOW()`,
+		userID, keep, by)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions " + err.Error(),
+		})
+	}
+	n, _ := result.RowsAffected()
+	return c.JSON(fiber.Map{
+		"message": "Sessions revoked successfully",
+		"revoked": n,
+	})
+}
+
+// GetMySessions lists where the caller is signed in.
+func GetMySessions(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+	return listSessions(c, td.UserID, td.SessionID)
+}
+
+// RevokeMySession signs one of the caller's sessions out, the current one
+// included.
+func RevokeMySession(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+	return revokeSession(c, td.UserID, td.UserID)
+}
+
+// RevokeMyOtherSessions signs the caller out everywhere but here.
+func RevokeMyOtherSessions(c *fiber.Ctx) error {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return err
+	}
+	return revokeSessionsExcept(c, td.UserID, td.SessionID, td.UserID)
+}
+
+func GetUserSessions(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	return listSessions(c, userID, td.SessionID)
+}
+
+func RevokeUserSession(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	return revokeSession(c, userID, td.UserID)
+}
+
+// RevokeUserSessions signs the user out everywhere, e.g. when an admin
+// suspects the account is compromised.
+func RevokeUserSessions(c *fiber.Ctx) error {
+	td, userID, err := selfOrAdmin(c)
+	if err != nil {
+		return err
+	}
+	return revokeSessionsExcept(c, userID, uuid.Nil, td.UserID)
+}
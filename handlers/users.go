@@ -7,12 +7,16 @@ import (
 	"chat-api/utils"
 	"database/sql"
 	"fmt"
+	"log"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
+var validRoles = map[string]bool{"user": true, "clinician": true, "admin": true}
+
 func GetUsers(c *fiber.Ctx) error {
 	rows, err := database.DB.Query(`
 		SELECT user_id, email, name, age, height, weight, gender, 
@@ -88,7 +92,13 @@ func CreateUser(c *fiber.Ctx) error {
 			"error": "Invalid updateData json",
 		})
 	}
-	if insertData.Role != "admin" {
+	// New users have no avatar; images go through UploadAvatar once they exist
+	if insertData.ProfileImageUrl != nil && *insertData.ProfileImageUrl != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Use POST /api/users/:id/avatar to set the profile image",
+		})
+	}
+	if !validRoles[insertData.Role] {
 		insertData.Role = "user"
 	}
 	hashedPassword, hashErr := utils.HashPassword(insertData.Password)
@@ -101,18 +111,21 @@ func CreateUser(c *fiber.Ctx) error {
 	var userID uuid.UUID
 	err := database.DB.QueryRow(
 		`INSERT INTO users
-		(email, password, role, name, age, height, weight, gender, physical_condition, medical_history, profile_image_url)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		(email, password, role, name, age, height, weight, gender, physical_condition, medical_history)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 		RETURNING user_id`,
 		insertData.Email, hashedPassword, insertData.Role, insertData.Name,
 		insertData.Age, insertData.Height, insertData.Weight, insertData.Gender,
-		insertData.PhysicalCondition, insertData.MedicalHistory, insertData.ProfileImageUrl).Scan(&userID)
+		insertData.PhysicalCondition, insertData.MedicalHistory).Scan(&userID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create user " + err.Error(),
 		})
 	}
-	token, err := middleware.GenerateJWTToken(userID, insertData.Email, insertData.Role)
+	if err := sendVerificationEmail(c.Context(), publicBaseURL(), userID, insertData.Email); err != nil {
+		log.Println("Failed to send verification email to", userID, err)
+	}
+	token, err := issueSessionToken(c, userID, insertData.Email, insertData.Role, "created")
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
@@ -158,6 +171,17 @@ func UpdateUser(c *fiber.Ctx) error {
 			"error": "Invalid updateData json",
 		})
 	}
+	// profile_image_url may only be cleared here; images go through UploadAvatar
+	if updateData.ProfileImageUrl != nil && *updateData.ProfileImageUrl != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Use POST /api/users/:id/avatar to set the profile image",
+		})
+	}
+	if updateData.Role != "" && !validRoles[updateData.Role] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be one of user, clinician, admin",
+		})
+	}
 
 	// Build dynamic query
 	query, args, argCount, err := utils.BuildUsersUpdateDynamicArray(&updateData, role)
@@ -177,6 +201,17 @@ func UpdateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	if updateData.Email != "" {
+		var verified bool
+		err := database.DB.QueryRow("SELECT email_verified FROM users WHERE user_id = $1", paramID).Scan(&verified)
+		if err == nil && !verified {
+			err = sendVerificationEmail(c.Context(), publicBaseURL(), paramID, updateData.Email)
+		}
+		if err != nil {
+			log.Println("Failed to send verification email to", paramID, err)
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"message": "User updated successfully",
 	})
@@ -199,8 +234,27 @@ func DeleteUser(c *fiber.Ctx) error {
 		})
 	}
 
-	_, err = database.DB.Exec("DELETE FROM users WHERE user_id = $1", paramID)
+	// Deleting goes through erasure, so the user's chats stay for statistics
+	// without identifying them and the erasure log records who deleted them
+	var erasedAt *time.Time
+	err = database.DB.QueryRow("SELECT erased_at FROM users WHERE user_id = $1", paramID).Scan(&erasedAt)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch user",
+		})
+	}
+	if erasedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User has already been erased",
+		})
+	}
+	if err := eraseNow(c.Context(), paramID, td.UserID, "Deleted by an admin"); err != nil {
+		log.Println("Failed to delete user", paramID, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to delete user",
 		})
@@ -209,3 +263,32 @@ func DeleteUser(c *fiber.Ctx) error {
 		"message": "User deleted successfully",
 	})
 }
+
+// selfOrAdmin parses the :id param and checks the caller is that user or an
+// admin, the same rule UpdateUser applies.
+func selfOrAdmin(c *fiber.Ctx) (*middleware.TokenDetails, uuid.UUID, error) {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	paramID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, uuid.Nil, fiber.NewError(fiber.StatusBadRequest, "Invalid user ID")
+	}
+	if td.Role != "admin" && td.UserID != paramID {
+		return nil, uuid.Nil, fiber.NewError(fiber.StatusForbidden, "You can only access your own records")
+	}
+	return td, paramID, nil
+}
+
+// adminOnly checks the caller is an admin.
+func adminOnly(c *fiber.Ctx) (*middleware.TokenDetails, error) {
+	td, err := middleware.DecodeJWTToken(c)
+	if err != nil {
+		return nil, err
+	}
+	if td.Role != "admin" {
+		return nil, fiber.NewError(fiber.StatusForbidden, "Only admins can access this resource")
+	}
+	return td, nil
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"chat-api/database"
+	"chat-api/mail"
+	"chat-api/utils"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	// A new verification email is not sent sooner than this after the last
+	emailVerificationResendDelay = time.Minute
+
+	emailVerificationPurpose = "email-verification"
+)
+
+// unverifiedAccess reads UNVERIFIED_EMAIL_ACCESS, what accounts with an
+// unconfirmed email may do: "full", "read_only" (the default, GET requests
+// only) or "none" (cannot sign in at all).
+func unverifiedAccess() string {
+	switch v := os.Getenv("UNVERIFIED_EMAIL_ACCESS"); v {
+	case "full", "none":
+		return v
+	}
+	return "read_only"
+}
+
+// publicBaseURL is where links in emails and stored or exported URLs point:
+// APP_BASE_URL, which is required, see CheckConfig. Request headers are never
+// used, a forged Host would send the links, and the tokens in them, elsewhere.
+func publicBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/")
+}
+
+// checkBaseURL requires APP_BASE_URL to be an absolute http(s) URL.
+func checkBaseURL() error {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		return errors.New("APP_BASE_URL is required")
+	}
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("APP_BASE_URL must be an absolute http(s) URL, not %q", base)
+	}
+	return nil
+}
+
+// sendVerificationEmail records a verification for the address and mails
+// the link.
+func sendVerificationEmail(ctx context.Context, baseURL string, userID uuid.UUID, email string) error {
+	verificationID := uuid.New()
+	_, err := database.DB.Exec(`
+		INSERT INTO email_verifications (verification_id, user_id, email, expires_at) VALUES ($1, $2, $3, $4)`,
+		verificationID, userID, email, time.Now().Add(emailVerificationTTL))
+	if err != nil {
+		return err
+	}
+
+	token := utils.SignToken(emailVerificationPurpose, emailVerificationTTL, verificationID.String())
+	link := baseURL + "/auth/verify?token=" + url.QueryEscape(token)
+	return mail.Default().Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Text: fmt.Sprintf("Please confirm that %s is your email address by opening this link:\n\n%s\n\n"+
+			"The link is valid for %d hours. If you did not sign up, ignore this email.",
+			email, link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+// VerifyEmail confirms the address a verification link was sent to. Each
+// link works once, and not at all once the account's email has changed.
+func VerifyEmail(c *fiber.Ctx) error {
+	fields, err := utils.VerifyToken(emailVerificationPurpose, c.Query("token"))
+	if err == utils.ErrTokenExpired {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Verification link has expired, request a new one",
+		})
+	}
+	var verificationID uuid.UUID
+	if err == nil && len(fields) == 1 {
+		verificationID, err = uuid.Parse(fields[0])
+	}
+	if err != nil || len(fields) != 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid verification link",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	var usedAt *time.Time
+	var sentTo, currentEmail string
+	err = tx.QueryRow(`
+		SELECT v.user_id, v.email, v.used_at, u.email
+		FROM email_verifications v JOIN users u ON u.user_id = v.user_id
+		WHERE v.verification_id = $1 FOR UPDATE OF v`, verificationID).Scan(&userID, &sentTo, &usedAt, &currentEmail)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid verification link",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch verification",
+		})
+	}
+	if usedAt != nil {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Verification link has already been used",
+		})
+	}
+	if !strings.EqualFold(sentTo, currentEmail) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "The account's email address has changed since this link was sent",
+		})
+	}
+
+	// Using one link retires every other outstanding link of the user
+	_, err = tx.Exec(`
+		UPDATE email_verifications SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE users SET email_verified = TRUE WHERE user_id = $1", userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify email " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Email verified successfully",
+	})
+}
+
+// ResendVerification mails a new link. It answers the same whether or not
+// the address belongs to an unverified account, so it cannot be used to
+// find out who has one.
+func ResendVerification(c *fiber.Ctx) error {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&input); err != nil || input.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "email is required",
+		})
+	}
+
+	var userID uuid.UUID
+	var email string
+	err := database.DB.QueryRow(`
+		SELECT u.user_id, u.email FROM users u
+		WHERE lower(u.email) = lower($1) AND NOT u.email_verified
+		  AND NOT EXISTS (SELECT 1 FROM email_verifications v
+		                  WHERE v.user_id = u.user_id AND v.created_at > $2)`,
+		strings.TrimSpace(input.Email), time.Now().Add(-emailVerificationResendDelay)).Scan(&userID, &email)
+	if err == nil {
+		if err := sendVerificationEmail(c.Context(), publicBaseURL(), userID, email); err != nil {
+			log.Println("Failed to send verification email to", userID, err)
+		}
+	} else if err != sql.ErrNoRows {
+		log.Println("Failed to look up account for verification", err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If the address belongs to an unverified account, a new verification email is on its way",
+	})
+}
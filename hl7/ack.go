@@ -0,0 +1,42 @@
+package hl7
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Acknowledgment codes for MSA-1
+const (
+	AckAccept = "AA" // processed
+	AckError  = "AE" // valid message, processing failed
+	AckReject = "AR" // message rejected, e.g. unparseable
+)
+
+// ACK builds an acknowledgment for msg. msg may be nil when the message
+// could not be parsed, in which case the sender fields are left empty.
+func ACK(msg *Message, code, text string) string {
+	sendApp, sendFac, recvApp, recvFac, trigger, controlID, version := "", "", "", "", "", "", "2.5"
+	if msg != nil {
+		sendApp, sendFac = msg.Field("MSH", 5), msg.Field("MSH", 6)
+		recvApp, recvFac = msg.Field("MSH", 3), msg.Field("MSH", 4)
+		trigger = msg.Component(msg.Field("MSH", 9), 2)
+		controlID = msg.ControlID()
+		if v := msg.Field("MSH", 12); v != "" {
+			version = v
+		}
+	}
+
+	messageType := "ACK"
+	if trigger != "" {
+		messageType = "ACK^" + trigger + "^ACK"
+	}
+	escapeText := strings.NewReplacer(`\`, `\E\`, "|", `\F\`, "^", `\S\`, "&", `\T\`, "~", `\R\`, "\r", " ", "\n", " ")
+	msh := strings.Join([]string{
+		"MSH", `^~\&`, sendApp, sendFac, recvApp, recvFac, FormatTime(time.Now()), "",
+		messageType, strings.ReplaceAll(uuid.NewString(), "-", "")[:20], "P", version,
+	}, "|")
+	msa := strings.Join([]string{"MSA", code, controlID, escapeText.Replace(text)}, "|")
+	return msh + "\r" + msa + "\r"
+}
@@ -0,0 +1,193 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is a parsed HL7 v2 message. Fields are addressed the way HL7
+// documents them: Field("PID", 5) is PID-5, and for MSH the field
+// separator itself counts as MSH-1.
+type Message struct {
+	Raw      string
+	Segments []Segment
+
+	fieldSep     byte
+	componentSep byte
+	repeatSep    byte
+	escape       byte
+	subSep       byte
+}
+
+type Segment struct {
+	Name   string
+	Fields []string // Fields[0] is the segment name
+}
+
+// Parse splits a message into segments and fields. Segments may be
+// separated by CR, LF or CRLF.
+func Parse(raw string) (*Message, error) {
+	raw = strings.TrimSpace(strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\r"), "\n", "\r"))
+	if !strings.HasPrefix(raw, "MSH") || len(raw) < 8 {
+		return nil, fmt.Errorf("message must start with an MSH segment")
+	}
+
+	m := &Message{
+		Raw:          raw,
+		fieldSep:     raw[3],
+		componentSep: raw[4],
+		repeatSep:    raw[5],
+		escape:       raw[6],
+		subSep:       raw[7],
+	}
+	for _, line := range strings.Split(raw, "\r") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, string(m.fieldSep))
+		if len(fields[0]) != 3 {
+			return nil, fmt.Errorf("invalid segment %q", line)
+		}
+		if fields[0] == "MSH" {
+			// Re-insert the field separator as MSH-1 so indexes match the spec
+			fields = append([]string{"MSH", string(m.fieldSep)}, fields[1:]...)
+		}
+		m.Segments = append(m.Segments, Segment{Name: fields[0], Fields: fields})
+	}
+
+	if m.MessageType() == "" {
+		return nil, fmt.Errorf("MSH-9 message type is missing")
+	}
+	if m.ControlID() == "" {
+		return nil, fmt.Errorf("MSH-10 message control id is missing")
+	}
+	return m, nil
+}
+
+// Segment returns the first segment with the given name.
+func (m *Message) Segment(name string) (Segment, bool) {
+	for _, s := range m.Segments {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Segment{}, false
+}
+
+// All returns every segment with the given name, in order.
+func (m *Message) All(name string) []Segment {
+	var out []Segment
+	for _, s := range m.Segments {
+		if s.Name == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Field returns the raw value of field n of the first named segment.
+func (m *Message) Field(segment string, n int) string {
+	s, ok := m.Segment(segment)
+	if !ok {
+		return ""
+	}
+	return s.Field(n)
+}
+
+func (s Segment) Field(n int) string {
+	if n < len(s.Fields) {
+		return s.Fields[n]
+	}
+	return ""
+}
+
+// Component returns component c (1-based) of the first repetition of a
+// field, with escape sequences decoded.
+func (m *Message) Component(field string, c int) string {
+	return m.Unescape(m.component(field, c))
+}
+
+// Subcomponent returns subcomponent s of component c, both 1-based.
+func (m *Message) Subcomponent(field string, c, s int) string {
+	parts := strings.Split(m.component(field, c), string(m.subSep))
+	if s < 1 || s > len(parts) {
+		return ""
+	}
+	return m.Unescape(parts[s-1])
+}
+
+func (m *Message) component(field string, c int) string {
+	if i := strings.IndexByte(field, m.repeatSep); i >= 0 {
+		field = field[:i]
+	}
+	parts := strings.Split(field, string(m.componentSep))
+	if c < 1 || c > len(parts) {
+		return ""
+	}
+	return parts[c-1]
+}
+
+// Repetitions splits a field on the repetition separator.
+func (m *Message) Repetitions(field string) []string {
+	if field == "" {
+		return nil
+	}
+	return strings.Split(field, string(m.repeatSep))
+}
+
+// Unescape decodes the standard \F\ \S\ \T\ \R\ \E\ escape sequences.
+func (m *Message) Unescape(s string) string {
+	esc := string(m.escape)
+	if !strings.Contains(s, esc) {
+		return s
+	}
+	return strings.NewReplacer(
+		esc+"F"+esc, string(m.fieldSep),
+		esc+"S"+esc, string(m.componentSep),
+		esc+"T"+esc, string(m.subSep),
+		esc+"R"+esc, string(m.repeatSep),
+		esc+"E"+esc, esc,
+		esc+".br"+esc, "\n",
+	).Replace(s)
+}
+
+// MessageType returns MSH-9 as "ADT^A04".
+func (m *Message) MessageType() string {
+	msh9 := m.Field("MSH", 9)
+	code, trigger := m.Component(msh9, 1), m.Component(msh9, 2)
+	if trigger == "" {
+		return code
+	}
+	return code + "^" + trigger
+}
+
+func (m *Message) ControlID() string {
+	return m.Field("MSH", 10)
+}
+
+// ParseTime parses an HL7 DTM value (YYYY[MM[DD[HH[MM[SS[.S+]]]]]][+/-ZZZZ]).
+// Values without an offset are taken as local time.
+func ParseTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	zone := ""
+	if i := strings.IndexAny(v, "+-"); i >= 0 {
+		v, zone = v[:i], v[i:]
+	}
+	if i := strings.IndexByte(v, '.'); i >= 0 {
+		v = v[:i]
+	}
+	layouts := map[int]string{4: "2006", 6: "200601", 8: "20060102", 10: "2006010215", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(v)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid HL7 time %q", v)
+	}
+	if zone != "" {
+		return time.Parse(layout+"-0700", v+zone)
+	}
+	return time.ParseInLocation(layout, v, time.Local)
+}
+
+func FormatTime(t time.Time) string {
+	return t.Format("20060102150405-0700")
+}
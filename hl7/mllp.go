@@ -0,0 +1,235 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// MLLP frames every message as <VT> message <FS><CR>
+const (
+	startBlock = 0x0b
+	endBlock   = 0x1c
+	carriage   = 0x0d
+
+	maxMessageBytes = 1 << 20
+
+	defaultReadTimeout = 30 * time.Second
+)
+
+// Handler processes one parsed message. A returned error is sent back to the
+// sender as an AE acknowledgment.
+type Handler func(ctx context.Context, msg *Message) error
+
+// DeadLetterFunc records a message that could not be parsed or processed.
+// msg is nil when parsing failed.
+type DeadLetterFunc func(remoteAddr, raw string, msg *Message, err error)
+
+// Server accepts MLLP connections and acknowledges every message it reads.
+type Server struct {
+	Addr       string
+	Handler    Handler
+	DeadLetter DeadLetterFunc
+
+	// IdleTimeout closes connections that send nothing for this long.
+	IdleTimeout time.Duration
+	// ReadTimeout bounds how long the rest of a message may take once its
+	// start block has arrived, 30 seconds when zero.
+	ReadTimeout time.Duration
+
+	// AllowedNets lists the sender addresses accepted; connections from
+	// anywhere else are closed before anything is read. Empty allows none.
+	AllowedNets []*net.IPNet
+}
+
+// ParseAllowList parses a comma separated list of IP addresses and CIDR
+// ranges, e.g. "10.0.4.0/24,192.0.2.7".
+func ParseAllowList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// allowed reports whether addr is inside one of the AllowedNets.
+func (s *Server) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.AllowedNets {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	if !s.allowed(conn.RemoteAddr()) {
+		log.Println("HL7 connection from", remote, "refused: address not allowed")
+		return
+	}
+	reader := bufio.NewReader(conn)
+	readTimeout := s.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = defaultReadTimeout
+	}
+
+	for {
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		raw, err := readFrame(reader, func() {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		})
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Println("HL7 connection from", remote, "closed:", err)
+			}
+			return
+		}
+
+		ack := s.process(remote, string(raw))
+		conn.SetWriteDeadline(time.Now().Add(readTimeout))
+		if _, err := conn.Write(frame(ack)); err != nil {
+			log.Println("Failed to send HL7 ACK to", remote, err)
+			return
+		}
+	}
+}
+
+// process turns one framed message into the ACK to send back.
+func (s *Server) process(remote, raw string) string {
+	msg, err := Parse(raw)
+	if err != nil {
+		s.deadLetter(remote, raw, nil, err)
+		return ACK(nil, AckReject, err.Error())
+	}
+
+	if err := s.Handler(context.Background(), msg); err != nil {
+		s.deadLetter(remote, raw, msg, err)
+		return ACK(msg, AckError, err.Error())
+	}
+	return ACK(msg, AckAccept, "")
+}
+
+func (s *Server) deadLetter(remote, raw string, msg *Message, err error) {
+	log.Println("HL7 message from", remote, "failed:", err)
+	if s.DeadLetter != nil {
+		s.DeadLetter(remote, raw, msg, err)
+	}
+}
+
+// readFrame returns the next message, skipping anything outside a frame.
+// started is called once the start block has been read. Neither the bytes
+// skipped nor the message may exceed maxMessageBytes.
+func readFrame(r *bufio.Reader, started func()) ([]byte, error) {
+	for skipped := 0; ; skipped++ {
+		if skipped > maxMessageBytes {
+			return nil, fmt.Errorf("no start block in %d bytes", maxMessageBytes)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == startBlock {
+			break
+		}
+	}
+	if started != nil {
+		started()
+	}
+
+	var buf bytes.Buffer
+	for {
+		// ReadSlice stops at the end of bufio's buffer, so no read is unbounded
+		chunk, err := r.ReadSlice(endBlock)
+		if buf.Len()+len(chunk) > maxMessageBytes+1 {
+			return nil, fmt.Errorf("message exceeds %d bytes", maxMessageBytes)
+		}
+		buf.Write(chunk)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		next, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if next == carriage {
+			return buf.Bytes()[:buf.Len()-1], nil
+		}
+		// A stray FS inside the payload, keep reading
+		buf.WriteByte(next)
+	}
+}
+
+func frame(msg string) []byte {
+	out := make([]byte, 0, len(msg)+3)
+	out = append(out, startBlock)
+	out = append(out, msg...)
+	return append(out, endBlock, carriage)
+}
@@ -0,0 +1,243 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testADT = "MSH|^~\\&|LAB|HOSP|CHAT|CLINIC|20240105083000||ADT^A04|MSG0001|P|2.5\r" +
+	"PID|1||12345^^^HOSP||Doe^Jane||19800101|F"
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		err   bool
+	}{
+		{"plain", "\x0bMSH|a\x1c\r", "MSH|a", false},
+		{"noise before the frame", "junk\r\n\x0bMSH|b\x1c\r", "MSH|b", false},
+		{"stray FS in payload", "\x0bMSH|\x1cc\x1c\r", "MSH|\x1cc", false},
+		{"truncated", "\x0bMSH|d", "", true},
+		{"FS without CR at EOF", "\x0bMSH|e\x1c", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readFrame(bufio.NewReader(strings.NewReader(tt.input)), nil)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("readFrame = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("readFrame = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFrameConsecutive(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(string(frame("one")) + string(frame("two"))))
+	for _, want := range []string{"one", "two"} {
+		got, err := readFrame(r, nil)
+		if err != nil || string(got) != want {
+			t.Fatalf("readFrame = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := readFrame(r, nil); err != io.EOF {
+		t.Fatalf("readFrame at end = %v, want io.EOF", err)
+	}
+}
+
+// limitedSource fails the test if more than limit bytes are read from it, so
+// an unbounded read shows up as a failure rather than an allocation.
+type limitedSource struct {
+	t     *testing.T
+	data  io.Reader
+	read  int
+	limit int
+}
+
+func (s *limitedSource) Read(p []byte) (int, error) {
+	n, err := s.data.Read(p)
+	s.read += n
+	if s.read > s.limit {
+		s.t.Fatalf("read %d bytes, more than the %d a bounded reader needs", s.read, s.limit)
+	}
+	return n, err
+}
+
+func TestReadFrameRejectsOversizedMessage(t *testing.T) {
+	huge := io.MultiReader(strings.NewReader("\x0b"), endless('A'))
+	src := &limitedSource{t: t, data: huge, limit: maxMessageBytes + 2*4096}
+	_, err := readFrame(bufio.NewReader(src), nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("readFrame = %v, want a size error", err)
+	}
+}
+
+func TestReadFrameRejectsEndlessNoise(t *testing.T) {
+	src := &limitedSource{t: t, data: endless('x'), limit: maxMessageBytes + 2*4096}
+	_, err := readFrame(bufio.NewReader(src), nil)
+	if err == nil || !strings.Contains(err.Error(), "no start block") {
+		t.Fatalf("readFrame = %v, want a missing start block error", err)
+	}
+}
+
+func TestReadFrameCallsStarted(t *testing.T) {
+	calls := 0
+	_, err := readFrame(bufio.NewReader(strings.NewReader("noise\x0bMSH\x1c\r")), func() { calls++ })
+	if err != nil || calls != 1 {
+		t.Fatalf("readFrame = %v with %d started calls, want one", err, calls)
+	}
+}
+
+type endlessReader byte
+
+func endless(b byte) io.Reader { return endlessReader(b) }
+
+func (e endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(e)
+	}
+	return len(p), nil
+}
+
+func TestParseAllowList(t *testing.T) {
+	nets, err := ParseAllowList(" 10.0.4.0/24, 192.0.2.7 ,,2001:db8::1")
+	if err != nil {
+		t.Fatalf("ParseAllowList: %v", err)
+	}
+	s := &Server{AllowedNets: nets}
+	for addr, want := range map[string]bool{
+		"10.0.4.19":   true,
+		"10.0.5.1":    false,
+		"192.0.2.7":   true,
+		"192.0.2.8":   false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+	} {
+		if got := s.allowed(&net.TCPAddr{IP: net.ParseIP(addr), Port: 2575}); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := ParseAllowList(bad); err == nil {
+			t.Errorf("ParseAllowList(%q) succeeded, want an error", bad)
+		}
+	}
+	if nets, _ := ParseAllowList(""); len(nets) != 0 {
+		t.Errorf("ParseAllowList(\"\") = %v, want none", nets)
+	}
+}
+
+func startServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestServerAcknowledges(t *testing.T) {
+	loopback, _ := ParseAllowList("127.0.0.1")
+	var got *Message
+	addr := startServer(t, &Server{
+		Handler: func(ctx context.Context, msg *Message) error {
+			got = msg
+			if msg.Field("PID", 8) == "X" {
+				return errors.New("rejected by handler")
+			}
+			return nil
+		},
+		AllowedNets: loopback,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	conn.Write(frame(testADT))
+	ack, err := readFrame(r, nil)
+	if err != nil {
+		t.Fatalf("reading ACK: %v", err)
+	}
+	if !bytes.Contains(ack, []byte("MSA|AA|MSG0001")) {
+		t.Errorf("ACK = %q, want MSA|AA|MSG0001", ack)
+	}
+	if got == nil || got.MessageType() != "ADT^A04" {
+		t.Errorf("handler got %v, want the ADT^A04", got)
+	}
+
+	conn.Write(frame(strings.Replace(testADT, "|F", "|X", 1)))
+	if ack, err = readFrame(r, nil); err != nil {
+		t.Fatalf("reading ACK: %v", err)
+	}
+	if !bytes.Contains(ack, []byte("MSA|AE|MSG0001|rejected by handler")) {
+		t.Errorf("ACK = %q, want an AE with the handler error", ack)
+	}
+}
+
+func TestServerRefusesUnlistedAddress(t *testing.T) {
+	elsewhere, _ := ParseAllowList("192.0.2.0/24")
+	called := false
+	addr := startServer(t, &Server{
+		Handler:     func(ctx context.Context, msg *Message) error { called = true; return nil },
+		AllowedNets: elsewhere,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(frame(testADT))
+	if _, err := readFrame(bufio.NewReader(conn), nil); err == nil {
+		t.Fatal("got an ACK from a server that should have closed the connection")
+	}
+	if called {
+		t.Error("handler ran for a refused connection")
+	}
+}
+
+func TestServerTimesOutSlowMessage(t *testing.T) {
+	loopback, _ := ParseAllowList("127.0.0.1")
+	addr := startServer(t, &Server{
+		Handler:     func(ctx context.Context, msg *Message) error { return nil },
+		ReadTimeout: 100 * time.Millisecond,
+		AllowedNets: loopback,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Start a frame and never finish it
+	conn.Write([]byte{startBlock, 'M', 'S', 'H'})
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded, want the server to close the connection")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("server held the connection for %s, want about the 100ms read timeout", elapsed)
+	}
+}
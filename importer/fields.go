@@ -0,0 +1,287 @@
+package importer
+
+import (
+	"chat-api/codes"
+	"chat-api/utils"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var userFields = []string{
+	"email", "password", "role", "name", "age", "height", "weight", "gender",
+	"physical_condition", "medical_history",
+}
+
+var chatFields = []string{
+	"email", "user_id", "created_at", "disease", "text", "name", "age", "height", "weight",
+	"blood_pressure", "pulse", "gender", "physical_condition", "medical_history",
+	"L", "O", "D", "C", "R", "A", "F", "T", "diagnosis_codes",
+}
+
+var importRoles = map[string]bool{"user": true, "clinician": true, "admin": true}
+
+// rowParser converts the optional typed fields of a record, remembering the
+// first error per column.
+type rowParser struct {
+	rec  record
+	errs []RowError
+}
+
+func (p *rowParser) fail(column, format string, args ...interface{}) {
+	p.errs = append(p.errs, RowError{Row: p.rec.line, Column: column, Error: fmt.Sprintf(format, args...)})
+}
+
+func (p *rowParser) text(field string) interface{} {
+	if v := p.rec.get(field); v != "" {
+		return v
+	}
+	return nil
+}
+
+func (p *rowParser) number(field string, min, max float64, integer bool) interface{} {
+	v := p.rec.get(field)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < min || n > max || (integer && n != float64(int64(n))) {
+		kind := "a number"
+		if integer {
+			kind = "a whole number"
+		}
+		p.fail(field, "must be %s between %g and %g", kind, min, max)
+		return nil
+	}
+	if integer {
+		return int64(n)
+	}
+	return n
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+func (p *rowParser) time(field string) (time.Time, bool) {
+	v := p.rec.get(field)
+	if v == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, true
+		}
+	}
+	p.fail(field, "must be a date (YYYY-MM-DD) or timestamp (RFC 3339)")
+	return time.Time{}, false
+}
+
+// validateUsers checks user rows. Passwords are only hashed when hash is
+// set, so dry runs stay fast.
+func validateUsers(ctx context.Context, db *sql.DB, records []record, hash bool) (rowsBatch, []RowError, error) {
+	batch := rowsBatch{
+		table:   "users",
+		columns: append([]string{"user_id"}, userFields...),
+	}
+	var errs []RowError
+
+	var emails []string
+	for _, rec := range records {
+		emails = append(emails, strings.ToLower(rec.get("email")))
+	}
+	existing, err := existingEmails(ctx, db, emails)
+	if err != nil {
+		return batch, nil, err
+	}
+
+	shared := ""
+	firstLine := map[string]int{}
+	for _, rec := range records {
+		p := &rowParser{rec: rec}
+		email := strings.ToLower(rec.get("email"))
+		switch {
+		case email == "" || !strings.Contains(email, "@"):
+			p.fail("email", "a valid email is required")
+		case existing[email] != uuid.Nil:
+			p.fail("email", "a user with this email already exists")
+		case firstLine[email] != 0:
+			p.fail("email", "duplicate of row %d", firstLine[email])
+		default:
+			firstLine[email] = rec.line
+		}
+
+		role := strings.ToLower(rec.get("role"))
+		if role == "" {
+			role = "user"
+		}
+		if !importRoles[role] {
+			p.fail("role", "must be one of user, clinician, admin")
+		}
+
+		var password string
+		if pw := rec.get("password"); pw != "" {
+			if len(pw) < 6 {
+				p.fail("password", "must be at least 6 characters long")
+			} else if !hash {
+				password = pw
+			} else if password, err = utils.HashPassword(pw); err != nil {
+				return batch, nil, err
+			}
+		} else if hash {
+			// One unusable hash per import, bcrypt per row is too slow
+			if shared == "" {
+				if shared, err = utils.UnusablePasswordHash(); err != nil {
+					return batch, nil, err
+				}
+			}
+			password = shared
+		}
+
+		row := []interface{}{
+			uuid.New(), email, password, role, p.text("name"),
+			p.number("age", 0, 150, true), p.number("height", 1, 300, false), p.number("weight", 1, 500, false),
+			p.text("gender"), p.text("physical_condition"), p.text("medical_history"),
+		}
+		if len(p.errs) > 0 {
+			errs = append(errs, p.errs...)
+			continue
+		}
+		batch.rows = append(batch.rows, row)
+		batch.lines = append(batch.lines, rec.line)
+	}
+	return batch, errs, nil
+}
+
+func validateChats(ctx context.Context, db *sql.DB, records []record) (rowsBatch, []RowError, error) {
+	batch := rowsBatch{
+		table: "chats",
+		columns: []string{"chat_id", "user_id", "created_at", "updated_at", "disease", "text", "name", "age",
+			"height", "weight", "blood_pressure", "pulse", "gender", "physical_condition", "medical_history",
+			"L", "O", "D", "C", "R", "A", "F", "T"},
+	}
+	diagnoses := rowsBatch{table: "chat_diagnoses", columns: []string{"chat_id", "code", "description", "source"}}
+	var errs []RowError
+
+	var emails []string
+	var ids []string
+	for _, rec := range records {
+		if e := rec.get("email"); e != "" {
+			emails = append(emails, strings.ToLower(e))
+		}
+		if id, err := uuid.Parse(rec.get("user_id")); err == nil {
+			ids = append(ids, id.String())
+		}
+	}
+	byEmail, err := existingEmails(ctx, db, emails)
+	if err != nil {
+		return batch, nil, err
+	}
+	knownIDs := map[uuid.UUID]bool{}
+	rows, err := db.QueryContext(ctx, "SELECT user_id FROM users WHERE user_id = ANY($1::uuid[])", pq.Array(ids))
+	if err != nil {
+		return batch, nil, err
+	}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return batch, nil, err
+		}
+		knownIDs[id] = true
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, rec := range records {
+		p := &rowParser{rec: rec}
+
+		var userID uuid.UUID
+		if v := rec.get("user_id"); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil || !knownIDs[id] {
+				p.fail("user_id", "no user with this id")
+			}
+			userID = id
+		} else if v := strings.ToLower(rec.get("email")); v != "" {
+			if userID = byEmail[v]; userID == uuid.Nil {
+				p.fail("email", "no user with this email")
+			}
+		} else {
+			p.fail("email", "email or user_id is required")
+		}
+
+		createdAt, ok := p.time("created_at")
+		if !ok {
+			createdAt = now
+		}
+
+		bp := p.text("blood_pressure")
+		if bp != nil {
+			if _, _, ok := utils.ParseBloodPressure(bp.(string)); !ok {
+				p.fail("blood_pressure", "must look like 120/80")
+			}
+		}
+
+		var disease *string
+		if v := rec.get("disease"); v != "" {
+			disease = &v
+		}
+		var explicit []string
+		for _, code := range strings.FieldsFunc(rec.get("diagnosis_codes"), func(r rune) bool { return r == ';' || r == ',' }) {
+			explicit = append(explicit, strings.TrimSpace(code))
+		}
+		diags, err := codes.Diagnoses(explicit, disease)
+		if err != nil {
+			p.fail("diagnosis_codes", "%s", err.Error())
+		}
+
+		chatID := uuid.New()
+		row := []interface{}{
+			chatID, userID, createdAt, createdAt, p.text("disease"), p.text("text"), p.text("name"),
+			p.number("age", 0, 150, true), p.number("height", 1, 300, false), p.number("weight", 1, 500, false),
+			bp, p.number("pulse", 1, 300, true), p.text("gender"), p.text("physical_condition"), p.text("medical_history"),
+			p.text("L"), p.text("O"), p.text("D"), p.text("C"), p.text("R"), p.text("A"), p.text("F"), p.text("T"),
+		}
+		if len(p.errs) > 0 {
+			errs = append(errs, p.errs...)
+			continue
+		}
+		batch.rows = append(batch.rows, row)
+		batch.lines = append(batch.lines, rec.line)
+		seen := map[string]bool{}
+		for _, d := range diags {
+			if !seen[d.Code] {
+				seen[d.Code] = true
+				diagnoses.rows = append(diagnoses.rows, []interface{}{chatID, d.Code, d.Description, d.Source})
+			}
+		}
+	}
+	batch.extra = []rowsBatch{diagnoses}
+	return batch, errs, nil
+}
+
+func existingEmails(ctx context.Context, db *sql.DB, emails []string) (map[string]uuid.UUID, error) {
+	found := map[string]uuid.UUID{}
+	if len(emails) == 0 {
+		return found, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT user_id, lower(email) FROM users WHERE lower(email) = ANY($1)", pq.Array(emails))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uuid.UUID
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return nil, err
+		}
+		found[email] = id
+	}
+	return found, rows.Err()
+}
@@ -0,0 +1,247 @@
+// Package importer loads users or chats from CSV. It is shared by the admin
+// import endpoint and the import command so both validate the same way.
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Kinds of import
+const (
+	Users = "users"
+	Chats = "chats"
+)
+
+// Rows per COPY batch; progress is reported after each batch
+const batchSize = 1000
+
+// RowError is a validation failure. Row is the 1-based CSV line, so the
+// header is row 1 and the first record row 2.
+type RowError struct {
+	Row    int    `json:"row"`
+	Column string `json:"column,omitempty"`
+	Error  string `json:"error"`
+}
+
+type Options struct {
+	Kind string
+
+	// Mapping renames CSV header columns to target fields, for example
+	// {"Patient email": "email"}. Headers that are not mapped must already
+	// be field names. Map a header to "-" to ignore the column.
+	Mapping map[string]string
+
+	// DryRun validates every row and reports errors without writing.
+	DryRun bool
+
+	// Progress is called after each committed batch.
+	Progress func(processed, total int)
+}
+
+type Result struct {
+	Rows     int        `json:"rows"`
+	Imported int        `json:"imported"`
+	Errors   []RowError `json:"errors"`
+}
+
+// ErrInvalidRows is returned when validation failed and nothing was written.
+var ErrInvalidRows = errors.New("import has invalid rows")
+
+// record is one CSV row keyed by target field.
+type record struct {
+	line   int
+	fields map[string]string
+}
+
+func (r record) get(field string) string {
+	return strings.TrimSpace(r.fields[field])
+}
+
+// Fields returns the target fields accepted for a kind, in COPY order.
+func Fields(kind string) ([]string, error) {
+	switch kind {
+	case Users:
+		return userFields, nil
+	case Chats:
+		return chatFields, nil
+	}
+	return nil, fmt.Errorf("kind must be %s or %s", Users, Chats)
+}
+
+// readRecords reads the header, applies the mapping and returns every row.
+func readRecords(r io.Reader, kind string, mapping map[string]string) ([]record, error) {
+	fields, err := Fields(kind)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f] = true
+	}
+	byHeader := map[string]string{}
+	for from, to := range mapping {
+		byHeader[strings.ToLower(strings.TrimSpace(from))] = strings.TrimSpace(to)
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	targets := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		target, ok := byHeader[strings.ToLower(h)]
+		if !ok {
+			target = h
+		}
+		if target == "-" {
+			continue
+		}
+		if !known[target] {
+			return nil, fmt.Errorf("column %q does not map to a %s field (one of %s)", h, kind, strings.Join(fields, ", "))
+		}
+		if seen[target] {
+			return nil, fmt.Errorf("field %s is mapped more than once", target)
+		}
+		seen[target] = true
+		targets[i] = target
+	}
+	switch {
+	case kind == Users && !seen["email"]:
+		return nil, fmt.Errorf("a users import needs an email column")
+	case kind == Chats && !seen["email"] && !seen["user_id"]:
+		return nil, fmt.Errorf("a chats import needs an email or user_id column")
+	}
+
+	var records []record
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		rec := record{line: line, fields: map[string]string{}}
+		for i, v := range row {
+			if i < len(targets) && targets[i] != "" {
+				rec.fields[targets[i]] = v
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// Run validates the CSV and, unless DryRun is set or a row is invalid,
+// inserts every row in one transaction using COPY. Nothing is written when
+// any row fails validation.
+func Run(ctx context.Context, db *sql.DB, r io.Reader, opts Options) (Result, error) {
+	records, err := readRecords(r, opts.Kind, opts.Mapping)
+	if err != nil {
+		return Result{}, err
+	}
+	result := Result{Rows: len(records), Errors: []RowError{}}
+
+	var batch rowsBatch
+	switch opts.Kind {
+	case Users:
+		batch, result.Errors, err = validateUsers(ctx, db, records, !opts.DryRun)
+	case Chats:
+		batch, result.Errors, err = validateChats(ctx, db, records)
+	}
+	if err != nil {
+		return result, err
+	}
+	if len(result.Errors) > 0 {
+		return result, ErrInvalidRows
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(batch.rows); start += batchSize {
+		end := start + batchSize
+		if end > len(batch.rows) {
+			end = len(batch.rows)
+		}
+		if err := copyRows(ctx, tx, batch.table, batch.columns, batch.rows[start:end]); err != nil {
+			return result, fmt.Errorf("rows %d-%d: %w", batch.lines[start], batch.lines[end-1], err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(end, len(batch.rows))
+		}
+	}
+	for _, extra := range batch.extra {
+		if err := copyRows(ctx, tx, extra.table, extra.columns, extra.rows); err != nil {
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.Imported = len(batch.rows)
+	return result, nil
+}
+
+// rowsBatch holds validated rows ready for COPY. extra carries dependent
+// rows such as chat diagnoses, copied after the main table.
+type rowsBatch struct {
+	table   string
+	columns []string
+	rows    [][]interface{}
+	lines   []int
+	extra   []rowsBatch
+}
+
+func copyRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+// WriteErrors writes row errors as CSV, the format of the error file.
+func WriteErrors(w io.Writer, errs []RowError) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"row", "column", "error"})
+	for _, e := range errs {
+		out.Write([]string{fmt.Sprint(e.Row), e.Column, e.Error})
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,226 @@
+package interactions
+
+import (
+	"bytes"
+	"chat-api/models"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//go:embed data/interactions.csv
+var bundledDataset []byte
+
+// Severity rank, most severe first. Allergy conflicts are reported as
+// contraindicated, cross-reactivity within a drug group as major.
+var severityRank = map[string]int{
+	"contraindicated": 0,
+	"major":           1,
+	"moderate":        2,
+	"minor":           3,
+}
+
+type interaction struct {
+	a, b        string
+	severity    string
+	description string
+}
+
+// Checker holds an interaction dataset: drug pairs plus named drug groups
+// (nsaid, penicillin, ...) that pairs and allergies may refer to.
+type Checker struct {
+	pairs   []interaction
+	groups  map[string][]string // group -> members
+	groupOf map[string][]string // member -> groups
+}
+
+// loadDefault reads the dataset at INTERACTIONS_DATASET, or the bundled
+// dataset when the variable is unset.
+func loadDefault() (*Checker, error) {
+	if path := os.Getenv("INTERACTIONS_DATASET"); path != "" {
+		return LoadFile(path)
+	}
+	return Load(bytes.NewReader(bundledDataset))
+}
+
+var defaultChecker = sync.OnceValues(loadDefault)
+
+// CheckDataset loads the dataset Default uses and reports why it is not
+// usable, so a bad INTERACTIONS_DATASET stops the server at startup.
+func CheckDataset() error {
+	if _, err := defaultChecker(); err != nil {
+		return fmt.Errorf("interaction dataset: %w", err)
+	}
+	return nil
+}
+
+// Default returns the checker for the configured dataset. A dataset that
+// failed to load, which CheckDataset reports at startup, gives a checker
+// without any interactions rather than taking the server down.
+func Default() *Checker {
+	c, err := defaultChecker()
+	if err != nil {
+		return &Checker{}
+	}
+	return c
+}
+
+func LoadFile(path string) (*Checker, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Load reads a CSV dataset with the header kind,a,b,severity,description.
+// "group" rows add drug b to group a; "interaction" rows describe a pair,
+// where either side may be a drug or a group name.
+func Load(r io.Reader) (*Checker, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 5
+	reader.Comment = '#'
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Checker{groups: map[string][]string{}, groupOf: map[string][]string{}}
+	for i, rec := range records {
+		if i == 0 && rec[0] == "kind" {
+			continue
+		}
+		a, b := normalize(rec[1]), normalize(rec[2])
+		switch rec[0] {
+		case "group":
+			c.groups[a] = append(c.groups[a], b)
+			c.groupOf[b] = append(c.groupOf[b], a)
+		case "interaction":
+			severity := strings.ToLower(strings.TrimSpace(rec[3]))
+			if _, ok := severityRank[severity]; !ok {
+				return nil, fmt.Errorf("line %d: unknown severity %q", i+1, rec[3])
+			}
+			c.pairs = append(c.pairs, interaction{a: a, b: b, severity: severity, description: rec[4]})
+		default:
+			return nil, fmt.Errorf("line %d: unknown kind %q", i+1, rec[0])
+		}
+	}
+	return c, nil
+}
+
+func normalize(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+	}), " ")
+}
+
+// containsTerm reports whether term appears as whole words in a free-text
+// medication name, so "Amoxicillin 500 mg" matches "amoxicillin".
+func containsTerm(text, term string) bool {
+	return strings.Contains(" "+text+" ", " "+term+" ")
+}
+
+// matches reports whether a dataset term (drug or group) covers a medication.
+func (c *Checker) matches(term, medication string) bool {
+	if containsTerm(medication, term) {
+		return true
+	}
+	for _, member := range c.groups[term] {
+		if containsTerm(medication, member) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsFor returns the groups a medication or substance belongs to.
+func (c *Checker) groupsFor(name string) []string {
+	var groups []string
+	for member, gs := range c.groupOf {
+		if containsTerm(name, member) {
+			groups = append(groups, gs...)
+		}
+	}
+	return groups
+}
+
+// Check returns drug-drug interactions among medications and conflicts
+// between medications and allergy substances, most severe first.
+func (c *Checker) Check(medications, allergies []string) []models.InteractionWarning {
+	warnings := []models.InteractionWarning{}
+	seen := map[string]bool{}
+	add := func(w models.InteractionWarning) {
+		key := w.Type + "|" + strings.Join(w.Subjects, "|") + "|" + w.Description
+		if !seen[key] {
+			seen[key] = true
+			warnings = append(warnings, w)
+		}
+	}
+
+	meds := make([]string, len(medications))
+	for i, m := range medications {
+		meds[i] = normalize(m)
+	}
+
+	for i := 0; i < len(meds); i++ {
+		for j := i + 1; j < len(meds); j++ {
+			if meds[i] == "" || meds[i] == meds[j] {
+				continue
+			}
+			for _, p := range c.pairs {
+				if (c.matches(p.a, meds[i]) && c.matches(p.b, meds[j])) ||
+					(c.matches(p.b, meds[i]) && c.matches(p.a, meds[j])) {
+					add(models.InteractionWarning{
+						Type:        "interaction",
+						Severity:    p.severity,
+						Subjects:    []string{medications[i], medications[j]},
+						Description: p.description,
+					})
+				}
+			}
+		}
+	}
+
+	for _, allergy := range allergies {
+		substance := normalize(allergy)
+		if substance == "" {
+			continue
+		}
+		allergyGroups := c.groupsFor(substance)
+		for i, med := range meds {
+			switch {
+			case c.matches(substance, med) || containsTerm(substance, med):
+				add(models.InteractionWarning{
+					Type:        "allergy",
+					Severity:    "contraindicated",
+					Subjects:    []string{allergy, medications[i]},
+					Description: fmt.Sprintf("Patient has a recorded allergy to %s.", allergy),
+				})
+			default:
+				for _, g := range allergyGroups {
+					if c.matches(g, med) {
+						add(models.InteractionWarning{
+							Type:        "allergy",
+							Severity:    "major",
+							Subjects:    []string{allergy, medications[i]},
+							Description: fmt.Sprintf("Possible cross-reactivity: both belong to the %s group.", g),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return severityRank[warnings[i].Severity] < severityRank[warnings[j].Severity]
+	})
+	return warnings
+}
@@ -0,0 +1,125 @@
+package interactions
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDataset = `kind,a,b,severity,description
+# comments are skipped
+group,nsaid,ibuprofen,,
+group,nsaid,naproxen,,
+group,penicillin,amoxicillin,,
+group,penicillin,co-amoxiclav,,
+interaction,warfarin,nsaid,major,Bleeding risk.
+interaction,simvastatin,clarithromycin,contraindicated,Myopathy.
+`
+
+func testChecker(t *testing.T) *Checker {
+	t.Helper()
+	c, err := Load(strings.NewReader(testDataset))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return c
+}
+
+func TestCheckMatchesGroupMembers(t *testing.T) {
+	c := testChecker(t)
+	got := c.Check([]string{"Warfarin 5 mg", "Ibuprofen 400mg tablets"}, nil)
+	if len(got) != 1 || got[0].Type != "interaction" || got[0].Severity != "major" ||
+		got[0].Subjects[0] != "Warfarin 5 mg" || got[0].Subjects[1] != "Ibuprofen 400mg tablets" {
+		t.Fatalf("Check = %+v, want one major warfarin/ibuprofen interaction", got)
+	}
+
+	// Either order, and a member of the group on the first side
+	if got := c.Check([]string{"naproxen", "warfarin"}, nil); len(got) != 1 {
+		t.Errorf("Check(naproxen, warfarin) = %+v, want one interaction", got)
+	}
+}
+
+func TestCheckNeedsWholeWords(t *testing.T) {
+	c := testChecker(t)
+	// "warfarinx" is not warfarin, and a drug never interacts with itself
+	for _, meds := range [][]string{{"warfarinx", "ibuprofen"}, {"ibuprofen", "ibuprofen"}, {"warfarin"}} {
+		if got := c.Check(meds, nil); len(got) != 0 {
+			t.Errorf("Check(%q) = %+v, want none", meds, got)
+		}
+	}
+}
+
+func TestCheckAllergies(t *testing.T) {
+	c := testChecker(t)
+	tests := []struct {
+		name      string
+		meds      []string
+		allergy   string
+		severity  string
+		groupNote bool
+	}{
+		{"same drug", []string{"Amoxicillin 500 mg"}, "amoxicillin", "contraindicated", false},
+		{"allergy to the group", []string{"co-amoxiclav"}, "Penicillin", "contraindicated", false},
+		{"cross-reactivity within a group", []string{"co-amoxiclav"}, "amoxicillin", "major", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.Check(tt.meds, []string{tt.allergy})
+			if len(got) != 1 || got[0].Type != "allergy" || got[0].Severity != tt.severity {
+				t.Fatalf("Check = %+v, want one %s allergy warning", got, tt.severity)
+			}
+			if tt.groupNote != strings.Contains(got[0].Description, "penicillin group") {
+				t.Errorf("description = %q", got[0].Description)
+			}
+		})
+	}
+
+	if got := c.Check([]string{"ibuprofen"}, []string{"amoxicillin"}); len(got) != 0 {
+		t.Errorf("an unrelated allergy gave %+v", got)
+	}
+}
+
+func TestCheckSortsBySeverity(t *testing.T) {
+	c := testChecker(t)
+	got := c.Check([]string{"warfarin", "ibuprofen", "simvastatin", "clarithromycin"}, nil)
+	if len(got) != 2 || got[0].Severity != "contraindicated" || got[1].Severity != "major" {
+		t.Fatalf("Check = %+v, want the contraindication first", got)
+	}
+}
+
+func TestLoadRejectsBadRows(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown severity": "interaction,a,b,fatal,x\n",
+		"unknown kind":     "pair,a,b,major,x\n",
+		"wrong columns":    "group,a\n",
+	} {
+		if _, err := Load(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: loaded without error", name)
+		}
+	}
+}
+
+func TestBundledDatasetLoads(t *testing.T) {
+	c, err := Load(bytes.NewReader(bundledDataset))
+	if err != nil {
+		t.Fatalf("bundled dataset: %v", err)
+	}
+	if len(c.pairs) == 0 || len(c.groups) == 0 {
+		t.Error("bundled dataset is empty")
+	}
+}
+
+func TestLoadDefaultReportsABadDataset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "interactions.csv")
+	os.WriteFile(path, []byte("interaction,a,b,fatal,x\n"), 0o600)
+	t.Setenv("INTERACTIONS_DATASET", path)
+	if _, err := loadDefault(); err == nil {
+		t.Error("a dataset with an unknown severity loaded")
+	}
+	t.Setenv("INTERACTIONS_DATASET", filepath.Join(t.TempDir(), "missing.csv"))
+	if _, err := loadDefault(); err == nil {
+		t.Error("a missing dataset loaded")
+	}
+}
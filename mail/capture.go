@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// DefaultCaptureMax is how many messages a Capture keeps when Max is 0.
+const DefaultCaptureMax = 100
+
+// Capture keeps sent messages in memory instead of delivering them. Only
+// the most recent Max are kept, so a long running dev server does not
+// grow without bound.
+type Capture struct {
+	Log bool // also log each message, so links can be followed in development
+	Max int
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (c *Capture) Send(ctx context.Context, msg Message) error {
+	max := c.Max
+	if max <= 0 {
+		max = DefaultCaptureMax
+	}
+	c.mu.Lock()
+	c.messages = append(c.messages, msg)
+	if n := len(c.messages); n > max {
+		c.messages = append(c.messages[:0:0], c.messages[n-max:]...)
+	}
+	c.mu.Unlock()
+	if c.Log {
+		log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	}
+	return nil
+}
+
+// Messages returns a copy of the messages kept, oldest first.
+func (c *Capture) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message(nil), c.messages...)
+}
+
+// Last returns the most recent message to the address.
+func (c *Capture) Last(to string) (Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].To == to {
+			return c.messages[i], true
+		}
+	}
+	return Message{}, false
+}
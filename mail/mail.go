@@ -0,0 +1,89 @@
+// Package mail sends transactional email such as verification links.
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer delivers a message or reports why it could not.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// ErrNotConfigured is returned for every message when no mailer is
+// configured, so nothing is silently dropped.
+var ErrNotConfigured = errors.New("mail: no mailer configured, set SMTP_ADDR or MAIL_MODE")
+
+// FromEnv returns the mailer selected by MAIL_MODE:
+//
+//   - smtp, the default: deliver through SMTP_ADDR (see NewSMTPFromEnv)
+//   - capture: keep messages in memory, for tests
+//   - log: keep and log messages, so links can be followed in development
+//
+// Capture and log modes must be chosen explicitly; without SMTP_ADDR the
+// smtp mode is an error rather than a fallback.
+func FromEnv() (Mailer, error) {
+	switch mode := os.Getenv("MAIL_MODE"); mode {
+	case "", "smtp":
+		if os.Getenv("SMTP_ADDR") == "" {
+			return nil, ErrNotConfigured
+		}
+		return NewSMTPFromEnv(), nil
+	case "capture":
+		return &Capture{}, nil
+	case "log":
+		return &Capture{Log: true}, nil
+	default:
+		return nil, fmt.Errorf("mail: MAIL_MODE must be smtp, capture or log, not %q", mode)
+	}
+}
+
+// CheckEnv reports whether FromEnv can build a mailer.
+func CheckEnv() error {
+	_, err := FromEnv()
+	return err
+}
+
+type unconfigured struct{ err error }
+
+func (u unconfigured) Send(ctx context.Context, msg Message) error { return u.err }
+
+var (
+	defaultOnce   sync.Once
+	defaultMailer Mailer
+)
+
+// Default returns the mailer from FromEnv. When that fails, every Send
+// returns its error.
+func Default() Mailer {
+	defaultOnce.Do(func() {
+		m, err := FromEnv()
+		if err != nil {
+			log.Println("Email cannot be sent:", err)
+			m = unconfigured{err}
+		}
+		if c, ok := m.(*Capture); ok && c.Log {
+			log.Println("MAIL_MODE=log, email is captured and logged instead of sent")
+		}
+		defaultMailer = m
+	})
+	return defaultMailer
+}
+
+// SetDefault replaces the mailer Default returns, e.g. with a Capture in
+// tests.
+func SetDefault(m Mailer) {
+	defaultOnce.Do(func() {})
+	defaultMailer = m
+}
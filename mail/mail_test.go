@@ -0,0 +1,185 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCaptureKeepsTheMostRecent(t *testing.T) {
+	c := &Capture{Max: 3}
+	for i := 1; i <= 5; i++ {
+		c.Send(context.Background(), Message{To: fmt.Sprintf("u%d@example.com", i%2), Subject: fmt.Sprint(i)})
+	}
+	got := c.Messages()
+	if len(got) != 3 || got[0].Subject != "3" || got[2].Subject != "5" {
+		t.Fatalf("Messages = %+v, want 3 to 5", got)
+	}
+	if m, ok := c.Last("u0@example.com"); !ok || m.Subject != "4" {
+		t.Errorf("Last(u0) = %+v, %v, want message 4", m, ok)
+	}
+	if _, ok := c.Last("nobody@example.com"); ok {
+		t.Error("Last found a message to an address never mailed")
+	}
+
+	// Messages is a copy
+	got[0].Subject = "changed"
+	if c.Messages()[0].Subject != "3" {
+		t.Error("changing the result of Messages changed the capture")
+	}
+}
+
+func TestCaptureDefaultMax(t *testing.T) {
+	c := &Capture{}
+	for i := 0; i < DefaultCaptureMax+10; i++ {
+		c.Send(context.Background(), Message{To: "a@example.com"})
+	}
+	if n := len(c.Messages()); n != DefaultCaptureMax {
+		t.Errorf("kept %d messages, want %d", n, DefaultCaptureMax)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		mode, addr string
+		want       string // type of mailer, or "" for an error
+	}{
+		{"", "", ""},
+		{"smtp", "", ""},
+		{"", "mail.example.com:25", "smtp"},
+		{"capture", "", "capture"},
+		{"log", "", "log"},
+		{"stdout", "", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAIL_MODE", tt.mode)
+		t.Setenv("SMTP_ADDR", tt.addr)
+		m, err := FromEnv()
+		got := ""
+		switch m := m.(type) {
+		case *SMTP:
+			got = "smtp"
+		case *Capture:
+			got = "capture"
+			if m.Log {
+				got = "log"
+			}
+		}
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("MAIL_MODE=%q SMTP_ADDR=%q: FromEnv = %s, %v, want %q", tt.mode, tt.addr, got, err, tt.want)
+		}
+	}
+}
+
+func TestDefaultFailsClosed(t *testing.T) {
+	t.Setenv("MAIL_MODE", "")
+	t.Setenv("SMTP_ADDR", "")
+	defaultOnce, defaultMailer = sync.Once{}, nil
+	t.Cleanup(func() { defaultOnce, defaultMailer = sync.Once{}, nil })
+
+	err := Default().Send(context.Background(), Message{To: "a@example.com"})
+	if !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("Send = %v, want ErrNotConfigured", err)
+	}
+
+	c := &Capture{}
+	SetDefault(c)
+	if err := Default().Send(context.Background(), Message{To: "a@example.com"}); err != nil {
+		t.Fatalf("Send after SetDefault = %v", err)
+	}
+	if len(c.Messages()) != 1 {
+		t.Error("SetDefault mailer did not get the message")
+	}
+}
+
+// fakeSMTP accepts one message and hands back the DATA it received.
+func fakeSMTP(t *testing.T) (addr string, data <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	out := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 fake")
+			case "MAIL", "RCPT", "RSET", "NOOP":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				body, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				out <- string(body)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), out
+}
+
+func TestSMTPSend(t *testing.T) {
+	addr, data := fakeSMTP(t)
+	s := &SMTP{Addr: addr, From: "no-reply@example.com"}
+	err := s.Send(context.Background(), Message{
+		To:      "patient@example.com",
+		Subject: "Bestätigen Sie",
+		Text:    "line one\nline two",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	var body string
+	select {
+	case body = <-data:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server received no message")
+	}
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(body))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("headers: %v", err)
+	}
+	if msg.Get("To") != "patient@example.com" || msg.Get("From") != "no-reply@example.com" {
+		t.Errorf("headers = %v", msg)
+	}
+	if subject := msg.Get("Subject"); !strings.HasPrefix(subject, "=?utf-8?q?") {
+		t.Errorf("Subject = %q, want it Q-encoded", subject)
+	}
+	if !strings.HasSuffix(body, "line one\nline two\n") {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSMTPRejectsHeaderInjection(t *testing.T) {
+	s := &SMTP{Addr: "127.0.0.1:1", From: "no-reply@example.com"}
+	if err := s.Send(context.Background(), Message{To: "a@example.com\r\nBcc: b@example.com"}); err == nil {
+		t.Fatal("Send accepted a recipient with a line break")
+	}
+}
@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMTP sends through a relay. net/smtp upgrades to TLS with STARTTLS when
+// the server offers it, and authenticates with PLAIN when Username is set.
+type SMTP struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+// NewSMTPFromEnv reads SMTP_ADDR, SMTP_USERNAME, SMTP_PASSWORD and
+// MAIL_FROM (default no-reply@localhost).
+func NewSMTPFromEnv() *SMTP {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	return &SMTP{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return fmt.Errorf("mail: invalid recipient")
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Text, "\r\n", "\n"), "\n", "\r\n"))
+
+	// net/smtp has no context support, run it aside so callers can give up
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, []byte(b.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
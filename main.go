@@ -2,9 +2,17 @@ package main
 
 import (
 	"chat-api/database"
+	"chat-api/handlers"
+	"chat-api/hl7"
 	"chat-api/routes"
+	"chat-api/scheduler"
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -18,12 +26,45 @@ func main() {
 		log.Println("No .env file found, using system environment variables")
 	}
 
+	if err := handlers.CheckConfig(); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
 	// Connect to database
 	database.ConnectDB()
 	defer database.CloseDB()
 
-	// Initialize Fiber app
+	if err := database.Migrate(); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	bodyLimit, err := handlers.BodyLimit()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxies, err := trustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+	proxyHeader := ""
+	if len(proxies) > 0 {
+		proxyHeader = os.Getenv("PROXY_HEADER")
+		if proxyHeader == "" {
+			proxyHeader = "X-Real-IP"
+		}
+	}
+
+	// Initialize Fiber app. Behind a reverse proxy the client IP, which
+	// sign-in throttling and the rate limiters key on, comes from
+	// PROXY_HEADER, but only on requests from TRUSTED_PROXIES. The proxy
+	// must overwrite that header, not append to what the client sent.
 	app := fiber.New(fiber.Config{
+		BodyLimit:               bodyLimit,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          proxies,
+		ProxyHeader:             proxyHeader,
+		EnableIPValidation:      true,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -54,6 +95,39 @@ func main() {
 	// Setup routes
 	routes.SetupRoutes(app)
 
+	// Optional HL7 v2 listener for partners that can only send MLLP
+	if addr := os.Getenv("HL7_MLLP_ADDR"); addr != "" {
+		// MLLP has no authentication of its own, so senders are allowed by address
+		allowed, err := hl7.ParseAllowList(os.Getenv("HL7_ALLOWED_IPS"))
+		if err != nil {
+			log.Fatal("Invalid HL7_ALLOWED_IPS: ", err)
+		}
+		if len(allowed) == 0 {
+			log.Fatal("HL7_ALLOWED_IPS is required when HL7_MLLP_ADDR is set")
+		}
+		server := &hl7.Server{
+			Addr:        addr,
+			Handler:     handlers.HL7Message,
+			DeadLetter:  handlers.HL7DeadLetter,
+			IdleTimeout: 5 * time.Minute,
+			ReadTimeout: 30 * time.Second,
+			AllowedNets: allowed,
+		}
+		go func() {
+			log.Printf("HL7 MLLP listener starting on %s", addr)
+			log.Fatal(server.ListenAndServe())
+		}()
+	}
+
+	// Background jobs; with several instances only one runs each job at a time
+	jobs := scheduler.New(database.DB)
+	jobs.Add(scheduler.Job{Name: "erasures", Interval: time.Hour, Run: handlers.ProcessDueErasures})
+	jobs.Add(scheduler.Job{Name: "data-export-expiry", Interval: time.Hour, Run: handlers.PurgeExpiredDataExports})
+	jobs.Add(scheduler.Job{Name: "stale-exports", Interval: 15 * time.Minute, Run: handlers.FailStaleExports})
+	jobs.Add(scheduler.Job{Name: handlers.RetentionJob, Interval: 24 * time.Hour, Run: handlers.RunRetentionPolicies})
+	jobs.Add(scheduler.Job{Name: "analytics-refresh", Interval: time.Hour, Run: handlers.RefreshAnalytics})
+	jobs.Start(context.Background())
+
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -63,3 +137,20 @@ func main() {
 	log.Printf("Server starting on port %s", port)
 	log.Fatal(app.Listen(":" + port))
 }
+
+// trustedProxies parses a comma separated list of proxy IPs and CIDR
+// ranges.
+func trustedProxies(list string) ([]string, error) {
+	var proxies []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		proxies = append(proxies, entry)
+	}
+	return proxies, nil
+}
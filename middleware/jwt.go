@@ -32,9 +32,19 @@ type TokenDetails struct {
 	Email     string    `json:"email"`
 	Role      string    `json:"role"` // Optional role field
 	ExpiresIn *int64    `json:"exp"`
+	IssuedAt  int64     `json:"-"`
+	SessionID uuid.UUID `json:"-"` // sid claim, uuid.Nil for tokens without a session
 }
 
+// GenerateJWTToken issues a token without a session. handlers.AccountGuard
+// refuses those on protected routes; sign-ins use GenerateSessionJWTToken.
 func GenerateJWTToken(userID uuid.UUID, email string, role string) (*TokenDetails, error) {
+	return GenerateSessionJWTToken(uuid.Nil, userID, email, role)
+}
+
+// GenerateSessionJWTToken is GenerateJWTToken for a token that belongs to
+// a sign-in session, named by its sid claim so the session can be revoked.
+func GenerateSessionJWTToken(sessionID, userID uuid.UUID, email string, role string) (*TokenDetails, error) {
 	now := time.Now().UTC()
 
 	td := &TokenDetails{
@@ -47,6 +57,7 @@ func GenerateJWTToken(userID uuid.UUID, email string, role string) (*TokenDetail
 	td.UserID = userID
 	td.Email = email
 	td.Role = role
+	td.SessionID = sessionID
 
 	//ส่วนของ signature
 	SigningKey := []byte(os.Getenv("JWT_SECRET_KEY"))
@@ -60,6 +71,9 @@ func GenerateJWTToken(userID uuid.UUID, email string, role string) (*TokenDetail
 	// atClaims["exp"] = time.Now().Add(14 * 24 * time.Hour).Unix()
 	atClaims["iat"] = time.Now().Unix()
 	atClaims["nbf"] = time.Now().Unix()
+	if sessionID != uuid.Nil {
+		atClaims["sid"] = sessionID.String()
+	}
 
 	log.Println("New claims: ", atClaims)
 
@@ -102,6 +116,16 @@ func DecodeJWTToken(ctx *fiber.Ctx) (*TokenDetails, error) {
 		if key == "role" {
 			td.Role = value.(string)
 		}
+		if key == "iat" {
+			if iat, ok := value.(float64); ok {
+				td.IssuedAt = int64(iat)
+			}
+		}
+		if key == "sid" {
+			if sid, ok := value.(string); ok {
+				td.SessionID, _ = uuid.Parse(sid)
+			}
+		}
 	}
 	*td.Token = token.Raw
 	return td, nil
@@ -147,6 +171,16 @@ func DecodeJWTTokenFromHeader(ctx *fiber.Ctx) (*TokenDetails, error) {
 		if key == "role" {
 			td.Role = value.(string)
 		}
+		if key == "iat" {
+			if iat, ok := value.(float64); ok {
+				td.IssuedAt = int64(iat)
+			}
+		}
+		if key == "sid" {
+			if sid, ok := value.(string); ok {
+				td.SessionID, _ = uuid.Parse(sid)
+			}
+		}
 	}
 	*td.Token = tokenStr
 	return td, nil
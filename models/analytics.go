@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// AnalyticsRow is one cell of an analytics result. Only the dimensions the
+// request grouped by are set. Suppressed cells have fewer chats than the
+// minimum cell size and carry no counts or averages.
+type AnalyticsRow struct {
+	Bucket     *time.Time `json:"bucket,omitempty"`
+	AgeBand    *string    `json:"age_band,omitempty"`
+	Gender     *string    `json:"gender,omitempty"`
+	Code       *string    `json:"code,omitempty"`
+	Chats      *int64     `json:"chats"`
+	Suppressed bool       `json:"suppressed"`
+
+	AvgHeight    *float64 `json:"avg_height,omitempty"`
+	AvgWeight    *float64 `json:"avg_weight,omitempty"`
+	AvgPulse     *float64 `json:"avg_pulse,omitempty"`
+	AvgSystolic  *float64 `json:"avg_systolic,omitempty"`
+	AvgDiastolic *float64 `json:"avg_diastolic,omitempty"`
+}
+
+type AnalyticsResult struct {
+	Bucket      string         `json:"bucket"`
+	GroupBy     []string       `json:"group_by"`
+	MinCellSize int            `json:"min_cell_size"`
+	RefreshedAt *time.Time     `json:"refreshed_at"`
+	Rows        []AnalyticsRow `json:"rows"`
+}
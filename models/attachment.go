@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Attachment struct {
+	AttachmentID uuid.UUID  `json:"attachment_id" db:"attachment_id"`
+	ChatID       uuid.UUID  `json:"chat_id" db:"chat_id"`
+	UploadedBy   *uuid.UUID `json:"uploaded_by" db:"uploaded_by"`
+	Filename     string     `json:"filename" db:"filename"`
+	ContentType  string     `json:"content_type" db:"content_type"`
+	SizeBytes    int64      `json:"size_bytes" db:"size_bytes"`
+	StorageKey   string     `json:"-" db:"storage_key"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	DownloadURL  string     `json:"download_url,omitempty"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CareTeamMember struct {
+	ClinicianID uuid.UUID  `json:"clinician_id" db:"clinician_id"`
+	PatientID   uuid.UUID  `json:"patient_id" db:"patient_id"`
+	AssignedBy  *uuid.UUID `json:"assigned_by" db:"assigned_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+
+	// Email and Name describe the other side of the relation: the clinician
+	// when listing a patient's care team, the patient when listing patients
+	Email string  `json:"email"`
+	Name  *string `json:"name"`
+}
+
+type CareTeamAssign struct {
+	ClinicianID uuid.UUID `json:"clinician_id"`
+}
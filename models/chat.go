@@ -6,6 +6,20 @@ import (
 	"github.com/google/uuid"
 )
 
+// LODCRAFT symptom history keys and their full labels, in interview order
+var LODCRAFTKeys = []string{"L", "O", "D", "C", "R", "A", "F", "T"}
+
+var LODCRAFTLabels = map[string]string{
+	"L": "Location",
+	"O": "Onset",
+	"D": "Duration",
+	"C": "Character",
+	"R": "Radiation",
+	"A": "Associated symptoms",
+	"F": "Aggravating and relieving factors",
+	"T": "Timing",
+}
+
 type Chat struct {
 	ChatID            uuid.UUID `json:"chat_id" db:"chat_id"`
 	UserID            uuid.UUID `json:"user_id" db:"user_id"`
@@ -30,6 +44,14 @@ type Chat struct {
 	A                 *string   `json:"A" db:"A"`
 	F                 *string   `json:"F" db:"F"`
 	T                 *string   `json:"T" db:"T"`
+
+	Diagnoses []ChatDiagnosis `json:"diagnoses"`
+
+	// Patient context, only filled when a single chat is fetched
+	Medications []Medication         `json:"medications,omitempty"`
+	Allergies   []Allergy            `json:"allergies,omitempty"`
+	Warnings    []InteractionWarning `json:"warnings,omitempty"`
+	Notes       []ChatNote           `json:"notes,omitempty"`
 }
 
 type ChatCreate struct {
@@ -52,4 +74,38 @@ type ChatCreate struct {
 	A                 *string  `json:"A"`
 	F                 *string  `json:"F"`
 	T                 *string  `json:"T"`
+
+	// DiagnosisCodes are explicit ICD-10 codes. When omitted they are
+	// resolved from Disease through the synonym table.
+	DiagnosisCodes []string `json:"diagnosis_codes"`
+}
+
+type ChatDiagnosis struct {
+	Code        string    `json:"code" db:"code"`
+	Description string    `json:"description" db:"description"`
+	Source      string    `json:"source" db:"source"` // manual | synonym
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// LODCRAFTAnswer returns the chat's answer for one LODCRAFT key.
+func (c *Chat) LODCRAFTAnswer(key string) *string {
+	switch key {
+	case "L":
+		return c.L
+	case "O":
+		return c.O
+	case "D":
+		return c.D
+	case "C":
+		return c.C
+	case "R":
+		return c.R
+	case "A":
+		return c.A
+	case "F":
+		return c.F
+	case "T":
+		return c.T
+	}
+	return nil
 }
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ChatNote struct {
+	NoteID      uuid.UUID  `json:"note_id" db:"note_id"`
+	ChatID      uuid.UUID  `json:"chat_id" db:"chat_id"`
+	AuthorID    *uuid.UUID `json:"author_id" db:"author_id"`
+	AuthorEmail *string    `json:"author_email"`
+	NoteType    string     `json:"note_type" db:"note_type"` // assessment | plan | observation | private
+	Body        string     `json:"body" db:"body"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+type ChatNoteCreate struct {
+	NoteType string `json:"note_type"`
+	Body     string `json:"body"`
+}
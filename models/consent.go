@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ConsentPolicy struct {
+	ConsentType string     `json:"consent_type" db:"consent_type"`
+	Version     int        `json:"version" db:"version"`
+	Body        string     `json:"body" db:"body"`
+	CreatedBy   *uuid.UUID `json:"created_by" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+type ConsentPolicyCreate struct {
+	ConsentType string `json:"consent_type"`
+	Body        string `json:"body"`
+}
+
+type Consent struct {
+	ConsentID     uuid.UUID  `json:"consent_id" db:"consent_id"`
+	UserID        uuid.UUID  `json:"user_id" db:"user_id"`
+	ConsentType   string     `json:"consent_type" db:"consent_type"` // data_processing | research_use | clinician_sharing
+	PolicyVersion int        `json:"policy_version" db:"policy_version"`
+	GrantedAt     time.Time  `json:"granted_at" db:"granted_at"`
+	WithdrawnAt   *time.Time `json:"withdrawn_at" db:"withdrawn_at"`
+	RecordedBy    *uuid.UUID `json:"recorded_by" db:"recorded_by"`
+	// Grandfathered consents were recorded for users who predate consents,
+	// not granted by the user
+	Grandfathered bool `json:"grandfathered" db:"grandfathered"`
+}
+
+// ConsentGrant accepts a policy. PolicyVersion must be the current version,
+// so the client proves it showed the text that is in force.
+type ConsentGrant struct {
+	ConsentType   string `json:"consent_type"`
+	PolicyVersion int    `json:"policy_version"`
+}
+
+// ConsentStatus is the state of one consent type for a user. Outdated means
+// the consent was given to an older policy version than the current one, or
+// grandfathered rather than given.
+type ConsentStatus struct {
+	ConsentType    string     `json:"consent_type"`
+	Granted        bool       `json:"granted"`
+	PolicyVersion  *int       `json:"policy_version"`
+	CurrentVersion int        `json:"current_version"`
+	Outdated       bool       `json:"outdated"`
+	GrantedAt      *time.Time `json:"granted_at"`
+}
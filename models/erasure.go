@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErasureRequest moves through pending -> approved -> completed, unless it
+// is rejected by an admin or cancelled during the grace period.
+type ErasureRequest struct {
+	RequestID   uuid.UUID  `json:"request_id" db:"request_id"`
+	UserID      uuid.UUID  `json:"user_id" db:"user_id"`
+	RequestedBy *uuid.UUID `json:"requested_by" db:"requested_by"`
+	Reason      *string    `json:"reason" db:"reason"`
+	Status      string     `json:"status" db:"status"`
+	GraceUntil  time.Time  `json:"grace_until" db:"grace_until"`
+	DecidedBy   *uuid.UUID `json:"decided_by" db:"decided_by"`
+	DecidedAt   *time.Time `json:"decided_at" db:"decided_at"`
+	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+type ErasureRequestCreate struct {
+	Reason *string `json:"reason"`
+}
+
+type ErasureLogEntry struct {
+	LogID     int64      `json:"log_id" db:"log_id"`
+	RequestID uuid.UUID  `json:"request_id" db:"request_id"`
+	UserID    uuid.UUID  `json:"user_id" db:"user_id"`
+	Event     string     `json:"event" db:"event"`
+	ActorID   *uuid.UUID `json:"actor_id" db:"actor_id"`
+	Details   string     `json:"details" db:"details"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	PrevHash  string     `json:"prev_hash" db:"prev_hash"`
+	Hash      string     `json:"hash" db:"hash"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExportJob tracks an export that runs in the background and is written to
+// storage. Kind is "chats" for admin chat exports, "research" for
+// de-identified research datasets, which carry a k-anonymity Report, and
+// "user_data" for a user's personal data export, which has a SubjectID and
+// expires.
+type ExportJob struct {
+	JobID       uuid.UUID       `json:"job_id" db:"job_id"`
+	Kind        string          `json:"kind" db:"kind"`
+	RequestedBy *uuid.UUID      `json:"requested_by" db:"requested_by"`
+	Format      string          `json:"format" db:"format"`
+	Params      json.RawMessage `json:"params" db:"params"`
+	Status      string          `json:"status" db:"status"` // pending | running | done | failed
+	RowCount    int64           `json:"row_count" db:"row_count"`
+	StorageKey  *string         `json:"-" db:"storage_key"`
+	Error       *string         `json:"error" db:"error"`
+	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
+	FinishedAt  *time.Time      `json:"finished_at" db:"finished_at"`
+	SubjectID   *uuid.UUID      `json:"subject_id,omitempty" db:"subject_id"`
+	ExpiresAt   *time.Time      `json:"expires_at,omitempty" db:"expires_at"`
+	Report      json.RawMessage `json:"report,omitempty" db:"report"`
+	DownloadURL string          `json:"download_url,omitempty"`
+}
+
+// ResearchExportSubject records that a user's data went into a research
+// export, under which consent and as which pseudonym. UserID and ConsentID
+// are cleared when the user or consent is deleted; the pseudonym stays.
+type ResearchExportSubject struct {
+	UserID    *uuid.UUID `json:"user_id" db:"user_id"`
+	ConsentID *uuid.UUID `json:"consent_id" db:"consent_id"`
+	Pseudonym *string    `json:"pseudonym" db:"pseudonym"`
+	Records   int        `json:"records" db:"records"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ImportJob tracks a CSV import of users or chats.
+type ImportJob struct {
+	JobID         uuid.UUID  `json:"job_id" db:"job_id"`
+	Kind          string     `json:"kind" db:"kind"` // users | chats
+	RequestedBy   *uuid.UUID `json:"requested_by" db:"requested_by"`
+	Filename      string     `json:"filename" db:"filename"`
+	DryRun        bool       `json:"dry_run" db:"dry_run"`
+	Status        string     `json:"status" db:"status"` // pending | running | done | failed
+	TotalRows     int        `json:"total_rows" db:"total_rows"`
+	ProcessedRows int        `json:"processed_rows" db:"processed_rows"`
+	ErrorCount    int        `json:"error_count" db:"error_count"`
+	ErrorKey      *string    `json:"-" db:"error_key"`
+	Error         *string    `json:"error" db:"error"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	FinishedAt    *time.Time `json:"finished_at" db:"finished_at"`
+}
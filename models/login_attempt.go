@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LoginAttempt records one sign-in attempt. Reason is success,
+// mfa_pending, unknown_email, wrong_password, mfa_failed or throttled.
+type LoginAttempt struct {
+	AttemptID uuid.UUID  `json:"attempt_id" db:"attempt_id"`
+	Email     string     `json:"email" db:"email"`
+	UserID    *uuid.UUID `json:"user_id" db:"user_id"`
+	IP        string     `json:"ip" db:"ip"`
+	Success   bool       `json:"success" db:"success"`
+	Reason    string     `json:"reason" db:"reason"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Medication struct {
+	MedicationID uuid.UUID `json:"medication_id" db:"medication_id"`
+	UserID       uuid.UUID `json:"user_id" db:"user_id"`
+	Name         string    `json:"name" db:"name"`
+	Dose         *string   `json:"dose" db:"dose"`
+	Frequency    *string   `json:"frequency" db:"frequency"`
+	StartDate    *string   `json:"start_date" db:"start_date"` // YYYY-MM-DD
+	StopDate     *string   `json:"stop_date" db:"stop_date"`   // YYYY-MM-DD
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type MedicationInput struct {
+	Name      string  `json:"name"`
+	Dose      *string `json:"dose"`
+	Frequency *string `json:"frequency"`
+	StartDate *string `json:"start_date"`
+	StopDate  *string `json:"stop_date"`
+}
+
+type Allergy struct {
+	AllergyID uuid.UUID `json:"allergy_id" db:"allergy_id"`
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Substance string    `json:"substance" db:"substance"`
+	Reaction  *string   `json:"reaction" db:"reaction"`
+	Severity  *string   `json:"severity" db:"severity"` // mild | moderate | severe
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type AllergyInput struct {
+	Substance string  `json:"substance"`
+	Reaction  *string `json:"reaction"`
+	Severity  *string `json:"severity"`
+}
+
+type InteractionWarning struct {
+	Type        string   `json:"type"`     // interaction | allergy
+	Severity    string   `json:"severity"` // contraindicated | major | moderate | minor
+	Subjects    []string `json:"subjects"` // the two medications, or allergy then medication
+	Description string   `json:"description"`
+}
+
+type InteractionCheck struct {
+	// UserID adds the user's active medications and allergies to the check
+	UserID      *uuid.UUID `json:"user_id"`
+	Medications []string   `json:"medications"`
+	Allergies   []string   `json:"allergies"`
+}
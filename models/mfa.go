@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+type MFAStatus struct {
+	Enabled                bool       `json:"enabled"`
+	EnabledAt              *time.Time `json:"enabled_at"`
+	Required               bool       `json:"required"` // by MFA_REQUIRED_ROLES for the user's role
+	RecoveryCodesRemaining int        `json:"recovery_codes_remaining"`
+}
+
+type MFAEnrolment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"` // otpauth:// URI to show as a QR code
+}
+
+// MFACode carries a code from the authenticator app, or a recovery code
+// in its place where the endpoint accepts one.
+type MFACode struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type MFAChallenge struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
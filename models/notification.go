@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notification is an in-app message to a user, such as "your data export
+// is ready". Link is an API path the client can follow.
+type Notification struct {
+	NotificationID uuid.UUID  `json:"notification_id" db:"notification_id"`
+	UserID         uuid.UUID  `json:"user_id" db:"user_id"`
+	Kind           string     `json:"kind" db:"kind"`
+	Body           string     `json:"body" db:"body"`
+	Link           *string    `json:"link" db:"link"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	ReadAt         *time.Time `json:"read_at" db:"read_at"`
+}
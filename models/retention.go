@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RetentionPolicy deletes records of Resource older than MaxAgeDays. Age is
+// measured from the last activity where there is one (chat updated_at, user
+// last_active_at) and from creation otherwise.
+type RetentionPolicy struct {
+	PolicyID    uuid.UUID  `json:"policy_id" db:"policy_id"`
+	Resource    string     `json:"resource" db:"resource"` // chats | users | notifications | export_jobs | import_jobs | hl7_dead_letters | login_attempts | sessions
+	Role        *string    `json:"role" db:"role"`
+	MaxAgeDays  int        `json:"max_age_days" db:"max_age_days"`
+	Enabled     bool       `json:"enabled" db:"enabled"`
+	Description *string    `json:"description" db:"description"`
+	CreatedBy   *uuid.UUID `json:"created_by" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+type RetentionPolicyInput struct {
+	Resource    string  `json:"resource"`
+	Role        *string `json:"role"`
+	MaxAgeDays  int     `json:"max_age_days"`
+	Enabled     *bool   `json:"enabled"`
+	Description *string `json:"description"`
+}
+
+// RetentionRun is the audit record of one run of a policy. Sample holds a
+// few matched IDs and is only filled for dry runs.
+type RetentionRun struct {
+	RunID       uuid.UUID   `json:"run_id" db:"run_id"`
+	PolicyID    uuid.UUID   `json:"policy_id" db:"policy_id"`
+	Resource    string      `json:"resource" db:"resource"`
+	Role        *string     `json:"role" db:"role"`
+	MaxAgeDays  int         `json:"max_age_days" db:"max_age_days"`
+	Cutoff      time.Time   `json:"cutoff" db:"cutoff"`
+	DryRun      bool        `json:"dry_run" db:"dry_run"`
+	TriggeredBy *uuid.UUID  `json:"triggered_by" db:"triggered_by"`
+	Matched     int         `json:"matched" db:"matched"`
+	Deleted     int         `json:"deleted" db:"deleted"`
+	Error       *string     `json:"error" db:"error"`
+	StartedAt   time.Time   `json:"started_at" db:"started_at"`
+	FinishedAt  time.Time   `json:"finished_at" db:"finished_at"`
+	Sample      []uuid.UUID `json:"sample,omitempty"`
+}
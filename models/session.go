@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is one signed in device: a JWT and where it was used from.
+type Session struct {
+	SessionID  uuid.UUID  `json:"session_id" db:"session_id"`
+	UserID     uuid.UUID  `json:"user_id" db:"user_id"`
+	Method     string     `json:"method" db:"method"` // password | signup | oidc:<provider>, +mfa with a second factor
+	UserAgent  *string    `json:"user_agent" db:"user_agent"`
+	IP         string     `json:"ip" db:"ip"`
+	LastIP     string     `json:"last_ip" db:"last_ip"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at" db:"revoked_at"`
+	RevokedBy  *uuid.UUID `json:"revoked_by" db:"revoked_by"`
+	Current    bool       `json:"current"` // the session of the token making the request
+}
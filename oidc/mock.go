@@ -0,0 +1,167 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MockIdP is a minimal identity provider for local development and
+// testing (see cmd/mockidp). It signs in whoever asks as the user its
+// Claims describe, without a login page, but checks PKCE and redirect
+// URIs like a real provider.
+type MockIdP struct {
+	Issuer string
+	// Claims go into every ID token, e.g. sub, email, email_verified,
+	// name and the role claim
+	Claims map[string]interface{}
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	expires     time.Time
+}
+
+func NewMockIdP(issuer string, claims map[string]interface{}) (*MockIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockIdP{Issuer: issuer, Claims: claims, key: key, codes: map[string]mockGrant{}}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (m *MockIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                m.Issuer,
+			"authorization_endpoint":                m.Issuer + "/authorize",
+			"token_endpoint":                        m.Issuer + "/token",
+			"jwks_uri":                              m.Issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	case "/jwks":
+		pub := m.key.PublicKey
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			}},
+		})
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "response_type=code with an S256 code_challenge is required", http.StatusBadRequest)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = mockGrant{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	code := r.PostForm.Get("code")
+	m.mu.Lock()
+	grant, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(grant.expires) ||
+		grant.clientID != r.PostForm.Get("client_id") || grant.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	if CodeChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for k, v := range m.Claims {
+		claims[k] = v
+	}
+	claims["iss"] = m.Issuer
+	claims["aud"] = grant.clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(5 * time.Minute).Unix()
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": idToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
@@ -0,0 +1,309 @@
+// Package oidc signs users in with external OpenID Connect identity
+// providers using the authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Provider is one configured identity provider. Providers are read from
+// the environment: OIDC_PROVIDERS lists their names and each name has
+// OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET (empty for public
+// clients), _SCOPES, _ROLE_CLAIM, _ROLE_MAP and _DEFAULT_ROLE.
+type Provider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// RoleClaim names the ID token claim (a string or a list of strings)
+	// holding the user's groups or roles
+	RoleClaim string
+	// RoleMap maps claim values to our roles. The first entry whose value
+	// the user has wins, so the most privileged mappings come first.
+	RoleMap     []RoleMapping
+	DefaultRole string
+
+	mu       sync.Mutex
+	metadata *metadata
+	jwks     *keyfunc.JWKS
+}
+
+type RoleMapping struct {
+	Value string
+	Role  string
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the ID token claims sign-in needs.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Nonce         string
+	Raw           jwt.MapClaims
+}
+
+var (
+	loadOnce  sync.Once
+	providers map[string]*Provider
+)
+
+func env(name, key, fallback string) string {
+	if v := os.Getenv("OIDC_" + strings.ToUpper(name) + "_" + key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func load() {
+	providers = map[string]*Provider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		p := &Provider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(env(name, "ISSUER", ""), "/"),
+			ClientID:     env(name, "CLIENT_ID", ""),
+			ClientSecret: env(name, "CLIENT_SECRET", ""),
+			Scopes:       strings.Fields(env(name, "SCOPES", "openid email profile")),
+			RoleClaim:    env(name, "ROLE_CLAIM", "roles"),
+			DefaultRole:  env(name, "DEFAULT_ROLE", "user"),
+		}
+		// e.g. "IT-Admins=admin,Clinicians=clinician"
+		for _, pair := range strings.Split(env(name, "ROLE_MAP", ""), ",") {
+			value, role, ok := strings.Cut(pair, "=")
+			if ok && strings.TrimSpace(value) != "" {
+				p.RoleMap = append(p.RoleMap, RoleMapping{Value: strings.TrimSpace(value), Role: strings.TrimSpace(role)})
+			}
+		}
+		providers[name] = p
+	}
+}
+
+// Lookup returns the configured provider called name.
+func Lookup(name string) (*Provider, bool) {
+	loadOnce.Do(load)
+	p, ok := providers[strings.ToLower(name)]
+	if !ok || p.Issuer == "" || p.ClientID == "" {
+		return nil, false
+	}
+	return p, true
+}
+
+// discover fetches the provider's metadata and signing keys on first use.
+func (p *Provider) discover(ctx context.Context) (*metadata, *keyfunc.JWKS, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, p.jwks, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("discovery: status %d", resp.StatusCode)
+	}
+	var m metadata
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != p.Issuer {
+		return nil, nil, fmt.Errorf("discovery: issuer %s does not match %s", m.Issuer, p.Issuer)
+	}
+
+	jwks, err := keyfunc.Get(m.JWKSURI, keyfunc.Options{
+		Client:            httpClient,
+		RefreshInterval:   time.Hour,
+		RefreshRateLimit:  time.Minute,
+		RefreshUnknownKID: true,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("jwks: %w", err)
+	}
+	p.metadata, p.jwks = &m, jwks
+	return p.metadata, p.jwks, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewLogin returns the random values one sign-in needs: state, nonce and
+// the PKCE code verifier.
+func NewLogin() (state, nonce, verifier string, err error) {
+	if state, err = randomString(); err != nil {
+		return
+	}
+	if nonce, err = randomString(); err != nil {
+		return
+	}
+	verifier, err = randomString()
+	return
+}
+
+// CodeChallenge is the S256 PKCE challenge for verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where to send the browser to sign in.
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, verifier string) (string, error) {
+	m, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", CodeChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems the authorization code and returns the verified claims
+// of the ID token. The caller compares Claims.Nonce with the one it sent.
+func (p *Provider) Exchange(ctx context.Context, code, redirectURI, verifier string) (*Claims, error) {
+	m, jwks, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("token: status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	return p.verifyIDToken(tokens.IDToken, m, jwks)
+}
+
+func (p *Provider) verifyIDToken(raw string, m *metadata, jwks *keyfunc.JWKS) (*Claims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, jwks.Keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "PS256"}),
+		jwt.WithIssuer(m.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute))
+	if err != nil {
+		return nil, fmt.Errorf("id_token: %w", err)
+	}
+
+	c := &Claims{Raw: claims}
+	c.Subject, _ = claims["sub"].(string)
+	c.Email, _ = claims["email"].(string)
+	c.Name, _ = claims["name"].(string)
+	c.Nonce, _ = claims["nonce"].(string)
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		c.EmailVerified = v
+	case string: // some providers send "true"
+		c.EmailVerified = v == "true"
+	}
+	if c.Subject == "" {
+		return nil, errors.New("id_token: no sub claim")
+	}
+	return c, nil
+}
+
+// Role maps the role claim to one of our roles and reports whether a
+// RoleMap entry matched. Without a match it returns DefaultRole, which is
+// only meant for new users.
+func (p *Provider) Role(c *Claims) (string, bool) {
+	var values []string
+	switch v := c.Raw[p.RoleClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, mapping := range p.RoleMap {
+		for _, v := range values {
+			if v == mapping.Value {
+				return mapping.Role, true
+			}
+		}
+	}
+	return p.DefaultRole, false
+}
@@ -0,0 +1,128 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const testRedirect = "https://chat.example.com/auth/oidc/mock/callback"
+
+// startMockIdP serves a MockIdP and returns a provider configured for it.
+func startMockIdP(t *testing.T, claims map[string]interface{}) *Provider {
+	var idp *MockIdP
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { idp.ServeHTTP(w, r) }))
+	t.Cleanup(srv.Close)
+	var err error
+	if idp, err = NewMockIdP(srv.URL, claims); err != nil {
+		t.Fatal(err)
+	}
+	return &Provider{
+		Name:        "mock",
+		Issuer:      srv.URL,
+		ClientID:    "chat-api",
+		Scopes:      []string{"openid", "email"},
+		RoleClaim:   "groups",
+		RoleMap:     []RoleMapping{{"IT-Admins", "admin"}, {"Clinicians", "clinician"}},
+		DefaultRole: "user",
+	}
+}
+
+// authorize follows AuthCodeURL to the provider and returns the code and
+// state it redirects back with.
+func authorize(t *testing.T, p *Provider, state, nonce, verifier string) (code, returnedState string) {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), testRedirect, state, nonce, verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %d, want a redirect", resp.StatusCode)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Scheme+"://"+back.Host+back.Path != testRedirect {
+		t.Fatalf("redirected to %s, want %s", back, testRedirect)
+	}
+	return back.Query().Get("code"), back.Query().Get("state")
+}
+
+func TestSignInWithMockIdP(t *testing.T) {
+	p := startMockIdP(t, map[string]interface{}{
+		"sub": "user-1", "email": "jane@example.com", "email_verified": true, "name": "Jane Doe",
+		"groups": []interface{}{"Staff", "Clinicians"},
+	})
+	state, nonce, verifier, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, returned := authorize(t, p, state, nonce, verifier)
+	if returned != state {
+		t.Errorf("state = %q, want %q", returned, state)
+	}
+	claims, err := p.Exchange(context.Background(), code, testRedirect, verifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "jane@example.com" || !claims.EmailVerified ||
+		claims.Name != "Jane Doe" || claims.Nonce != nonce {
+		t.Errorf("claims = %+v", claims)
+	}
+	if role, matched := p.Role(claims); role != "clinician" || !matched {
+		t.Errorf("Role = %s, %v, want clinician from the mapping", role, matched)
+	}
+
+	// A code is good for one exchange only
+	if _, err := p.Exchange(context.Background(), code, testRedirect, verifier); err == nil {
+		t.Error("the code was redeemed twice")
+	}
+}
+
+func TestExchangeChecksPKCEAndRedirect(t *testing.T) {
+	p := startMockIdP(t, map[string]interface{}{"sub": "user-1"})
+	state, nonce, verifier, _ := NewLogin()
+
+	code, _ := authorize(t, p, state, nonce, verifier)
+	if _, err := p.Exchange(context.Background(), code, testRedirect, verifier+"x"); err == nil {
+		t.Error("Exchange succeeded with the wrong code verifier")
+	}
+	code, _ = authorize(t, p, state, nonce, verifier)
+	if _, err := p.Exchange(context.Background(), code, testRedirect+"x", verifier); err == nil {
+		t.Error("Exchange succeeded with another redirect URI")
+	}
+}
+
+func TestRole(t *testing.T) {
+	p := &Provider{
+		RoleClaim:   "groups",
+		RoleMap:     []RoleMapping{{"IT-Admins", "admin"}, {"Clinicians", "clinician"}},
+		DefaultRole: "user",
+	}
+	tests := []struct {
+		groups  interface{}
+		role    string
+		matched bool
+	}{
+		{[]interface{}{"Clinicians", "IT-Admins"}, "admin", true}, // map order wins
+		{"Staff Clinicians", "clinician", true},
+		{[]interface{}{"Staff"}, "user", false},
+		{nil, "user", false},
+	}
+	for _, tt := range tests {
+		role, matched := p.Role(&Claims{Raw: map[string]interface{}{"groups": tt.groups}})
+		if role != tt.role || matched != tt.matched {
+			t.Errorf("Role(%v) = %s, %v, want %s, %v", tt.groups, role, matched, tt.role, tt.matched)
+		}
+	}
+}
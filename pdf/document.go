@@ -0,0 +1,325 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// A4 portrait in points
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+	Margin     = 50.0
+
+	ContentWidth = PageWidth - 2*Margin
+)
+
+// Document lays out text top to bottom, starting a new page when the
+// current one is full. It only knows the handful of elements our reports
+// need: headings, wrapped paragraphs, key/value lists and tables.
+type Document struct {
+	title   string
+	created time.Time
+	pages   []*bytes.Buffer
+	page    *bytes.Buffer
+	y       float64
+
+	// TrueType fonts drawn with, in order of first use, and the glyphs
+	// used from each with the character each one shows
+	embedded []*trueType
+	used     map[*trueType]map[uint16]rune
+}
+
+func New(title string) *Document {
+	d := &Document{title: title, created: time.Now(), used: map[*trueType]map[uint16]rune{}}
+	d.newPage()
+	return d
+}
+
+func (d *Document) newPage() {
+	d.page = &bytes.Buffer{}
+	d.pages = append(d.pages, d.page)
+	d.y = PageHeight - Margin
+}
+
+// ensure starts a new page unless h points still fit on the current one.
+func (d *Document) ensure(h float64) {
+	if d.y-h < Margin+20 {
+		d.newPage()
+	}
+}
+
+func (d *Document) text(x, y float64, font Font, size float64, s string) {
+	if chain := loadedFonts()[font]; len(chain) > 0 {
+		// Glyph IDs as two-byte codes, switching font where the fallback
+		// chain does; each Tj advances past the previous run
+		fmt.Fprintf(d.page, "BT %.2f %.2f Td", x, y)
+		for _, run := range runs(chain, s) {
+			fmt.Fprintf(d.page, " %s %.1f Tf <", d.embed(run.font), size)
+			for i, g := range run.glyphs {
+				fmt.Fprintf(d.page, "%04X", g)
+				d.used[run.font][g] = run.runes[i]
+			}
+			d.page.WriteString("> Tj")
+		}
+		d.page.WriteString(" ET\n")
+		return
+	}
+
+	fmt.Fprintf(d.page, "BT %s %.1f Tf %.2f %.2f Td (", font.resource(), size, x, y)
+	for _, b := range encode(s) {
+		if b == '(' || b == ')' || b == '\\' {
+			d.page.WriteByte('\\')
+		}
+		d.page.WriteByte(b)
+	}
+	d.page.WriteString(") Tj ET\n")
+}
+
+// embed returns the resource name of f, adding it to the document on first
+// use.
+func (d *Document) embed(f *trueType) string {
+	if d.used[f] == nil {
+		d.used[f] = map[uint16]rune{}
+		d.embedded = append(d.embedded, f)
+	}
+	for i, e := range d.embedded {
+		if e == f {
+			return fmt.Sprintf("/E%d", i+1)
+		}
+	}
+	return ""
+}
+
+func (d *Document) line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(d.page, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, y1, x2, y2)
+}
+
+// Space moves the cursor down.
+func (d *Document) Space(h float64) {
+	d.y -= h
+}
+
+// Title writes the large document heading.
+func (d *Document) Title(s string) {
+	d.ensure(30)
+	d.y -= 20
+	d.text(Margin, d.y, Bold, 18, s)
+	d.y -= 10
+}
+
+// Heading writes a section heading with a rule beneath it.
+func (d *Document) Heading(s string) {
+	d.ensure(40)
+	d.y -= 24
+	d.text(Margin, d.y, Bold, 12, s)
+	d.y -= 5
+	d.line(Margin, d.y, PageWidth-Margin, d.y, 0.5)
+	d.y -= 4
+}
+
+// Paragraph writes wrapped text. Blank lines in s are kept.
+func (d *Document) Paragraph(s string, font Font, size float64) {
+	leading := size * 1.35
+	for _, line := range Wrap(s, font, size, ContentWidth) {
+		d.ensure(leading)
+		d.y -= leading
+		d.text(Margin, d.y, font, size, line)
+	}
+}
+
+// Fields writes label/value pairs in two columns, wrapping long values.
+func (d *Document) Fields(pairs [][2]string) {
+	const size, labelWidth = 10.0, 150.0
+	leading := size * 1.4
+	for _, p := range pairs {
+		lines := Wrap(p[1], Regular, size, ContentWidth-labelWidth)
+		d.ensure(leading)
+		for i, line := range lines {
+			if i > 0 {
+				d.ensure(leading)
+			}
+			d.y -= leading
+			if i == 0 {
+				d.text(Margin, d.y, Bold, size, p[0])
+			}
+			d.text(Margin+labelWidth, d.y, Regular, size, line)
+		}
+	}
+}
+
+// Table writes a header row and data rows. widths are column fractions of
+// the content width and must sum to 1. Cells wrap within their column.
+func (d *Document) Table(widths []float64, header []string, rows [][]string) {
+	const size, pad = 9.5, 4.0
+	leading := size * 1.35
+
+	row := func(cells []string, font Font) {
+		wrapped := make([][]string, len(cells))
+		height := 1
+		for i, cell := range cells {
+			wrapped[i] = Wrap(cell, font, size, widths[i]*ContentWidth-2*pad)
+			if len(wrapped[i]) > height {
+				height = len(wrapped[i])
+			}
+		}
+		rowHeight := float64(height)*leading + 2*pad
+		d.ensure(rowHeight)
+
+		top := d.y
+		x := Margin
+		for i, lines := range wrapped {
+			for j, line := range lines {
+				d.text(x+pad, top-pad-float64(j+1)*leading+2, font, size, line)
+			}
+			x += widths[i] * ContentWidth
+		}
+		d.y -= rowHeight
+		d.line(Margin, d.y, PageWidth-Margin, d.y, 0.3)
+	}
+
+	d.ensure(3 * leading)
+	d.y -= 4
+	d.line(Margin, d.y, PageWidth-Margin, d.y, 0.3)
+	row(header, Bold)
+	for _, cells := range rows {
+		row(cells, Regular)
+	}
+}
+
+// Wrap breaks s into lines no wider than width, splitting on spaces and
+// breaking words that are longer than a line by themselves.
+func Wrap(s string, font Font, size, width float64) []string {
+	var lines []string
+	for _, para := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			for TextWidth(word, font, size) > width {
+				// Hard break an overlong word at the last rune that fits
+				cut := len(word)
+				for cut > 1 && TextWidth(word[:cut], font, size) > width {
+					cut--
+					for cut > 1 && !isRuneStart(word[cut]) {
+						cut--
+					}
+				}
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, word[:cut])
+				word = word[cut:]
+			}
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if TextWidth(candidate, font, size) > width && line != "" {
+				lines = append(lines, line)
+				candidate = word
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xc0 != 0x80
+}
+
+// pdfString writes s as a literal string, or as UTF-16 with a byte order
+// mark when it has characters outside Latin-1.
+func pdfString(s string) string {
+	for _, r := range s {
+		if r < 32 || (r >= 127 && r < 0xa0) || r > 0xff {
+			var b strings.Builder
+			b.WriteString("<FEFF")
+			for _, u := range utf16.Encode([]rune(s)) {
+				fmt.Fprintf(&b, "%04X", u)
+			}
+			b.WriteByte('>')
+			return b.String()
+		}
+	}
+
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, c := range encode(s) {
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// WriteTo renders the document, adding "Page n of m" footers.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	// Footers go on copies so rendering twice gives the same output
+	current := d.page
+	contents := make([][]byte, len(d.pages))
+	for i, page := range d.pages {
+		footer := fmt.Sprintf("Page %d of %d", i+1, len(d.pages))
+		d.page = bytes.NewBuffer(append([]byte(nil), page.Bytes()...))
+		d.text(PageWidth-Margin-TextWidth(footer, Regular, 8), Margin-20, Regular, 8, footer)
+		d.text(Margin, Margin-20, Regular, 8, d.title)
+		contents[i] = d.page.Bytes()
+	}
+	d.page = current
+
+	// Objects: 1 catalog, 2 page tree, 3-4 core fonts, 5 info, then a page
+	// and its content stream for every page, then five objects for every
+	// embedded font
+	var objects []string
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	fontsStart := 6 + 2*len(d.pages)
+	resources := "/F1 3 0 R /F2 4 0 R"
+	for i := range d.embedded {
+		resources += fmt.Sprintf(" /E%d %d 0 R", i+1, fontsStart+5*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Title %s /Producer (chat-api) /CreationDate (D:%s) >>",
+			pdfString(d.title), d.created.UTC().Format("20060102150405Z")),
+	)
+	for i, content := range contents {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+				"/Resources << /Font << %s >> >> /Contents %d 0 R >>",
+				PageWidth, PageHeight, resources, 7+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+	for i, f := range d.embedded {
+		objects = append(objects, fontObjects(f, d.used[f], fontsStart+5*i)...)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return out.WriteTo(w)
+}
@@ -0,0 +1,291 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// Glyph widths of the standard Helvetica fonts for ASCII 32-126, in 1/1000
+// of the font size, taken from the Adobe core font metrics. Every PDF reader
+// ships these fonts; they are only used when no TrueType font is found.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// Font selects one of the two styles every document carries.
+type Font int
+
+const (
+	Regular Font = iota
+	Bold
+)
+
+// resource names the core font used when the style has no TrueType font.
+func (f Font) resource() string {
+	if f == Bold {
+		return "/F2"
+	}
+	return "/F1"
+}
+
+// Fonts tried, in order, when PDF_FONT_REGULAR or PDF_FONT_BOLD is not set.
+// Every one found is embedded as needed, so a character missing from the
+// first (Thai in Noto Sans, say) is taken from the next that has it.
+var defaultFontFiles = map[Font][]string{
+	Regular: {
+		"/usr/share/fonts/truetype/noto/NotoSans-Regular.ttf",
+		"/usr/share/fonts/truetype/noto/NotoSansThai-Regular.ttf",
+		"/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf",
+		"/usr/share/fonts/truetype/tlwg/Garuda.ttf",
+	},
+	Bold: {
+		"/usr/share/fonts/truetype/noto/NotoSans-Bold.ttf",
+		"/usr/share/fonts/truetype/noto/NotoSansThai-Bold.ttf",
+		"/usr/share/fonts/truetype/dejavu/DejaVuSans-Bold.ttf",
+		"/usr/share/fonts/truetype/tlwg/Garuda-Bold.ttf",
+	},
+}
+
+// fontSet holds the TrueType fonts of each style in fallback order. A style
+// without any falls back to the core Helvetica fonts, which cover Latin-1.
+type fontSet map[Font][]*trueType
+
+// loadedFonts reads the fonts once per process; documents only record
+// which glyphs they use.
+var loadedFonts = sync.OnceValue(func() fontSet {
+	fonts := fontSet{}
+	for font, env := range map[Font]string{Regular: "PDF_FONT_REGULAR", Bold: "PDF_FONT_BOLD"} {
+		paths, configured := defaultFontFiles[font], false
+		if v := os.Getenv(env); v != "" {
+			paths, configured = strings.Split(v, ","), true
+		}
+		for _, path := range paths {
+			f, err := loadFontFile(strings.TrimSpace(path))
+			if err != nil {
+				if configured || !os.IsNotExist(err) {
+					log.Printf("pdf: cannot use font %s: %v", path, err)
+				}
+				continue
+			}
+			fonts[font] = append(fonts[font], f)
+		}
+		if len(fonts[font]) == 0 {
+			log.Printf("pdf: no TrueType font for %s, characters outside Latin-1 will print as '?'", env)
+		}
+	}
+	return fonts
+})
+
+func loadFontFile(path string) (*trueType, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTrueType(data)
+}
+
+// glyphRun is a stretch of text drawn with one TrueType font.
+type glyphRun struct {
+	font   *trueType
+	glyphs []uint16
+	runes  []rune
+}
+
+// runs splits s into runs of the first font in chain that has each
+// character. Characters no font has are drawn as the first font's '?'.
+func runs(chain []*trueType, s string) []glyphRun {
+	var out []glyphRun
+	for _, r := range s {
+		if r == '\t' {
+			r = ' '
+		}
+		font, g := chain[0], uint16(0)
+		found := false
+		for _, f := range chain {
+			if g, found = f.glyph(r); found {
+				font = f
+				break
+			}
+		}
+		if !found {
+			g, _ = font.glyph('?')
+			r = '?'
+		}
+		if n := len(out); n > 0 && out[n-1].font == font {
+			out[n-1].glyphs = append(out[n-1].glyphs, g)
+			out[n-1].runes = append(out[n-1].runes, r)
+			continue
+		}
+		out = append(out, glyphRun{font: font, glyphs: []uint16{g}, runes: []rune{r}})
+	}
+	return out
+}
+
+// encode maps text to WinAnsiEncoding for the core fonts. Characters outside
+// Latin-1, such as Thai, cannot be shown by them and become '?'.
+func encode(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == '\t':
+			out = append(out, ' ')
+		case r >= 32 && r < 127, r >= 0xa0 && r <= 0xff:
+			out = append(out, byte(r))
+		case r == '–' || r == '—':
+			out = append(out, '-')
+		case r == '‘' || r == '’':
+			out = append(out, '\'')
+		case r == '“' || r == '”':
+			out = append(out, '"')
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+// TextWidth returns the width of s in points.
+func TextWidth(s string, font Font, size float64) float64 {
+	if chain := loadedFonts()[font]; len(chain) > 0 {
+		total := 0.0
+		for _, run := range runs(chain, s) {
+			for _, g := range run.glyphs {
+				total += run.font.width(g)
+			}
+		}
+		return total * size / 1000
+	}
+
+	widths := &helveticaWidths
+	if font == Bold {
+		widths = &helveticaBoldWidths
+	}
+	total := 0
+	for _, b := range encode(s) {
+		if b >= 32 && b < 127 {
+			total += widths[b-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// fontObjects renders f as a Type0 font with Identity-H encoding, so text
+// is written as glyph IDs: the font, its CIDFontType2 descendant, the font
+// descriptor, the subset font file and a ToUnicode map for copy and search.
+// first is the object number of the first of the five.
+func fontObjects(f *trueType, used map[uint16]rune, first int) []string {
+	glyphs := make([]uint16, 0, len(used))
+	for g := range used {
+		glyphs = append(glyphs, g)
+	}
+	sort.Slice(glyphs, func(i, j int) bool { return glyphs[i] < glyphs[j] })
+
+	// Subsets are named with a tag derived from their contents
+	h := fnv.New32a()
+	h.Write([]byte(f.name))
+	var widths strings.Builder
+	for _, g := range glyphs {
+		fmt.Fprintf(h, "%d,", g)
+		fmt.Fprintf(&widths, "%d [%d] ", g, int(math.Round(f.width(g))))
+	}
+	sum := h.Sum32()
+	tag := make([]byte, 6)
+	for i := range tag {
+		tag[i] = byte('A' + sum%26)
+		sum /= 26
+	}
+	name := "/" + string(tag) + "+" + f.name
+
+	flags := 32 // nonsymbolic
+	if f.fixedPitch {
+		flags |= 1
+	}
+	if f.italicAngle != 0 {
+		flags |= 64
+	}
+	stemV := 80
+	if f.weight >= 600 {
+		stemV = 140
+	}
+
+	file := f.subset(used)
+	return []string{
+		fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont %s /Encoding /Identity-H "+
+			"/DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>", name, first+1, first+4),
+		fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont %s "+
+			"/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> "+
+			"/FontDescriptor %d 0 R /CIDToGIDMap /Identity /DW 1000 /W [%s] >>",
+			name, first+2, strings.TrimSpace(widths.String())),
+		fmt.Sprintf("<< /Type /FontDescriptor /FontName %s /Flags %d /FontBBox [%d %d %d %d] "+
+			"/ItalicAngle %.1f /Ascent %d /Descent %d /CapHeight %d /StemV %d /FontFile2 %d 0 R >>",
+			name, flags, f.scale(f.bbox[0]), f.scale(f.bbox[1]), f.scale(f.bbox[2]), f.scale(f.bbox[3]),
+			f.italicAngle, f.scale(f.ascent), f.scale(f.descent), f.scale(f.capHeight), stemV, first+3),
+		flateStream(fmt.Sprintf("/Length1 %d", len(file)), file),
+		flateStream("", toUnicode(glyphs, used)),
+	}
+}
+
+// toUnicode builds the CMap from glyph IDs back to the characters they show.
+func toUnicode(glyphs []uint16, used map[uint16]rune) []byte {
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	// At most 100 entries per block
+	for start := 0; start < len(glyphs); start += 100 {
+		end := start + 100
+		if end > len(glyphs) {
+			end = len(glyphs)
+		}
+		fmt.Fprintf(&b, "%d beginbfchar\n", end-start)
+		for _, g := range glyphs[start:end] {
+			fmt.Fprintf(&b, "<%04X> <", g)
+			for _, u := range utf16.Encode([]rune{used[g]}) {
+				fmt.Fprintf(&b, "%04X", u)
+			}
+			b.WriteString(">\n")
+		}
+		b.WriteString("endbfchar\n")
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return b.Bytes()
+}
+
+// flateStream returns a compressed stream object; extra is added to its
+// dictionary.
+func flateStream(extra string, data []byte) string {
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(data)
+	w.Close()
+	if extra != "" {
+		extra = " " + extra
+	}
+	return fmt.Sprintf("<< /Length %d /Filter /FlateDecode%s >>\nstream\n%s\nendstream", z.Len(), extra, z.Bytes())
+}
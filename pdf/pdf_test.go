@@ -0,0 +1,286 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const (
+	dejaVuSans     = "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"
+	dejaVuSansBold = "/usr/share/fonts/truetype/dejavu/DejaVuSans-Bold.ttf"
+)
+
+func loadTestFont(t *testing.T, path string) *trueType {
+	t.Helper()
+	f, err := loadFontFile(path)
+	if os.IsNotExist(err) {
+		t.Skipf("%s is not installed", path)
+	}
+	if err != nil {
+		t.Fatalf("loading %s: %v", path, err)
+	}
+	return f
+}
+
+// useFonts replaces the process fonts for the duration of a test.
+func useFonts(t *testing.T, fonts fontSet) {
+	previous := loadedFonts
+	loadedFonts = func() fontSet { return fonts }
+	t.Cleanup(func() { loadedFonts = previous })
+}
+
+func TestParseTrueType(t *testing.T) {
+	f := loadTestFont(t, dejaVuSans)
+	if f.name != "DejaVuSans" {
+		t.Errorf("name = %q, want DejaVuSans", f.name)
+	}
+	if f.unitsPerEm != 2048 {
+		t.Errorf("unitsPerEm = %d, want 2048", f.unitsPerEm)
+	}
+	for _, r := range "Aп Ωé€" {
+		if _, ok := f.glyph(r); !ok {
+			t.Errorf("no glyph for %q", r)
+		}
+	}
+	if _, ok := f.glyph('ก'); ok {
+		t.Error("DejaVu Sans has no Thai, but a glyph was found for ก")
+	}
+	if g, _ := f.glyph(' '); f.width(g) < 250 || f.width(g) > 400 {
+		t.Errorf("space width = %.0f, want about 318", f.width(g))
+	}
+}
+
+func TestParseTrueTypeRejectsBadInput(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":     {},
+		"cff":       []byte("OTTO\x00\x00\x00\x00"),
+		"garbage":   []byte("this is not a font at all"),
+		"truncated": []byte{0, 1, 0, 0, 0, 12, 0, 0},
+	} {
+		if _, err := parseTrueType(data); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+
+	full, err := os.ReadFile(dejaVuSans)
+	if err != nil {
+		t.Skip(err)
+	}
+	if _, err := parseTrueType(full[:len(full)/3]); err == nil {
+		t.Error("truncated font parsed without error")
+	}
+}
+
+func TestSubsetKeepsUsedGlyphs(t *testing.T) {
+	f := loadTestFont(t, dejaVuSans)
+	used := map[uint16]rune{}
+	for _, r := range "Привет é" {
+		g, _ := f.glyph(r)
+		used[g] = r
+	}
+
+	data := f.subset(used)
+	if got := checksum(data); got != 0xb1b0afba {
+		t.Errorf("font checksum = %#x, want 0xb1b0afba", got)
+	}
+	if len(data) >= len(f.tables["glyf"]) {
+		t.Errorf("subset is %d bytes, want far less than the %d byte glyf table", len(data), len(f.tables["glyf"]))
+	}
+
+	sub, err := parseSubset(data)
+	if err != nil {
+		t.Fatalf("subset does not parse: %v", err)
+	}
+	original := f.tables["glyf"]
+	for g := range used {
+		want := original[f.loca[g]:f.loca[g+1]]
+		got := sub.tables["glyf"][sub.loca[g]:sub.loca[g+1]]
+		if !bytes.Equal(bytes.TrimRight(got, "\x00"), bytes.TrimRight(want, "\x00")) {
+			t.Errorf("glyph %d outline changed in the subset", g)
+		}
+	}
+	// Unused glyphs are emptied
+	if g, _ := f.glyph('Z'); sub.loca[g] != sub.loca[g+1] {
+		t.Error("unused glyph Z kept its outline")
+	}
+}
+
+// parseSubset reads a subset font, which has no cmap of its own.
+func parseSubset(data []byte) (*trueType, error) {
+	cmap := []byte{0, 0, 0, 1, 0, 3, 0, 1, 0, 0, 0, 12, 0, 4, 0, 24, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 0xff, 0xff, 0, 1, 0, 0}
+	tables := map[string][]byte{"cmap": cmap}
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	for i := 0; i < n; i++ {
+		rec := data[12+16*i:]
+		off, length := binary.BigEndian.Uint32(rec[8:]), binary.BigEndian.Uint32(rec[12:])
+		tables[string(rec[:4])] = data[off : off+length]
+	}
+	return parseTrueType(writeSFNT(tables))
+}
+
+func TestRunsFallBackThroughTheChain(t *testing.T) {
+	regular := loadTestFont(t, dejaVuSans)
+	bold := loadTestFont(t, dejaVuSansBold)
+	chain := []*trueType{bold, regular}
+
+	got := runs(chain, "Ab\tc")
+	if len(got) != 1 || got[0].font != bold || string(got[0].runes) != "Ab c" {
+		t.Fatalf("runs = %+v, want a single bold run with the tab as a space", got)
+	}
+
+	// Thai is in neither font and becomes '?' in the first
+	got = runs(chain, "xก")
+	if len(got) != 1 || string(got[0].runes) != "x?" {
+		t.Fatalf("runs = %+v, want x? in one run", got)
+	}
+	q, _ := bold.glyph('?')
+	if got[0].glyphs[1] != q {
+		t.Errorf("missing character drawn as glyph %d, want '?' (%d)", got[0].glyphs[1], q)
+	}
+}
+
+func TestTextWidthUsesTrueTypeMetrics(t *testing.T) {
+	f := loadTestFont(t, dejaVuSans)
+	useFonts(t, fontSet{Regular: {f}})
+
+	g, _ := f.glyph('W')
+	want := float64(f.advances[g]) * 10 / float64(f.unitsPerEm) * 3
+	if got := TextWidth("WWW", Regular, 10); got < want-0.001 || got > want+0.001 {
+		t.Errorf("TextWidth = %f, want %f", got, want)
+	}
+	// Bold has no TrueType font here and uses the Helvetica metrics
+	if got := TextWidth("WWW", Bold, 10); got != 3*9.44 {
+		t.Errorf("core TextWidth = %f, want %f", got, 3*9.44)
+	}
+}
+
+func TestDocumentEmbedsUnicodeFont(t *testing.T) {
+	regular := loadTestFont(t, dejaVuSans)
+	bold := loadTestFont(t, dejaVuSansBold)
+	useFonts(t, fontSet{Regular: {regular}, Bold: {bold}})
+
+	doc := New("Отчёт пациента")
+	doc.Title("Сводка")
+	doc.Paragraph("Пациент: Ελένη (ok)", Regular, 10)
+	var out bytes.Buffer
+	if _, err := doc.WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	pdf := out.String()
+
+	checkXref(t, pdf)
+	for _, want := range []string{
+		"/Subtype /Type0", "/Encoding /Identity-H", "/Subtype /CIDFontType2",
+		"/CIDToGIDMap /Identity", "/FontFile2", "+DejaVuSans ", "+DejaVuSans-Bold ",
+	} {
+		if !strings.Contains(pdf, want) {
+			t.Errorf("PDF has no %q", want)
+		}
+	}
+	if strings.Contains(pdf, ") Tj") {
+		t.Error("PDF has text in core font strings")
+	}
+
+	// The title is UTF-16 in the document info
+	title := "<FEFF"
+	for _, u := range utf16.Encode([]rune("Отчёт пациента")) {
+		title += fmt.Sprintf("%04X", u)
+	}
+	if !strings.Contains(pdf, "/Title "+title+">") {
+		t.Error("info dictionary has no UTF-16 title")
+	}
+
+	// Every glyph drawn maps back to its character through a ToUnicode CMap
+	text := map[rune]bool{}
+	for _, cmap := range flateStreams(t, pdf) {
+		for _, m := range regexp.MustCompile(`<([0-9A-F]{4})> <([0-9A-F]+)>`).FindAllStringSubmatch(cmap, -1) {
+			var units []uint16
+			for i := 0; i+4 <= len(m[2]); i += 4 {
+				u, _ := strconv.ParseUint(m[2][i:i+4], 16, 16)
+				units = append(units, uint16(u))
+			}
+			for _, r := range utf16.Decode(units) {
+				text[r] = true
+			}
+		}
+	}
+	for _, r := range "СводкаПациент:Ελένη()" {
+		if !text[r] {
+			t.Errorf("no ToUnicode entry for %q", r)
+		}
+	}
+}
+
+func TestDocumentWithoutTrueTypeUsesCoreFonts(t *testing.T) {
+	useFonts(t, fontSet{})
+
+	doc := New("Report")
+	doc.Paragraph("Café ไทย", Regular, 10)
+	var out bytes.Buffer
+	doc.WriteTo(&out)
+	pdf := out.String()
+
+	checkXref(t, pdf)
+	if strings.Contains(pdf, "/Type0") {
+		t.Error("embedded a font with none configured")
+	}
+	if !strings.Contains(pdf, "(Caf\xe9 ???) Tj") {
+		t.Error("Latin-1 text is not WinAnsi encoded with '?' for the rest")
+	}
+}
+
+func TestWriteToIsRepeatable(t *testing.T) {
+	useFonts(t, fontSet{Regular: {loadTestFont(t, dejaVuSans)}})
+	doc := New("Repeat")
+	doc.Paragraph("Один два три", Regular, 10)
+
+	var first, second bytes.Buffer
+	doc.WriteTo(&first)
+	doc.WriteTo(&second)
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("rendering twice gave different output")
+	}
+}
+
+// checkXref verifies that every xref entry points at its object.
+func checkXref(t *testing.T, pdf string) {
+	t.Helper()
+	start := strings.LastIndex(pdf, "startxref\n")
+	xref, _ := strconv.Atoi(strings.Fields(pdf[start+len("startxref\n"):])[0])
+	lines := strings.Split(pdf[xref:], "\n")
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+	for i := 1; i < count; i++ {
+		off, _ := strconv.Atoi(strings.Fields(lines[2+i])[0])
+		if want := strconv.Itoa(i) + " 0 obj"; !strings.HasPrefix(pdf[off:], want) {
+			t.Fatalf("xref entry %d points at %q", i, pdf[off:off+10])
+		}
+	}
+}
+
+// flateStreams returns the decompressed contents of every compressed stream.
+func flateStreams(t *testing.T, pdf string) []string {
+	var out []string
+	re := regexp.MustCompile(`/Length (\d+) /Filter /FlateDecode[^>]*>>\nstream\n`)
+	for _, loc := range re.FindAllStringSubmatchIndex(pdf, -1) {
+		n, _ := strconv.Atoi(pdf[loc[2]:loc[3]])
+		r, err := zlib.NewReader(strings.NewReader(pdf[loc[1] : loc[1]+n]))
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+		out = append(out, string(data))
+	}
+	return out
+}
@@ -0,0 +1,405 @@
+package pdf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// trueType is a parsed TrueType font: what the PDF font dictionaries need
+// and what subsetting needs. It is read-only once parsed, so one font can
+// serve every document.
+type trueType struct {
+	name        string // PostScript name
+	tables      map[string][]byte
+	unitsPerEm  int
+	bbox        [4]int
+	ascent      int
+	descent     int
+	capHeight   int
+	italicAngle float64
+	fixedPitch  bool
+	weight      int
+	advances    []uint16
+	loca        []uint32
+	cmap        map[rune]uint16
+}
+
+// parseTrueType reads a TrueType font, or the first font of a TrueType
+// collection. Fonts with CFF outlines and fonts whose licence forbids
+// embedding are rejected.
+func parseTrueType(data []byte) (f *trueType, err error) {
+	// Every offset below comes from the file; a truncated or corrupt font
+	// indexes past the end of a slice, which we report instead of crashing.
+	defer func() {
+		if r := recover(); r != nil {
+			f, err = nil, errors.New("malformed font")
+		}
+	}()
+
+	offset := 0
+	switch string(data[:4]) {
+	case "ttcf":
+		offset = int(u32(data, 12))
+	case "OTTO":
+		return nil, errors.New("OpenType fonts with CFF outlines are not supported")
+	}
+	if v := u32(data, offset); v != 0x00010000 && v != 0x74727565 { // 1.0 or 'true'
+		return nil, errors.New("not a TrueType font")
+	}
+
+	f = &trueType{tables: map[string][]byte{}}
+	numTables := int(u16(data, offset+4))
+	for i := 0; i < numTables; i++ {
+		rec := offset + 12 + 16*i
+		start, length := int(u32(data, rec+8)), int(u32(data, rec+12))
+		if start+length > len(data) {
+			return nil, errors.New("malformed font")
+		}
+		f.tables[string(data[rec:rec+4])] = data[start : start+length]
+	}
+	for _, tag := range []string{"head", "hhea", "hmtx", "maxp", "loca", "glyf", "cmap"} {
+		if f.tables[tag] == nil {
+			return nil, fmt.Errorf("font has no %s table", tag)
+		}
+	}
+
+	head := f.tables["head"]
+	f.unitsPerEm = int(u16(head, 18))
+	if f.unitsPerEm == 0 {
+		return nil, errors.New("font has no units per em")
+	}
+	f.bbox = [4]int{int(i16(head, 36)), int(i16(head, 38)), int(i16(head, 40)), int(i16(head, 42))}
+
+	hhea := f.tables["hhea"]
+	f.ascent, f.descent = int(i16(hhea, 4)), int(i16(hhea, 6))
+	f.capHeight = f.ascent
+
+	numGlyphs := int(u16(f.tables["maxp"], 4))
+	numMetrics := int(u16(hhea, 34))
+	hmtx := f.tables["hmtx"]
+	f.advances = make([]uint16, numGlyphs)
+	for g := range f.advances {
+		if g < numMetrics {
+			f.advances[g] = u16(hmtx, 4*g)
+		} else {
+			f.advances[g] = f.advances[numMetrics-1]
+		}
+	}
+
+	loca := f.tables["loca"]
+	f.loca = make([]uint32, numGlyphs+1)
+	for g := range f.loca {
+		if i16(head, 50) == 0 {
+			f.loca[g] = uint32(u16(loca, 2*g)) * 2
+		} else {
+			f.loca[g] = u32(loca, 4*g)
+		}
+	}
+	for g := 0; g < numGlyphs; g++ {
+		if f.loca[g] > f.loca[g+1] {
+			return nil, errors.New("malformed font")
+		}
+	}
+	if int(f.loca[numGlyphs]) > len(f.tables["glyf"]) {
+		return nil, errors.New("malformed font")
+	}
+
+	f.weight = 400
+	if os2 := f.tables["OS/2"]; os2 != nil {
+		if fsType := u16(os2, 8); fsType&0x000f == 0x0002 {
+			return nil, errors.New("font licence does not permit embedding")
+		}
+		f.weight = int(u16(os2, 4))
+		if u16(os2, 0) >= 2 && len(os2) >= 90 {
+			f.capHeight = int(i16(os2, 88))
+		}
+	}
+	if post := f.tables["post"]; post != nil {
+		f.italicAngle = float64(int32(u32(post, 4))) / 65536
+		f.fixedPitch = u32(post, 12) != 0
+	}
+
+	if f.cmap, err = parseCmap(f.tables["cmap"], numGlyphs); err != nil {
+		return nil, err
+	}
+	f.name = postScriptName(f.tables["name"])
+	if f.name == "" {
+		f.name = "Embedded"
+	}
+	return f, nil
+}
+
+// parseCmap reads the Unicode mapping, preferring the full-repertoire
+// format 12 subtable over the BMP-only format 4.
+func parseCmap(cmap []byte, numGlyphs int) (map[rune]uint16, error) {
+	var format4, format12 []byte
+	for i := 0; i < int(u16(cmap, 2)); i++ {
+		rec := 4 + 8*i
+		platform, encoding := u16(cmap, rec), u16(cmap, rec+2)
+		sub := cmap[u32(cmap, rec+4):]
+		unicode := platform == 0 || (platform == 3 && (encoding == 1 || encoding == 10))
+		if !unicode {
+			continue
+		}
+		switch u16(sub, 0) {
+		case 4:
+			format4 = sub
+		case 12:
+			format12 = sub
+		}
+	}
+
+	m := map[rune]uint16{}
+	add := func(r rune, g int) {
+		if g > 0 && g < numGlyphs {
+			m[r] = uint16(g)
+		}
+	}
+	switch {
+	case format12 != nil:
+		for i := 0; i < int(u32(format12, 12)); i++ {
+			grp := 16 + 12*i
+			start, end, glyph := u32(format12, grp), u32(format12, grp+4), u32(format12, grp+8)
+			if end < start || end > 0x10ffff {
+				continue
+			}
+			for c := start; c <= end; c++ {
+				add(rune(c), int(glyph+c-start))
+			}
+		}
+	case format4 != nil:
+		segX2 := int(u16(format4, 6))
+		for i := 0; i < segX2/2; i++ {
+			end := int(u16(format4, 14+2*i))
+			start := int(u16(format4, 16+segX2+2*i))
+			delta := int(u16(format4, 16+2*segX2+2*i))
+			rangePos := 16 + 3*segX2 + 2*i
+			rangeOffset := int(u16(format4, rangePos))
+			for c := start; c <= end && c != 0xffff; c++ {
+				if rangeOffset == 0 {
+					add(rune(c), (c+delta)&0xffff)
+					continue
+				}
+				g := int(u16(format4, rangePos+rangeOffset+2*(c-start)))
+				if g != 0 {
+					add(rune(c), (g+delta)&0xffff)
+				}
+			}
+		}
+	default:
+		return nil, errors.New("font has no Unicode cmap")
+	}
+	return m, nil
+}
+
+// postScriptName returns name ID 6, which PDF uses as the BaseFont.
+func postScriptName(name []byte) string {
+	if name == nil {
+		return ""
+	}
+	storage := int(u16(name, 4))
+	for i := 0; i < int(u16(name, 2)); i++ {
+		rec := 6 + 12*i
+		if u16(name, rec+6) != 6 {
+			continue
+		}
+		platform := u16(name, rec)
+		raw := name[storage+int(u16(name, rec+10)):][:u16(name, rec+8)]
+		var out []byte
+		if platform == 3 || platform == 0 {
+			for j := 0; j+1 < len(raw); j += 2 {
+				out = append(out, raw[j+1])
+			}
+		} else {
+			out = raw
+		}
+		// PDF names cannot hold spaces or delimiters
+		clean := make([]byte, 0, len(out))
+		for _, b := range out {
+			if b > 32 && b < 127 && b != '/' && b != '(' && b != ')' && b != '[' && b != ']' &&
+				b != '<' && b != '>' && b != '{' && b != '}' && b != '%' && b != '#' {
+				clean = append(clean, b)
+			}
+		}
+		if len(clean) > 0 {
+			return string(clean)
+		}
+	}
+	return ""
+}
+
+// glyph returns the glyph for r, or false if the font has none.
+func (f *trueType) glyph(r rune) (uint16, bool) {
+	g, ok := f.cmap[r]
+	return g, ok
+}
+
+// width returns the advance of glyph g in 1/1000 of the font size.
+func (f *trueType) width(g uint16) float64 {
+	return float64(f.advances[g]) * 1000 / float64(f.unitsPerEm)
+}
+
+func (f *trueType) scale(v int) int {
+	return v * 1000 / f.unitsPerEm
+}
+
+// subset returns a font file holding only the outlines of used, plus the
+// glyphs composite glyphs are built from. Glyph IDs do not change, so the
+// font can still be addressed with an identity CIDToGIDMap.
+func (f *trueType) subset(used map[uint16]rune) []byte {
+	glyf := f.tables["glyf"]
+	keep := map[uint16]bool{}
+	queue := []uint16{0} // .notdef is always kept
+	for g := range used {
+		queue = append(queue, g)
+	}
+	for len(queue) > 0 {
+		g := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if keep[g] {
+			continue
+		}
+		keep[g] = true
+		for _, c := range f.components(glyf[f.loca[g]:f.loca[g+1]]) {
+			if int(c) < len(f.advances) && !keep[c] {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	var newGlyf []byte
+	newLoca := make([]byte, 4*len(f.loca))
+	for g := 0; g < len(f.loca)-1; g++ {
+		binary.BigEndian.PutUint32(newLoca[4*g:], uint32(len(newGlyf)))
+		if keep[uint16(g)] {
+			newGlyf = append(newGlyf, glyf[f.loca[g]:f.loca[g+1]]...)
+			for len(newGlyf)%4 != 0 {
+				newGlyf = append(newGlyf, 0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(newLoca[4*(len(f.loca)-1):], uint32(len(newGlyf)))
+
+	head := append([]byte(nil), f.tables["head"]...)
+	binary.BigEndian.PutUint32(head[8:], 0)  // checkSumAdjustment, set below
+	binary.BigEndian.PutUint16(head[50:], 1) // long loca offsets
+
+	tables := map[string][]byte{
+		"head": head,
+		"hhea": f.tables["hhea"],
+		"hmtx": f.tables["hmtx"],
+		"maxp": f.tables["maxp"],
+		"loca": newLoca,
+		"glyf": newGlyf,
+	}
+	// Hinting programs, which glyph outlines may call into
+	for _, tag := range []string{"cvt ", "fpgm", "prep"} {
+		if t := f.tables[tag]; t != nil {
+			tables[tag] = t
+		}
+	}
+	out := writeSFNT(tables)
+
+	// The whole font must checksum to 0xB1B0AFBA
+	headOffset := int(binary.BigEndian.Uint32(out[12+16*tableIndex(tables, "head")+8:]))
+	binary.BigEndian.PutUint32(out[headOffset+8:], 0xb1b0afba-checksum(out))
+	return out
+}
+
+// components lists the glyphs a composite glyph is made of.
+func (f *trueType) components(g []byte) []uint16 {
+	if len(g) < 10 || i16(g, 0) >= 0 {
+		return nil
+	}
+	const (
+		argsAreWords  = 0x0001
+		haveScale     = 0x0008
+		moreComponent = 0x0020
+		haveXYScale   = 0x0040
+		haveTwoByTwo  = 0x0080
+	)
+	var out []uint16
+	for pos := 10; pos+4 <= len(g); {
+		flags := u16(g, pos)
+		out = append(out, u16(g, pos+2))
+		pos += 4
+		if flags&argsAreWords != 0 {
+			pos += 4
+		} else {
+			pos += 2
+		}
+		switch {
+		case flags&haveScale != 0:
+			pos += 2
+		case flags&haveXYScale != 0:
+			pos += 4
+		case flags&haveTwoByTwo != 0:
+			pos += 8
+		}
+		if flags&moreComponent == 0 {
+			break
+		}
+	}
+	return out
+}
+
+func sortedTags(tables map[string][]byte) []string {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func tableIndex(tables map[string][]byte, tag string) int {
+	return sort.SearchStrings(sortedTags(tables), tag)
+}
+
+// writeSFNT lays tables out as a TrueType file, sorted by tag with the
+// directory's binary search fields and per-table checksums.
+func writeSFNT(tables map[string][]byte) []byte {
+	tags := sortedTags(tables)
+	n := len(tags)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= n {
+		entrySelector++
+	}
+	searchRange := (1 << entrySelector) * 16
+
+	out := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(out, 0x00010000)
+	binary.BigEndian.PutUint16(out[4:], uint16(n))
+	binary.BigEndian.PutUint16(out[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(out[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(out[10:], uint16(n*16-searchRange))
+	for i, tag := range tags {
+		t := tables[tag]
+		rec := out[12+16*i:]
+		copy(rec, tag)
+		binary.BigEndian.PutUint32(rec[4:], checksum(t))
+		binary.BigEndian.PutUint32(rec[8:], uint32(len(out)))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(t)))
+		out = append(out, t...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+func checksum(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(b); i += 4 {
+		var word [4]byte
+		copy(word[:], b[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
+
+func u16(b []byte, off int) uint16 { return binary.BigEndian.Uint16(b[off:]) }
+func i16(b []byte, off int) int16  { return int16(binary.BigEndian.Uint16(b[off:])) }
+func u32(b []byte, off int) uint32 { return binary.BigEndian.Uint32(b[off:]) }
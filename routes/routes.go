@@ -3,8 +3,10 @@ package routes
 import (
 	"chat-api/handlers"
 	"chat-api/middleware"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 )
 
 func SetupRoutes(app *fiber.App) {
@@ -12,15 +14,36 @@ func SetupRoutes(app *fiber.App) {
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Welcome to Chat API")
 	})
+	// Signed download links (public, the signature in the query is the credential)
+	app.Get("/files/attachments/:attachmentId", handlers.DownloadAttachment)
+	app.Get("/files/avatars/:userId/:version/:file", handlers.ServeAvatar)
+	app.Get("/files/data-exports/:jobId", handlers.DownloadDataExport)
+
 	// Auth routes (public)
 	// auth routes don't require JWT token
 	auth := app.Group("/auth")
 	auth.Post("/signup", handlers.SignUp) //body required: email, password(6 length)
 	auth.Post("/signin", handlers.SignIn) //body required: email, password(6 length)
 
+	// Email verification (UNVERIFIED_EMAIL_ACCESS decides what unverified accounts may do)
+	auth.Get("/verify", handlers.VerifyEmail)                // link from the verification email | query: token
+	auth.Post("/verify/resend", handlers.ResendVerification) // body required: email
+
+	// Password reset, rate limited per IP | body required: email / token, password(6 length)
+	resetLimit := limiter.New(limiter.Config{Max: 5, Expiration: 15 * time.Minute})
+	auth.Post("/password/forgot", resetLimit, handlers.ForgotPassword)
+	auth.Post("/password/reset", resetLimit, handlers.ResetPassword)
+
+	// Second sign-in step when SignIn answered mfa_required | body required: mfa_token, code or recovery_code
+	auth.Post("/mfa", limiter.New(limiter.Config{Max: 10, Expiration: 5 * time.Minute}), handlers.VerifyMFAChallenge)
+
+	// Sign in with an external OpenID Connect provider (OIDC_PROVIDERS), linked to the user with the same verified email
+	auth.Get("/oidc/:provider", handlers.OIDCLogin)             // redirects to the provider
+	auth.Get("/oidc/:provider/callback", handlers.OIDCCallback) // provider redirects back here | answers like signin
+
 	// Protected routes
 	api := app.Group("/api")
-	protected := api.Group("", middleware.SetJWtHeaderHandler()) //all below route require JWT token
+	protected := api.Group("", middleware.SetJWtHeaderHandler(), handlers.AccountGuard()) //all below route require JWT token
 
 	// User routes
 	users := protected.Group("/users")
@@ -33,14 +56,147 @@ func SetupRoutes(app *fiber.App) {
 	// Delete a user by ID (jwt must role admin)
 	users.Delete("/:id", handlers.DeleteUser)
 
+	// Lift a sign-in lockout (jwt must role admin) | query: ip to also unlock that address
+	users.Post("/:id/unlock", handlers.UnlockAccount)
+
+	// Sessions of a user (jwt must role admin or have the same user ID as params) | query: all=true for ended ones too
+	users.Get("/:id/sessions", handlers.GetUserSessions)
+	users.Delete("/:id/sessions", handlers.RevokeUserSessions) // sign out everywhere
+	users.Delete("/:id/sessions/:sessionId", handlers.RevokeUserSession)
+
+	// Upload a profile image (jwt must role admin or have the same user ID as params) | multipart field: image
+	users.Post("/:id/avatar", handlers.UploadAvatar)
+
+	// Medication and allergy routes (jwt must role admin or have the same user ID as params; assigned clinicians may read)
+	users.Get("/:id/medications", handlers.GetMedications) // query: active=true for current medications only
+	users.Post("/:id/medications", handlers.CreateMedication)
+	users.Put("/:id/medications/:medicationId", handlers.UpdateMedication)
+	users.Delete("/:id/medications/:medicationId", handlers.DeleteMedication)
+	users.Get("/:id/allergies", handlers.GetAllergies)
+	users.Post("/:id/allergies", handlers.CreateAllergy)
+	users.Put("/:id/allergies/:allergyId", handlers.UpdateAllergy)
+	users.Delete("/:id/allergies/:allergyId", handlers.DeleteAllergy)
+
+	// Care team routes
+	users.Get("/:id/care-team", handlers.GetCareTeam) // patient, admin or assigned clinician
+	// Assign a clinician to the patient (jwt must role admin) | body required: clinician_id
+	users.Post("/:id/care-team", handlers.AssignClinician)
+	users.Delete("/:id/care-team/:clinicianId", handlers.UnassignClinician) // jwt must role admin
+	users.Get("/:id/patients", handlers.GetClinicianPatients)               // clinician themself or admin
+
+	// Personal data export (jwt must role admin or have the same user ID as params)
+	users.Post("/:id/data-export", handlers.CreateDataExport)    // ZIP of JSON and HTML, built in the background
+	users.Get("/:id/data-export/:jobId", handlers.GetDataExport) // status, and a short-lived download_url once done
+	users.Get("/:id/notifications", handlers.GetNotifications)   // query: unread=true
+	users.Put("/:id/notifications/:notificationId/read", handlers.MarkNotificationRead)
+
+	// TOTP multi-factor authentication (MFA_REQUIRED_ROLES must enrol before using anything else)
+	users.Get("/:id/mfa", handlers.GetMFAStatus)                            // jwt must role admin or have the same user ID as params
+	users.Post("/:id/mfa/totp", handlers.StartMFAEnrolment)                 // account holder only | secret and provisioning_uri
+	users.Post("/:id/mfa/totp/verify", handlers.ConfirmMFAEnrolment)        // body required: code | returns recovery codes
+	users.Post("/:id/mfa/recovery-codes", handlers.RegenerateRecoveryCodes) // body required: code
+	users.Delete("/:id/mfa", handlers.DisableMFA)                           // body: code or recovery_code; admins reset others without
+
+	// Consent routes (jwt must role admin or have the same user ID as params)
+	users.Get("/:id/consents", handlers.GetConsents)                 // state per type and full history
+	users.Post("/:id/consents", handlers.GrantConsent)               // body required: consent_type, policy_version (current)
+	users.Delete("/:id/consents/:type", handlers.WithdrawConsent)    // withdraw an active consent
+	protected.Get("/consents/policies", handlers.GetConsentPolicies) // policy texts in force
+
+	// Right to erasure (jwt must role admin or have the same user ID as params)
+	users.Post("/:id/erasure", handlers.RequestErasure)   // body: reason | anonymised after admin approval and the grace period
+	users.Get("/:id/erasure", handlers.GetErasureRequest) // latest request
+	users.Delete("/:id/erasure", handlers.CancelErasure)  // possible until the grace period ends
+
+	// The caller's own sessions | query: all=true for ended ones too
+	me := protected.Group("/me")
+	me.Get("/sessions", handlers.GetMySessions)
+	me.Delete("/sessions", handlers.RevokeMyOtherSessions) // every session but the current one
+	me.Delete("/sessions/:sessionId", handlers.RevokeMySession)
+
 	// Chat routes
 	chats := protected.Group("/chats")
-	chats.Get("/", handlers.GetChats)               // get all chats
-	chats.Get("/getByChatID/:id", handlers.GetChat) // Get chat by ID
+	// get all chats visible to the caller (admin: all, clinician: own and patients') | query: user_id, from, to, code
+	chats.Get("/", handlers.GetChats)
+	chats.Get("/getByChatID/:id", handlers.GetChat) // Get chat by ID (owner, admin or assigned clinician)
 	chats.Post("/", handlers.CreateChat)            // Create a new chat
-	// Update a chat by ID (jwt must role admin or have the same user ID as chat's user_id)
+	// Update a chat by ID (jwt must role admin or have the same user ID as chat's user_id; assigned clinicians may only set diagnosis_codes)
 	chats.Put("/:id", handlers.UpdateChat)
 	// Delete a chat by ID (jwt must role admin or have the same user ID as chat's user_id)
 	chats.Delete("/:id", handlers.DeleteChat)
 	chats.Get("/all_chat_id", handlers.GetUserChats) // Get user's all chats
+
+	// Chat note routes (private notes are hidden from the patient)
+	chats.Get("/:id/notes", handlers.GetChatNotes)
+	// Add a note (jwt must role admin or be an assigned clinician) | body required: body, note_type
+	chats.Post("/:id/notes", handlers.CreateChatNote)
+	chats.Delete("/:id/notes/:noteId", handlers.DeleteChatNote) // note author or admin
+
+	// Attachment routes (same rule as updating the chat)
+	chats.Post("/:id/attachments", handlers.UploadAttachment) // multipart field: file (jpeg, png, gif, webp, pdf)
+	chats.Get("/:id/attachments", handlers.GetAttachments)    // includes short-lived download_url
+	chats.Delete("/:id/attachments/:attachmentId", handlers.DeleteAttachment)
+
+	// Printable intake summary (same rule as viewing the chat, private notes omitted)
+	chats.Get("/:id/report.pdf", handlers.GetChatReport)
+
+	// Admin export routes (jwt must role admin) | query: format=csv|ndjson, columns=a,b,c and the chat listing filters
+	admin := protected.Group("/admin")
+	admin.Get("/exports/chats", handlers.ExportChats)          // streamed download
+	admin.Post("/exports/chats", handlers.CreateChatExportJob) // background job written to storage
+	// De-identified research dataset of consented users | query: format, k, max_suppression, project
+	admin.Post("/exports/research", handlers.CreateResearchExport)
+	admin.Get("/exports/:jobId", handlers.GetExportJob)
+	admin.Get("/exports/:jobId/download", handlers.DownloadExportJob)
+	admin.Get("/exports/:jobId/subjects", handlers.GetResearchExportSubjects) // users included in a research export
+
+	// Admin CSV import (jwt must role admin) | multipart: file, kind=users|chats, mapping (JSON header->field), dry_run=true
+	admin.Post("/imports", handlers.CreateImportJob)
+	admin.Get("/imports/:jobId", handlers.GetImportJob)                // progress
+	admin.Get("/imports/:jobId/errors", handlers.DownloadImportErrors) // row,column,error CSV
+
+	// Publish a new consent policy version (jwt must role admin) | body required: consent_type, body
+	admin.Post("/consent-policies", handlers.CreateConsentPolicy)
+
+	// Admin erasure review (jwt must role admin)
+	admin.Get("/erasures", handlers.GetErasureRequests) // query: status
+	admin.Post("/erasures/:requestId/approve", handlers.ApproveErasure)
+	admin.Post("/erasures/:requestId/reject", handlers.RejectErasure)
+	admin.Get("/erasure-log", handlers.GetErasureLog) // entries and hash chain verification
+
+	// Sign-in attempts for security review (jwt must role admin) | query: email, ip, user_id, success, from, to, limit
+	admin.Get("/login-attempts", handlers.GetLoginAttempts)
+
+	// Retention policies (jwt must role admin) | body: resource, role, max_age_days, enabled, description
+	admin.Get("/retention-policies", handlers.GetRetentionPolicies)
+	admin.Post("/retention-policies", handlers.CreateRetentionPolicy)
+	admin.Put("/retention-policies/:policyId", handlers.UpdateRetentionPolicy)
+	admin.Delete("/retention-policies/:policyId", handlers.DeleteRetentionPolicy)
+	admin.Post("/retention-policies/:policyId/run", handlers.RunRetentionPolicy) // query: dry_run=true to only count matches
+	admin.Get("/retention-runs", handlers.GetRetentionRuns)                      // purge audit | query: policy_id
+
+	// Aggregate analytics (jwt must role admin), served from views refreshed hourly; cells under the minimum size are suppressed
+	// query: bucket=week|month|quarter|year|none, group_by=age_band,gender, from, to (YYYY-MM-DD, bucket aligned)
+	analytics := protected.Group("/analytics")
+	analytics.Get("/chats", handlers.GetChatAnalytics)
+	analytics.Get("/vitals", handlers.GetVitalsAnalytics)
+	analytics.Get("/diagnoses", handlers.GetDiagnosisAnalytics) // also group_by=code, code=<ICD-10 category>, code_level=category|full
+	analytics.Post("/refresh", handlers.RefreshAnalyticsNow)
+
+	// Interaction routes
+	// body: medications, allergies, optional user_id (jwt must role admin, be that user or an assigned clinician) to include their records
+	protected.Post("/interactions/check", handlers.CheckInteractions)
+
+	// FHIR R4 routes (patient, admin or assigned clinician) | search query: patient=<id> or Patient/<id>
+	fhirRoutes := app.Group("/fhir", middleware.SetJWtHeaderHandler(), handlers.AccountGuard())
+	fhirRoutes.Post("/", handlers.FHIRImportBundle) // import a transaction Bundle of Patient, Observation, Condition (jwt must role admin)
+	fhirRoutes.Get("/Patient/:id", handlers.FHIRPatient)
+	fhirRoutes.Get("/Patient/:id/$everything", handlers.FHIRPatientEverything) // Bundle export of the patient
+	fhirRoutes.Get("/Observation", handlers.FHIRObservations)                  // height, weight, BMI, pulse, blood pressure
+	fhirRoutes.Get("/Condition", handlers.FHIRConditions)
+	fhirRoutes.Get("/QuestionnaireResponse", handlers.FHIRQuestionnaireResponses) // LODCRAFT answers
+
+	// Code routes
+	codes := protected.Group("/codes")
+	codes.Get("/icd10", handlers.SearchICD10) // autocomplete ICD-10 codes | query: q, limit
 }
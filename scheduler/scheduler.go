@@ -0,0 +1,84 @@
+// Package scheduler runs periodic jobs inside the server process. Every
+// instance runs the same schedule; a Postgres advisory lock per job makes
+// sure only one of them does the work at a time.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// Job is run every Interval, the first time right after Start.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+type Scheduler struct {
+	db   *sql.DB
+	jobs []Job
+}
+
+func New(db *sql.DB) *Scheduler {
+	return &Scheduler{db: db}
+}
+
+func (s *Scheduler) Add(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// Start runs every job on its own ticker until ctx is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, job := range s.jobs {
+		go func(job Job) {
+			ticker := time.NewTicker(job.Interval)
+			defer ticker.Stop()
+			for {
+				if ran, err := s.RunOnce(ctx, job); err != nil {
+					log.Printf("Scheduled job %s failed: %v", job.Name, err)
+				} else if !ran {
+					log.Printf("Scheduled job %s skipped, another instance holds the lock", job.Name)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(job)
+	}
+}
+
+// lockKey maps a job name to the advisory lock key every instance uses.
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("chat-api/scheduler/" + name))
+	return int64(h.Sum64())
+}
+
+// RunOnce runs the job if no other instance is running it and reports
+// whether it did. The lock is session level, so it is taken and released
+// on one dedicated connection and is dropped by Postgres if we die.
+func (s *Scheduler) RunOnce(ctx context.Context, job Job) (bool, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	key := lockKey(job.Name)
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+
+	return true, job.Run(ctx)
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Get when no object exists under the key.
+var ErrNotFound = errors.New("storage: object not found")
+
+// Storage keeps uploaded files. Keys are slash separated paths such as
+// "attachments/<chat_id>/<attachment_id>".
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Presigner is implemented by backends that can hand out their own
+// short-lived download URLs, so clients fetch directly from the backend.
+type Presigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+var (
+	defaultOnce    sync.Once
+	defaultStorage Storage
+)
+
+// Default returns the backend selected by STORAGE_BACKEND: "s3" for an
+// S3-compatible service (see NewS3FromEnv), anything else for the local
+// filesystem under STORAGE_LOCAL_DIR (default ./uploads).
+func Default() Storage {
+	defaultOnce.Do(func() {
+		switch os.Getenv("STORAGE_BACKEND") {
+		case "s3":
+			s3, err := NewS3FromEnv()
+			if err != nil {
+				log.Fatal("Failed to configure S3 storage: ", err)
+			}
+			defaultStorage = s3
+		default:
+			dir := os.Getenv("STORAGE_LOCAL_DIR")
+			if dir == "" {
+				dir = "uploads"
+			}
+			defaultStorage = NewLocal(dir)
+		}
+	})
+	return defaultStorage
+}
@@ -11,6 +11,8 @@ func BuildUsersUpdateDynamicArray(data *models.UserInsertUpdate, role string) (s
 	argCount := 1
 
 	if data.Email != "" {
+		// A new address has to be verified again
+		query += "email_verified = (email_verified AND email = $" + strconv.Itoa(argCount) + "), "
 		query += "email = $" + strconv.Itoa(argCount) + ", "
 		args = append(args, data.Email)
 		argCount++
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 vectors of RFC 6238 appendix B, cut to six digits.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateTOTPWithRFCVectors(t *testing.T) {
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		step, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(unix, 0))
+		if !ok || step != unix/30 {
+			t.Errorf("ValidateTOTP(%s at %d) = %d, %v, want step %d", code, unix, step, ok, unix/30)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	at := time.Unix(1234567890, 0)
+	// A code is accepted one step before and after, not two
+	for offset, want := range map[time.Duration]bool{
+		-30 * time.Second: true, 30 * time.Second: true, -60 * time.Second: false, 60 * time.Second: false,
+	} {
+		if _, ok := ValidateTOTP(rfc6238Secret, "005924", at.Add(offset)); ok != want {
+			t.Errorf("code checked %s from its step: ok = %v, want %v", offset, ok, want)
+		}
+	}
+}
+
+func TestValidateTOTPRejectsMalformedInput(t *testing.T) {
+	at := time.Unix(1234567890, 0)
+	if _, ok := ValidateTOTP(rfc6238Secret, "005 924", at); !ok {
+		t.Error("a code with a space was rejected")
+	}
+	if _, ok := ValidateTOTP(strings.ToLower(rfc6238Secret), "005924", at); !ok {
+		t.Error("a lower case secret was rejected")
+	}
+	for _, code := range []string{"", "05924", "0059240", "abcdef", "005925"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, code, at); ok {
+			t.Errorf("code %q was accepted", code)
+		}
+	}
+	if _, ok := ValidateTOTP("not base32!", "005924", at); ok {
+		t.Error("an invalid secret was accepted")
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	a, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewTOTPSecret()
+	key, err := totpEncoding.DecodeString(a)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v, want 20", a, len(key), err)
+	}
+	if a == b {
+		t.Error("two secrets are the same")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI("Chat Clinic", "jane@example.com", "JBSWY3DP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Chat Clinic:jane@example.com" {
+		t.Errorf("URI = %s", u)
+	}
+	q := u.Query()
+	for k, want := range map[string]string{"secret": "JBSWY3DP", "issuer": "Chat Clinic", "digits": "6", "period": "30", "algorithm": "SHA1"} {
+		if q.Get(k) != want {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), want)
+		}
+	}
+}
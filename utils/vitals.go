@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// BMI returns weight (kg) / height (m)^2 from height in cm, or nil when either
+// value is missing or not positive.
+func BMI(heightCm, weightKg *float32) *float64 {
+	if heightCm == nil || weightKg == nil || *heightCm <= 0 || *weightKg <= 0 {
+		return nil
+	}
+	m := float64(*heightCm) / 100
+	bmi := float64(*weightKg) / (m * m)
+	return &bmi
+}
+
+// BMICategory uses the WHO Asian cut-offs commonly applied in Thailand.
+func BMICategory(bmi float64) string {
+	switch {
+	case bmi < 18.5:
+		return "Underweight"
+	case bmi < 23:
+		return "Normal"
+	case bmi < 25:
+		return "Overweight"
+	case bmi < 30:
+		return "Obese class I"
+	default:
+		return "Obese class II"
+	}
+}
+
+// ParseBloodPressure splits a "120/80" style reading into systolic and
+// diastolic mmHg.
+func ParseBloodPressure(s string) (int, int, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	sys, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	dia, err2 := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(parts[1]), "mmHg")))
+	if err1 != nil || err2 != nil || sys <= 0 || dia <= 0 {
+		return 0, 0, false
+	}
+	return sys, dia, true
+}
+
+// MeanArterialPressure is diastolic + (systolic - diastolic) / 3.
+func MeanArterialPressure(sys, dia int) float64 {
+	return float64(dia) + float64(sys-dia)/3
+}